@@ -0,0 +1,22 @@
+package auth
+
+import "encoding/base64"
+
+// Bytes is binary data such as a signature or a ciphertext. It is serialized
+// as base64 text in both JSON and YAML.
+type Bytes []byte
+
+func (b Bytes) MarshalText() ([]byte, error) {
+	return []byte(base64.StdEncoding.EncodeToString(b)), nil
+}
+
+func (b *Bytes) UnmarshalText(text []byte) error {
+	d, err := base64.StdEncoding.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+
+	*b = d
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package auth_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestBytes(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	b := auth.Bytes("hello")
+	text, err := b.MarshalText()
+	require.NoError(err)
+	require.Equal("aGVsbG8=", string(text))
+
+	j, err := json.Marshal(map[string]auth.Bytes{"a": b})
+	require.NoError(err)
+	require.JSONEq(`{"a":"aGVsbG8="}`, string(j))
+
+	y, err := yaml.Marshal(map[string]auth.Bytes{"a": b})
+	require.NoError(err)
+	require.Equal("a: aGVsbG8=\n", string(y))
+
+	m := map[string]auth.Bytes{}
+	require.NoError(yaml.Unmarshal(y, &m))
+	require.Equal(b, m["a"])
+
+	require.NoError(json.Unmarshal(j, &m))
+	require.Equal(b, m["a"])
+
+	require.Error(b.UnmarshalText([]byte("!!!")))
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	EnvelopeVersion = 1
+	AlgAES256GCM    = "aes-256-gcm"
+	DataKeySize     = 32
+)
+
+var (
+	ErrNotRecipient        = errors.New("identity is not a recipient of the envelope")
+	ErrUnsupportedEnvelope = errors.New("unsupported envelope")
+	ErrNoRecipients        = errors.New("envelope needs at least one recipient")
+)
+
+// Envelope is a payload encrypted with a random data key using hybrid
+// encryption. The data key is wrapped with the public key of every
+// recipient, indexed by the fingerprint of that key, so the payload size is
+// not limited by the public key algorithm.
+type Envelope struct {
+	Version    int              `json:"version"    yaml:"version"`
+	Algorithm  string           `json:"algorithm"  yaml:"algorithm"`
+	Keys       map[string]Bytes `json:"keys"       yaml:"keys"`
+	Nonce      Bytes            `json:"nonce"      yaml:"nonce"`
+	Ciphertext Bytes            `json:"ciphertext" yaml:"ciphertext"`
+}
+
+// Seal encrypts the plaintext so that only the recipients can open it.
+func Seal(plaintext []byte, recipients ...*Identity) (*Envelope, error) {
+	if len(recipients) == 0 {
+		return nil, ErrNoRecipients
+	}
+
+	dataKey := make([]byte, DataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	env := &Envelope{
+		Version:    EnvelopeVersion,
+		Algorithm:  AlgAES256GCM,
+		Keys:       make(map[string]Bytes, len(recipients)),
+		Nonce:      nil,
+		Ciphertext: nil,
+	}
+
+	for _, recipient := range recipients {
+		fp, err := recipient.Fingerprint()
+		if err != nil {
+			return nil, err
+		}
+
+		wrapped, err := recipient.Encrypt(dataKey, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error wrapping key for %s: %w", fp, err)
+		}
+
+		env.Keys[fp] = wrapped
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	env.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(env.Nonce); err != nil {
+		return nil, err
+	}
+
+	env.Ciphertext = aead.Seal(nil, env.Nonce, plaintext, env.additionalData())
+
+	return env, nil
+}
+
+// Open decrypts an envelope that was sealed for this identity.
+func (r *Identity) Open(env *Envelope) ([]byte, error) {
+	if env == nil || env.Version != EnvelopeVersion || env.Algorithm != AlgAES256GCM {
+		return nil, ErrUnsupportedEnvelope
+	}
+
+	fp, err := r.Fingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, ok := env.Keys[fp]
+	if !ok {
+		return nil, ErrNotRecipient
+	}
+
+	dataKey, err := r.Decrypt(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping key: %w", err)
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(env.Nonce) != aead.NonceSize() {
+		return nil, ErrUnsupportedEnvelope
+	}
+
+	return aead.Open(nil, env.Nonce, env.Ciphertext, env.additionalData())
+}
+
+// IsRecipient reports whether the envelope can be opened by the identity.
+func (env *Envelope) IsRecipient(r *Identity) bool {
+	fp, err := r.Fingerprint()
+	if err != nil {
+		return false
+	}
+
+	_, ok := env.Keys[fp]
+
+	return ok
+}
+
+// additionalData binds the format of the envelope to the ciphertext.
+func (env *Envelope) additionalData() []byte {
+	return []byte(strconv.Itoa(env.Version) + "/" + env.Algorithm)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Fingerprint returns the hex encoded SHA-256 hash of the public key.
+func (r *Identity) Fingerprint() (string, error) {
+	der, err := r.publicDER()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(der)
+
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,109 @@
+package auth_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealOpen(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	henk := auth.GenerateIdentity()
+	ingrid := auth.GenerateIdentity()
+	jaap := auth.GenerateIdentity()
+
+	// Much larger than what RSA-OAEP can encrypt directly
+	msg := make([]byte, 64*1024)
+	_, err := rand.Read(msg)
+	require.NoError(err)
+
+	env, err := auth.Seal(msg, henk.Public(), ingrid.Public())
+	require.NoError(err)
+	assert.Equal(auth.EnvelopeVersion, env.Version)
+	assert.Equal(auth.AlgAES256GCM, env.Algorithm)
+	assert.Len(env.Keys, 2)
+	assert.True(env.IsRecipient(henk))
+	assert.True(env.IsRecipient(ingrid.Public()))
+	assert.False(env.IsRecipient(jaap))
+	assert.False(env.IsRecipient(auth.EmptyIdentity()))
+
+	b, err := henk.Open(env)
+	require.NoError(err)
+	assert.True(bytes.Equal(msg, b))
+
+	b, err = ingrid.Open(env)
+	require.NoError(err)
+	assert.True(bytes.Equal(msg, b))
+
+	_, err = jaap.Open(env)
+	require.ErrorIs(err, auth.ErrNotRecipient)
+
+	// The public key alone cannot open the envelope
+	_, err = henk.Public().Open(env)
+	require.Error(err)
+}
+
+func TestOpenErrors(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	henk := auth.GenerateIdentity()
+
+	_, err := auth.Seal([]byte("hello"))
+	require.ErrorIs(err, auth.ErrNoRecipients)
+
+	_, err = auth.Seal([]byte("hello"), auth.EmptyIdentity())
+	require.Error(err)
+
+	_, err = henk.Open(nil)
+	require.ErrorIs(err, auth.ErrUnsupportedEnvelope)
+
+	env, err := auth.Seal([]byte("hello"), henk)
+	require.NoError(err)
+
+	env.Version = 2
+	_, err = henk.Open(env)
+	require.ErrorIs(err, auth.ErrUnsupportedEnvelope)
+	env.Version = auth.EnvelopeVersion
+
+	// Tampering with the ciphertext is detected
+	env.Ciphertext[0] ^= 0xff
+	_, err = henk.Open(env)
+	require.Error(err)
+	env.Ciphertext[0] ^= 0xff
+
+	env.Nonce = env.Nonce[1:]
+	_, err = henk.Open(env)
+	require.ErrorIs(err, auth.ErrUnsupportedEnvelope)
+}
+
+func TestFingerprint(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	henk := auth.GenerateIdentity()
+	fp, err := henk.Fingerprint()
+	require.NoError(err)
+	require.Len(fp, 64)
+
+	pfp, err := henk.Public().Fingerprint()
+	require.NoError(err)
+	require.Equal(fp, pfp)
+
+	other, err := auth.GenerateIdentity().Fingerprint()
+	require.NoError(err)
+	require.NotEqual(fp, other)
+
+	_, err = auth.EmptyIdentity().Fingerprint()
+	require.ErrorIs(err, auth.ErrIdentityEmpty)
+}
@@ -0,0 +1,474 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const ReadOnly = 0o600
+
+var (
+	ErrIdentityEmpty   = errors.New("identity is empty")
+	ErrBadPEMFile      = errors.New("bad PEM file")
+	ErrUnknownPEMBlock = errors.New("unknown PEM block")
+	ErrNoPrivateKey    = errors.New("no private key")
+	ErrUnknownKeyType  = errors.New("unknown key type")
+	ErrBadAlgorithm    = errors.New("key does not match the identity algorithm")
+)
+
+const RSAKeySize = 2048
+
+// Algorithms of an identity.
+const (
+	AlgRSA     = "rsa"
+	AlgEd25519 = "ed25519-x25519"
+)
+
+// AlgorithmHeader tags every PEM block of a serialized identity.
+const AlgorithmHeader = "Chata-Algorithm"
+
+// Identity is just a small struct that clearly differentiates between the
+// private and public keys of a user. Legacy identities are a single RSA
+// keypair used for both signing and encryption. Modern identities use an
+// Ed25519 keypair for signing and an X25519 keypair for encryption.
+type Identity struct {
+	public  *rsa.PublicKey
+	private *rsa.PrivateKey
+
+	signPublic  ed25519.PublicKey
+	signPrivate ed25519.PrivateKey
+	encPublic   *ecdh.PublicKey
+	encPrivate  *ecdh.PrivateKey
+
+	// locked is the passphrase encrypted private key, see Lock.
+	locked *pem.Block
+}
+
+func PanicOnError(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// GenerateIdentity generates a new Ed25519/X25519 identity.
+func GenerateIdentity() *Identity {
+	signPub, signPriv, err := ed25519.GenerateKey(rand.Reader)
+	PanicOnError(err)
+
+	encPriv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	PanicOnError(err)
+
+	return &Identity{
+		signPublic:  signPub,
+		signPrivate: signPriv,
+		encPublic:   encPriv.PublicKey(),
+		encPrivate:  encPriv,
+	}
+}
+
+// GenerateRSAIdentity generates a legacy RSA identity.
+func GenerateRSAIdentity() *Identity {
+	priv, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	PanicOnError(err)
+
+	return NewIdentity(priv)
+}
+
+func EmptyIdentity() *Identity {
+	return &Identity{
+		private: nil,
+		public:  nil,
+	}
+}
+
+func LoadIdentity(rsaFile string) (*Identity, error) {
+	rsaText, err := os.ReadFile(rsaFile)
+	if err != nil {
+		return nil, fmt.Errorf("file read error: %w", err)
+	}
+
+	id := EmptyIdentity()
+	if err := id.UnmarshalText(rsaText); err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+func (r *Identity) SaveIdentity(rsaFile string) error {
+	data, err := r.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(rsaFile, data, ReadOnly)
+	if err != nil {
+		err = fmt.Errorf("error writing file: %w", err)
+	}
+
+	return err
+}
+
+// Algorithm returns the algorithm of the identity, it is empty for an empty
+// identity.
+func (r *Identity) Algorithm() string {
+	switch {
+	case r.public != nil:
+		return AlgRSA
+	case r.signPublic != nil && r.encPublic != nil:
+		return AlgEd25519
+	}
+
+	return ""
+}
+
+// MarshalText encodes RSA identities as PKCS#1 PEM blocks, for compatibility
+// with existing users, and modern identities as PKCS#8 or PKIX PEM blocks
+// tagged with their algorithm.
+func (r *Identity) MarshalText() ([]byte, error) {
+	if r.locked != nil {
+		pub, err := r.Public().MarshalText()
+		if err != nil {
+			return nil, err
+		}
+
+		return append(pub, pem.EncodeToMemory(r.locked)...), nil
+	}
+
+	if r.private != nil {
+		return pem.EncodeToMemory(&pem.Block{
+			Type:    "RSA PRIVATE KEY",
+			Headers: nil,
+			Bytes:   x509.MarshalPKCS1PrivateKey(r.private),
+		}), nil
+	} else if r.public != nil {
+		return pem.EncodeToMemory(&pem.Block{
+			Type:    "RSA PUBLIC KEY",
+			Headers: nil,
+			Bytes:   x509.MarshalPKCS1PublicKey(r.public),
+		}), nil
+	}
+
+	if r.Algorithm() != AlgEd25519 {
+		return nil, ErrIdentityEmpty
+	}
+
+	keys := []any{r.signPublic, r.encPublic}
+	blockType := "PUBLIC KEY"
+	marshal := x509.MarshalPKIXPublicKey
+
+	if r.signPrivate != nil && r.encPrivate != nil {
+		keys = []any{r.signPrivate, r.encPrivate}
+		blockType = "PRIVATE KEY"
+		marshal = x509.MarshalPKCS8PrivateKey
+	}
+
+	text := bytes.Buffer{}
+	for _, key := range keys {
+		der, err := marshal(key)
+		if err != nil {
+			return nil, err
+		}
+
+		text.Write(pem.EncodeToMemory(&pem.Block{
+			Type:    blockType,
+			Headers: map[string]string{AlgorithmHeader: AlgEd25519},
+			Bytes:   der,
+		}))
+	}
+
+	return text.Bytes(), nil
+}
+
+// UnmarshalText decodes all the PEM blocks of an identity.
+func (r *Identity) UnmarshalText(text []byte) error {
+	b, rest := pem.Decode(text)
+	if b == nil {
+		return ErrBadPEMFile
+	}
+
+	id := EmptyIdentity()
+	for ; b != nil; b, rest = pem.Decode(rest) {
+		if err := id.unmarshalBlock(b); err != nil {
+			return err
+		}
+	}
+
+	if id.public != nil && (id.signPublic != nil || id.encPublic != nil) {
+		return ErrBadAlgorithm
+	}
+
+	if id.Algorithm() == "" {
+		return ErrIdentityEmpty
+	}
+
+	*r = *id
+
+	return nil
+}
+
+func (r *Identity) unmarshalBlock(b *pem.Block) error {
+	if b.Type == EncryptedKeyBlock {
+		r.locked = b
+		return nil
+	}
+
+	alg, tagged := b.Headers[AlgorithmHeader]
+	if tagged && alg != AlgEd25519 && alg != AlgRSA {
+		return fmt.Errorf("%w: %s", ErrUnknownKeyType, alg)
+	}
+
+	var key any
+	var err error
+
+	switch b.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(b.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(b.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(b.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(b.Bytes)
+	default:
+		return ErrUnknownPEMBlock
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, isRSAPriv := key.(*rsa.PrivateKey)
+	_, isRSAPub := key.(*rsa.PublicKey)
+	if tagged && (alg == AlgRSA) != (isRSAPriv || isRSAPub) {
+		return ErrBadAlgorithm
+	}
+
+	return r.setKey(key)
+}
+
+func (r *Identity) setKey(key any) error {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		r.private = k
+		r.public = &k.PublicKey
+	case *rsa.PublicKey:
+		r.public = k
+	case ed25519.PrivateKey:
+		r.signPrivate = k
+		r.signPublic, _ = k.Public().(ed25519.PublicKey)
+	case ed25519.PublicKey:
+		r.signPublic = k
+	case *ecdh.PrivateKey:
+		if k.Curve() != ecdh.X25519() {
+			return ErrUnknownKeyType
+		}
+		r.encPrivate = k
+		r.encPublic = k.PublicKey()
+	case *ecdh.PublicKey:
+		if k.Curve() != ecdh.X25519() {
+			return ErrUnknownKeyType
+		}
+		r.encPublic = k
+	default:
+		return ErrUnknownKeyType
+	}
+
+	return nil
+}
+
+func (r *Identity) String() string {
+	b, e := r.MarshalText()
+	if e != nil {
+		return ""
+	}
+
+	return string(b)
+}
+
+// NewIdentity returns a new identity with spefied keys.
+func NewIdentity(pri *rsa.PrivateKey) *Identity {
+	return &Identity{
+		private: pri,
+		public:  &pri.PublicKey,
+	}
+}
+
+// PubIdentity returns identity with public key. This identity object can
+// only be used to verify messages.
+func PubIdentity(pub *rsa.PublicKey) *Identity {
+	return &Identity{
+		private: nil,
+		public:  pub,
+	}
+}
+
+// PublicKey returns the RSA public key of a legacy identity, it is nil for
+// modern identities.
+func (r *Identity) PublicKey() *rsa.PublicKey {
+	return r.public
+}
+
+func (r *Identity) Public() *Identity {
+	return &Identity{
+		public:     r.public,
+		private:    nil,
+		signPublic: r.signPublic,
+		encPublic:  r.encPublic,
+	}
+}
+
+// HasPrivateKey reports whether the identity can sign and decrypt.
+func (r *Identity) HasPrivateKey() bool {
+	return r.private != nil || (r.signPrivate != nil && r.encPrivate != nil)
+}
+
+// Sign returns a signature made by combining the message and the signers private key
+// With the r.Verify function, the signature can be checked.
+func (r *Identity) Sign(msg []byte) ([]byte, error) {
+	if r.signPrivate != nil {
+		return ed25519.Sign(r.signPrivate, msg), nil
+	}
+
+	hs := r.getHashSum(msg)
+
+	if r.private == nil {
+		return nil, r.noPrivateKey()
+	}
+
+	return rsa.SignPKCS1v15(rand.Reader, r.private, crypto.SHA256, hs)
+}
+
+// Verify checks if a message is signed by a given Public Key, which is either
+// an *rsa.PublicKey or an ed25519.PublicKey. The identity's own key is used
+// when pubKey is nil.
+func (r *Identity) Verify(msg []byte, sig []byte, pubKey crypto.PublicKey) error {
+	switch k := pubKey.(type) {
+	case *rsa.PublicKey:
+		if k != nil {
+			return rsa.VerifyPKCS1v15(k, crypto.SHA256, r.getHashSum(msg), sig)
+		}
+	case ed25519.PublicKey:
+		if k != nil {
+			return verifyEd25519(k, msg, sig)
+		}
+	case nil:
+	default:
+		return ErrUnknownKeyType
+	}
+
+	switch r.Algorithm() {
+	case AlgRSA:
+		return rsa.VerifyPKCS1v15(r.public, crypto.SHA256, r.getHashSum(msg), sig)
+	case AlgEd25519:
+		return verifyEd25519(r.signPublic, msg, sig)
+	}
+
+	return ErrIdentityEmpty
+}
+
+func verifyEd25519(key ed25519.PublicKey, msg []byte, sig []byte) error {
+	if !ed25519.Verify(key, msg, sig) {
+		return errors.New("ed25519: verification error")
+	}
+
+	return nil
+}
+
+// Encrypt's the message for the given public key. RSA keys use EncryptOAEP which encrypts
+// the given message with RSA-OAEP.
+// https://en.wikipedia.org/wiki/Optimal_asymmetric_encryption_padding
+// X25519 keys use an ephemeral key agreement, see encryptX25519.
+// The identity's own key is used when key is nil.
+// Returns the encrypted message and an error.
+func (r *Identity) Encrypt(msg []byte, key crypto.PublicKey) ([]byte, error) {
+	label := []byte("")
+	hash := sha256.New()
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if k != nil {
+			return rsa.EncryptOAEP(hash, rand.Reader, k, msg, label)
+		}
+	case *ecdh.PublicKey:
+		if k != nil {
+			return encryptX25519(k, msg)
+		}
+	case nil:
+	default:
+		return nil, ErrUnknownKeyType
+	}
+
+	switch r.Algorithm() {
+	case AlgRSA:
+		return rsa.EncryptOAEP(hash, rand.Reader, r.public, msg, label)
+	case AlgEd25519:
+		return encryptX25519(r.encPublic, msg)
+	}
+
+	return nil, ErrIdentityEmpty
+}
+
+// Decrypt a message using your private key.
+// A received message should be encrypted using the receivers public key.
+func (r *Identity) Decrypt(msg []byte) ([]byte, error) {
+	label := []byte("")
+	hash := sha256.New()
+
+	if r.encPrivate != nil {
+		return decryptX25519(r.encPrivate, msg)
+	}
+
+	if r.private == nil {
+		return nil, r.noPrivateKey()
+	}
+
+	return rsa.DecryptOAEP(hash, rand.Reader, r.private, msg, label)
+}
+
+func (r *Identity) noPrivateKey() error {
+	if r.IsLocked() {
+		return ErrLocked
+	}
+
+	return ErrNoPrivateKey
+}
+
+func (r *Identity) getHashSum(msg []byte) []byte {
+	h := sha256.New()
+	h.Write(msg)
+
+	return h.Sum(nil)
+}
+
+// publicDER returns the PKIX encoding of the public keys of the identity.
+func (r *Identity) publicDER() ([]byte, error) {
+	switch r.Algorithm() {
+	case AlgRSA:
+		return x509.MarshalPKIXPublicKey(r.public)
+	case AlgEd25519:
+		sign, err := x509.MarshalPKIXPublicKey(r.signPublic)
+		if err != nil {
+			return nil, err
+		}
+
+		enc, err := x509.MarshalPKIXPublicKey(r.encPublic)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(sign, enc...), nil
+	}
+
+	return nil, ErrIdentityEmpty
+}
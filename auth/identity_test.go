@@ -0,0 +1,218 @@
+package auth_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModernIdentity(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	henk := auth.GenerateIdentity()
+	assert.Equal(auth.AlgEd25519, henk.Algorithm())
+	assert.Nil(henk.PublicKey())
+	assert.True(henk.HasPrivateKey())
+	assert.False(henk.Public().HasPrivateKey())
+	assert.Empty(auth.EmptyIdentity().Algorithm())
+
+	b, err := henk.MarshalText()
+	require.NoError(err)
+	assert.Equal(2, strings.Count(string(b), "BEGIN PRIVATE KEY"))
+	assert.Contains(string(b), auth.AlgorithmHeader+": "+auth.AlgEd25519)
+
+	x := auth.EmptyIdentity()
+	require.NoError(x.UnmarshalText(b))
+	assert.Equal(auth.AlgEd25519, x.Algorithm())
+	assert.True(x.HasPrivateKey())
+
+	pub, err := henk.Public().MarshalText()
+	require.NoError(err)
+	assert.Equal(2, strings.Count(string(pub), "BEGIN PUBLIC KEY"))
+	assert.NotContains(string(pub), "PRIVATE")
+
+	require.NoError(x.UnmarshalText(pub))
+	assert.False(x.HasPrivateKey())
+
+	fp1, err := henk.Fingerprint()
+	require.NoError(err)
+	fp2, err := x.Fingerprint()
+	require.NoError(err)
+	assert.Equal(fp1, fp2)
+}
+
+func TestModernSignVerify(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	henk := auth.GenerateIdentity()
+	ingrid := auth.GenerateIdentity()
+	msg := []byte("Wilders doet tenminste iets tegen de politiek.")
+
+	sig, err := henk.Sign(msg)
+	require.NoError(err)
+	require.Len(sig, ed25519.SignatureSize)
+
+	require.NoError(henk.Public().Verify(msg, sig, nil))
+	require.Error(ingrid.Public().Verify(msg, sig, nil))
+	require.Error(henk.Public().Verify([]byte("changed"), sig, nil))
+
+	_, err = henk.Public().Sign(msg)
+	require.ErrorIs(err, auth.ErrNoPrivateKey)
+
+	require.ErrorIs(auth.EmptyIdentity().Verify(msg, sig, nil), auth.ErrIdentityEmpty)
+	require.ErrorIs(henk.Verify(msg, sig, "not a key"), auth.ErrUnknownKeyType)
+
+	// A typed nil key falls back to the identity's own key
+	var nilKey *rsa.PublicKey
+	require.NoError(henk.Verify(msg, sig, nilKey))
+}
+
+func TestModernEncryptDecrypt(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	henk := auth.GenerateIdentity()
+	ingrid := auth.GenerateIdentity()
+	msg := []byte("Die uitkeringstrekkers pikken al onze banen in.")
+
+	c1, err := ingrid.Public().Encrypt(msg, nil)
+	require.NoError(err)
+	c2, err := ingrid.Public().Encrypt(msg, nil)
+	require.NoError(err)
+	assert.False(bytes.Equal(c1, c2))
+
+	b, err := ingrid.Decrypt(c1)
+	require.NoError(err)
+	assert.Equal(msg, b)
+
+	_, err = henk.Decrypt(c1)
+	require.Error(err)
+
+	_, err = ingrid.Public().Decrypt(c1)
+	require.ErrorIs(err, auth.ErrNoPrivateKey)
+
+	_, err = ingrid.Decrypt(c1[:10])
+	require.Error(err)
+
+	_, err = ingrid.Decrypt(c1[:40])
+	require.Error(err)
+
+	_, err = auth.EmptyIdentity().Encrypt(msg, nil)
+	require.ErrorIs(err, auth.ErrIdentityEmpty)
+
+	_, err = henk.Encrypt(msg, "not a key")
+	require.ErrorIs(err, auth.ErrUnknownKeyType)
+
+	// Modern and legacy identities can be mixed in one envelope
+	legacy := auth.GenerateRSAIdentity()
+	env, err := auth.Seal(msg, henk.Public(), legacy.Public())
+	require.NoError(err)
+
+	b, err = henk.Open(env)
+	require.NoError(err)
+	assert.Equal(msg, b)
+
+	b, err = legacy.Open(env)
+	require.NoError(err)
+	assert.Equal(msg, b)
+}
+
+func TestLegacyIdentityCompatibility(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	// RSA identities keep their PKCS#1 encoding so existing users still load
+	legacy := auth.GenerateRSAIdentity()
+	require.Equal(auth.AlgRSA, legacy.Algorithm())
+
+	b, err := legacy.MarshalText()
+	require.NoError(err)
+	require.Contains(string(b), "RSA PRIVATE KEY")
+
+	x := auth.EmptyIdentity()
+	require.NoError(x.UnmarshalText(b))
+	require.Equal(auth.AlgRSA, x.Algorithm())
+
+	// RSA keys in PKCS#8 and PKIX encoding are accepted too
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(err)
+	require.NoError(x.UnmarshalText(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+	require.Equal(auth.AlgRSA, x.Algorithm())
+	require.True(x.HasPrivateKey())
+
+	der, err = x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(err)
+	require.NoError(x.UnmarshalText(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	require.False(x.HasPrivateKey())
+}
+
+func TestModernUnmarshalErrors(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	henk := auth.GenerateIdentity()
+	b, err := henk.MarshalText()
+	require.NoError(err)
+
+	x := auth.EmptyIdentity()
+
+	// Only one of the two keys
+	first, _ := pem.Decode(b)
+	require.ErrorIs(x.UnmarshalText(pem.EncodeToMemory(first)), auth.ErrIdentityEmpty)
+
+	// Unknown algorithm tag
+	first.Headers[auth.AlgorithmHeader] = "rot13"
+	require.ErrorIs(x.UnmarshalText(pem.EncodeToMemory(first)), auth.ErrUnknownKeyType)
+
+	// Tag that does not match the key
+	first.Headers[auth.AlgorithmHeader] = auth.AlgRSA
+	require.ErrorIs(x.UnmarshalText(pem.EncodeToMemory(first)), auth.ErrBadAlgorithm)
+
+	// RSA and modern keys cannot be mixed
+	legacy, err := auth.GenerateRSAIdentity().MarshalText()
+	require.NoError(err)
+	require.ErrorIs(x.UnmarshalText(append(legacy, b...)), auth.ErrBadAlgorithm)
+
+	// Garbage in a known block
+	bad := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("bad")})
+	require.Error(x.UnmarshalText(bad))
+
+	bad = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("bad")})
+	require.Error(x.UnmarshalText(bad))
+
+	// A failed unmarshal leaves the identity untouched
+	require.Empty(x.Algorithm())
+}
+
+func BenchmarkGenerateIdentity(b *testing.B) {
+	for range b.N {
+		auth.GenerateIdentity()
+	}
+}
+
+func BenchmarkGenerateRSAIdentity(b *testing.B) {
+	for range b.N {
+		auth.GenerateRSAIdentity()
+	}
+}
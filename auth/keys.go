@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNoKey          = errors.New("no key was valid at that time")
+	ErrBadFingerprint = errors.New("fingerprint does not match the key")
+	ErrBadRotation    = errors.New("key rotation is not signed by the current key")
+	ErrStaleRotation  = errors.New("key rotation is older than the current key")
+)
+
+// KeyRecord is a key of a user with the period it was in use. Every key
+// after the first one carries a rotation signature made by the key it
+// replaces, so the history forms a chain back to the registered key.
+type KeyRecord struct {
+	Key         *Identity `json:"key"                yaml:"key"`
+	Fingerprint string    `json:"fingerprint"        yaml:"fingerprint"`
+	Created     time.Time `json:"created"            yaml:"created"`
+	Retired     time.Time `json:"retired"            yaml:"retired,omitempty"`
+	Rotation    Bytes     `json:"rotation,omitempty" yaml:"rotation,omitempty"`
+}
+
+// NewKeyRecord returns the record of a key created at the given time.
+func NewKeyRecord(key *Identity, created time.Time) (*KeyRecord, error) {
+	fp, err := key.Fingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyRecord{
+		Key:         key,
+		Fingerprint: fp,
+		Created:     created.UTC(),
+		Retired:     time.Time{},
+		Rotation:    nil,
+	}, nil
+}
+
+// IsRetired reports whether the key was replaced by a newer one.
+func (rec *KeyRecord) IsRetired() bool {
+	return !rec.Retired.IsZero()
+}
+
+// ValidAt reports whether the key was in use at time t.
+func (rec *KeyRecord) ValidAt(t time.Time) bool {
+	if t.Before(rec.Created) {
+		return false
+	}
+
+	return !rec.IsRetired() || t.Before(rec.Retired)
+}
+
+// RotationBytes returns the statement that the previous key signs to hand
+// over to this key.
+func (rec *KeyRecord) RotationBytes(id string, previous string) []byte {
+	return []byte(fmt.Sprintf("chata-key-rotation\n%s\n%s\n%s\n%d",
+		id, previous, rec.Fingerprint, rec.Created.UnixNano()))
+}
+
+// Public returns a copy of the record without the private key.
+func (rec *KeyRecord) Public() *KeyRecord {
+	pub := *rec
+	pub.Key = rec.Key.Public()
+
+	return &pub
+}
+
+// KeyHistory returns the keys of the user, oldest first. Users saved before
+// keys were recorded have a single key that is valid since forever.
+func (user *User) KeyHistory() []*KeyRecord {
+	if len(user.Keys) != 0 || user.Key == nil {
+		return user.Keys
+	}
+
+	fp, err := user.Key.Fingerprint()
+	if err != nil {
+		return nil
+	}
+
+	return []*KeyRecord{{
+		Key:         user.Key,
+		Fingerprint: fp,
+		Created:     time.Time{},
+		Retired:     time.Time{},
+		Rotation:    nil,
+	}}
+}
+
+// KeyAt returns the key of the user that was in use at time t, which is used
+// to verify what the user signed at that time. The first key also covers the
+// time before it was created, to tolerate clock skew at registration.
+func (user *User) KeyAt(t time.Time) (*Identity, error) {
+	history := user.KeyHistory()
+	for i := len(history) - 1; i >= 0; i-- {
+		rec := history[i]
+		if i == 0 && t.Before(rec.Created) {
+			t = rec.Created
+		}
+
+		if rec.ValidAt(t) {
+			return rec.Key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrNoKey, t)
+}
+
+// RecipientKey returns the key of the user that an envelope was sealed for,
+// or the current key if none of the keys is a recipient.
+func (user *User) RecipientKey(env *Envelope) *Identity {
+	history := user.KeyHistory()
+	for i := len(history) - 1; i >= 0; i-- {
+		if env != nil && env.Keys[history[i].Fingerprint] != nil {
+			return history[i].Key
+		}
+	}
+
+	return user.Key
+}
+
+// RotateKey replaces the current key of the user with a new one. The
+// rotation is signed with the current private key.
+func (user *User) RotateKey(key *Identity, now time.Time) (*KeyRecord, error) {
+	rec, err := NewKeyRecord(key, now)
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := user.Key.Fingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	rec.Rotation, err = user.Key.Sign(rec.RotationBytes(user.ID, previous))
+	if err != nil {
+		return nil, err
+	}
+
+	if e := user.AddKey(rec); e != nil {
+		return nil, e
+	}
+
+	return rec, nil
+}
+
+// AddKey makes the key of the record the current key of the user and retires
+// the previous one, after checking that the previous key signed the rotation.
+func (user *User) AddKey(rec *KeyRecord) error {
+	if rec == nil || rec.Key == nil || user.Key == nil {
+		return ErrIdentityEmpty
+	}
+
+	fp, err := rec.Key.Fingerprint()
+	if err != nil {
+		return err
+	}
+
+	if fp != rec.Fingerprint {
+		return ErrBadFingerprint
+	}
+
+	history := user.KeyHistory()
+	current := history[len(history)-1]
+	if !rec.Created.After(current.Created) {
+		return ErrStaleRotation
+	}
+
+	if e := current.Key.Verify(rec.RotationBytes(user.ID, current.Fingerprint), rec.Rotation, nil); e != nil {
+		return fmt.Errorf("%w: %w", ErrBadRotation, e)
+	}
+
+	current.Retired = rec.Created
+	rec.Retired = time.Time{}
+
+	user.Keys = append(history, rec)
+	user.Key = rec.Key
+
+	return nil
+}
+
+// VerifyKeyChain checks that every key that replaced the key with the
+// fingerprint was signed by the key before it, which proves that the current
+// key was handed over by the holder of that key.
+func (user *User) VerifyKeyChain(fingerprint string) error {
+	history := user.KeyHistory()
+
+	start := -1
+	for i, rec := range history {
+		if rec.Fingerprint == fingerprint {
+			start = i
+		}
+	}
+
+	if start < 0 {
+		return fmt.Errorf("%w: %s", ErrNoKey, fingerprint)
+	}
+
+	for i := start; i < len(history); i++ {
+		rec := history[i]
+		if fp, err := rec.Key.Fingerprint(); err != nil || fp != rec.Fingerprint {
+			return fmt.Errorf("%w: %s", ErrBadFingerprint, rec.Fingerprint)
+		}
+
+		if i == start {
+			continue
+		}
+
+		prev := history[i-1]
+		if e := prev.Key.Verify(rec.RotationBytes(user.ID, prev.Fingerprint), rec.Rotation, nil); e != nil {
+			return fmt.Errorf("%w: %s: %w", ErrBadRotation, rec.Fingerprint, e)
+		}
+	}
+
+	// The current key must be the last key of the chain
+	if fp, err := user.Key.Fingerprint(); err != nil || fp != history[len(history)-1].Fingerprint {
+		return ErrBadFingerprint
+	}
+
+	return nil
+}
+
+// VerifyKeyHistory checks the whole key history of the user, from its first
+// key on, before a key is picked from it: every key must be handed over by the
+// key before it and retire the key before it as it takes over. A history that
+// does not check out may hold keys put there by whoever handed out the user.
+func (user *User) VerifyKeyHistory() error {
+	history := user.KeyHistory()
+	if len(history) == 0 {
+		return ErrIdentityEmpty
+	}
+
+	if e := user.VerifyKeyChain(history[0].Fingerprint); e != nil {
+		return e
+	}
+
+	for i, rec := range history {
+		next := time.Time{}
+		if i+1 < len(history) {
+			next = history[i+1].Created
+		}
+
+		if !rec.Retired.Equal(next) {
+			return fmt.Errorf("%w: %s is retired at %s", ErrBadRotation, rec.Fingerprint, rec.Retired)
+		}
+	}
+
+	return nil
+}
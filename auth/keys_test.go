@@ -0,0 +1,239 @@
+package auth_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateKey(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	u := auth.NewUser("henk", "henk")
+	require.Len(u.KeyHistory(), 1)
+
+	first := u.Key
+	created := u.Keys[0].Created
+	rotated := created.Add(time.Hour)
+
+	rec, err := u.RotateKey(auth.GenerateIdentity(), rotated)
+	require.NoError(err)
+	assert.NotEmpty(rec.Rotation)
+	assert.Equal(rec.Key, u.Key)
+	require.Len(u.Keys, 2)
+	assert.True(u.Keys[0].IsRetired())
+	assert.Equal(rotated.UTC(), u.Keys[0].Retired)
+	assert.False(u.Keys[1].IsRetired())
+
+	key, err := u.KeyAt(created.Add(time.Minute))
+	require.NoError(err)
+	assert.Equal(first, key)
+
+	// The first key covers the time before its creation
+	key, err = u.KeyAt(created.Add(-time.Minute))
+	require.NoError(err)
+	assert.Equal(first, key)
+
+	key, err = u.KeyAt(rotated)
+	require.NoError(err)
+	assert.Equal(rec.Key, key)
+
+	key, err = u.KeyAt(rotated.Add(time.Hour))
+	require.NoError(err)
+	assert.Equal(rec.Key, key)
+}
+
+func TestAddKey(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	u := auth.NewUser("henk", "henk")
+	server := u.Public()
+	now := u.Keys[0].Created.Add(time.Hour)
+
+	rec, err := u.RotateKey(auth.GenerateIdentity(), now)
+	require.NoError(err)
+
+	// The server only knows the public keys and accepts a signed rotation
+	require.NoError(server.Copy().AddKey(rec.Public()))
+
+	// Not signed by the current key
+	forged, err := auth.NewKeyRecord(auth.GenerateIdentity(), now)
+	require.NoError(err)
+	forged.Rotation, err = auth.GenerateIdentity().Sign(forged.RotationBytes("henk", server.Keys[0].Fingerprint))
+	require.NoError(err)
+	require.ErrorIs(server.Copy().AddKey(forged), auth.ErrBadRotation)
+
+	// Signed for another user
+	forged.Rotation, err = u.Keys[0].Key.Sign(forged.RotationBytes("ingrid", server.Keys[0].Fingerprint))
+	require.NoError(err)
+	require.ErrorIs(server.Copy().AddKey(forged), auth.ErrBadRotation)
+
+	// Fingerprint of another key
+	bad := rec.Public()
+	bad.Fingerprint = server.Keys[0].Fingerprint
+	require.ErrorIs(server.Copy().AddKey(bad), auth.ErrBadFingerprint)
+
+	// Older than the current key
+	stale, err := auth.NewKeyRecord(auth.GenerateIdentity(), server.Keys[0].Created.Add(-time.Hour))
+	require.NoError(err)
+	require.ErrorIs(server.Copy().AddKey(stale), auth.ErrStaleRotation)
+
+	require.ErrorIs(server.Copy().AddKey(nil), auth.ErrIdentityEmpty)
+
+	// A rejected rotation does not change the user
+	require.Len(server.Keys, 1)
+	require.False(server.Keys[0].IsRetired())
+}
+
+func TestKeyHistoryLegacy(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	u := auth.NewUser("henk", "henk")
+	u.Keys = nil
+
+	history := u.KeyHistory()
+	require.Len(history, 1)
+	assert.True(history[0].Created.IsZero())
+
+	key, err := u.KeyAt(time.Now())
+	require.NoError(err)
+	assert.Equal(u.Key, key)
+
+	first := u.Key
+	rec, err := u.RotateKey(auth.GenerateIdentity(), time.Now())
+	require.NoError(err)
+	require.Len(u.Keys, 2)
+
+	key, err = u.KeyAt(rec.Created.Add(-time.Second))
+	require.NoError(err)
+	assert.Equal(first, key)
+}
+
+func TestRecipientKey(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	u := auth.NewUser("henk", "henk")
+	old, err := auth.Seal([]byte("old"), u.Key)
+	require.NoError(err)
+
+	_, err = u.RotateKey(auth.GenerateIdentity(), time.Now())
+	require.NoError(err)
+
+	current, err := auth.Seal([]byte("new"), u.Key)
+	require.NoError(err)
+
+	b, err := u.RecipientKey(old).Open(old)
+	require.NoError(err)
+	require.Equal("old", string(b))
+
+	b, err = u.RecipientKey(current).Open(current)
+	require.NoError(err)
+	require.Equal("new", string(b))
+
+	require.Equal(u.Key, u.RecipientKey(nil))
+}
+
+func TestSaveKeyHistory(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	dir := t.TempDir()
+	u := auth.NewUser("henk", "henk")
+	_, err := u.RotateKey(auth.GenerateIdentity(), time.Now())
+	require.NoError(err)
+	require.NoError(u.Public().SaveUser(dir, nil))
+
+	u1, err := auth.LoadUser(dir+"/henk", nil)
+	require.NoError(err)
+	require.Len(u1.Keys, 2)
+
+	for i, rec := range u1.Keys {
+		require.Equal(u.Keys[i].Fingerprint, rec.Fingerprint)
+		require.True(u.Keys[i].Created.Equal(rec.Created))
+		require.True(u.Keys[i].Retired.Equal(rec.Retired))
+		require.Equal(u.Keys[i].Rotation, rec.Rotation)
+	}
+}
+
+func TestVerifyKeyChain(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	u := auth.NewUser("henk", "henk")
+	verified := u.Keys[0].Fingerprint
+	require.NoError(u.VerifyKeyChain(verified))
+
+	for range 2 {
+		_, err := u.RotateKey(auth.GenerateIdentity(), time.Now())
+		require.NoError(err)
+	}
+
+	server := u.Public()
+	require.NoError(server.VerifyKeyChain(verified))
+	require.NoError(server.VerifyKeyChain(server.Keys[1].Fingerprint))
+	require.ErrorIs(server.VerifyKeyChain("unknown"), auth.ErrNoKey)
+
+	// A key swapped by the server breaks the chain
+	swapped := server.Copy()
+	swapped.Key = auth.GenerateIdentity().Public()
+	swapped.Keys[2].Key = swapped.Key
+	require.ErrorIs(swapped.VerifyKeyChain(verified), auth.ErrBadFingerprint)
+
+	forged, err := auth.NewKeyRecord(swapped.Key, time.Now())
+	require.NoError(err)
+	swapped.Keys[2] = forged
+	require.ErrorIs(swapped.VerifyKeyChain(verified), auth.ErrBadRotation)
+
+	// The current key must be the end of the chain
+	detached := server.Copy()
+	detached.Key = auth.GenerateIdentity().Public()
+	require.ErrorIs(detached.VerifyKeyChain(verified), auth.ErrBadFingerprint)
+}
+
+func TestVerifyKeyHistory(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	u := auth.NewUser("henk", "henk")
+	require.NoError(u.VerifyKeyHistory())
+
+	for range 2 {
+		_, err := u.RotateKey(auth.GenerateIdentity(), time.Now())
+		require.NoError(err)
+	}
+
+	server := u.Public()
+	require.NoError(server.VerifyKeyHistory())
+
+	// A key slipped into the history by the server
+	inserted := server.Copy()
+	rec, err := auth.NewKeyRecord(auth.GenerateIdentity().Public(), inserted.Keys[1].Created.Add(-time.Nanosecond))
+	require.NoError(err)
+	rec.Retired = inserted.Keys[1].Created
+	inserted.Keys[0].Retired = rec.Created
+	inserted.Keys = append(inserted.Keys[:1], append([]*auth.KeyRecord{rec}, inserted.Keys[1:]...)...)
+	require.ErrorIs(inserted.VerifyKeyHistory(), auth.ErrBadRotation)
+
+	// Or a key kept in use for longer than it was
+	extended := server.Copy()
+	extended.Keys[0].Retired = extended.Keys[1].Created.Add(time.Hour)
+	require.ErrorIs(extended.VerifyKeyHistory(), auth.ErrBadRotation)
+
+	require.ErrorIs((&auth.User{}).VerifyKeyHistory(), auth.ErrIdentityEmpty)
+}
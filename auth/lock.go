@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// EncryptedKeyBlock is the PEM block of a passphrase protected private key.
+const EncryptedKeyBlock = "CHATA ENCRYPTED PRIVATE KEY"
+
+// Parameters of the scrypt key derivation for new locked identities.
+const (
+	ScryptN   = 1 << 15
+	ScryptR   = 8
+	ScryptP   = 1
+	SaltSize  = 16
+	KDFScrypt = "scrypt"
+)
+
+var (
+	ErrLocked        = errors.New("private key is locked with a passphrase")
+	ErrNotLocked     = errors.New("private key is not locked")
+	ErrBadPassphrase = errors.New("bad passphrase")
+	ErrBadLockedKey  = errors.New("bad encrypted private key")
+)
+
+// IsLocked reports whether the private key is encrypted with a passphrase.
+func (r *Identity) IsLocked() bool {
+	return r.locked != nil
+}
+
+// Lock returns a copy of the identity with the private keys encrypted with a
+// key derived from the passphrase using scrypt and AES-256-GCM. The copy has
+// only the public keys in the clear.
+func (r *Identity) Lock(passphrase []byte) (*Identity, error) {
+	if r.IsLocked() {
+		return r, nil
+	}
+
+	if !r.HasPrivateKey() {
+		return nil, ErrNoPrivateKey
+	}
+
+	plaintext, err := r.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	block := &pem.Block{
+		Type: EncryptedKeyBlock,
+		Headers: map[string]string{
+			"KDF":    KDFScrypt,
+			"N":      strconv.Itoa(ScryptN),
+			"R":      strconv.Itoa(ScryptR),
+			"P":      strconv.Itoa(ScryptP),
+			"Salt":   hex.EncodeToString(salt),
+			"Cipher": AlgAES256GCM,
+		},
+		Bytes: nil,
+	}
+
+	locked := r.Public()
+	aead, ad, err := locked.lockCipher(block, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	block.Headers["Nonce"] = hex.EncodeToString(nonce)
+	block.Bytes = aead.Seal(nil, nonce, plaintext, ad)
+	locked.locked = block
+
+	return locked, nil
+}
+
+// Unlock returns a copy of the identity with the private keys decrypted using
+// the passphrase.
+func (r *Identity) Unlock(passphrase []byte) (*Identity, error) {
+	if !r.IsLocked() {
+		return nil, ErrNotLocked
+	}
+
+	aead, ad, err := r.lockCipher(r.locked, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := hex.DecodeString(r.locked.Headers["Nonce"])
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, ErrBadLockedKey
+	}
+
+	plaintext, err := aead.Open(nil, nonce, r.locked.Bytes, ad)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+
+	id := EmptyIdentity()
+	if err := id.UnmarshalText(plaintext); err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+// lockCipher derives the cipher of an encrypted key block from the
+// passphrase. The fingerprint of the public keys is authenticated with the
+// private keys so the two cannot be swapped.
+func (r *Identity) lockCipher(block *pem.Block, passphrase []byte) (cipher.AEAD, []byte, error) {
+	h := block.Headers
+	if h["KDF"] != KDFScrypt || h["Cipher"] != AlgAES256GCM {
+		return nil, nil, ErrBadLockedKey
+	}
+
+	n, errN := strconv.Atoi(h["N"])
+	p, errP := strconv.Atoi(h["P"])
+	rr, errR := strconv.Atoi(h["R"])
+	salt, errS := hex.DecodeString(h["Salt"])
+	if err := errors.Join(errN, errP, errR, errS); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrBadLockedKey, err)
+	}
+
+	key, err := scrypt.Key(passphrase, salt, n, rr, p, DataKeySize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrBadLockedKey, err)
+	}
+
+	fp, err := r.Fingerprint()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return aead, []byte(fp), nil
+}
@@ -0,0 +1,116 @@
+package auth_test
+
+import (
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockUnlock(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	for _, henk := range []*auth.Identity{auth.GenerateIdentity(), auth.GenerateRSAIdentity()} {
+		pass := []byte("correct horse battery staple")
+
+		locked, err := henk.Lock(pass)
+		require.NoError(err)
+		assert.True(locked.IsLocked())
+		assert.False(locked.HasPrivateKey())
+		assert.False(henk.IsLocked())
+
+		same, err := locked.Lock([]byte("other"))
+		require.NoError(err)
+		assert.Same(locked, same)
+
+		// The locked identity can still be used for its public key
+		fp, err := henk.Fingerprint()
+		require.NoError(err)
+		lfp, err := locked.Fingerprint()
+		require.NoError(err)
+		assert.Equal(fp, lfp)
+
+		_, err = locked.Sign([]byte("hello"))
+		require.ErrorIs(err, auth.ErrLocked)
+		_, err = locked.Decrypt([]byte("hello"))
+		require.ErrorIs(err, auth.ErrLocked)
+
+		// Round trip through text keeps the private key encrypted
+		b, err := locked.MarshalText()
+		require.NoError(err)
+		assert.Contains(string(b), auth.EncryptedKeyBlock)
+		assert.NotContains(string(b), "BEGIN PRIVATE KEY")
+		assert.NotContains(string(b), "BEGIN RSA PRIVATE KEY")
+
+		loaded := auth.EmptyIdentity()
+		require.NoError(loaded.UnmarshalText(b))
+		assert.True(loaded.IsLocked())
+
+		_, err = loaded.Unlock([]byte("wrong"))
+		require.ErrorIs(err, auth.ErrBadPassphrase)
+
+		unlocked, err := loaded.Unlock(pass)
+		require.NoError(err)
+		assert.False(unlocked.IsLocked())
+		assert.True(unlocked.HasPrivateKey())
+
+		sig, err := unlocked.Sign([]byte("hello"))
+		require.NoError(err)
+		require.NoError(henk.Public().Verify([]byte("hello"), sig, nil))
+	}
+}
+
+func TestLockErrors(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	henk := auth.GenerateIdentity()
+
+	_, err := henk.Public().Lock([]byte("pass"))
+	require.ErrorIs(err, auth.ErrNoPrivateKey)
+
+	_, err = henk.Unlock([]byte("pass"))
+	require.ErrorIs(err, auth.ErrNotLocked)
+
+	locked, err := henk.Lock([]byte("pass"))
+	require.NoError(err)
+	b, err := locked.MarshalText()
+	require.NoError(err)
+
+	tamper := func(f func(*pem.Block)) error {
+		text := string(b)
+		i := strings.Index(text, "-----BEGIN "+auth.EncryptedKeyBlock)
+		block, _ := pem.Decode([]byte(text[i:]))
+		f(block)
+
+		id := auth.EmptyIdentity()
+		require.NoError(id.UnmarshalText(append([]byte(text[:i]), pem.EncodeToMemory(block)...)))
+		_, err := id.Unlock([]byte("pass"))
+
+		return err
+	}
+
+	require.ErrorIs(tamper(func(b *pem.Block) { b.Headers["KDF"] = "md5" }), auth.ErrBadLockedKey)
+	require.ErrorIs(tamper(func(b *pem.Block) { b.Headers["N"] = "lots" }), auth.ErrBadLockedKey)
+	require.ErrorIs(tamper(func(b *pem.Block) { b.Headers["N"] = "3" }), auth.ErrBadLockedKey)
+	require.ErrorIs(tamper(func(b *pem.Block) { b.Headers["Nonce"] = "00" }), auth.ErrBadLockedKey)
+	require.ErrorIs(tamper(func(b *pem.Block) { b.Bytes[0] ^= 0xff }), auth.ErrBadPassphrase)
+
+	// Swapping the public key of a locked identity is detected
+	other, err := auth.GenerateIdentity().Public().MarshalText()
+	require.NoError(err)
+
+	text := string(b)
+	i := strings.Index(text, "-----BEGIN "+auth.EncryptedKeyBlock)
+	swapped := auth.EmptyIdentity()
+	require.NoError(swapped.UnmarshalText(append(other, text[i:]...)))
+	_, err = swapped.Unlock([]byte("pass"))
+	require.ErrorIs(err, auth.ErrBadPassphrase)
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Action is an operation on a resource that is subject to authorization.
+type Action string
+
+const (
+	ListUsers     Action = "users:list"
+	GetUser       Action = "users:get"
+	UpdateUser    Action = "users:update"
+	DeleteUser    Action = "users:delete"
+	ChangeRoles   Action = "users:roles"
+	ListChats     Action = "chats:list"
+	ReadChat      Action = "chats:read"
+	CreateChat    Action = "chats:create"
+	DeleteChat    Action = "chats:delete"
+	SendMessage   Action = "messages:send"
+	EditMessage   Action = "messages:edit"
+	DeleteMessage Action = "messages:delete"
+	BackupData    Action = "admin:backup"
+)
+
+var ErrForbidden = errors.New("forbidden")
+
+// Policy maps every action to the roles that may perform it, holding any one
+// of the roles is sufficient. SELF is only granted when the caller is the
+// owner of the resource. Actions that are not in the policy are denied.
+type Policy map[Action][]Role
+
+func DefaultPolicy() Policy {
+	return Policy{
+		ListUsers:     {ADMIN, CHATTER},
+		GetUser:       {ADMIN, CHATTER},
+		UpdateUser:    {ADMIN, SELF},
+		DeleteUser:    {ADMIN, SELF},
+		ChangeRoles:   {ADMIN},
+		ListChats:     {SELF},
+		ReadChat:      {SELF},
+		CreateChat:    {SELF},
+		DeleteChat:    {ADMIN, SELF},
+		SendMessage:   {SELF},
+		EditMessage:   {SELF},
+		DeleteMessage: {ADMIN, SELF},
+		BackupData:    {ADMIN},
+	}
+}
+
+// Allowed reports whether the caller may perform the action on a resource
+// owned by the user with id owner. An empty owner means the resource is not
+// owned by anyone.
+func (p Policy) Allowed(action Action, caller *User, owner string) bool {
+	if caller == nil || caller.Roles == nil {
+		return false
+	}
+
+	for _, role := range p[action] {
+		if !caller.Roles.HasRole(role) {
+			continue
+		}
+
+		if role != SELF || (owner != "" && owner == caller.ID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authorize returns ErrForbidden if the caller may not perform the action.
+func (p Policy) Authorize(action Action, caller *User, owner string) error {
+	if p.Allowed(action, caller, owner) {
+		return nil
+	}
+
+	id := ""
+	if caller != nil {
+		id = caller.ID
+	}
+
+	return fmt.Errorf("%w: %s may not %s", ErrForbidden, id, action)
+}
@@ -0,0 +1,83 @@
+package auth_test
+
+import (
+	"testing"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	t.Parallel()
+
+	admin := &auth.User{ID: "admin", Roles: auth.NewRoles(auth.ADMIN, auth.CHATTER, auth.SELF)}
+	alice := &auth.User{ID: "alice", Roles: auth.NewRoles(auth.CHATTER, auth.SELF)}
+	nobody := &auth.User{ID: "nobody", Roles: auth.NewRoles()}
+
+	tests := []struct {
+		action  auth.Action
+		caller  *auth.User
+		owner   string
+		allowed bool
+	}{
+		{auth.ListUsers, admin, "", true},
+		{auth.ListUsers, alice, "", true},
+		{auth.ListUsers, nobody, "", false},
+		{auth.GetUser, alice, "bob", true},
+		{auth.UpdateUser, alice, "alice", true},
+		{auth.UpdateUser, alice, "bob", false},
+		{auth.UpdateUser, admin, "bob", true},
+		{auth.DeleteUser, alice, "alice", true},
+		{auth.DeleteUser, alice, "bob", false},
+		{auth.DeleteUser, admin, "bob", true},
+		{auth.ChangeRoles, alice, "alice", false},
+		{auth.ChangeRoles, admin, "alice", true},
+		{auth.ListChats, alice, "alice", true},
+		{auth.ListChats, alice, "bob", false},
+		{auth.ReadChat, alice, "alice", true},
+		{auth.ReadChat, alice, "bob", false},
+		{auth.ReadChat, admin, "bob", false},
+		{auth.CreateChat, alice, "bob", false},
+		{auth.DeleteChat, admin, "bob", true},
+		{auth.SendMessage, alice, "alice", true},
+		{auth.SendMessage, alice, "bob", false},
+		{auth.SendMessage, alice, "", false},
+		{auth.SendMessage, nil, "alice", false},
+		{auth.EditMessage, alice, "alice", true},
+		{auth.EditMessage, admin, "alice", false},
+		{auth.DeleteMessage, alice, "alice", true},
+		{auth.DeleteMessage, alice, "bob", false},
+		{auth.BackupData, alice, "", false},
+		{auth.BackupData, admin, "", true},
+		{auth.DeleteMessage, admin, "alice", true},
+		{auth.Action("unknown"), admin, "admin", false},
+	}
+
+	policy := auth.DefaultPolicy()
+	for _, test := range tests {
+		id := "<nil>"
+		if test.caller != nil {
+			id = test.caller.ID
+		}
+
+		assert.Equal(t, test.allowed, policy.Allowed(test.action, test.caller, test.owner),
+			"%s %s on %q", id, test.action, test.owner)
+
+		err := policy.Authorize(test.action, test.caller, test.owner)
+		if test.allowed {
+			require.NoError(t, err)
+		} else {
+			require.ErrorIs(t, err, auth.ErrForbidden)
+		}
+	}
+}
+
+func TestPolicySelfNeedsRole(t *testing.T) {
+	t.Parallel()
+
+	// Owning the resource is not enough without the SELF role
+	u := &auth.User{ID: "alice", Roles: auth.NewRoles(auth.CHATTER)}
+	assert.False(t, auth.DefaultPolicy().Allowed(auth.ReadChat, u, "alice"))
+	assert.False(t, auth.DefaultPolicy().Allowed(auth.ReadChat, &auth.User{ID: "alice"}, "alice"))
+}
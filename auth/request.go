@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers carried by every signed API request.
+const (
+	HeaderUser      = "X-Chata-User"
+	HeaderTimestamp = "X-Chata-Timestamp"
+	HeaderNonce     = "X-Chata-Nonce"
+	HeaderSignature = "X-Chata-Signature"
+)
+
+const (
+	DefaultClockSkew = 5 * time.Minute
+	NonceSize        = 16
+)
+
+var (
+	ErrNotSigned     = errors.New("request is not signed")
+	ErrClockSkew     = errors.New("request timestamp is outside the allowed clock skew")
+	ErrNonceReplayed = errors.New("request nonce has already been used")
+)
+
+// RequestSignature is the authentication material attached to a request.
+type RequestSignature struct {
+	User      string
+	Timestamp time.Time
+	Nonce     string
+	Signature []byte
+}
+
+// CanonicalRequest returns the bytes that are signed for a request. The body
+// is represented by its SHA-256 hash.
+func CanonicalRequest(method, uri string, timestamp time.Time, nonce string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+
+	return []byte(strings.Join([]string{
+		strings.ToUpper(method),
+		uri,
+		strconv.FormatInt(timestamp.Unix(), 10),
+		nonce,
+		hex.EncodeToString(sum[:]),
+	}, "\n"))
+}
+
+// NewNonce returns a random hex encoded nonce.
+func NewNonce() string {
+	b := make([]byte, NonceSize)
+	_, err := rand.Read(b)
+	PanicOnError(err)
+
+	return hex.EncodeToString(b)
+}
+
+// SignRequest signs the request on behalf of user and sets the signature
+// headers. The body must be the exact bytes that are sent with the request.
+func (r *Identity) SignRequest(user string, req *http.Request, body []byte) error {
+	ts := time.Now()
+	nonce := NewNonce()
+
+	sig, err := r.Sign(CanonicalRequest(req.Method, req.URL.RequestURI(), ts, nonce, body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(HeaderUser, user)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts.Unix(), 10))
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(sig))
+
+	return nil
+}
+
+// ParseRequestSignature reads the signature headers of a request.
+func ParseRequestSignature(header http.Header) (*RequestSignature, error) {
+	user := header.Get(HeaderUser)
+	ts := header.Get(HeaderTimestamp)
+	nonce := header.Get(HeaderNonce)
+	sig := header.Get(HeaderSignature)
+
+	if user == "" || ts == "" || nonce == "" || sig == "" {
+		return nil, ErrNotSigned
+	}
+
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad request timestamp: %w", err)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, fmt.Errorf("bad request signature: %w", err)
+	}
+
+	return &RequestSignature{
+		User:      user,
+		Timestamp: time.Unix(secs, 0),
+		Nonce:     nonce,
+		Signature: b,
+	}, nil
+}
+
+// NonceCache remembers the nonces seen within a time window so that a signed
+// request cannot be replayed.
+type NonceCache struct {
+	window time.Duration
+	seen   map[string]time.Time
+	pruned time.Time
+	lock   *sync.Mutex
+}
+
+func NewNonceCache(window time.Duration) *NonceCache {
+	return &NonceCache{
+		window: window,
+		seen:   map[string]time.Time{},
+		pruned: time.Time{},
+		lock:   &sync.Mutex{},
+	}
+}
+
+// Check records the nonce of a user and fails if it was already used.
+func (n *NonceCache) Check(user string, nonce string, now time.Time) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if now.Sub(n.pruned) > n.window {
+		for k, t := range n.seen {
+			if now.Sub(t) > n.window {
+				delete(n.seen, k)
+			}
+		}
+		n.pruned = now
+	}
+
+	key := user + "/" + nonce
+	if _, ok := n.seen[key]; ok {
+		return ErrNonceReplayed
+	}
+
+	n.seen[key] = now
+
+	return nil
+}
+
+// RequestVerifier checks signed requests for freshness, replays and
+// authenticity.
+type RequestVerifier struct {
+	Skew   time.Duration
+	Nonces *NonceCache
+	Now    func() time.Time
+}
+
+func NewRequestVerifier(skew time.Duration) *RequestVerifier {
+	// Nonces must be remembered for as long as their timestamp is acceptable,
+	// that is skew on either side of now.
+	return &RequestVerifier{
+		Skew:   skew,
+		Nonces: NewNonceCache(2 * skew),
+		Now:    time.Now,
+	}
+}
+
+// Verify checks the signature of a request against the signer's key.
+func (v *RequestVerifier) Verify(sig *RequestSignature, key *Identity,
+	method string, uri string, body []byte,
+) error {
+	now := v.Now()
+	if d := now.Sub(sig.Timestamp); d > v.Skew || d < -v.Skew {
+		return ErrClockSkew
+	}
+
+	msg := CanonicalRequest(method, uri, sig.Timestamp, sig.Nonce, body)
+	if err := key.Verify(msg, sig.Signature, nil); err != nil {
+		return fmt.Errorf("bad request signature: %w", err)
+	}
+
+	// Only remember nonces of authentic requests, otherwise anyone could
+	// burn the nonces of another user.
+	return v.Nonces.Check(sig.User, sig.Nonce, now)
+}
@@ -0,0 +1,125 @@
+package auth_test
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signedRequest(t *testing.T, key *auth.Identity, body []byte) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost/message/user1/user2?a=b",
+		bytes.NewReader(body))
+	require.NoError(t, err)
+	require.NoError(t, key.SignRequest("user1", req, body))
+
+	return req
+}
+
+func TestSignRequest(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	key := auth.GenerateIdentity()
+	body := []byte(`{"text":"hello"}`)
+	req := signedRequest(t, key, body)
+
+	sig, err := auth.ParseRequestSignature(req.Header)
+	require.NoError(err)
+	assert.Equal("user1", sig.User)
+	assert.NotEmpty(sig.Nonce)
+	assert.NotEmpty(sig.Signature)
+
+	v := auth.NewRequestVerifier(auth.DefaultClockSkew)
+	uri := req.URL.RequestURI()
+	require.NoError(v.Verify(sig, key.Public(), req.Method, uri, body))
+
+	// Replaying the same request is rejected
+	require.ErrorIs(v.Verify(sig, key.Public(), req.Method, uri, body), auth.ErrNonceReplayed)
+
+	// Tampering with the method, uri or body is rejected
+	sig, err = auth.ParseRequestSignature(signedRequest(t, key, body).Header)
+	require.NoError(err)
+	require.Error(v.Verify(sig, key.Public(), http.MethodDelete, uri, body))
+	require.Error(v.Verify(sig, key.Public(), req.Method, "/message/user1/user3", body))
+	require.Error(v.Verify(sig, key.Public(), req.Method, uri, []byte(`{"text":"bye"}`)))
+
+	// A different key is rejected
+	require.Error(v.Verify(sig, auth.GenerateIdentity().Public(), req.Method, uri, body))
+
+	// A forged request does not burn the nonce of the genuine one
+	require.NoError(v.Verify(sig, key.Public(), req.Method, uri, body))
+}
+
+func TestVerifyClockSkew(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	key := auth.GenerateIdentity()
+	req := signedRequest(t, key, nil)
+	sig, err := auth.ParseRequestSignature(req.Header)
+	require.NoError(err)
+
+	v := auth.NewRequestVerifier(time.Minute)
+	v.Now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	require.ErrorIs(v.Verify(sig, key, req.Method, req.URL.RequestURI(), nil), auth.ErrClockSkew)
+
+	v.Now = func() time.Time { return time.Now().Add(-2 * time.Minute) }
+	require.ErrorIs(v.Verify(sig, key, req.Method, req.URL.RequestURI(), nil), auth.ErrClockSkew)
+
+	v.Now = time.Now
+	require.NoError(v.Verify(sig, key, req.Method, req.URL.RequestURI(), nil))
+}
+
+func TestParseRequestSignature(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	h := http.Header{}
+	_, err := auth.ParseRequestSignature(h)
+	require.ErrorIs(err, auth.ErrNotSigned)
+
+	h.Set(auth.HeaderUser, "user1")
+	h.Set(auth.HeaderTimestamp, "not-a-number")
+	h.Set(auth.HeaderNonce, auth.NewNonce())
+	h.Set(auth.HeaderSignature, "c2ln")
+	_, err = auth.ParseRequestSignature(h)
+	require.Error(err)
+
+	h.Set(auth.HeaderTimestamp, "1000")
+	h.Set(auth.HeaderSignature, "!!not base64!!")
+	_, err = auth.ParseRequestSignature(h)
+	require.Error(err)
+
+	h.Set(auth.HeaderSignature, "c2ln")
+	sig, err := auth.ParseRequestSignature(h)
+	require.NoError(err)
+	require.Equal(time.Unix(1000, 0), sig.Timestamp)
+}
+
+func TestNonceCache(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	now := time.Now()
+	n := auth.NewNonceCache(time.Minute)
+	require.NoError(n.Check("user1", "n1", now))
+	require.ErrorIs(n.Check("user1", "n1", now), auth.ErrNonceReplayed)
+	require.NoError(n.Check("user2", "n1", now))
+
+	// Nonces are forgotten once they are out of the window
+	later := now.Add(2 * time.Minute)
+	require.NoError(n.Check("user1", "n1", later))
+	require.ErrorIs(n.Check("user1", "n1", later), auth.ErrNonceReplayed)
+}
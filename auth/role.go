@@ -74,6 +74,15 @@ func (r *Roles) Equal(anotherRoles *Roles) bool {
 	return true
 }
 
+func (r *Roles) Copy() *Roles {
+	c := NewRoles()
+	for role := range r.roles {
+		c.Add(role)
+	}
+
+	return c
+}
+
 func (r *Roles) HasRole(role Role) bool {
 	_, ok := r.roles[role]
 
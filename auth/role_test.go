@@ -118,3 +118,17 @@ func TestRolesEqual(t *testing.T) {
 	anotherRoles.Add(auth.SELF)
 	assert.False(roles.Equal(anotherRoles))
 }
+
+func TestRolesCopy(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	roles := auth.NewRoles(auth.ADMIN, auth.SELF)
+	c := roles.Copy()
+	assert.True(roles.Equal(c))
+
+	c.Remove(auth.ADMIN)
+	assert.False(roles.Equal(c))
+	assert.True(roles.HasRole(auth.ADMIN))
+}
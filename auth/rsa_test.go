@@ -20,7 +20,7 @@ func TestNewIdentity(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 
-	henk := auth.GenerateIdentity()
+	henk := auth.GenerateRSAIdentity()
 
 	pkSize := henk.PublicKey().Size()
 	assert.Equal(256, pkSize)
@@ -78,7 +78,7 @@ func TestUnmarshalErrors(t *testing.T) {
 
 	assert.Empty(auth.EmptyIdentity().String())
 
-	henk := auth.GenerateIdentity()
+	henk := auth.GenerateRSAIdentity()
 
 	pkSize := henk.PublicKey().Size()
 	assert.Equal(256, pkSize)
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Layout of fingerprints and safety numbers shown to users.
+const (
+	FingerprintGroup   = 4
+	SafetyNumberGroups = 12
+)
+
+// FormatFingerprint splits a hex fingerprint into groups that are easier to
+// read out loud.
+func FormatFingerprint(fp string) string {
+	groups := make([]string, 0, len(fp)/FingerprintGroup+1)
+	for len(fp) > FingerprintGroup {
+		groups = append(groups, fp[:FingerprintGroup])
+		fp = fp[FingerprintGroup:]
+	}
+
+	return strings.Join(append(groups, fp), " ")
+}
+
+// SafetyNumber returns a number that is the same for both users as long as
+// both see the same keys. Comparing it out of band detects a server that
+// swaps the keys of either user.
+func SafetyNumber(a *User, b *User) (string, error) {
+	if b.ID < a.ID {
+		a, b = b, a
+	}
+
+	fa, err := a.Key.Fingerprint()
+	if err != nil {
+		return "", err
+	}
+
+	fb, err := b.Key.Fingerprint()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha512.Sum512([]byte(fmt.Sprintf("chata-safety-number\n%s\n%s\n%s\n%s", a.ID, fa, b.ID, fb)))
+
+	// Every 5 bytes of the hash become a group of 5 digits
+	groups := make([]string, 0, SafetyNumberGroups)
+	for i := range SafetyNumberGroups {
+		chunk := make([]byte, 8)
+		copy(chunk[3:], sum[i*5:i*5+5])
+		groups = append(groups, fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk)%100000))
+	}
+
+	return strings.Join(groups, " "), nil
+}
@@ -0,0 +1,66 @@
+package auth_test
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatFingerprint(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	assert.Equal("", auth.FormatFingerprint(""))
+	assert.Equal("abcd", auth.FormatFingerprint("abcd"))
+	assert.Equal("abcd ef", auth.FormatFingerprint("abcdef"))
+	assert.Equal("abcd ef01", auth.FormatFingerprint("abcdef01"))
+
+	fp, err := auth.GenerateIdentity().Fingerprint()
+	assert.NoError(err)
+	formatted := auth.FormatFingerprint(fp)
+	assert.Len(strings.Fields(formatted), 16)
+	assert.Equal(fp, strings.ReplaceAll(formatted, " ", ""))
+}
+
+func TestSafetyNumber(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	henk := auth.NewUser("henk", "henk")
+	ingrid := auth.NewUser("ingrid", "ingrid")
+
+	n1, err := auth.SafetyNumber(henk, ingrid.Public())
+	require.NoError(err)
+	assert.Regexp(regexp.MustCompile(`^\d{5}( \d{5}){11}$`), n1)
+
+	// Both users see the same number
+	n2, err := auth.SafetyNumber(ingrid, henk.Public())
+	require.NoError(err)
+	assert.Equal(n1, n2)
+
+	// A swapped key changes the number
+	mallory := ingrid.Public()
+	mallory.Key = auth.GenerateIdentity().Public()
+	n3, err := auth.SafetyNumber(henk, mallory)
+	require.NoError(err)
+	assert.NotEqual(n1, n3)
+
+	// So does a rotated key
+	_, err = ingrid.RotateKey(auth.GenerateIdentity(), time.Now())
+	require.NoError(err)
+	n4, err := auth.SafetyNumber(henk, ingrid)
+	require.NoError(err)
+	assert.NotEqual(n1, n4)
+
+	ingrid.Key = auth.EmptyIdentity()
+	_, err = auth.SafetyNumber(henk, ingrid)
+	require.ErrorIs(err, auth.ErrIdentityEmpty)
+}
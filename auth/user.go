@@ -5,29 +5,74 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"time"
 
+	"github.com/rchamarthy/chata"
 	"gopkg.in/yaml.v3"
 )
 
+// UserVersion is the version of the schema of saved users. Users are saved
+// with the version they were written in, store migrates older ones up to it.
+const UserVersion = 1
+
+// User is a chata user. Key is the current key of the user and Keys is the
+// history of all its keys, including the current one.
 type User struct {
-	ID    string    `json:"id"    yaml:"id"`
-	Name  string    `json:"name"  yaml:"name"`
-	Key   *Identity `json:"key"   yaml:"key"`
-	Roles *Roles    `json:"roles" yaml:"roles"`
+	ID    string       `json:"id"             yaml:"id"`
+	Name  string       `json:"name"           yaml:"name"`
+	Key   *Identity    `json:"key"            yaml:"key"`
+	Keys  []*KeyRecord `json:"keys,omitempty" yaml:"keys,omitempty"`
+	Roles *Roles       `json:"roles"          yaml:"roles"`
 }
 
 func NewUser(name string, id string, roles ...Role) *User {
 	r := NewRoles(roles...)
 	r.Add(SELF) // Everyone has their own role!
 
+	key := GenerateIdentity()
+	rec, err := NewKeyRecord(key, time.Now())
+	PanicOnError(err)
+
 	return &User{
 		Name:  name,
 		ID:    id,
-		Key:   GenerateIdentity(),
+		Key:   key,
+		Keys:  []*KeyRecord{rec},
 		Roles: r,
 	}
 }
 
+// Copy returns a copy of the user that can be changed without changing the
+// user.
+func (user *User) Copy() *User {
+	c := *user
+	if user.Roles != nil {
+		c.Roles = user.Roles.Copy()
+	}
+
+	c.Keys = make([]*KeyRecord, 0, len(user.Keys))
+	for _, rec := range user.Keys {
+		r := *rec
+		c.Keys = append(c.Keys, &r)
+	}
+
+	return &c
+}
+
+// Public returns a copy of the user without any private key.
+func (user *User) Public() *User {
+	c := user.Copy()
+	if c.Key != nil {
+		c.Key = c.Key.Public()
+	}
+
+	for i, rec := range c.Keys {
+		c.Keys[i] = rec.Public()
+	}
+
+	return c
+}
+
 func (user *User) Validate() error {
 	if user.ID == "" {
 		return errors.New("id cannot be empty")
@@ -44,13 +89,25 @@ func (user *User) Validate() error {
 	return nil
 }
 
-func LoadUser(userFile string) (*User, error) {
+// LoadUser reads the user in the file and unseals it with the sealer, without
+// one the file is read as it is.
+func LoadUser(userFile string, sealer chata.Sealer) (*User, error) {
 	b, err := os.ReadFile(userFile)
 	if err != nil {
 		return nil, err
 	}
 
-	user := &User{ID: "", Name: "", Key: nil, Roles: NewRoles()}
+	b, err = chata.Unseal(sealer, userFile, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseUser(b)
+}
+
+// ParseUser reads a user saved in YAML.
+func ParseUser(b []byte) (*User, error) {
+	user := &User{ID: "", Name: "", Key: nil, Keys: nil, Roles: NewRoles()}
 	if e := yaml.Unmarshal(b, user); e != nil {
 		return nil, e
 	}
@@ -58,21 +115,37 @@ func LoadUser(userFile string) (*User, error) {
 	return user, nil
 }
 
-func (user *User) SaveUser(usersDir string) error {
+// SaveUser writes the user to its file in the directory, sealed with the
+// sealer if there is one.
+func (user *User) SaveUser(usersDir string, sealer chata.Sealer) error {
 	if e := user.Validate(); e != nil {
 		return e
 	}
 
 	userFile := path.Join(usersDir, user.ID)
-	b, e := yaml.Marshal(user)
+	b, e := user.Marshal()
 	if e != nil {
 		return e
 	}
 
-	e = os.WriteFile(userFile, b, 0600)
+	b, e = chata.Seal(sealer, userFile, b)
+	if e != nil {
+		return e
+	}
+
+	e = chata.WriteFile(userFile, b, 0600)
 	if e != nil {
 		e = fmt.Errorf("error writing user file: %w", e)
 	}
 
 	return e
 }
+
+// Marshal returns the user in YAML as it is saved, with the version of its
+// schema.
+func (user *User) Marshal() ([]byte, error) {
+	return yaml.Marshal(&struct {
+		Version int `yaml:"version"`
+		User    `yaml:",inline"`
+	}{Version: UserVersion, User: *user})
+}
@@ -37,21 +37,21 @@ func TestLoadUser(t *testing.T) {
 	t.Parallel()
 
 	require := require.New(t)
-	u, e := auth.LoadUser("file-doesnt-exist")
+	u, e := auth.LoadUser("file-doesnt-exist", nil)
 	require.Error(e)
 	require.Nil(u)
 
 	require.NoError(os.WriteFile("./blah", []byte("blah"), 0600))
 	defer os.Remove("./blah")
-	u, e = auth.LoadUser("./blah")
+	u, e = auth.LoadUser("./blah", nil)
 	require.Error(e)
 	require.Nil(u)
 
 	u = auth.NewUser("user1", "user1")
-	require.NoError(u.SaveUser("."))
+	require.NoError(u.SaveUser(".", nil))
 	defer os.Remove("./user1")
 
-	u1, e := auth.LoadUser("./user1")
+	u1, e := auth.LoadUser("./user1", nil)
 	require.NoError(e)
 	require.NotNil(u1)
 	require.Equal(u.Name, u1.Name)
@@ -65,15 +65,35 @@ func TestSaveUser(t *testing.T) {
 
 	u := auth.NewUser("", "")
 	require.NotNil(u)
-	require.Error(u.SaveUser("blah"))
+	require.Error(u.SaveUser("blah", nil))
 
 	u = auth.NewUser("user1", "user1")
 	u.Roles.Add(auth.Role(200))
-	require.Error(u.SaveUser("blah"))
+	require.Error(u.SaveUser("blah", nil))
 
 	u = auth.NewUser("user1", "user1")
-	require.Error(u.SaveUser("blah"))
+	require.Error(u.SaveUser("blah", nil))
 
-	require.NoError(u.SaveUser("."))
+	require.NoError(u.SaveUser(".", nil))
 	defer os.Remove("user1")
 }
+
+func TestLoadLegacyRSAUser(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	dir := t.TempDir()
+	u := auth.NewUser("legacy", "legacy")
+	u.Key = auth.GenerateRSAIdentity()
+	require.NoError(u.SaveUser(dir, nil))
+
+	u1, err := auth.LoadUser(dir+"/legacy", nil)
+	require.NoError(err)
+	require.Equal(auth.AlgRSA, u1.Key.Algorithm())
+	require.NotNil(u1.Key.PublicKey())
+
+	sig, err := u1.Key.Sign([]byte("hello"))
+	require.NoError(err)
+	require.NoError(u.Key.Public().Verify([]byte("hello"), sig, nil))
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const x25519Info = "chata x25519 aes-256-gcm"
+
+var ErrBadCiphertext = errors.New("bad ciphertext")
+
+// encryptX25519 encrypts the message for the recipient with a key derived
+// from an ephemeral X25519 key agreement. The result is the ephemeral public
+// key followed by the nonce and the AES-256-GCM ciphertext.
+func encryptX25519(recipient *ecdh.PublicKey, msg []byte) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x25519Key(shared, ephemeral.PublicKey(), recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := ephemeral.PublicKey().Bytes()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out = append(out, nonce...)
+
+	return aead.Seal(out, nonce, msg, nil), nil
+}
+
+func decryptX25519(priv *ecdh.PrivateKey, msg []byte) ([]byte, error) {
+	size := len(priv.PublicKey().Bytes())
+	if len(msg) < size {
+		return nil, ErrBadCiphertext
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(msg[:size])
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := priv.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x25519Key(shared, ephemeral, priv.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	msg = msg[size:]
+	if len(msg) < aead.NonceSize() {
+		return nil, ErrBadCiphertext
+	}
+
+	return aead.Open(nil, msg[:aead.NonceSize()], msg[aead.NonceSize():], nil)
+}
+
+// x25519Key derives the symmetric key from the shared secret, bound to both
+// the ephemeral and the recipient public keys.
+func x25519Key(shared []byte, ephemeral *ecdh.PublicKey, recipient *ecdh.PublicKey) ([]byte, error) {
+	salt := append(ephemeral.Bytes(), recipient.Bytes()...)
+	key := make([]byte, DataKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(x25519Info)), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
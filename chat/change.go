@@ -0,0 +1,147 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Operations of a change to a message.
+const (
+	ChangeEdit   = "edit"
+	ChangeDelete = "delete"
+)
+
+var (
+	ErrNoMessage      = errors.New("message not found")
+	ErrNotSender      = errors.New("only the sender may edit a message")
+	ErrMessageDeleted = errors.New("message is deleted")
+	ErrBadChange      = errors.New("bad change")
+)
+
+// Tombstone marks a message that was deleted, by its sender or, for
+// moderation, by an admin.
+type Tombstone struct {
+	By   string    `json:"by"   yaml:"by"`
+	Time time.Time `json:"time" yaml:"time"`
+}
+
+// Change is an edit or a deletion of the message with the id ID. An edit
+// carries the new revision of the message, composed and signed by the sender
+// like a message of its own that replaces ID.
+type Change struct {
+	Op      string     `json:"op"                yaml:"op"`
+	ID      uint64     `json:"id"                yaml:"id"`
+	Edit    *Message   `json:"edit,omitempty"    yaml:"edit,omitempty"`
+	Deleted *Tombstone `json:"deleted,omitempty" yaml:"deleted,omitempty"`
+}
+
+// NewEdit returns the change that replaces the message with the revision.
+func NewEdit(revision Message) Change {
+	return Change{Op: ChangeEdit, ID: revision.Replaces, Edit: &revision, Deleted: nil}
+}
+
+// NewDelete returns the change that deletes the message with the id.
+func NewDelete(id uint64, by string, at time.Time) Change {
+	return Change{Op: ChangeDelete, ID: id, Edit: nil, Deleted: &Tombstone{By: by, Time: at}}
+}
+
+// IsEdited reports whether the message was edited.
+func (m *Message) IsEdited() bool {
+	return len(m.Edits) > 0
+}
+
+// IsDeleted reports whether the message was deleted.
+func (m *Message) IsDeleted() bool {
+	return m.Deleted != nil
+}
+
+// Current returns the latest revision of the message, the message itself if
+// it was never edited.
+func (m *Message) Current() *Message {
+	if n := len(m.Edits); n > 0 {
+		return &m.Edits[n-1]
+	}
+
+	return m
+}
+
+// Find returns the index of the message with the id.
+func (s *Session) Find(id uint64) (int, bool) {
+	return slices.BinarySearchFunc(s.Messages, id, func(m Message, id uint64) int {
+		switch {
+		case m.ID < id:
+			return -1
+		case m.ID > id:
+			return 1
+		default:
+			return 0
+		}
+	})
+}
+
+// Check returns the index of the message the change applies to, or an error
+// if the change cannot be applied to the session.
+func (s *Session) Check(c Change) (int, error) {
+	i, ok := s.Find(c.ID)
+	if !ok {
+		return -1, fmt.Errorf("%w: %d", ErrNoMessage, c.ID)
+	}
+
+	m := &s.Messages[i]
+	if m.IsDeleted() {
+		return -1, fmt.Errorf("%w: %d", ErrMessageDeleted, c.ID)
+	}
+
+	switch c.Op {
+	case ChangeEdit:
+		if c.Edit == nil || c.Edit.Replaces != c.ID {
+			return -1, fmt.Errorf("%w: edit of message %d has no revision of it", ErrBadChange, c.ID)
+		}
+
+		if c.Edit.Sender != m.Sender {
+			return -1, ErrNotSender
+		}
+	case ChangeDelete:
+		if c.Deleted == nil {
+			return -1, fmt.Errorf("%w: deletion of message %d has no tombstone", ErrBadChange, c.ID)
+		}
+	default:
+		return -1, fmt.Errorf("%w: unknown operation %q", ErrBadChange, c.Op)
+	}
+
+	return i, nil
+}
+
+// Apply changes the message of the session and returns its index. An edit
+// is added to the history of the message, a deletion drops the content of
+// the message and its history and leaves a tombstone. The messages are
+// replaced rather than changed in place so that snapshots of the session are
+// not disturbed.
+func (s *Session) Apply(c Change) (int, error) {
+	i, err := s.Check(c)
+	if err != nil {
+		return -1, err
+	}
+
+	s.Messages = slices.Clone(s.Messages)
+	s.change(i, c)
+
+	return i, nil
+}
+
+// change applies the change to the message at i in place.
+func (s *Session) change(i int, c Change) {
+	m := &s.Messages[i]
+
+	switch c.Op {
+	case ChangeEdit:
+		edit := *c.Edit
+		edit.ID, edit.ClientID, edit.Edits, edit.Deleted = 0, "", nil, nil
+		m.Edits = append(m.Edits, edit)
+	case ChangeDelete:
+		deleted := *c.Deleted
+		m.Body, m.Envelope, m.Signature, m.Edits, m.Deleted = "", nil, nil, nil, &deleted
+	}
+}
@@ -0,0 +1,154 @@
+package chat_test
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChanges(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	s := chat.NewSession("user1", "user2")
+	s.AddMessage("user1", "one")
+	s.AddMessage("user2", "two")
+	s.AddMessage("user1", "three")
+
+	i, ok := s.Find(2)
+	require.True(ok)
+	require.Equal(1, i)
+
+	_, ok = s.Find(4)
+	require.False(ok)
+
+	edit := chat.Message{Sender: "user1", Body: "one!", Time: time.Now(), Replaces: 1}
+	i, err := s.Apply(chat.NewEdit(edit))
+	require.NoError(err)
+	require.Equal(0, i)
+
+	m := s.Messages[0]
+	require.True(m.IsEdited())
+	require.Equal("one", m.Body)
+	require.Equal("one!", m.Current().Body)
+	require.Equal(uint64(1), m.ID)
+
+	edit.Body = "one!!"
+	_, err = s.Apply(chat.NewEdit(edit))
+	require.NoError(err)
+	require.Len(s.Messages[0].Edits, 2)
+	require.Equal("one!!", s.Messages[0].Current().Body)
+
+	// Only the sender edits a message
+	_, err = s.Apply(chat.NewEdit(chat.Message{Sender: "user1", Body: "mine", Time: time.Now(), Replaces: 2}))
+	require.ErrorIs(err, chat.ErrNotSender)
+
+	_, err = s.Apply(chat.NewEdit(chat.Message{Sender: "user1", Body: "gone", Time: time.Now(), Replaces: 9}))
+	require.ErrorIs(err, chat.ErrNoMessage)
+
+	_, err = s.Apply(chat.Change{Op: "rename", ID: 1, Edit: nil, Deleted: nil})
+	require.ErrorIs(err, chat.ErrBadChange)
+
+	// A deletion drops the content and the history
+	i, err = s.Apply(chat.NewDelete(1, "admin", time.Now()))
+	require.NoError(err)
+
+	m = s.Messages[i]
+	require.True(m.IsDeleted())
+	require.False(m.IsEdited())
+	require.Empty(m.Body)
+	require.Equal("admin", m.Deleted.By)
+
+	_, err = s.Apply(chat.NewEdit(edit))
+	require.ErrorIs(err, chat.ErrMessageDeleted)
+
+	_, err = s.Apply(chat.NewDelete(1, "user1", time.Now()))
+	require.ErrorIs(err, chat.ErrMessageDeleted)
+
+	require.Len(s.Messages, 3)
+}
+
+func TestEditSignature(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	key := auth.GenerateIdentity()
+	id := chat.SessionID("user1", "user2")
+
+	edit := chat.Message{Sender: "user1", Body: "fixed", Time: time.Now(), Replaces: 3}
+	require.NoError(edit.Sign(id, "user2", key))
+	require.NoError(edit.Verify(id, "user2", key.Public()))
+
+	// An edit does not pass for a new message, nor for an edit of another
+	forged := edit
+	forged.Replaces = 0
+	require.Error(forged.Verify(id, "user2", key.Public()))
+
+	forged.Replaces = 4
+	require.Error(forged.Verify(id, "user2", key.Public()))
+}
+
+func TestChangeLog(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	dir := "./test-log-changes"
+	require.NoError(os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+
+	s := chat.NewSession("user1", "user2")
+	require.NoError(s.Save(dir, nil))
+
+	for _, body := range []string{"one", "two", "three"} {
+		require.NoError(s.AppendMessage(dir, nil, chat.Message{Sender: "user1", Body: body, Time: time.Now()}))
+	}
+
+	edit := chat.Message{Sender: "user1", Body: "two!", Time: time.Now(), Replaces: 2}
+	i, err := s.AppendChange(dir, nil, chat.NewEdit(edit))
+	require.NoError(err)
+	require.Equal(1, i)
+
+	i, err = s.AppendChange(dir, nil, chat.NewDelete(3, "user1", time.Now()))
+	require.NoError(err)
+	require.Equal(2, i)
+	require.True(s.NeedsCompaction())
+
+	// A change that does not apply is not logged
+	_, err = s.AppendChange(dir, nil, chat.NewDelete(3, "user1", time.Now()))
+	require.ErrorIs(err, chat.ErrMessageDeleted)
+
+	sessionFile := path.Join(dir, s.ID)
+	s1, err := chat.LoadSession(sessionFile, nil)
+	require.NoError(err)
+	require.Len(s1.Messages, 3)
+	require.Equal("two!", s1.Messages[1].Current().Body)
+	require.True(s1.Messages[2].IsDeleted())
+	require.True(s1.NeedsCompaction())
+
+	// Messages go on after the changes
+	require.NoError(s1.AppendMessage(dir, nil, chat.Message{Sender: "user2", Body: "four", Time: time.Now()}))
+	require.Equal(uint64(4), s1.Messages[3].ID)
+
+	// Compaction folds the changes into the messages
+	require.NoError(s1.Compact(dir, nil))
+	require.False(s1.NeedsCompaction())
+
+	b, err := os.ReadFile(chat.LogFile(sessionFile))
+	require.NoError(err)
+	require.NotContains(string(b), `"op"`)
+	require.NotContains(string(b), "three")
+
+	s2, err := chat.LoadSession(sessionFile, nil)
+	require.NoError(err)
+	require.Len(s2.Messages, 4)
+	require.Equal("two!", s2.Messages[1].Current().Body)
+	require.True(s2.Messages[2].IsDeleted())
+	require.False(s2.NeedsCompaction())
+}
@@ -0,0 +1,181 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rchamarthy/chata/auth"
+)
+
+const (
+	// GroupIDPrefix starts the id of every group. Group ids have no dash so
+	// they never collide with the "a-b" ids of sessions between two users.
+	GroupIDPrefix = "g"
+
+	// MaxGroupMembers bounds the size of a group, every message carries a
+	// wrapped key per member.
+	MaxGroupMembers = 100
+
+	groupIDBytes = 16
+)
+
+var (
+	ErrNotMember     = errors.New("user is not a member of the group")
+	ErrAlreadyMember = errors.New("user is already a member of the group")
+	ErrNotAdmin      = errors.New("only admins of the group may do this")
+	ErrNotOwner      = errors.New("only the owner of the group may do this")
+	ErrGroupFull     = errors.New("group is full")
+	ErrKickOwner     = errors.New("the owner cannot be removed from the group")
+)
+
+// NewGroup returns a group session owned by owner with the members.
+func NewGroup(owner string, name string, members ...string) (*Session, error) {
+	g := &Session{
+		ID:           NewGroupID(),
+		Name:         name,
+		Owner:        owner,
+		Admins:       []string{},
+		Participants: []string{owner},
+		StartTime:    time.Now(),
+		LastMsg:      time.Now(),
+		TTL:          0,
+		Purged:       0,
+		Receipts:     nil,
+		Messages:     []Message{},
+	}
+
+	for _, m := range members {
+		if m == owner {
+			continue
+		}
+
+		if e := g.AddMember(owner, m); e != nil {
+			return nil, fmt.Errorf("error adding %s: %w", m, e)
+		}
+	}
+
+	return g, nil
+}
+
+// NewGroupID returns a random group id.
+func NewGroupID() string {
+	b := make([]byte, groupIDBytes)
+	_, err := rand.Read(b)
+	auth.PanicOnError(err)
+
+	return GroupIDPrefix + hex.EncodeToString(b)
+}
+
+// IsGroupID reports whether id has the form of a group id.
+func IsGroupID(id string) bool {
+	hexID, ok := strings.CutPrefix(id, GroupIDPrefix)
+	if !ok || len(hexID) != 2*groupIDBytes {
+		return false
+	}
+
+	_, err := hex.DecodeString(hexID)
+
+	return err == nil
+}
+
+// IsGroup reports whether the session is a group rather than a chat between
+// two users.
+func (s *Session) IsGroup() bool {
+	return s.Owner != ""
+}
+
+// Members returns the users of the session.
+func (s *Session) Members() []string {
+	if s.IsGroup() {
+		return slices.Clone(s.Participants)
+	}
+
+	return []string{s.User1, s.User2}
+}
+
+// HasMember reports whether the user takes part in the session.
+func (s *Session) HasMember(user string) bool {
+	return slices.Contains(s.Members(), user)
+}
+
+// IsAdmin reports whether the user may manage the members of the group.
+func (s *Session) IsAdmin(user string) bool {
+	return s.IsGroup() && (s.Owner == user || slices.Contains(s.Admins, user))
+}
+
+// Recipient returns what a message of the sender is addressed to: the peer
+// in a chat between two users and the group itself in a group.
+func (s *Session) Recipient(sender string) string {
+	if s.IsGroup() {
+		return s.ID
+	}
+
+	return s.Peer(sender)
+}
+
+// AddMember adds a user to the group, by must be an admin.
+func (s *Session) AddMember(by string, user string) error {
+	if !s.IsAdmin(by) {
+		return ErrNotAdmin
+	}
+
+	if s.HasMember(user) {
+		return ErrAlreadyMember
+	}
+
+	if len(s.Participants) >= MaxGroupMembers {
+		return ErrGroupFull
+	}
+
+	s.Participants = append(s.Participants, user)
+
+	return nil
+}
+
+// RemoveMember removes a user from the group. Members may leave by removing
+// themselves, admins may remove members and only the owner may remove other
+// admins. The owner cannot be removed.
+func (s *Session) RemoveMember(by string, user string) error {
+	if !s.HasMember(user) {
+		return ErrNotMember
+	}
+
+	switch {
+	case user == s.Owner:
+		return ErrKickOwner
+	case by == user:
+	case s.IsAdmin(user) && by != s.Owner:
+		return ErrNotOwner
+	case !s.IsAdmin(by):
+		return ErrNotAdmin
+	}
+
+	s.Participants = slices.DeleteFunc(s.Participants, func(m string) bool { return m == user })
+	s.Admins = slices.DeleteFunc(s.Admins, func(m string) bool { return m == user })
+
+	return nil
+}
+
+// SetAdmin grants or revokes the admin role of a member, by must be the
+// owner.
+func (s *Session) SetAdmin(by string, user string, admin bool) error {
+	if by != s.Owner {
+		return ErrNotOwner
+	}
+
+	if !s.HasMember(user) {
+		return ErrNotMember
+	}
+
+	s.Admins = slices.DeleteFunc(s.Admins, func(m string) bool { return m == user })
+	if admin && user != s.Owner {
+		s.Admins = append(s.Admins, user)
+	}
+
+	return nil
+}
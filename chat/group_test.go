@@ -0,0 +1,87 @@
+package chat_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rchamarthy/chata/chat"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewGroup(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	g, err := chat.NewGroup("alice", "friends", "bob", "alice", "carol")
+	require.NoError(err)
+	require.True(g.IsGroup())
+	require.True(strings.HasPrefix(g.ID, chat.GroupIDPrefix))
+	require.NotContains(g.ID, "-")
+	require.True(chat.IsGroupID(g.ID))
+	require.False(chat.IsGroupID("gopher"))
+	require.False(chat.IsGroupID(chat.SessionID("alice", "bob")))
+	require.Equal([]string{"alice", "bob", "carol"}, g.Members())
+	require.Equal(g.ID, g.Recipient("bob"))
+	require.True(g.IsAdmin("alice"))
+	require.False(g.IsAdmin("bob"))
+
+	other, err := chat.NewGroup("alice", "friends")
+	require.NoError(err)
+	require.NotEqual(g.ID, other.ID)
+
+	_, err = chat.NewGroup("alice", "dup", "bob", "bob")
+	require.ErrorIs(err, chat.ErrAlreadyMember)
+
+	s := chat.NewSession("alice", "bob")
+	require.False(s.IsGroup())
+	require.Equal([]string{"alice", "bob"}, s.Members())
+	require.Equal("bob", s.Recipient("alice"))
+	require.False(s.IsAdmin("alice"))
+}
+
+func TestGroupMembers(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	g, err := chat.NewGroup("alice", "friends", "bob", "carol")
+	require.NoError(err)
+
+	require.ErrorIs(g.AddMember("bob", "dave"), chat.ErrNotAdmin)
+	require.ErrorIs(g.SetAdmin("bob", "bob", true), chat.ErrNotOwner)
+	require.ErrorIs(g.SetAdmin("alice", "dave", true), chat.ErrNotMember)
+	require.NoError(g.SetAdmin("alice", "bob", true))
+	require.True(g.IsAdmin("bob"))
+
+	require.NoError(g.AddMember("bob", "dave"))
+	require.ErrorIs(g.AddMember("bob", "dave"), chat.ErrAlreadyMember)
+	require.True(g.HasMember("dave"))
+
+	// Admins remove members, only the owner removes admins
+	require.ErrorIs(g.RemoveMember("carol", "dave"), chat.ErrNotAdmin)
+	require.NoError(g.RemoveMember("bob", "dave"))
+	require.ErrorIs(g.RemoveMember("bob", "dave"), chat.ErrNotMember)
+	require.NoError(g.SetAdmin("alice", "carol", true))
+	require.ErrorIs(g.RemoveMember("bob", "carol"), chat.ErrNotOwner)
+	require.ErrorIs(g.RemoveMember("bob", "alice"), chat.ErrKickOwner)
+
+	// Members leave by removing themselves
+	require.NoError(g.RemoveMember("carol", "carol"))
+	require.False(g.IsAdmin("carol"))
+	require.NoError(g.RemoveMember("alice", "bob"))
+	require.Equal([]string{"alice"}, g.Members())
+	require.Empty(g.Admins)
+}
+
+func TestGroupFull(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	g, err := chat.NewGroup("owner", "big")
+	require.NoError(err)
+
+	for i := range chat.MaxGroupMembers - 1 {
+		require.NoError(g.AddMember("owner", "user"+strings.Repeat("x", i+1)))
+	}
+
+	require.ErrorIs(g.AddMember("owner", "one-too-many"), chat.ErrGroupFull)
+}
@@ -0,0 +1,217 @@
+package chat
+
+import (
+	"sync"
+)
+
+// Types of the events published to the users of a session.
+const (
+	EventMessage        = "message"
+	EventMessageEdited  = "message.edited"
+	EventMessageDeleted = "message.deleted"
+	EventSessionCreated = "session.created"
+	EventSessionDeleted = "session.deleted"
+	EventMembers        = "session.members"
+	EventReceipt        = "session.receipt"
+	EventSettings       = "session.settings"
+	EventPurged         = "session.purged"
+)
+
+// DefaultEventBuffer is the number of events a subscriber may lag behind
+// before it is dropped.
+const DefaultEventBuffer = 64
+
+// Event is a change to a session. ID is the id of the message for message
+// events, the id of the last message that was purged for purge events and
+// the id of the last message of the session for the others. Receipt events
+// carry the receipts of the session.
+type Event struct {
+	Type     string             `json:"type"               yaml:"type"`
+	Session  string             `json:"session"            yaml:"session"`
+	Users    []string           `json:"users"              yaml:"users"`
+	ID       uint64             `json:"id"                 yaml:"id"`
+	Message  *Message           `json:"message,omitempty"  yaml:"message,omitempty"`
+	Receipts map[string]Receipt `json:"receipts,omitempty" yaml:"receipts,omitempty"`
+}
+
+// NewMessageEvent returns the event of the message of the session.
+func NewMessageEvent(s *Session, m Message) Event {
+	return Event{
+		Type:     EventMessage,
+		Session:  s.ID,
+		Users:    s.Members(),
+		ID:       m.ID,
+		Message:  &m,
+		Receipts: nil,
+	}
+}
+
+// NewChangeEvent returns the event of an edit or a deletion of the message
+// of the session, as the message is after the change.
+func NewChangeEvent(s *Session, m Message) Event {
+	eventType := EventMessageEdited
+	if m.IsDeleted() {
+		eventType = EventMessageDeleted
+	}
+
+	return Event{
+		Type:     eventType,
+		Session:  s.ID,
+		Users:    s.Members(),
+		ID:       m.ID,
+		Message:  &m,
+		Receipts: nil,
+	}
+}
+
+// NewReceiptEvent returns the event of a change to the receipts of the
+// session.
+func NewReceiptEvent(s *Session) Event {
+	return Event{
+		Type:     EventReceipt,
+		Session:  s.ID,
+		Users:    s.Members(),
+		ID:       s.LastID(),
+		Message:  nil,
+		Receipts: s.Receipts,
+	}
+}
+
+// NewPurgeEvent returns the event of the purge of the old messages of the
+// session, the messages up to the id of the event are gone.
+func NewPurgeEvent(s *Session) Event {
+	return Event{
+		Type:     EventPurged,
+		Session:  s.ID,
+		Users:    s.Members(),
+		ID:       s.Purged,
+		Message:  nil,
+		Receipts: nil,
+	}
+}
+
+// NewSessionEvent returns an event about the session itself.
+func NewSessionEvent(eventType string, s *Session) Event {
+	return Event{
+		Type:     eventType,
+		Session:  s.ID,
+		Users:    s.Members(),
+		ID:       s.LastID(),
+		Message:  nil,
+		Receipts: nil,
+	}
+}
+
+// Hub fans out the events of sessions to the subscribers of their users.
+type Hub struct {
+	buffer int
+	subs   map[string]map[*Subscription]struct{}
+	lock   *sync.Mutex
+}
+
+// Subscription receives the events of a user until it is closed. A
+// subscriber that does not keep up is dropped, Dropped then reports true
+// and the subscriber should resume from the last message it has seen.
+type Subscription struct {
+	User    string
+	events  chan Event
+	hub     *Hub
+	dropped bool
+}
+
+func NewHub(buffer int) *Hub {
+	return &Hub{
+		buffer: buffer,
+		subs:   map[string]map[*Subscription]struct{}{},
+		lock:   &sync.Mutex{},
+	}
+}
+
+// Subscribe returns a subscription to the events of the user.
+func (h *Hub) Subscribe(user string) *Subscription {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	sub := &Subscription{
+		User:    user,
+		events:  make(chan Event, h.buffer),
+		hub:     h,
+		dropped: false,
+	}
+
+	if h.subs[user] == nil {
+		h.subs[user] = map[*Subscription]struct{}{}
+	}
+
+	h.subs[user][sub] = struct{}{}
+
+	return sub
+}
+
+// Publish sends the event to every subscriber of the users of the event. It
+// never blocks, subscribers with a full buffer are dropped.
+func (h *Hub) Publish(e Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for _, user := range e.Users {
+		for sub := range h.subs[user] {
+			select {
+			case sub.events <- e:
+			default:
+				sub.dropped = true
+				h.remove(sub)
+			}
+		}
+	}
+}
+
+// Subscribers returns the number of subscriptions of the user.
+func (h *Hub) Subscribers(user string) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return len(h.subs[user])
+}
+
+// remove must be called with the lock held.
+func (h *Hub) remove(sub *Subscription) {
+	subs, ok := h.subs[sub.User]
+	if !ok {
+		return
+	}
+
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subs, sub.User)
+	}
+
+	close(sub.events)
+}
+
+// Events returns the channel of events, it is closed when the subscription
+// is closed or dropped.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped reports whether the subscription was closed because it did not
+// keep up with the events.
+func (s *Subscription) Dropped() bool {
+	s.hub.lock.Lock()
+	defer s.hub.lock.Unlock()
+
+	return s.dropped
+}
+
+// Close stops the subscription.
+func (s *Subscription) Close() {
+	s.hub.lock.Lock()
+	defer s.hub.lock.Unlock()
+
+	s.hub.remove(s)
+}
@@ -0,0 +1,126 @@
+package chat_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/chat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHubPublish(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	hub := chat.NewHub(chat.DefaultEventBuffer)
+	s := chat.NewSession("henk", "ingrid")
+
+	henk := hub.Subscribe("henk")
+	ingrid := hub.Subscribe("ingrid")
+	jaap := hub.Subscribe("jaap")
+	assert.Equal(1, hub.Subscribers("henk"))
+
+	s.Append(chat.Message{Sender: "henk", Body: "hello", Time: time.Now()})
+	hub.Publish(chat.NewMessageEvent(s, s.Messages[0]))
+
+	for _, sub := range []*chat.Subscription{henk, ingrid} {
+		e := <-sub.Events()
+		assert.Equal(chat.EventMessage, e.Type)
+		assert.Equal(s.ID, e.Session)
+		assert.Equal(uint64(1), e.ID)
+		require.NotNil(e.Message)
+		assert.Equal("hello", e.Message.Body)
+	}
+
+	select {
+	case e := <-jaap.Events():
+		require.Fail("unexpected event", e)
+	default:
+	}
+
+	hub.Publish(chat.NewSessionEvent(chat.EventSessionDeleted, s))
+	e := <-ingrid.Events()
+	assert.Equal(chat.EventSessionDeleted, e.Type)
+	assert.Equal(uint64(1), e.ID)
+	assert.Nil(e.Message)
+
+	e = <-henk.Events()
+	assert.Equal(chat.EventSessionDeleted, e.Type)
+
+	henk.Close()
+	henk.Close()
+	assert.Equal(0, hub.Subscribers("henk"))
+
+	_, ok := <-henk.Events()
+	assert.False(ok)
+	assert.False(henk.Dropped())
+}
+
+func TestHubDropsSlowSubscribers(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	hub := chat.NewHub(2)
+	s := chat.NewSession("henk", "ingrid")
+	slow := hub.Subscribe("henk")
+
+	for i := range 3 {
+		hub.Publish(chat.NewSessionEvent(chat.EventSessionCreated, s))
+		assert.Equal(i < 2, hub.Subscribers("henk") == 1)
+	}
+
+	assert.True(slow.Dropped())
+
+	// The buffered events are still delivered before the channel is closed
+	n := 0
+	for range slow.Events() {
+		n++
+	}
+
+	assert.Equal(2, n)
+	slow.Close()
+}
+
+func TestHubConcurrent(t *testing.T) {
+	t.Parallel()
+
+	hub := chat.NewHub(chat.DefaultEventBuffer)
+	s := chat.NewSession("henk", "ingrid")
+
+	wg := &sync.WaitGroup{}
+	for range 8 {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			sub := hub.Subscribe("henk")
+			defer sub.Close()
+
+			for range 10 {
+				hub.Publish(chat.NewSessionEvent(chat.EventSessionCreated, s))
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			sub := hub.Subscribe("ingrid")
+			for range 5 {
+				select {
+				case <-sub.Events():
+				case <-time.After(time.Millisecond):
+				}
+			}
+			sub.Close()
+		}()
+	}
+
+	wg.Wait()
+	require.Equal(t, 0, hub.Subscribers("henk"))
+}
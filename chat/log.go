@@ -0,0 +1,269 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rchamarthy/chata"
+)
+
+// The messages of a session are kept in an append-only log next to the file
+// of the session. The log has one JSON encoded record per line, a message or
+// a change to an earlier message, a record is only in the log once its line
+// is complete. Sealed logs seal every record on its own. Compaction folds the
+// changes into the messages.
+const LogSuffix = ".log"
+
+var ErrCorruptLog = errors.New("corrupt message log")
+
+// IsSessionFile reports whether the file in a sessions directory holds the
+// metadata of a session rather than a message log or a temporary file.
+func IsSessionFile(name string) bool {
+	return !strings.HasSuffix(name, LogSuffix) && !chata.IsTempFile(name)
+}
+
+// LogFile returns the path of the message log of the session file.
+func LogFile(sessionFile string) string {
+	return sessionFile + LogSuffix
+}
+
+// AppendMessage adds a message to the session and to its log on disk, sealed
+// with the sealer if there is one. The message is synced to disk before
+// AppendMessage returns, the rest of the session is not written.
+func (s *Session) AppendMessage(sessionDir string, sealer chata.Sealer, m Message) error {
+	if e := s.appendLog(sessionDir, sealer, m); e != nil {
+		return e
+	}
+
+	s.Append(m)
+	s.logged++
+
+	return nil
+}
+
+// AppendChange applies the change to the session and appends it to its log
+// on disk. It returns the index of the changed message.
+func (s *Session) AppendChange(sessionDir string, sealer chata.Sealer, c Change) (int, error) {
+	if _, e := s.Check(c); e != nil {
+		return -1, e
+	}
+
+	if e := s.appendLog(sessionDir, sealer, c); e != nil {
+		return -1, e
+	}
+
+	s.changes++
+
+	return s.Apply(c)
+}
+
+// appendLog appends the record to the log and syncs it to disk.
+func (s *Session) appendLog(sessionDir string, sealer chata.Sealer, record any) error {
+	if s.logBehind() {
+		// Bring the log in line with the session before appending to it
+		if e := s.Compact(sessionDir, sealer); e != nil {
+			return e
+		}
+	}
+
+	logFile := LogFile(path.Join(sessionDir, s.ID))
+
+	line, err := marshalRecord(sealer, logFile, record)
+	if err != nil {
+		return err
+	}
+
+	created := false
+
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0600)
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		created = true
+	}
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, e := f.Write(line); e != nil {
+		return e
+	}
+
+	if e := f.Sync(); e != nil {
+		return e
+	}
+
+	// A new log lasts once its directory does
+	if created {
+		return chata.SyncDir(sessionDir)
+	}
+
+	return nil
+}
+
+// NeedsCompaction reports whether the log on disk does not hold exactly the
+// messages of the session, holds changes that are not folded in yet, or the
+// session file still holds messages.
+func (s *Session) NeedsCompaction() bool {
+	return s.logBehind() || s.changes > 0
+}
+
+// logBehind reports whether appending to the log would not give the messages
+// of the session back.
+func (s *Session) logBehind() bool {
+	return s.logged != len(s.Messages) || s.inlined
+}
+
+// Compact rewrites the log with the messages of the session and the session
+// file without them. Both files are replaced atomically.
+func (s *Session) Compact(sessionDir string, sealer chata.Sealer) error {
+	sessionFile := path.Join(sessionDir, s.ID)
+
+	buf := &bytes.Buffer{}
+	for i := range s.Messages {
+		line, err := marshalRecord(sealer, LogFile(sessionFile), &s.Messages[i])
+		if err != nil {
+			return err
+		}
+
+		buf.Write(line)
+	}
+
+	// The log goes first, a session file that still holds messages is
+	// ignored once there is a log
+	if e := chata.WriteFile(LogFile(sessionFile), buf.Bytes(), 0600); e != nil {
+		return e
+	}
+
+	s.logged = len(s.Messages)
+	s.changes = 0
+
+	if e := s.saveMetadata(sessionFile, sealer); e != nil {
+		return e
+	}
+
+	s.inlined = false
+
+	return nil
+}
+
+// marshalRecord returns the line of the record in the log, sealed on its own
+// if there is a sealer so that records can be appended.
+func marshalRecord(sealer chata.Sealer, logFile string, record any) ([]byte, error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	line, err = chata.Seal(sealer, logFile, line)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(line, '\n'), nil
+}
+
+// messageLog is what a message log holds, the messages and the changes to
+// them in the order they were appended. Torn is the size of the log without
+// its torn last record, it is -1 if the log is whole.
+type messageLog struct {
+	messages []Message
+	changes  []Change
+	torn     int64
+}
+
+// loadLog reads the records of the log of the session file. A torn last
+// record, left by a crash in the middle of an append, is cut off the log
+// unless readOnly is set. The log is nil if there is none.
+func loadLog(sessionFile string, sealer chata.Sealer, readOnly bool) (*messageLog, error) {
+	logFile := LogFile(sessionFile)
+
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(logFile, flag, 0600)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l := &messageLog{messages: []Message{}, changes: nil, torn: -1}
+	r := bufio.NewReader(f)
+	good := int64(0)
+
+	cut := func() (*messageLog, error) {
+		l.torn = good
+		if readOnly {
+			return l, nil
+		}
+
+		return l, f.Truncate(good)
+	}
+
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				return cut()
+			}
+
+			return l, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		record, err := chata.Unseal(sealer, logFile, bytes.TrimSuffix(line, []byte("\n")))
+		if errors.Is(err, chata.ErrNoKey) || errors.Is(err, chata.ErrNotSealed) {
+			return nil, err
+		}
+
+		if err == nil {
+			err = l.add(record)
+		}
+
+		if err != nil {
+			if _, e := r.Peek(1); errors.Is(e, io.EOF) {
+				// A complete line that did not make it to disk whole
+				return cut()
+			}
+
+			return nil, fmt.Errorf("%w %s: record %d: %w", ErrCorruptLog, logFile, n, err)
+		}
+
+		good += int64(len(line))
+	}
+}
+
+// add decodes a record of the log, changes have an operation and messages
+// do not.
+func (l *messageLog) add(line []byte) error {
+	c := Change{}
+	if e := json.Unmarshal(line, &c); e != nil {
+		return e
+	}
+
+	if c.Op != "" {
+		l.changes = append(l.changes, c)
+		return nil
+	}
+
+	m := Message{}
+	if e := json.Unmarshal(line, &m); e != nil {
+		return e
+	}
+
+	l.messages = append(l.messages, m)
+	return nil
+}
@@ -0,0 +1,158 @@
+package chat_test
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/chat"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestAppendMessage(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	dir := "./test-log-append"
+	require.NoError(os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+
+	s := chat.NewSession("user1", "user2")
+	require.NoError(s.Save(dir, nil))
+	require.NoFileExists(chat.LogFile(path.Join(dir, s.ID)))
+
+	for _, body := range []string{"one", "two", "three"} {
+		require.NoError(s.AppendMessage(dir, nil, chat.Message{Sender: "user1", Body: body, Time: time.Now()}))
+	}
+
+	require.Len(s.Messages, 3)
+	require.False(s.NeedsCompaction())
+
+	// The session file does not hold the messages
+	b, err := os.ReadFile(path.Join(dir, s.ID))
+	require.NoError(err)
+	require.NotContains(string(b), "three")
+
+	s1, err := chat.LoadSession(path.Join(dir, s.ID), nil)
+	require.NoError(err)
+	require.Len(s1.Messages, 3)
+	require.Equal("three", s1.Messages[2].Body)
+	require.True(s1.LastMsg.Equal(s.Messages[2].Time))
+	require.False(s1.NeedsCompaction())
+
+	require.True(chat.IsSessionFile(s.ID))
+	require.False(chat.IsSessionFile(s.ID + chat.LogSuffix))
+
+	require.NoError(s.Delete(dir))
+	require.NoFileExists(chat.LogFile(path.Join(dir, s.ID)))
+}
+
+func TestLogRecovery(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	dir := "./test-log-recovery"
+	require.NoError(os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+
+	s := chat.NewSession("user1", "user2")
+	require.NoError(s.Save(dir, nil))
+	require.NoError(s.AppendMessage(dir, nil, chat.Message{Sender: "user1", Body: "kept", Time: time.Now()}))
+
+	sessionFile := path.Join(dir, s.ID)
+	logFile := chat.LogFile(sessionFile)
+	good, err := os.ReadFile(logFile)
+	require.NoError(err)
+
+	// A crash in the middle of an append leaves a torn last record
+	for _, torn := range []string{`{"sender":"user1","bo`, `{"sender":"user1","bo` + "\n"} {
+		require.NoError(os.WriteFile(logFile, append(append([]byte{}, good...), torn...), 0600))
+
+		// Checking reports where the torn record starts and leaves it
+		b, err := os.ReadFile(sessionFile)
+		require.NoError(err)
+		checked, at, err := chat.CheckSessionData(sessionFile, b, nil)
+		require.NoError(err)
+		require.Len(checked.Messages, 1)
+		require.Equal(int64(len(good)), at)
+		b, err = os.ReadFile(logFile)
+		require.NoError(err)
+		require.Equal(string(good)+torn, string(b))
+
+		s1, err := chat.LoadSession(sessionFile, nil)
+		require.NoError(err)
+		require.Len(s1.Messages, 1)
+		require.Equal("kept", s1.Messages[0].Body)
+
+		b, err = os.ReadFile(logFile)
+		require.NoError(err)
+		require.Equal(good, b)
+
+		// Appends go after the last good record
+		require.NoError(s1.AppendMessage(dir, nil, chat.Message{Sender: "user2", Body: "next", Time: time.Now()}))
+		s2, err := chat.LoadSession(sessionFile, nil)
+		require.NoError(err)
+		require.Len(s2.Messages, 2)
+		require.NoError(os.WriteFile(logFile, good, 0600))
+	}
+
+	// A bad record that is not the last one is not a torn append
+	require.NoError(os.WriteFile(logFile, append([]byte("garbage\n"), good...), 0600))
+	_, err = chat.LoadSession(sessionFile, nil)
+	require.ErrorIs(err, chat.ErrCorruptLog)
+
+	// Session files cut short are corrupt
+	for _, b := range []string{"", "id: [user1"} {
+		require.NoError(os.WriteFile(sessionFile, []byte(b), 0600))
+		_, err = chat.LoadSession(sessionFile, nil)
+		require.ErrorIs(err, chat.ErrCorruptSession)
+	}
+}
+
+func TestLogCompaction(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	dir := "./test-log-compaction"
+	require.NoError(os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+
+	// Sessions used to be saved with their messages in the session file
+	legacy := chat.NewSession("user1", "user2")
+	legacy.AddMessage("user1", "old")
+	legacy.AddMessage("user2", "older")
+	b, err := yaml.Marshal(legacy)
+	require.NoError(err)
+
+	sessionFile := path.Join(dir, legacy.ID)
+	require.NoError(os.WriteFile(sessionFile, b, 0600))
+
+	s, err := chat.LoadSession(sessionFile, nil)
+	require.NoError(err)
+	require.Len(s.Messages, 2)
+	require.True(s.NeedsCompaction())
+
+	require.NoError(s.Compact(dir, nil))
+	require.False(s.NeedsCompaction())
+	require.FileExists(chat.LogFile(sessionFile))
+
+	b, err = os.ReadFile(sessionFile)
+	require.NoError(err)
+	require.NotContains(string(b), "older")
+
+	s1, err := chat.LoadSession(sessionFile, nil)
+	require.NoError(err)
+	require.Len(s1.Messages, 2)
+	require.False(s1.NeedsCompaction())
+
+	// Messages added in memory are written out by Save
+	s1.AddMessage("user1", "new")
+	require.True(s1.NeedsCompaction())
+	require.NoError(s1.Save(dir, nil))
+
+	s2, err := chat.LoadSession(sessionFile, nil)
+	require.NoError(err)
+	require.Len(s2.Messages, 3)
+}
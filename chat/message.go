@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rchamarthy/chata/auth"
+)
+
+type Message struct {
+	// ID is given by the server, it is unique in the session and grows with
+	// every message.
+	ID uint64 `json:"id,omitempty" yaml:"id,omitempty"`
+
+	// ClientID is chosen by the sender to send the message again safely, the
+	// server keeps a single message per ClientID of a sender in DedupeWindow.
+	ClientID string `json:"clientId,omitempty" yaml:"clientId,omitempty"`
+
+	Sender string    `json:"sender" yaml:"sender"`
+	Body   string    `json:"body"   yaml:"body"`
+	Time   time.Time `json:"time"   yaml:"time"`
+
+	// Envelope holds the end-to-end encrypted body, sealed for every
+	// participant of the session.
+	Envelope *auth.Envelope `json:"envelope,omitempty" yaml:"envelope,omitempty"`
+
+	// Signature is made by the sender over the canonical form of the message.
+	Signature auth.Bytes `json:"signature,omitempty" yaml:"signature,omitempty"`
+
+	// Replaces is the id of the message that this message is an edit of.
+	Replaces uint64 `json:"replaces,omitempty" yaml:"replaces,omitempty"`
+
+	// Edits are the revisions of the message, oldest first, the last one is
+	// what the message reads now.
+	Edits []Message `json:"edits,omitempty" yaml:"edits,omitempty"`
+
+	// Deleted is set once the message is deleted, its content is gone.
+	Deleted *Tombstone `json:"deleted,omitempty" yaml:"deleted,omitempty"`
+}
+
+// IdempotencyKeyHeader carries the client id of a message that is sent.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+var ErrNotSigned = errors.New("message is not signed")
+
+// canonicalMessage is what gets signed. Its fields are serialized in a fixed
+// order so the signer and the verifiers agree on the bytes.
+type canonicalMessage struct {
+	Sender    string         `json:"sender"`
+	Recipient string         `json:"recipient"`
+	Session   string         `json:"session"`
+	Time      string         `json:"time"`
+	Body      string         `json:"body"`
+	Envelope  *auth.Envelope `json:"envelope"`
+	Replaces  uint64         `json:"replaces,omitempty"`
+}
+
+// SigningBytes returns the canonical form of the message sent to recipient in
+// the session with the given id.
+func (m *Message) SigningBytes(sessionID string, recipient string) []byte {
+	b, err := json.Marshal(canonicalMessage{
+		Sender:    m.Sender,
+		Recipient: recipient,
+		Session:   sessionID,
+		Time:      m.Time.UTC().Format(time.RFC3339Nano),
+		Body:      m.Body,
+		Envelope:  m.Envelope,
+		Replaces:  m.Replaces,
+	})
+	auth.PanicOnError(err)
+
+	return b
+}
+
+// Sign signs the message with the sender's private key.
+func (m *Message) Sign(sessionID string, recipient string, key *auth.Identity) error {
+	sig, err := key.Sign(m.SigningBytes(sessionID, recipient))
+	if err != nil {
+		return err
+	}
+
+	m.Signature = sig
+
+	return nil
+}
+
+// Verify checks the signature of the message against the sender's key.
+func (m *Message) Verify(sessionID string, recipient string, key *auth.Identity) error {
+	if len(m.Signature) == 0 {
+		return ErrNotSigned
+	}
+
+	return key.Verify(m.SigningBytes(sessionID, recipient), m.Signature, nil)
+}
+
+// NewClientID returns a random client id for a message.
+func NewClientID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	auth.PanicOnError(err)
+
+	return hex.EncodeToString(b)
+}
+
+// Encrypt seals the body for the recipients with their public keys.
+func Encrypt(body string, recipients ...*auth.Identity) (*auth.Envelope, error) {
+	env, err := auth.Seal([]byte(body), recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting message: %w", err)
+	}
+
+	return env, nil
+}
+
+// IsEncrypted reports whether the message is end-to-end encrypted.
+func (m *Message) IsEncrypted() bool {
+	return m.Envelope != nil
+}
+
+// Decrypt returns the body of the message using the given private key.
+// Messages that were sent before encryption are returned as is.
+func (m *Message) Decrypt(key *auth.Identity) (string, error) {
+	if !m.IsEncrypted() {
+		return m.Body, nil
+	}
+
+	b, err := key.Open(m.Envelope)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting message: %w", err)
+	}
+
+	return string(b), nil
+}
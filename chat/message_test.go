@@ -0,0 +1,111 @@
+package chat_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageEncryption(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	user1 := auth.GenerateIdentity()
+	user2 := auth.GenerateIdentity()
+	user3 := auth.GenerateIdentity()
+
+	env, err := chat.Encrypt("hello", user1.Public(), user2.Public())
+	require.NoError(err)
+	require.Len(env.Keys, 2)
+
+	s := chat.NewSession("user1", "user2")
+	s.Append(chat.Message{Sender: "user1", Time: time.Now(), Envelope: env})
+	require.Len(s.Messages, 1)
+
+	m := s.Messages[0]
+	require.True(m.IsEncrypted())
+	require.Empty(m.Body)
+	require.Equal("user1", m.Sender)
+
+	body, err := m.Decrypt(user1)
+	require.NoError(err)
+	require.Equal("hello", body)
+
+	body, err = m.Decrypt(user2)
+	require.NoError(err)
+	require.Equal("hello", body)
+
+	_, err = m.Decrypt(user3)
+	require.ErrorIs(err, auth.ErrNotRecipient)
+
+	// Messages from before encryption are returned as they are
+	s.AddMessage("user2", "plain")
+	require.False(s.Messages[1].IsEncrypted())
+	body, err = s.Messages[1].Decrypt(user1)
+	require.NoError(err)
+	require.Equal("plain", body)
+
+	// Message size is not limited by the key size
+	long := strings.Repeat("long message ", 1024)
+	env, err = chat.Encrypt(long, user1)
+	require.NoError(err)
+	s.Append(chat.Message{Sender: "user1", Time: time.Now(), Envelope: env})
+	body, err = s.Messages[2].Decrypt(user1)
+	require.NoError(err)
+	require.Equal(long, body)
+
+	_, err = chat.Encrypt("hello")
+	require.Error(err)
+}
+
+func TestMessageSignature(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	user1 := auth.GenerateIdentity()
+	user2 := auth.GenerateIdentity()
+
+	env, err := chat.Encrypt("hello", user1.Public(), user2.Public())
+	require.NoError(err)
+
+	id := chat.SessionID("user1", "user2")
+	m := chat.Message{Sender: "user1", Time: time.Now(), Envelope: env}
+	require.ErrorIs(m.Verify(id, "user2", user1.Public()), chat.ErrNotSigned)
+	require.Error(m.Sign(id, "user2", user1.Public()))
+
+	require.NoError(m.Sign(id, "user2", user1))
+	require.NoError(m.Verify(id, "user2", user1.Public()))
+
+	// Verification survives a round trip through the server
+	b, err := json.Marshal(m)
+	require.NoError(err)
+	m2 := chat.Message{}
+	require.NoError(json.Unmarshal(b, &m2))
+	require.NoError(m2.Verify(id, "user2", user1.Public()))
+
+	// Forgeries are detected
+	require.Error(m.Verify(id, "user2", user2.Public()))
+	require.Error(m.Verify(id, "user3", user1.Public()))
+	require.Error(m.Verify("user1-user3", "user2", user1.Public()))
+
+	forged := m
+	forged.Sender = "user2"
+	require.Error(forged.Verify(id, "user1", user1.Public()))
+
+	forged = m
+	forged.Time = m.Time.Add(time.Second)
+	require.Error(forged.Verify(id, "user2", user1.Public()))
+
+	other, err := chat.Encrypt("bye", user1.Public(), user2.Public())
+	require.NoError(err)
+	forged = m
+	forged.Envelope = other
+	require.Error(forged.Verify(id, "user2", user1.Public()))
+}
@@ -0,0 +1,129 @@
+package chat
+
+import (
+	"time"
+)
+
+// Bounds of the number of messages in a page.
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// Page is a part of the messages of a session. Pages are found with the ids
+// of messages, which stay put when old messages are purged: Start is the id
+// to ask for messages before to get older messages and Next the id to ask for
+// messages after to get the following messages. Total is the number of
+// messages of the session and Unread the number of them the user asking has
+// not read.
+type Page struct {
+	Session  string             `json:"session"            yaml:"session"`
+	Start    uint64             `json:"start"              yaml:"start"`
+	Next     uint64             `json:"next"               yaml:"next"`
+	Total    int                `json:"total"              yaml:"total"`
+	Unread   int                `json:"unread"             yaml:"unread"`
+	Receipts map[string]Receipt `json:"receipts,omitempty" yaml:"receipts,omitempty"`
+	Messages []Message          `json:"messages"           yaml:"messages"`
+}
+
+// PageAfter returns up to limit messages with ids after id.
+func (s *Session) PageAfter(id uint64, limit int) Page {
+	start := s.indexAfter(id)
+	end := min(start+limit, len(s.Messages))
+
+	return s.page(start, end, id+1, id)
+}
+
+// PageBefore returns up to limit messages with ids before id.
+func (s *Session) PageBefore(id uint64, limit int) Page {
+	end := s.indexAfter(max(id, 1) - 1)
+	start := max(end-limit, 0)
+
+	return s.page(start, end, id, max(id, 1)-1)
+}
+
+// LastPage returns the last limit messages.
+func (s *Session) LastPage(limit int) Page {
+	end := len(s.Messages)
+	start := max(end-limit, 0)
+
+	return s.page(start, end, s.NextID(), s.LastID())
+}
+
+// page returns the page of the messages from index start up to end, the ids
+// of an empty page are start and next.
+func (s *Session) page(start int, end int, startID uint64, next uint64) Page {
+	msgs := append([]Message{}, s.Messages[start:end]...)
+	if n := len(msgs); n > 0 {
+		startID, next = msgs[0].ID, msgs[n-1].ID
+	}
+
+	return Page{
+		Session:  s.ID,
+		Start:    startID,
+		Next:     next,
+		Total:    len(s.Messages),
+		Unread:   0,
+		Receipts: s.Receipts,
+		Messages: msgs,
+	}
+}
+
+// IDSince returns the id to ask for messages after to get the last messages
+// that were sent at or after t.
+func (s *Session) IDSince(t time.Time) uint64 {
+	i := len(s.Messages)
+	for i > 0 && !s.Messages[i-1].Time.Before(t) {
+		i--
+	}
+
+	if i == 0 {
+		return s.Purged
+	}
+
+	return s.Messages[i-1].ID
+}
+
+// Summary describes a session without its messages. Last is the last message
+// of the session, still encrypted, for clients to preview.
+type Summary struct {
+	ID       string             `json:"id"                 yaml:"id"`
+	Peer     string             `json:"peer,omitempty"     yaml:"peer,omitempty"`
+	Name     string             `json:"name,omitempty"     yaml:"name,omitempty"`
+	Owner    string             `json:"owner,omitempty"    yaml:"owner,omitempty"`
+	Members  []string           `json:"members"            yaml:"members"`
+	Count    int                `json:"count"              yaml:"count"`
+	Unread   int                `json:"unread"             yaml:"unread"`
+	TTL      time.Duration      `json:"ttl,omitempty"      yaml:"ttl,omitempty"`
+	LastTime time.Time          `json:"lastTime"           yaml:"lastTime"`
+	Last     *Message           `json:"last,omitempty"     yaml:"last,omitempty"`
+	Receipts map[string]Receipt `json:"receipts,omitempty" yaml:"receipts,omitempty"`
+}
+
+// Summarize returns the summary of the session as seen by the user.
+func (s *Session) Summarize(user string) Summary {
+	summary := Summary{
+		ID:       s.ID,
+		Peer:     "",
+		Name:     s.Name,
+		Owner:    s.Owner,
+		Members:  s.Members(),
+		Count:    len(s.Messages),
+		Unread:   s.Unread(user),
+		TTL:      s.TTL,
+		LastTime: s.LastMsg,
+		Last:     nil,
+		Receipts: s.Receipts,
+	}
+
+	if !s.IsGroup() {
+		summary.Peer = s.Peer(user)
+	}
+
+	if n := len(s.Messages); n > 0 {
+		last := s.Messages[n-1]
+		summary.Last = &last
+	}
+
+	return summary
+}
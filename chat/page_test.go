@@ -0,0 +1,107 @@
+package chat_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/chat"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPages(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	s := chat.NewSession("user1", "user2")
+	start := time.Now()
+	for i := range 10 {
+		s.Append(chat.Message{Sender: "user1", Body: fmt.Sprint(i), Time: start.Add(time.Duration(i) * time.Minute)})
+	}
+
+	// Messages 1 to 10 have the bodies 0 to 9
+	p := s.PageAfter(2, 3)
+	require.Equal(uint64(3), p.Start)
+	require.Equal(uint64(5), p.Next)
+	require.Equal(10, p.Total)
+	require.Equal("2", p.Messages[0].Body)
+	require.Len(s.PageAfter(8, 5).Messages, 2)
+	require.Empty(s.PageAfter(10, 5).Messages)
+	require.Equal(uint64(10), s.PageAfter(10, 5).Next)
+
+	p = s.PageBefore(6, 3)
+	require.Equal(uint64(3), p.Start)
+	require.Equal(uint64(5), p.Next)
+	require.Equal("4", p.Messages[2].Body)
+
+	p = s.PageBefore(3, 5)
+	require.Equal(uint64(1), p.Start)
+	require.Len(p.Messages, 2)
+	require.Empty(s.PageBefore(1, 5).Messages)
+	require.Empty(s.PageBefore(0, 5).Messages)
+	require.Len(s.PageBefore(20, 5).Messages, 5)
+
+	p = s.LastPage(4)
+	require.Equal(uint64(7), p.Start)
+	require.Equal(uint64(10), p.Next)
+	require.Equal("9", p.Messages[3].Body)
+	require.Len(s.LastPage(20).Messages, 10)
+
+	// Pages are copies
+	p.Messages[0].Body = "changed"
+	require.Equal("6", s.Messages[6].Body)
+
+	require.Equal(uint64(7), s.IDSince(start.Add(7*time.Minute)))
+	require.Equal(uint64(0), s.IDSince(start.Add(-time.Hour)))
+	require.Equal(uint64(10), s.IDSince(start.Add(time.Hour)))
+
+	// Cursors still hold once old messages are purged
+	s.Purge(4)
+	p = s.PageAfter(2, 3)
+	require.Equal([]string{"4", "5", "6"}, bodies(p.Messages))
+	require.Equal(uint64(7), p.Next)
+	require.Equal([]string{"7", "8"}, bodies(s.PageAfter(p.Next, 2).Messages))
+	require.Equal([]string{"4", "5"}, bodies(s.PageBefore(7, 5).Messages))
+	require.Equal(uint64(4), s.IDSince(start.Add(-time.Hour)))
+	require.Equal(uint64(10), s.LastPage(3).Next)
+
+	empty := chat.NewSession("user1", "user2")
+	p = empty.LastPage(5)
+	require.Empty(p.Messages)
+	require.Equal(uint64(0), p.Next)
+}
+
+func bodies(msgs []chat.Message) []string {
+	b := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		b = append(b, m.Body)
+	}
+
+	return b
+}
+
+func TestSummarize(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	s := chat.NewSession("user1", "user2")
+	summary := s.Summarize("user2")
+	require.Equal("user1", summary.Peer)
+	require.Zero(summary.Count)
+	require.Nil(summary.Last)
+
+	s.AddMessage("user1", "hello")
+	s.AddMessage("user2", "bye")
+	summary = s.Summarize("user1")
+	require.Equal("user2", summary.Peer)
+	require.Equal(2, summary.Count)
+	require.Equal("bye", summary.Last.Body)
+	require.Equal([]string{"user1", "user2"}, summary.Members)
+
+	g, err := chat.NewGroup("user1", "friends", "user2", "user3")
+	require.NoError(err)
+	summary = g.Summarize("user1")
+	require.Empty(summary.Peer)
+	require.Equal("friends", summary.Name)
+	require.Len(summary.Members, 3)
+}
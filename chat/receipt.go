@@ -0,0 +1,118 @@
+package chat
+
+// Receipt is how far a participant got in a session: Delivered is the id of
+// the last message the participant received and Read the id of the last
+// message the participant read. Both only ever go up.
+type Receipt struct {
+	Delivered uint64 `json:"delivered" yaml:"delivered"`
+	Read      uint64 `json:"read"      yaml:"read"`
+}
+
+// Status of a message as seen by its sender.
+type Status int
+
+const (
+	StatusSent Status = iota
+	StatusDelivered
+	StatusRead
+)
+
+// Mark returns the status as shown next to a message, ✓ once it is
+// delivered and ✓✓ once it is read.
+func (st Status) Mark() string {
+	switch st {
+	case StatusDelivered:
+		return "✓"
+	case StatusRead:
+		return "✓✓"
+	default:
+		return ""
+	}
+}
+
+// Receipt returns the receipt of the user in the session.
+func (s *Session) Receipt(user string) Receipt {
+	return s.Receipts[user]
+}
+
+// MarkDelivered records that the user received the messages up to the id.
+// It reports whether the receipt of the user changed.
+func (s *Session) MarkDelivered(user string, id uint64) bool {
+	return s.Mark(user, Receipt{Delivered: id, Read: 0})
+}
+
+// MarkRead records that the user read the messages up to the id, which are
+// delivered too. It reports whether the receipt of the user changed.
+func (s *Session) MarkRead(user string, id uint64) bool {
+	return s.Mark(user, Receipt{Delivered: id, Read: id})
+}
+
+// Mark moves the receipt of the user up to r, never past the last message
+// of the session, and reports whether it changed. The receipts are replaced
+// rather than changed in place so that readers of the old receipts are not
+// disturbed.
+func (s *Session) Mark(user string, r Receipt) bool {
+	last := s.NextID() - 1
+	old := s.Receipts[user]
+	r.Delivered = max(old.Delivered, min(r.Delivered, last))
+	r.Read = max(old.Read, min(r.Read, last))
+
+	if r == old {
+		return false
+	}
+
+	receipts := make(map[string]Receipt, len(s.Receipts)+1)
+	for u, receipt := range s.Receipts {
+		receipts[u] = receipt
+	}
+
+	receipts[user] = r
+	s.Receipts = receipts
+
+	return true
+}
+
+// Unread returns the number of messages of the others that the user has not
+// read. Deleted messages are not counted.
+func (s *Session) Unread(user string) int {
+	read := s.Receipt(user).Read
+	n := 0
+
+	for i := len(s.Messages) - 1; i >= 0 && s.Messages[i].ID > read; i-- {
+		if m := &s.Messages[i]; m.Sender != user && !m.IsDeleted() {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Status returns how far the message got with the other members of the
+// session, the least of them counts. A message nobody else can get is only
+// sent.
+func (s *Session) Status(m *Message) Status {
+	status, others := StatusRead, false
+
+	for _, member := range s.Members() {
+		if member == m.Sender {
+			continue
+		}
+
+		others = true
+		r := s.Receipt(member)
+
+		switch {
+		case r.Read >= m.ID:
+		case r.Delivered >= m.ID:
+			status = StatusDelivered
+		default:
+			return StatusSent
+		}
+	}
+
+	if !others {
+		return StatusSent
+	}
+
+	return status
+}
@@ -0,0 +1,80 @@
+package chat_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/chat"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceipts(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	s := chat.NewSession("user1", "user2")
+	s.AddMessage("user1", "one")
+	s.AddMessage("user1", "two")
+	s.AddMessage("user2", "three")
+
+	require.Equal(chat.Receipt{}, s.Receipt("user2"))
+	require.Equal(2, s.Unread("user2"))
+	require.Equal(1, s.Unread("user1"))
+	require.Equal(chat.StatusSent, s.Status(&s.Messages[0]))
+
+	require.True(s.MarkDelivered("user2", 2))
+	require.False(s.MarkDelivered("user2", 1))
+	require.Equal(chat.StatusDelivered, s.Status(&s.Messages[1]))
+	require.Equal(2, s.Unread("user2"))
+
+	receipts := s.Receipts
+	require.True(s.MarkRead("user2", 1))
+	require.Equal(chat.Receipt{Delivered: 2, Read: 1}, s.Receipt("user2"))
+	require.Equal(chat.Receipt{Delivered: 2, Read: 0}, receipts["user2"], "receipts are replaced, not changed")
+	require.Equal(chat.StatusRead, s.Status(&s.Messages[0]))
+	require.Equal(chat.StatusDelivered, s.Status(&s.Messages[1]))
+	require.Equal(1, s.Unread("user2"))
+
+	// Receipts stop at the last message and never go back
+	require.True(s.MarkRead("user2", 10))
+	require.Equal(chat.Receipt{Delivered: 3, Read: 3}, s.Receipt("user2"))
+	require.False(s.MarkRead("user2", 2))
+	require.Zero(s.Unread("user2"))
+
+	// Deleted messages are not unread
+	_, err := s.Apply(chat.NewDelete(3, "user2", time.Now()))
+	require.NoError(err)
+	require.Zero(s.Unread("user1"))
+
+	require.Equal("", chat.StatusSent.Mark())
+	require.Equal("✓", chat.StatusDelivered.Mark())
+	require.Equal("✓✓", chat.StatusRead.Mark())
+}
+
+func TestGroupReceipts(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	g, err := chat.NewGroup("user1", "friends", "user2", "user3")
+	require.NoError(err)
+	g.AddMessage("user1", "hi all")
+
+	m := &g.Messages[0]
+	require.Equal(chat.StatusSent, g.Status(m))
+
+	g.MarkRead("user2", 1)
+	require.Equal(chat.StatusSent, g.Status(m), "the least of the members counts")
+
+	g.MarkDelivered("user3", 1)
+	require.Equal(chat.StatusDelivered, g.Status(m))
+
+	g.MarkRead("user3", 1)
+	require.Equal(chat.StatusRead, g.Status(m))
+
+	alone, err := chat.NewGroup("user1", "alone")
+	require.NoError(err)
+	alone.AddMessage("user1", "anyone?")
+	require.Equal(chat.StatusSent, alone.Status(&alone.Messages[0]))
+}
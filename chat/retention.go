@@ -0,0 +1,90 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MinTTL is the shortest time messages of a session may be kept for.
+const MinTTL = time.Minute
+
+var ErrBadTTL = fmt.Errorf("ttl must be 0 or at least %s", MinTTL)
+
+// Retention bounds how long messages are kept and how many of them a session
+// keeps, zero values do not bound anything.
+type Retention struct {
+	MaxAge      time.Duration `json:"maxAge"      yaml:"maxAge"`
+	MaxMessages int           `json:"maxMessages" yaml:"maxMessages"`
+}
+
+// SetTTL makes the messages of the session disappear ttl after they were
+// sent, a ttl of 0 keeps them. Either user of a chat may set it, only admins
+// may set it for a group.
+func (s *Session) SetTTL(by string, ttl time.Duration) error {
+	if ttl != 0 && ttl < MinTTL {
+		return ErrBadTTL
+	}
+
+	switch {
+	case !s.HasMember(by):
+		return ErrNotMember
+	case s.IsGroup() && !s.IsAdmin(by):
+		return ErrNotAdmin
+	}
+
+	s.TTL = ttl
+
+	return nil
+}
+
+// Expired returns the number of the oldest messages of the session that are
+// past the TTL of the session or the retention at now.
+func (s *Session) Expired(now time.Time, r Retention) int {
+	n := 0
+
+	maxAge := r.MaxAge
+	if s.TTL > 0 && (maxAge == 0 || s.TTL < maxAge) {
+		maxAge = s.TTL
+	}
+
+	if maxAge > 0 {
+		cutoff := now.Add(-maxAge)
+		for n < len(s.Messages) && s.Messages[n].Time.Before(cutoff) {
+			n++
+		}
+	}
+
+	if r.MaxMessages > 0 && len(s.Messages)-n > r.MaxMessages {
+		n = len(s.Messages) - r.MaxMessages
+	}
+
+	return n
+}
+
+// Purge drops the n oldest messages of the session. The ids of the dropped
+// messages are not given out again.
+func (s *Session) Purge(n int) {
+	n = min(n, len(s.Messages))
+	if n <= 0 {
+		return
+	}
+
+	s.Purged = s.Messages[n-1].ID
+
+	// A new array, pages handed out before still hold the old one
+	s.Messages = append([]Message{}, s.Messages[n:]...)
+}
+
+// Validate checks the retention.
+func (r Retention) Validate() error {
+	if r.MaxAge < 0 {
+		return errors.New("retention maxAge must not be negative")
+	}
+
+	if r.MaxMessages < 0 {
+		return errors.New("retention maxMessages must not be negative")
+	}
+
+	return nil
+}
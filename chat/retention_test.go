@@ -0,0 +1,73 @@
+package chat_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/chat"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetTTL(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	s := chat.NewSession("user1", "user2")
+	require.NoError(s.SetTTL("user2", time.Hour))
+	require.Equal(time.Hour, s.TTL)
+	require.ErrorIs(s.SetTTL("user1", time.Second), chat.ErrBadTTL)
+	require.ErrorIs(s.SetTTL("user3", time.Hour), chat.ErrNotMember)
+	require.NoError(s.SetTTL("user1", 0))
+	require.Zero(s.TTL)
+
+	g, err := chat.NewGroup("user1", "friends", "user2")
+	require.NoError(err)
+	require.ErrorIs(g.SetTTL("user2", time.Hour), chat.ErrNotAdmin)
+	require.NoError(g.SetTTL("user1", time.Hour))
+	require.Equal(time.Hour, g.TTL)
+}
+
+func TestExpired(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := chat.NewSession("user1", "user2")
+	for i := range 4 {
+		s.Messages = append(s.Messages, chat.Message{
+			ID:     uint64(i + 1),
+			Sender: "user1",
+			Body:   "hi",
+			Time:   now.Add(-time.Duration(4-i) * time.Hour),
+		})
+	}
+
+	require.Zero(s.Expired(now, chat.Retention{}), "nothing expires without a ttl or a retention")
+	require.Equal(2, s.Expired(now, chat.Retention{MaxAge: 150 * time.Minute}))
+	require.Equal(1, s.Expired(now, chat.Retention{MaxMessages: 3}))
+
+	require.NoError(s.SetTTL("user1", 90*time.Minute))
+	require.Equal(3, s.Expired(now, chat.Retention{MaxAge: 150 * time.Minute}), "the shorter of ttl and maxAge counts")
+	require.Equal(4, s.Expired(now, chat.Retention{MaxAge: 30 * time.Minute}))
+	require.Equal(3, s.Expired(now, chat.Retention{}))
+	require.Equal(3, s.Expired(now, chat.Retention{MaxMessages: 3}), "the larger of the two counts")
+
+	s.Purge(3)
+	require.Equal(uint64(3), s.Purged)
+	require.Len(s.Messages, 1)
+	require.Equal(uint64(4), s.Messages[0].ID)
+	require.Zero(s.Expired(now, chat.Retention{MaxMessages: 3}))
+
+	// Ids of purged messages are not given out again
+	s.Purge(1)
+	require.Empty(s.Messages)
+	require.Equal(uint64(5), s.NextID())
+	s.AddMessage("user2", "again")
+	require.Equal(uint64(5), s.Messages[0].ID)
+
+	require.Error(chat.Retention{MaxAge: -time.Hour}.Validate())
+	require.Error(chat.Retention{MaxMessages: -1}.Validate())
+	require.NoError(chat.Retention{MaxAge: time.Hour, MaxMessages: 10}.Validate())
+}
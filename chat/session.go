@@ -1,28 +1,60 @@
 package chat
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/rchamarthy/chata"
 	"gopkg.in/yaml.v3"
 )
 
-type Message struct {
-	Sender string    `json:"sender" yaml:"sender"`
-	Body   string    `json:"body"   yaml:"body"`
-	Time   time.Time `json:"time"   yaml:"time"`
-}
+// DedupeWindow is how long a client id keeps a message from being sent twice.
+const DedupeWindow = 24 * time.Hour
+
+var (
+	ErrDuplicateMessage = errors.New("message was already sent")
+	ErrCorruptSession   = errors.New("corrupt session file")
+)
+
+// SessionVersion is the version of the schema of saved sessions, their logs
+// included. Sessions are saved with the version they were written in, store
+// migrates older ones up to it.
+const SessionVersion = 1
 
+// Session is a conversation, either between User1 and User2 or, for a
+// group, between the Participants of a group that has an Owner.
 type Session struct {
-	ID        string    `json:"id"        yaml:"id"`
-	User1     string    `json:"user1"     yaml:"user1"`
-	User2     string    `json:"user2"     yaml:"user2"`
-	StartTime time.Time `json:"startTime" yaml:"startTime"`
-	LastMsg   time.Time `json:"lastMsg"   yaml:"lastMsg"`
-	Messages  []Message `json:"messages"  yaml:"messages"`
+	ID           string    `json:"id"                     yaml:"id"`
+	User1        string    `json:"user1,omitempty"        yaml:"user1,omitempty"`
+	User2        string    `json:"user2,omitempty"        yaml:"user2,omitempty"`
+	Name         string    `json:"name,omitempty"         yaml:"name,omitempty"`
+	Owner        string    `json:"owner,omitempty"        yaml:"owner,omitempty"`
+	Admins       []string  `json:"admins,omitempty"       yaml:"admins,omitempty"`
+	Participants []string  `json:"participants,omitempty" yaml:"participants,omitempty"`
+	StartTime    time.Time `json:"startTime"              yaml:"startTime"`
+	LastMsg      time.Time `json:"lastMsg"                yaml:"lastMsg"`
+
+	// TTL is how long messages are kept for, Purged is the id of the last
+	// message that was purged.
+	TTL    time.Duration `json:"ttl,omitempty"    yaml:"ttl,omitempty"`
+	Purged uint64        `json:"purged,omitempty" yaml:"purged,omitempty"`
+
+	// Receipts are the delivered and read receipts of the participants.
+	Receipts map[string]Receipt `json:"receipts,omitempty" yaml:"receipts,omitempty"`
+	Messages []Message          `json:"messages"           yaml:"messages,omitempty"`
+
+	// logged is the number of messages in the log on disk, changes the number
+	// of changes in the log since it was compacted and inlined is set while
+	// the session file still holds the messages, as it did before sessions
+	// had a log.
+	logged  int
+	changes int
+	inlined bool
 }
 
 func NewSession(user1 string, user2 string) *Session {
@@ -30,34 +62,143 @@ func NewSession(user1 string, user2 string) *Session {
 		return nil
 	}
 
-	id := fmt.Sprintf("%s-%s", user1, user2)
+	return &Session{
+		ID:           SessionID(user1, user2),
+		User1:        user1,
+		User2:        user2,
+		Name:         "",
+		Owner:        "",
+		Admins:       nil,
+		Participants: nil,
+		StartTime:    time.Now(),
+		LastMsg:      time.Now(),
+		TTL:          0,
+		Purged:       0,
+		Receipts:     nil,
+		Messages:     []Message{},
+	}
+}
+
+// SessionID returns the id of the session between two users, it is the same
+// irrespective of the order of the users.
+func SessionID(user1 string, user2 string) string {
 	if strings.Compare(user1, user2) > 0 {
-		id = fmt.Sprintf("%s-%s", user2, user1)
+		user1, user2 = user2, user1
 	}
 
-	return &Session{
-		ID:        id,
-		User1:     user1,
-		User2:     user2,
-		StartTime: time.Now(),
-		LastMsg:   time.Now(),
-		Messages:  []Message{},
+	return fmt.Sprintf("%s-%s", user1, user2)
+}
+
+// Peer returns the other participant of the session.
+func (s *Session) Peer(user string) string {
+	if s.User1 == user {
+		return s.User2
 	}
+
+	return s.User1
 }
 
 func (s *Session) AddMessage(from, msg string) {
 	s.LastMsg = time.Now()
 	s.Messages = append(s.Messages, Message{
+		ID:     s.NextID(),
 		Sender: from,
 		Body:   msg,
 		Time:   s.LastMsg,
 	})
 }
 
+// Append adds a message that was composed, encrypted and signed by the sender.
+// The server never sees the plaintext of such a message. A message without
+// an id gets the next one.
+func (s *Session) Append(m Message) {
+	if m.ID == 0 {
+		m.ID = s.NextID()
+	}
+
+	s.LastMsg = m.Time
+	s.Messages = append(s.Messages, m)
+}
+
+// Snapshot returns a copy of the session that later changes to the session
+// do not show in. The copy shares the messages and the receipts of the
+// session, which are never changed in place: messages are appended past the
+// end of the copy, and changes to messages and receipts replace them.
+func (s *Session) Snapshot() *Session {
+	snapshot := *s
+	snapshot.Admins = slices.Clone(s.Admins)
+	snapshot.Participants = slices.Clone(s.Participants)
+	snapshot.Messages = slices.Clip(s.Messages)
+
+	return &snapshot
+}
+
+// NextID returns the id of the next message of the session.
+func (s *Session) NextID() uint64 {
+	if n := len(s.Messages); n > 0 {
+		return s.Messages[n-1].ID + 1
+	}
+
+	return s.Purged + 1
+}
+
+// LastID returns the id of the last message of the session, or of the last
+// message that was purged if there are no messages left.
+func (s *Session) LastID() uint64 {
+	return s.NextID() - 1
+}
+
+// NumberMessages gives ids to the messages that were saved before messages
+// had ids.
+func (s *Session) NumberMessages() {
+	last := uint64(0)
+	for i := range s.Messages {
+		if s.Messages[i].ID <= last {
+			s.Messages[i].ID = last + 1
+		}
+
+		last = s.Messages[i].ID
+	}
+}
+
+// Prepare gives the message the next id of the session. If the sender has
+// already sent a message with the same client id in DedupeWindow, Prepare
+// returns that message and ErrDuplicateMessage instead.
+func (s *Session) Prepare(m Message, now time.Time) (Message, error) {
+	if m.ClientID != "" {
+		since := now.Add(-DedupeWindow)
+		for i := len(s.Messages) - 1; i >= 0 && s.Messages[i].Time.After(since); i-- {
+			if s.Messages[i].Sender == m.Sender && s.Messages[i].ClientID == m.ClientID {
+				return s.Messages[i], ErrDuplicateMessage
+			}
+		}
+	}
+
+	m.ID = s.NextID()
+
+	return m, nil
+}
+
 func (s *Session) GetMessages(index int) []Message {
 	return s.Messages[index:]
 }
 
+// MessagesAfter returns a copy of the messages with ids after id, it is
+// empty when the session has no such message yet.
+func (s *Session) MessagesAfter(id uint64) []Message {
+	return append([]Message{}, s.GetMessages(s.indexAfter(id))...)
+}
+
+// indexAfter returns the index of the first message with an id after id.
+func (s *Session) indexAfter(id uint64) int {
+	i, found := s.Find(id)
+	if found {
+		i++
+	}
+
+	return i
+}
+
 func (s *Session) LastNMessages(n int) []Message {
 	if n > len(s.Messages) {
 		n = len(s.Messages)
@@ -66,28 +207,167 @@ func (s *Session) LastNMessages(n int) []Message {
 	return s.Messages[len(s.Messages)-n:]
 }
 
-func (s *Session) Save(sessionDir string) error {
-	sessionFile := path.Join(sessionDir, s.ID)
+// Save writes the session file and, if it is behind, the message log of the
+// session, both sealed with the sealer if there is one. Messages are better
+// added with AppendMessage which only appends to the log.
+func (s *Session) Save(sessionDir string, sealer chata.Sealer) error {
+	if s.NeedsCompaction() {
+		return s.Compact(sessionDir, sealer)
+	}
 
-	b, _ := yaml.Marshal(s)
+	return s.saveMetadata(path.Join(sessionDir, s.ID), sealer)
+}
 
-	return os.WriteFile(sessionFile, b, 0600)
+// SaveMetadata writes the session file, the log is only written if it is
+// behind the session.
+func (s *Session) SaveMetadata(sessionDir string, sealer chata.Sealer) error {
+	if s.logBehind() {
+		return s.Compact(sessionDir, sealer)
+	}
+
+	return s.saveMetadata(path.Join(sessionDir, s.ID), sealer)
 }
 
-func LoadSession(sessionFile string) (*Session, error) {
-	b, err := os.ReadFile(sessionFile)
+// saveMetadata writes the session without its messages.
+func (s *Session) saveMetadata(sessionFile string, sealer chata.Sealer) error {
+	b, err := s.MarshalMetadata()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	b, err = chata.Seal(sealer, sessionFile, b)
+	if err != nil {
+		return err
 	}
 
+	return chata.WriteFile(sessionFile, b, 0600)
+}
+
+// MarshalMetadata returns the session without its messages in YAML, with the
+// version of its schema.
+func (s *Session) MarshalMetadata() ([]byte, error) {
+	metadata := *s
+	metadata.Messages = nil
+
+	return yaml.Marshal(&struct {
+		Version int `yaml:"version"`
+		Session `yaml:",inline"`
+	}{Version: SessionVersion, Session: metadata})
+}
+
+// ParseSession reads a session saved in YAML.
+func ParseSession(b []byte) (*Session, error) {
 	session := &Session{}
 	if e := yaml.Unmarshal(b, session); e != nil {
 		return nil, e
 	}
 
+	session.inlined = len(session.Messages) > 0
+	if session.Messages == nil {
+		session.Messages = []Message{}
+	}
+
 	return session, nil
 }
 
+// LoadSession reads the session file and the message log of the session and
+// unseals them with the sealer, without one they are read as they are.
+func LoadSession(sessionFile string, sealer chata.Sealer) (*Session, error) {
+	b, err := ReadSessionFile(sessionFile, sealer)
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadSessionData(sessionFile, b, sealer)
+}
+
+// ReadSessionFile reads the session file and unseals it with the sealer.
+func ReadSessionFile(sessionFile string, sealer chata.Sealer) ([]byte, error) {
+	b, err := os.ReadFile(sessionFile)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err = chata.Unseal(sealer, sessionFile, b)
+	if errors.Is(err, chata.ErrNoKey) || errors.Is(err, chata.ErrNotSealed) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("%w %s: %w", ErrCorruptSession, sessionFile, err)
+	}
+
+	return b, nil
+}
+
+// LoadSessionData parses the session read from the session file and loads
+// the message log of the session.
+func LoadSessionData(sessionFile string, b []byte, sealer chata.Sealer) (*Session, error) {
+	session, _, err := loadSessionData(sessionFile, b, sealer, false)
+
+	return session, err
+}
+
+// CheckSessionData is LoadSessionData without changing the files, for
+// checking them. A torn last record of the log is left in place, the size of
+// the log without it is returned. It is -1 if the log is whole.
+func CheckSessionData(sessionFile string, b []byte, sealer chata.Sealer) (*Session, int64, error) {
+	return loadSessionData(sessionFile, b, sealer, true)
+}
+
+func loadSessionData(sessionFile string, b []byte, sealer chata.Sealer, readOnly bool) (*Session, int64, error) {
+	session, err := ParseSession(b)
+	if err != nil {
+		return nil, -1, fmt.Errorf("%w %s: %w", ErrCorruptSession, sessionFile, err)
+	}
+
+	if session.ID == "" {
+		return nil, -1, fmt.Errorf("%w %s: no id", ErrCorruptSession, sessionFile)
+	}
+
+	l, err := loadLog(sessionFile, sealer, readOnly)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	torn := int64(-1)
+	if l != nil {
+		torn = l.torn
+	}
+
+	// The log wins over messages left in the session file
+	if l != nil {
+		session.Messages = l.messages
+		session.logged = len(l.messages)
+
+		// The session file is not rewritten on append
+		if n := len(l.messages); n > 0 && l.messages[n-1].Time.After(session.LastMsg) {
+			session.LastMsg = l.messages[n-1].Time
+		}
+	}
+
+	session.NumberMessages()
+
+	if l != nil {
+		// Nobody else has the session yet, the messages are changed in place
+		for _, c := range l.changes {
+			i, e := session.Check(c)
+			if e != nil {
+				return nil, -1, fmt.Errorf("%w %s: %w", ErrCorruptLog, LogFile(sessionFile), e)
+			}
+
+			session.change(i, c)
+		}
+
+		session.changes = len(l.changes)
+	}
+
+	return session, torn, nil
+}
+
 func (s *Session) Delete(sessionDir string) error {
-	return os.Remove(path.Join(sessionDir, s.ID))
+	sessionFile := path.Join(sessionDir, s.ID)
+	if e := os.Remove(LogFile(sessionFile)); e != nil && !errors.Is(e, os.ErrNotExist) {
+		return e
+	}
+
+	return os.Remove(sessionFile)
 }
@@ -3,6 +3,7 @@ package chat_test
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/rchamarthy/chata/chat"
 	"github.com/stretchr/testify/require"
@@ -28,12 +29,19 @@ func TestSession(t *testing.T) {
 	require.Equal("hello", s.LastNMessages(1)[0].Body)
 	require.Len(s.GetMessages(0), 1)
 	require.Len(s.LastNMessages(2), 1)
+	require.Len(s.MessagesAfter(0), 1)
+	require.Empty(s.MessagesAfter(1))
+	require.Empty(s.MessagesAfter(5))
+	require.Equal(uint64(1), s.LastID())
 
 	require.Nil(chat.NewSession("user1", "user1"))
 
 	s = chat.NewSession("user2", "user1")
 	require.NotNil(s)
 	require.Equal("user1-user2", s.ID)
+	require.Equal("user1-user2", chat.SessionID("user2", "user1"))
+	require.Equal("user1", s.Peer("user2"))
+	require.Equal("user2", s.Peer("user1"))
 }
 
 func TestSessionSave(t *testing.T) {
@@ -42,13 +50,13 @@ func TestSessionSave(t *testing.T) {
 	require := require.New(t)
 	s := chat.NewSession("user1", "user2")
 	require.NotNil(s)
-	require.NoError(s.Save("./"))
+	require.NoError(s.Save("./", nil))
 
-	bs, err := chat.LoadSession("./user1-user3")
+	bs, err := chat.LoadSession("./user1-user3", nil)
 	require.Error(err)
 	require.Nil(bs)
 
-	s1, err := chat.LoadSession("./user1-user2")
+	s1, err := chat.LoadSession("./user1-user2", nil)
 	require.NoError(err)
 	require.NotNil(s1)
 	require.Equal(s.User1, s1.User1)
@@ -57,9 +65,75 @@ func TestSessionSave(t *testing.T) {
 
 	require.NoError(os.WriteFile("crappy-session", []byte("blah"), 0600))
 	defer os.Remove("crappy-session")
-	s2, err := chat.LoadSession("crappy-session")
+	s2, err := chat.LoadSession("crappy-session", nil)
 	require.Error(err)
 	require.Nil(s2)
 
 	require.NoError(s.Delete("./"))
 }
+
+func TestMessageIDs(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	s := chat.NewSession("user1", "user2")
+	require.Equal(uint64(1), s.NextID())
+
+	s.AddMessage("user1", "one")
+	s.Append(chat.Message{Sender: "user2", Body: "two", Time: time.Now()})
+	require.Equal(uint64(1), s.Messages[0].ID)
+	require.Equal(uint64(2), s.Messages[1].ID)
+
+	// Messages saved before ids are numbered after the ones that have ids
+	s.Messages = append(s.Messages, chat.Message{Sender: "user1", Body: "old"})
+	s.NumberMessages()
+	require.Equal(uint64(3), s.Messages[2].ID)
+
+	now := time.Now()
+	m, err := s.Prepare(chat.Message{Sender: "user1", ClientID: "c1", Time: now}, now)
+	require.NoError(err)
+	require.Equal(uint64(4), m.ID)
+	s.Append(m)
+
+	dup, err := s.Prepare(chat.Message{Sender: "user1", ClientID: "c1", Time: now}, now)
+	require.ErrorIs(err, chat.ErrDuplicateMessage)
+	require.Equal(m, dup)
+
+	// Client ids are per sender and forgotten after the window
+	_, err = s.Prepare(chat.Message{Sender: "user2", ClientID: "c1", Time: now}, now)
+	require.NoError(err)
+	_, err = s.Prepare(chat.Message{Sender: "user1", ClientID: "c1", Time: now}, now.Add(chat.DedupeWindow+time.Second))
+	require.NoError(err)
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	g, err := chat.NewGroup("user1", "friends", "user2")
+	require.NoError(err)
+	g.AddMessage("user1", "one")
+	g.MarkRead("user2", 1)
+
+	snapshot := g.Snapshot()
+	require.Equal(g, snapshot)
+
+	// Changes to the session do not show in the snapshot
+	g.AddMessage("user2", "two")
+	require.NoError(g.AddMember("user1", "user3"))
+	require.NoError(g.SetAdmin("user1", "user2", true))
+	_, err = g.Apply(chat.NewEdit(chat.Message{Sender: "user1", Body: "one!", Replaces: 1}))
+	require.NoError(err)
+	g.MarkRead("user2", 2)
+
+	require.Len(snapshot.Messages, 1)
+	require.Equal("one", snapshot.Messages[0].Current().Body)
+	require.Equal([]string{"user1", "user2"}, snapshot.Members())
+	require.Empty(snapshot.Admins)
+	require.Equal(uint64(1), snapshot.Receipt("user2").Read)
+
+	// Nor do appends to the snapshot show in the session
+	snapshot.AddMessage("user1", "mine")
+	require.Equal("two", g.Messages[1].Body)
+}
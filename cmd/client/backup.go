@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func adminCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "admin",
+		Short: "administer the server",
+		Long:  "administer the server, only admins may do this",
+	}
+
+	c.AddCommand(backupCmd())
+
+	return c
+}
+
+func backupCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "backup <admin> <archive>",
+		Short: "back up the server",
+		Long: "save a backup of the users and the chats of the server to a new tar.gz archive, " +
+			"chata-server restore restores it",
+		RunE: Backup,
+		Args: cobra.ExactArgs(2),
+	}
+}
+
+func Backup(cmd *cobra.Command, args []string) error {
+	serverAddress, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return err
+	}
+
+	admin, archive := args[0], args[1]
+
+	client, err := newClient(admin)
+	if err != nil {
+		return err
+	}
+
+	r, err := client.R().SetDoNotParseResponse(true).Post(serverAddress + "/admin/backup")
+	if err != nil {
+		return err
+	}
+
+	body := r.RawBody()
+	defer body.Close()
+
+	if r.StatusCode() != http.StatusOK {
+		b, _ := io.ReadAll(body)
+		return fmt.Errorf("error backing up:\n %s", string(b))
+	}
+
+	f, err := os.OpenFile(archive, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(f, body)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		os.Remove(archive)
+		return err
+	}
+
+	fmt.Printf("backup of %d bytes saved to %s\n", n, archive)
+	return nil
+}
@@ -4,8 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/rchamarthy/chata/auth"
 	"github.com/rchamarthy/chata/chat"
 	"github.com/spf13/cobra"
 )
@@ -21,6 +26,10 @@ func chatCmd() *cobra.Command {
 	c.AddCommand(deleteChatCmd())
 	c.AddCommand(sendMessageCmd())
 	c.AddCommand(showChatsCmd())
+	c.AddCommand(openChatCmd())
+	c.AddCommand(editMessageCmd())
+	c.AddCommand(retractMessageCmd())
+	c.AddCommand(chatTTLCmd())
 
 	return c
 }
@@ -56,13 +65,18 @@ func sendMessageCmd() *cobra.Command {
 }
 
 func showChatsCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "show",
+	c := &cobra.Command{
+		Use:   "show <from> [to]",
 		Short: "show all chats between two users",
 		Long:  "show all chats between two users",
 		RunE:  ShowChats,
 		Args:  cobra.MaximumNArgs(2),
 	}
+
+	c.Flags().Int("limit", chat.DefaultPageSize, "number of messages to show, 0 shows them all")
+	c.Flags().String("since", "", "show the messages since a time (RFC 3339) or for a duration (1h)")
+
+	return c
 }
 
 func Connect(cmd *cobra.Command, args []string) error {
@@ -74,8 +88,12 @@ func Connect(cmd *cobra.Command, args []string) error {
 	from := args[0]
 	to := args[1]
 
+	client, err := newClient(from)
+	if err != nil {
+		return err
+	}
+
 	url := fmt.Sprintf("%s/chats/%s/%s", serverAddress, from, to)
-	client := resty.New()
 	r, err := client.R().Post(url)
 	if err != nil {
 		return err
@@ -101,8 +119,12 @@ func DeleteChat(cmd *cobra.Command, args []string) error {
 	from := args[0]
 	to := args[1]
 
+	client, err := newClient(from)
+	if err != nil {
+		return err
+	}
+
 	url := fmt.Sprintf("%s/chats/%s/%s", serverAddress, from, to)
-	client := resty.New()
 	r, err := client.R().Delete(url)
 	if err != nil {
 		return err
@@ -126,19 +148,28 @@ func SendMessage(cmd *cobra.Command, args []string) error {
 	to := args[1]
 	message := args[2]
 
-	url := fmt.Sprintf("%s/message/%s/%s", serverAddress, from, to)
-	client := resty.New()
+	accept, err := cmd.Flags().GetBool(AcceptKeyChangeFlag)
+	if err != nil {
+		return err
+	}
+
+	user, err := loadUser(from)
+	if err != nil {
+		return err
+	}
 
-	m := struct {
-		Text string `json:"text"`
-	}{Text: message}
-	r, err := client.R().SetBody(&m).Post(url)
+	client := signingClient(user.ID, user.Key)
+	peer, err := fetchUser(client, serverAddress, to)
 	if err != nil {
 		return err
 	}
 
-	if r.StatusCode() != http.StatusOK {
-		return fmt.Errorf("error sending message:\n %s", string(r.Body()))
+	if e := checkPeer(user.ID, peer, accept); e != nil {
+		return e
+	}
+
+	if e := sendMessage(client, serverAddress, user, peer, message); e != nil {
+		return e
 	}
 
 	fmt.Printf("message sent from %s to %s\n", from, to)
@@ -151,23 +182,95 @@ func ShowChats(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	switch len(args) {
-	case 0:
+	if len(args) == 0 {
 		return errors.New("need at least one user id")
+	}
+
+	user, err := loadUser(args[0])
+	if err != nil {
+		return err
+	}
+
+	client := signingClient(user.ID, user.Key)
+
+	switch len(args) {
 	case 1:
-		return showAllChats(serverAddress, args[0])
+		return showAllChats(client, serverAddress, user)
 	case 2:
-		return showOneChat(serverAddress, args[0], args[1])
+		query, err := pageQuery(cmd)
+		if err != nil {
+			return err
+		}
+
+		accept, err := cmd.Flags().GetBool(AcceptKeyChangeFlag)
+		if err != nil {
+			return err
+		}
+
+		return showOneChat(client, serverAddress, user, args[1], query, accept)
 	default:
 		return errors.New("invalid number of arguments")
 	}
 }
 
-func showAllChats(server string, from string) error {
-	url := fmt.Sprintf("%s/chats/%s", server, from)
-	client := resty.New()
-	sessions := []*chat.Session{}
-	r, err := client.R().SetResult(&sessions).Get(url)
+// pageQuery returns the query of the first page of messages to show from
+// the --limit and --since flags.
+func pageQuery(cmd *cobra.Command) (map[string]string, error) {
+	limit, err := cmd.Flags().GetInt("limit")
+	if err != nil {
+		return nil, err
+	}
+
+	since, err := cmd.Flags().GetString("since")
+	if err != nil {
+		return nil, err
+	}
+
+	query := map[string]string{}
+
+	switch {
+	case limit < 0:
+		return nil, fmt.Errorf("bad limit %d", limit)
+	case limit == 0:
+		// All the messages, a page at a time from the first one
+		query["after"] = "0"
+		query["wait"] = "0s"
+		query["limit"] = strconv.Itoa(chat.MaxPageSize)
+	default:
+		query["limit"] = strconv.Itoa(limit)
+	}
+
+	if since != "" {
+		t, err := parseSince(since, time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		delete(query, "after")
+		query["since"] = t.Format(time.RFC3339Nano)
+	}
+
+	return query, nil
+}
+
+// parseSince parses a time, or a duration back from now.
+func parseSince(since string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(since); err == nil {
+		return now.Add(-d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad since %q, expected a time (RFC 3339) or a duration", since)
+	}
+
+	return t, nil
+}
+
+func showAllChats(client *resty.Client, server string, user *auth.User) error {
+	url := fmt.Sprintf("%s/chats/%s", server, user.ID)
+	summaries := []chat.Summary{}
+	r, err := client.R().SetResult(&summaries).Get(url)
 	if err != nil {
 		return err
 	}
@@ -176,34 +279,300 @@ func showAllChats(server string, from string) error {
 		return fmt.Errorf("error getting chats:\n %s", string(r.Body()))
 	}
 
-	for _, session := range sessions {
-		otherUser := from
-		if session.User1 == from {
-			otherUser = session.User2
+	users := map[string]*auth.User{user.ID: user}
+
+	for _, summary := range summaries {
+		preview := ""
+		if summary.Last != nil {
+			preview = " " + previewMessage(client, server, user, users, summary)
+		}
+
+		preview += disappearing(summary.TTL)
+
+		if summary.Peer == "" {
+			fmt.Printf("group: %s (%s) members: %d messages: %d unread: %d last message: %s%s\n", summary.Name,
+				summary.ID, len(summary.Members), summary.Count, summary.Unread, summary.LastTime.String(), preview)
+			continue
 		}
-		lastMessage := session.LastMsg.String()
-		fmt.Printf("other user: %s messages: %d last message: %s\n", otherUser,
-			len(session.Messages), lastMessage)
+
+		fmt.Printf("other user: %s messages: %d unread: %d last message: %s%s\n", summary.Peer,
+			summary.Count, summary.Unread, summary.LastTime.String(), preview)
 	}
 
 	return nil
 }
 
-func showOneChat(server string, from string, to string) error {
-	url := fmt.Sprintf("%s/chats/%s/%s", server, from, to)
-	client := resty.New()
-	session := &chat.Session{}
-	r, err := client.R().SetResult(session).Get(url)
+// previewMessage returns the start of the last message of the session, the
+// sender is fetched into users to check its signature.
+func previewMessage(client *resty.Client, server string, user *auth.User, users map[string]*auth.User,
+	summary chat.Summary,
+) string {
+	msg := summary.Last
+	if _, ok := users[msg.Sender]; !ok {
+		if sender, e := fetchUser(client, server, msg.Sender); e == nil {
+			users[sender.ID] = sender
+		}
+	}
+
+	session := &chat.Session{ID: summary.ID, User1: user.ID, User2: summary.Peer, Receipts: summary.Receipts}
+	if summary.Peer == "" {
+		session = &chat.Session{ID: summary.ID, Owner: user.ID, Participants: summary.Members, Receipts: summary.Receipts}
+	}
+
+	body, warning := readMessage(msg, session, users, user)
+	if warning != "" {
+		warning = " [WARNING: " + warning + "]"
+	}
+
+	const previewLength = 40
+	if runes := []rune(body); len(runes) > previewLength {
+		body = string(runes[:previewLength]) + "..."
+	}
+
+	status := ""
+	if msg.Sender == user.ID {
+		if mark := session.Status(msg).Mark(); mark != "" {
+			status = " " + mark
+		}
+	}
+
+	return fmt.Sprintf("%s: %q%s%s", msg.Sender, body, status, warning)
+}
+
+func showOneChat(client *resty.Client, server string, user *auth.User, to string,
+	query map[string]string, accept bool,
+) error {
+	peer, err := fetchUser(client, server, to)
+	if err != nil {
+		return err
+	}
+
+	if e := checkPeer(user.ID, peer, accept); e != nil {
+		return e
+	}
+
+	users := map[string]*auth.User{user.ID: user, peer.ID: peer}
+	session := chat.NewSession(user.ID, to)
+	if session == nil {
+		return errors.New("cannot chat with yourself")
+	}
+
+	return showMessages(client, server, fmt.Sprintf("%s/chats/%s/%s", server, user.ID, to), query, session,
+		users, user)
+}
+
+// showMessages prints the pages of the messages of the session at url that
+// the query asks for and marks them read. Senders that are not in users, such
+// as former members of a group, are fetched into it.
+func showMessages(client *resty.Client, server string, url string, query map[string]string,
+	session *chat.Session, users map[string]*auth.User, user *auth.User,
+) error {
+	last := uint64(0)
+
+	for first := true; ; first = false {
+		page := &chat.Page{}
+		r, err := client.R().SetQueryParams(query).SetResult(page).Get(url + "/messages")
+		if err != nil {
+			return err
+		}
+
+		if r.StatusCode() != http.StatusOK {
+			return fmt.Errorf("error getting messages:\n %s", string(r.Body()))
+		}
+
+		if first && page.Unread > 0 {
+			fmt.Printf("unread: %d\n", page.Unread)
+		}
+
+		session.Receipts = page.Receipts
+		for _, msg := range page.Messages {
+			if _, ok := users[msg.Sender]; !ok {
+				if sender, e := fetchUser(client, server, msg.Sender); e == nil {
+					users[sender.ID] = sender
+				}
+			}
+
+			printMessage(&msg, session, users, user)
+			last = msg.ID
+		}
+
+		// Only the whole history takes more than one page, up to a short one
+		if query["after"] == "" || len(page.Messages) < chat.MaxPageSize {
+			break
+		}
+
+		query["after"] = strconv.FormatUint(page.Next, 10)
+	}
+
+	if last == 0 {
+		return nil
+	}
+
+	return markRead(client, url, last)
+}
+
+// printMessage prints a message of the session, the messages of the user
+// with their status.
+func printMessage(msg *chat.Message, session *chat.Session, users map[string]*auth.User, me *auth.User) {
+	body, warning := readMessage(msg, session, users, me)
+	if warning != "" {
+		warning = fmt.Sprintf(" [WARNING: %s]", warning)
+	}
+
+	if msg.Sender == me.ID {
+		if mark := session.Status(msg).Mark(); mark != "" {
+			body += " " + mark
+		}
+	}
+
+	fmt.Printf("[%d] %s: %s\n", msg.ID, sanitize(msg.Sender), sanitize(body+warning))
+}
+
+// sanitize replaces the control characters of text that came from peers or
+// the server, so that it cannot move the cursor or restyle the terminal.
+// Newlines and tabs are kept.
+func sanitize(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || !unicode.IsControl(r) {
+			return r
+		}
+
+		return unicode.ReplacementChar
+	}, text)
+}
+
+// markRead tells the server that the user read the messages of the chat, or
+// the group, at url up to the id.
+func markRead(client *resty.Client, url string, id uint64) error {
+	r, err := client.R().Post(fmt.Sprintf("%s/read/%d", url, id))
 	if err != nil {
 		return err
 	}
 
 	if r.StatusCode() != http.StatusOK {
-		return fmt.Errorf("error getting chat:\n %s", string(r.Body()))
+		return fmt.Errorf("error marking messages read:\n %s", string(r.Body()))
+	}
+
+	return nil
+}
+
+// sendMessage encrypts the message for the peer and for the user, signs it
+// and sends it.
+func sendMessage(client *resty.Client, server string, user *auth.User, peer *auth.User, message string) error {
+	// Seal for the peer and for ourselves to be able to read the history
+	m, err := composeMessage(user, chat.SessionID(user.ID, peer.ID), peer.ID, message, 0, user.Key.Public(), peer.Key)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/message/%s/%s", server, user.ID, peer.ID)
+
+	return postMessage(client, url, m)
+}
+
+// composeMessage encrypts the message for the keys and signs it for the
+// recipient in the session. A message that is an edit replaces the message
+// with the id replaces.
+func composeMessage(user *auth.User, sessionID string, recipient string, message string, replaces uint64,
+	keys ...*auth.Identity,
+) (*chat.Message, error) {
+	env, err := chat.Encrypt(message, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &chat.Message{Sender: user.ID, Time: time.Now(), Envelope: env, Replaces: replaces}
+	if e := m.Sign(sessionID, recipient, user.Key); e != nil {
+		return nil, e
+	}
+
+	return m, nil
+}
+
+// Retries of a message that could not be sent. The message keeps its client
+// id so the server adds it once however many times it gets it.
+const (
+	SendRetries      = 3
+	SendRetryWait    = 500 * time.Millisecond
+	SendRetryMaxWait = 4 * time.Second
+)
+
+// postMessage sends the message, again on network and server errors.
+func postMessage(client *resty.Client, url string, m *chat.Message) error {
+	m.ClientID = chat.NewClientID()
+	wait := SendRetryWait
+
+	for retry := 0; ; retry++ {
+		r, err := client.R().SetHeader(chat.IdempotencyKeyHeader, m.ClientID).SetBody(m).Post(url)
+
+		switch {
+		case err == nil && r.StatusCode() == http.StatusOK:
+			return nil
+		case err == nil && r.StatusCode() < http.StatusInternalServerError:
+			return fmt.Errorf("error sending message:\n %s", string(r.Body()))
+		case retry == SendRetries:
+			if err != nil {
+				return fmt.Errorf("error sending message after %d retries: %w", retry, err)
+			}
+
+			return fmt.Errorf("error sending message after %d retries:\n %s", retry, string(r.Body()))
+		}
+
+		time.Sleep(wait)
+		wait = min(2*wait, SendRetryMaxWait)
+	}
+}
+
+// readMessage returns the decrypted body of the message and a warning if its
+// signature does not check out.
+func readMessage(msg *chat.Message, session *chat.Session, users map[string]*auth.User, me *auth.User) (string, string) {
+	if msg.IsDeleted() {
+		if msg.Deleted.By != msg.Sender {
+			return fmt.Sprintf("<message deleted by %s>", msg.Deleted.By), ""
+		}
+
+		return "<message deleted>", ""
+	}
+
+	// An edited message reads as its last revision, which is signed too
+	current := msg.Current()
+	body, err := current.Decrypt(me.RecipientKey(current.Envelope))
+	if err != nil {
+		body = fmt.Sprintf("<%v>", err)
+	}
+
+	if msg.IsEdited() {
+		body += " (edited)"
+	}
+
+	warning := ""
+	if e := verifyMessage(current, session, users); e != nil {
+		warning = e.Error()
+	}
+
+	return body, warning
+}
+
+// verifyMessage checks that the message was signed by its sender with the
+// key the sender had at the time of the message. The key history comes from
+// the server, it is checked before a key is picked from it.
+func verifyMessage(msg *chat.Message, session *chat.Session, users map[string]*auth.User) error {
+	sender, ok := users[msg.Sender]
+	if !ok {
+		return fmt.Errorf("unknown sender %s", msg.Sender)
+	}
+
+	if e := sender.VerifyKeyHistory(); e != nil {
+		return fmt.Errorf("key history of %s does not check out: %w", msg.Sender, e)
+	}
+
+	key, err := sender.KeyAt(msg.Time)
+	if err != nil {
+		return err
 	}
 
-	for _, msg := range session.Messages {
-		fmt.Printf("%s: %s\n", msg.Sender, msg.Body)
+	if e := msg.Verify(session.ID, session.Recipient(msg.Sender), key); e != nil {
+		return fmt.Errorf("signature does not match the key of %s: %w", msg.Sender, e)
 	}
 
 	return nil
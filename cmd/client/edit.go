@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/spf13/cobra"
+)
+
+func editMessageCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "edit <from> <to> <id> <message>",
+		Short: "edit a message sent to another user",
+		Long:  "replace the text of a message, the message keeps its earlier revisions",
+		RunE:  EditMessage,
+		Args:  cobra.ExactArgs(4),
+	}
+}
+
+func retractMessageCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "retract <from> <to> <id>",
+		Short: "delete a message of a chat",
+		Long:  "delete a message of a chat, admins delete any message with --as",
+		RunE:  RetractMessage,
+		Args:  cobra.ExactArgs(3),
+	}
+
+	c.Flags().String("as", "", "delete as another user, such as an admin moderating the chat")
+
+	return c
+}
+
+func editGroupMessageCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "edit <from> <group> <id> <message>",
+		Short: "edit a message sent to a group",
+		Long:  "replace the text of a message, the message keeps its earlier revisions",
+		RunE:  EditGroupMessage,
+		Args:  cobra.ExactArgs(4),
+	}
+}
+
+func retractGroupMessageCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "retract <from> <group> <id>",
+		Short: "delete a message of a group",
+		Long:  "delete a message of a group, admins of the group delete any message of the group",
+		RunE:  RetractGroupMessage,
+		Args:  cobra.ExactArgs(3),
+	}
+
+	c.Flags().String("as", "", "delete as another user, such as an admin moderating the group")
+
+	return c
+}
+
+func EditMessage(cmd *cobra.Command, args []string) error {
+	serverAddress, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return err
+	}
+
+	id, err := parseMessageID(args[2])
+	if err != nil {
+		return err
+	}
+
+	accept, err := cmd.Flags().GetBool(AcceptKeyChangeFlag)
+	if err != nil {
+		return err
+	}
+
+	user, err := loadUser(args[0])
+	if err != nil {
+		return err
+	}
+
+	client := signingClient(user.ID, user.Key)
+	peer, err := fetchUser(client, serverAddress, args[1])
+	if err != nil {
+		return err
+	}
+
+	if e := checkPeer(user.ID, peer, accept); e != nil {
+		return e
+	}
+
+	m, err := composeMessage(user, chat.SessionID(user.ID, peer.ID), peer.ID, args[3], id, user.Key.Public(), peer.Key)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/chats/%s/%s/messages/%d", serverAddress, user.ID, peer.ID, id)
+	if e := patchMessage(client, url, m); e != nil {
+		return e
+	}
+
+	fmt.Printf("message %d is edited\n", id)
+	return nil
+}
+
+func EditGroupMessage(cmd *cobra.Command, args []string) error {
+	serverAddress, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return err
+	}
+
+	id, err := parseMessageID(args[2])
+	if err != nil {
+		return err
+	}
+
+	accept, err := cmd.Flags().GetBool(AcceptKeyChangeFlag)
+	if err != nil {
+		return err
+	}
+
+	user, err := loadUser(args[0])
+	if err != nil {
+		return err
+	}
+
+	client := signingClient(user.ID, user.Key)
+	group, err := fetchGroup(client, serverAddress, user.ID, args[1])
+	if err != nil {
+		return err
+	}
+
+	members, err := fetchMembers(client, serverAddress, user, group.Members(), accept)
+	if err != nil {
+		return err
+	}
+
+	m, err := composeMessage(user, group.ID, group.Recipient(user.ID), args[3], id, groupKeys(user, group, members)...)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/groups/%s/%s/messages/%d", serverAddress, user.ID, group.ID, id)
+	if e := patchMessage(client, url, m); e != nil {
+		return e
+	}
+
+	fmt.Printf("message %d of group %s is edited\n", id, group.ID)
+	return nil
+}
+
+func RetractMessage(cmd *cobra.Command, args []string) error {
+	return retractMessage(cmd, "chats", args)
+}
+
+func RetractGroupMessage(cmd *cobra.Command, args []string) error {
+	return retractMessage(cmd, "groups", args)
+}
+
+// retractMessage deletes the message of the chat or the group in args, as
+// the user in the --as flag if there is one.
+func retractMessage(cmd *cobra.Command, what string, args []string) error {
+	serverAddress, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return err
+	}
+
+	as, err := cmd.Flags().GetString("as")
+	if err != nil {
+		return err
+	}
+
+	id, err := parseMessageID(args[2])
+	if err != nil {
+		return err
+	}
+
+	if as == "" {
+		as = args[0]
+	}
+
+	client, err := newClient(as)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/%s/%s/%s/messages/%d", serverAddress, what, args[0], args[1], id)
+	r, err := client.R().Delete(url)
+	if err != nil {
+		return err
+	}
+
+	if r.StatusCode() != http.StatusOK {
+		return fmt.Errorf("error deleting message:\n %s", string(r.Body()))
+	}
+
+	fmt.Printf("message %d is deleted\n", id)
+	return nil
+}
+
+func patchMessage(client *resty.Client, url string, m *chat.Message) error {
+	r, err := client.R().SetBody(m).Patch(url)
+	if err != nil {
+		return err
+	}
+
+	if r.StatusCode() != http.StatusOK {
+		return fmt.Errorf("error editing message:\n %s", string(r.Body()))
+	}
+
+	return nil
+}
+
+func parseMessageID(s string) (uint64, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("bad message id %q", s)
+	}
+
+	return id, nil
+}
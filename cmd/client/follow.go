@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/gorilla/websocket"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+)
+
+// Delays between attempts to reconnect to the server.
+const (
+	MinReconnectDelay = time.Second
+	MaxReconnectDelay = 30 * time.Second
+	PollWait          = 30 * time.Second
+)
+
+var (
+	errNoStream       = errors.New("server does not stream")
+	errSessionDeleted = errors.New("chat was deleted")
+)
+
+// followUpdate is either an event of the session or a change of the status
+// of the connection.
+type followUpdate struct {
+	event  *chat.Event
+	status string
+}
+
+// follower delivers the new messages of a session. It uses the WebSocket
+// stream of the server and falls back to long-polling when WebSockets do
+// not get through.
+type follower struct {
+	client  *resty.Client
+	server  string
+	user    *auth.User
+	peer    string
+	session string
+	last    uint64
+	updates chan followUpdate
+}
+
+// newFollower returns a follower of the session of the user with the peer
+// that delivers the messages after the message with the id last.
+func newFollower(client *resty.Client, server string, user *auth.User, peer string, last uint64) *follower {
+	return &follower{
+		client:  client,
+		server:  server,
+		user:    user,
+		peer:    peer,
+		session: chat.SessionID(user.ID, peer),
+		last:    last,
+		updates: make(chan followUpdate, 16),
+	}
+}
+
+// run follows the session until the context is done or the session is
+// deleted.
+func (f *follower) run(ctx context.Context) {
+	defer close(f.updates)
+
+	poll := false
+	delay := MinReconnectDelay
+
+	for ctx.Err() == nil {
+		var err error
+		if !poll {
+			err = f.stream(ctx)
+			if errors.Is(err, errNoStream) {
+				poll = true
+				continue
+			}
+		} else {
+			err = f.poll(ctx)
+		}
+
+		if errors.Is(err, errSessionDeleted) || ctx.Err() != nil {
+			return
+		}
+
+		f.status(fmt.Sprintf("disconnected: %v, retrying in %s", err, delay))
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+
+		delay = min(2*delay, MaxReconnectDelay)
+	}
+}
+
+// stream reads the events of the WebSocket stream, resuming after the last
+// message it delivered.
+func (f *follower) stream(ctx context.Context) error {
+	url := fmt.Sprintf("%s/stream?resume=%s:%d", f.server, f.peer, f.last)
+	url = "ws" + strings.TrimPrefix(url, "http")
+
+	header, err := signedHeader(f.user.ID, f.user.Key, url)
+	if err != nil {
+		return err
+	}
+
+	conn, r, err := websocket.DefaultDialer.DialContext(ctx, url, header)
+	if err != nil {
+		if r != nil && r.StatusCode != http.StatusUnauthorized {
+			return fmt.Errorf("%w: %w", errNoStream, err)
+		}
+
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	f.status("live")
+
+	for {
+		e := &chat.Event{}
+		if err := conn.ReadJSON(e); err != nil {
+			return err
+		}
+
+		if e.Session != f.session {
+			continue
+		}
+
+		if e.Type == chat.EventMessage {
+			if e.ID <= f.last {
+				continue
+			}
+
+			f.last = e.ID
+		}
+
+		if !f.deliver(ctx, e) {
+			return errSessionDeleted
+		}
+	}
+}
+
+// poll long-polls the server for messages after the last one it delivered.
+func (f *follower) poll(ctx context.Context) error {
+	f.status("live (polling)")
+
+	for {
+		url := fmt.Sprintf("%s/chats/%s/%s/messages?after=%d&wait=%s",
+			f.server, f.user.ID, f.peer, f.last, PollWait)
+
+		page := &chat.Page{}
+		r, err := f.client.R().SetContext(ctx).SetResult(page).Get(url)
+		if err != nil {
+			return err
+		}
+
+		s := &chat.Session{ID: f.session, User1: f.user.ID, User2: f.peer}
+
+		switch r.StatusCode() {
+		case http.StatusOK:
+		case http.StatusNotFound:
+			e := chat.NewSessionEvent(chat.EventSessionDeleted, s)
+			f.deliver(ctx, &e)
+			return errSessionDeleted
+		default:
+			return fmt.Errorf("error polling messages: %s", r.Status())
+		}
+
+		for _, m := range page.Messages {
+			e := chat.NewMessageEvent(s, m)
+			f.deliver(ctx, &e)
+		}
+
+		f.last = max(f.last, page.Next)
+	}
+}
+
+// deliver sends the event to the UI, it reports false once the session is
+// deleted.
+func (f *follower) deliver(ctx context.Context, e *chat.Event) bool {
+	select {
+	case f.updates <- followUpdate{event: e}:
+	case <-ctx.Done():
+	}
+
+	return e.Type != chat.EventSessionDeleted
+}
+
+func (f *follower) status(s string) {
+	select {
+	case f.updates <- followUpdate{status: s}:
+	default:
+	}
+}
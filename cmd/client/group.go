@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/spf13/cobra"
+)
+
+func groupCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "group",
+		Short: "chat with a group of users",
+		Long:  "manage group chats and their members",
+	}
+
+	c.AddCommand(createGroupCmd())
+	c.AddCommand(addMemberCmd())
+	c.AddCommand(removeMemberCmd())
+	c.AddCommand(groupAdminCmd())
+	c.AddCommand(deleteGroupCmd())
+	c.AddCommand(sendGroupMessageCmd())
+	c.AddCommand(showGroupsCmd())
+	c.AddCommand(editGroupMessageCmd())
+	c.AddCommand(retractGroupMessageCmd())
+	c.AddCommand(groupTTLCmd())
+
+	return c
+}
+
+func createGroupCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "create <from> <name> [member...]",
+		Short: "create a group",
+		Long:  "create a group owned by the user with the members",
+		RunE:  CreateGroup,
+		Args:  cobra.MinimumNArgs(2),
+	}
+}
+
+func addMemberCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "add <from> <group> <user>",
+		Short: "add a member to a group",
+		Long:  "add a member to a group, only admins of the group may add members",
+		RunE:  AddMember,
+		Args:  cobra.ExactArgs(3),
+	}
+}
+
+func removeMemberCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove <from> <group> <user>",
+		Short: "remove a member from a group",
+		Long:  "remove a member from a group, remove yourself to leave the group",
+		RunE:  RemoveMember,
+		Args:  cobra.ExactArgs(3),
+	}
+}
+
+func groupAdminCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "admin <from> <group> <user>",
+		Short: "make a member an admin of a group",
+		Long:  "grant or revoke the admin role of a member, only the owner of the group may do this",
+		RunE:  GroupAdmin,
+		Args:  cobra.ExactArgs(3),
+	}
+
+	c.Flags().Bool("revoke", false, "revoke the admin role")
+
+	return c
+}
+
+func deleteGroupCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete <from> <group>",
+		Short: "delete a group",
+		Long:  "delete a group, only the owner of the group may do this",
+		RunE:  DeleteGroup,
+		Args:  cobra.ExactArgs(2),
+	}
+}
+
+func sendGroupMessageCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "send <from> <group> <message>",
+		Short: "send message to a group",
+		Long:  "send message to all the members of a group",
+		RunE:  SendGroupMessage,
+		Args:  cobra.ExactArgs(3),
+	}
+}
+
+func showGroupsCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "show <from> [group]",
+		Short: "show the groups of a user or the messages of a group",
+		Long:  "show the groups of a user or the messages of a group",
+		RunE:  ShowGroups,
+		Args:  cobra.RangeArgs(1, 2),
+	}
+
+	c.Flags().Int("limit", chat.DefaultPageSize, "number of messages to show, 0 shows them all")
+	c.Flags().String("since", "", "show the messages since a time (RFC 3339) or for a duration (1h)")
+
+	return c
+}
+
+func CreateGroup(cmd *cobra.Command, args []string) error {
+	serverAddress, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return err
+	}
+
+	from := args[0]
+	client, err := newClient(from)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]any{"name": args[1], "members": args[2:]}
+	result := map[string]string{}
+
+	url := fmt.Sprintf("%s/groups/%s", serverAddress, from)
+	r, err := client.R().SetBody(body).SetResult(&result).Post(url)
+	if err != nil {
+		return err
+	}
+
+	if r.StatusCode() != http.StatusCreated {
+		return fmt.Errorf("error creating group:\n %s", string(r.Body()))
+	}
+
+	fmt.Printf("group %s is created with id %s\n", args[1], result["id"])
+	return nil
+}
+
+func AddMember(cmd *cobra.Command, args []string) error {
+	return changeGroup(cmd, http.MethodPost, "members", args, "%s is added to group %s\n")
+}
+
+func RemoveMember(cmd *cobra.Command, args []string) error {
+	return changeGroup(cmd, http.MethodDelete, "members", args, "%s is removed from group %s\n")
+}
+
+func GroupAdmin(cmd *cobra.Command, args []string) error {
+	revoke, err := cmd.Flags().GetBool("revoke")
+	if err != nil {
+		return err
+	}
+
+	if revoke {
+		return changeGroup(cmd, http.MethodDelete, "admins", args, "%s is no longer an admin of group %s\n")
+	}
+
+	return changeGroup(cmd, http.MethodPost, "admins", args, "%s is an admin of group %s\n")
+}
+
+// changeGroup adds the user in args to, or removes it from, the members or
+// the admins of the group.
+func changeGroup(cmd *cobra.Command, method string, what string, args []string, done string) error {
+	serverAddress, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return err
+	}
+
+	from, group, user := args[0], args[1], args[2]
+	client, err := newClient(from)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/groups/%s/%s/%s/%s", serverAddress, from, group, what, user)
+	r, err := client.R().Execute(method, url)
+	if err != nil {
+		return err
+	}
+
+	if r.StatusCode() != http.StatusOK {
+		return fmt.Errorf("error changing group %s:\n %s", group, string(r.Body()))
+	}
+
+	fmt.Printf(done, user, group)
+	return nil
+}
+
+func DeleteGroup(cmd *cobra.Command, args []string) error {
+	serverAddress, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return err
+	}
+
+	from := args[0]
+	group := args[1]
+
+	client, err := newClient(from)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/groups/%s/%s", serverAddress, from, group)
+	r, err := client.R().Delete(url)
+	if err != nil {
+		return err
+	}
+
+	if r.StatusCode() != http.StatusOK {
+		return fmt.Errorf("error deleting group:\n %s", string(r.Body()))
+	}
+
+	fmt.Printf("group %s is deleted\n", group)
+	return nil
+}
+
+func SendGroupMessage(cmd *cobra.Command, args []string) error {
+	serverAddress, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return err
+	}
+
+	user, err := loadUser(args[0])
+	if err != nil {
+		return err
+	}
+
+	accept, err := cmd.Flags().GetBool(AcceptKeyChangeFlag)
+	if err != nil {
+		return err
+	}
+
+	client := signingClient(user.ID, user.Key)
+	group, err := fetchGroup(client, serverAddress, user.ID, args[1])
+	if err != nil {
+		return err
+	}
+
+	members, err := fetchMembers(client, serverAddress, user, group.Members(), accept)
+	if err != nil {
+		return err
+	}
+
+	if e := sendGroupMessage(client, serverAddress, user, group, members, args[2]); e != nil {
+		return e
+	}
+
+	fmt.Printf("message sent from %s to group %s\n", user.ID, group.ID)
+	return nil
+}
+
+func ShowGroups(cmd *cobra.Command, args []string) error {
+	serverAddress, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return err
+	}
+
+	user, err := loadUser(args[0])
+	if err != nil {
+		return err
+	}
+
+	client := signingClient(user.ID, user.Key)
+
+	if len(args) == 1 {
+		return showAllGroups(client, serverAddress, user.ID)
+	}
+
+	query, err := pageQuery(cmd)
+	if err != nil {
+		return err
+	}
+
+	accept, err := cmd.Flags().GetBool(AcceptKeyChangeFlag)
+	if err != nil {
+		return err
+	}
+
+	return showOneGroup(client, serverAddress, user, args[1], query, accept)
+}
+
+func showAllGroups(client *resty.Client, server string, from string) error {
+	url := fmt.Sprintf("%s/groups/%s", server, from)
+	summaries := []chat.Summary{}
+	r, err := client.R().SetResult(&summaries).Get(url)
+	if err != nil {
+		return err
+	}
+
+	if r.StatusCode() != http.StatusOK {
+		return fmt.Errorf("error getting groups:\n %s", string(r.Body()))
+	}
+
+	for _, g := range summaries {
+		fmt.Printf("group: %s (%s) owner: %s members: %d messages: %d unread: %d last message: %s%s\n",
+			sanitize(g.Name), g.ID, g.Owner, len(g.Members), g.Count, g.Unread, g.LastTime.String(),
+			disappearing(g.TTL))
+	}
+
+	return nil
+}
+
+func showOneGroup(client *resty.Client, server string, user *auth.User, id string,
+	query map[string]string, accept bool,
+) error {
+	group, err := fetchGroup(client, server, user.ID, id)
+	if err != nil {
+		return err
+	}
+
+	users, err := fetchMembers(client, server, user, group.Members(), accept)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("group: %s (%s) owner: %s admins: %v members: %v%s\n",
+		sanitize(group.Name), group.ID, group.Owner, group.Admins, group.Participants, disappearing(group.TTL))
+
+	return showMessages(client, server, fmt.Sprintf("%s/groups/%s/%s", server, user.ID, group.ID), query, group,
+		users, user)
+}
+
+// sendGroupMessage encrypts the message for every member of the group, the
+// user included, signs it and sends it.
+func sendGroupMessage(client *resty.Client, server string, user *auth.User, group *chat.Session,
+	members map[string]*auth.User, message string,
+) error {
+	m, err := composeMessage(user, group.ID, group.Recipient(user.ID), message, 0, groupKeys(user, group, members)...)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/groups/%s/%s/messages", server, user.ID, group.ID)
+
+	return postMessage(client, url, m)
+}
+
+// groupKeys returns the keys of the members of the group to encrypt for.
+func groupKeys(user *auth.User, group *chat.Session, members map[string]*auth.User) []*auth.Identity {
+	keys := make([]*auth.Identity, 0, len(members))
+	for _, id := range group.Members() {
+		if id == user.ID {
+			keys = append(keys, user.Key.Public())
+			continue
+		}
+
+		keys = append(keys, members[id].Key)
+	}
+
+	return keys
+}
+
+// fetchGroup gets the group without its messages.
+func fetchGroup(client *resty.Client, server string, from string, id string) (*chat.Session, error) {
+	group := &chat.Session{}
+	url := fmt.Sprintf("%s/groups/%s/%s", server, from, id)
+	r, err := client.R().SetResult(group).Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("error getting group:\n %s", string(r.Body()))
+	}
+
+	return group, nil
+}
+
+// fetchMembers gets the members of a group and checks their keys against the
+// keys the user trusts.
+func fetchMembers(client *resty.Client, server string, user *auth.User, ids []string,
+	accept bool,
+) (map[string]*auth.User, error) {
+	members := map[string]*auth.User{user.ID: user}
+
+	for _, id := range ids {
+		if id == user.ID {
+			continue
+		}
+
+		member, err := fetchUser(client, server, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if e := checkPeer(user.ID, member, accept); e != nil {
+			return nil, e
+		}
+
+		members[id] = member
+	}
+
+	return members, nil
+}
@@ -13,13 +13,17 @@ import (
 )
 
 func listCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "list",
+	cmd := &cobra.Command{
+		Use:   "list [id]",
 		Short: "list users or a user",
 		Long:  "list a user's information or all users if no user is specified",
 		RunE:  ListUsers,
 		Args:  cobra.MaximumNArgs(1),
 	}
+
+	cmd.Flags().StringP("as", "a", "", "id of the user making the request, defaults to the listed user")
+
+	return cmd
 }
 
 func ListUsers(cmd *cobra.Command, args []string) error {
@@ -28,30 +32,56 @@ func ListUsers(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	as, err := cmd.Flags().GetString("as")
+	if err != nil {
+		return err
+	}
+
+	if as == "" && len(args) == 1 {
+		as = args[0]
+	}
+
+	if as == "" {
+		return errors.New("need the id of the user making the request, use --as")
+	}
+
+	client, err := newClient(as)
+	if err != nil {
+		return err
+	}
+
 	if len(args) == 0 {
-		return listAllUsers(server)
+		return listAllUsers(client, server)
+	}
+
+	user, err := fetchUser(client, server, args[0])
+	if err != nil {
+		return err
 	}
 
+	return PrintYaml(user)
+}
+
+// fetchUser gets a user and its public key from the server.
+func fetchUser(client *resty.Client, server string, id string) (*auth.User, error) {
 	user := &auth.User{}
-	url := fmt.Sprintf("%s/users/%s", server, args[0])
-	client := resty.New()
+	url := fmt.Sprintf("%s/users/%s", server, id)
 	r, err := client.R().SetResult(user).Get(url)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if r.StatusCode() != http.StatusOK {
-		return fmt.Errorf("unable to list user: %s", args[0])
+		return nil, fmt.Errorf("unable to list user: %s", id)
 	}
 
-	return PrintYaml(user)
+	return user, nil
 }
 
-func listAllUsers(server string) error {
+func listAllUsers(client *resty.Client, server string) error {
 	users := store.Users{}
 
 	url := server + "/users"
-	client := resty.New()
 	r, err := client.R().SetResult(&users).Get(url)
 	if err != nil {
 		return err
@@ -25,6 +25,8 @@ func NewClient() *Client {
 	}
 
 	c.rootCmd.PersistentFlags().StringP("server", "s", "http://127.0.0.1:8888", "server address")
+	c.rootCmd.PersistentFlags().Bool(AcceptKeyChangeFlag, false,
+		"use the keys of verified peers that changed without a rotation signed by the verified key")
 
 	userCmd := &cobra.Command{
 		Use:   "user",
@@ -38,8 +40,12 @@ func NewClient() *Client {
 	userCmd.AddCommand(unregisterCmd())
 	userCmd.AddCommand(listCmd())
 	userCmd.AddCommand(updateCmd())
+	userCmd.AddCommand(passwdCmd())
+	userCmd.AddCommand(verifyCmd())
 
 	c.rootCmd.AddCommand(chatCmd())
+	c.rootCmd.AddCommand(groupCmd())
+	c.rootCmd.AddCommand(adminCmd())
 
 	return c
 }
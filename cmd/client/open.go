@@ -0,0 +1,769 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// DefaultHistory is the number of messages loaded when a chat is opened, and
+// each time the user scrolls up past the oldest message loaded.
+const DefaultHistory = 50
+
+// ANSI escape sequences of the terminal UI.
+const (
+	ansiReset       = "\x1b[0m"
+	ansiDim         = "\x1b[2m"
+	ansiReverse     = "\x1b[7m"
+	ansiRed         = "\x1b[31m"
+	ansiYellow      = "\x1b[33m"
+	ansiCyan        = "\x1b[36m"
+	ansiClearLine   = "\x1b[2K"
+	ansiHome        = "\x1b[H"
+	ansiAltScreen   = "\x1b[?1049h"
+	ansiMainScreen  = "\x1b[?1049l"
+	ansiClearScreen = "\x1b[2J"
+)
+
+var ErrNotTerminal = errors.New("chat open needs a terminal")
+
+func openChatCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "open <me> <peer>",
+		Short: "open an interactive chat with another user",
+		Long: "open a full screen chat with another user. New messages show up as they arrive, " +
+			"type /help for the commands",
+		RunE: OpenChat,
+		Args: cobra.ExactArgs(2),
+	}
+}
+
+func OpenChat(cmd *cobra.Command, args []string) error {
+	serverAddress, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return err
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return ErrNotTerminal
+	}
+
+	accept, err := cmd.Flags().GetBool(AcceptKeyChangeFlag)
+	if err != nil {
+		return err
+	}
+
+	user, err := loadUser(args[0])
+	if err != nil {
+		return err
+	}
+
+	client := signingClient(user.ID, user.Key)
+	peer, err := fetchUser(client, serverAddress, args[1])
+	if err != nil {
+		return err
+	}
+
+	// The full screen hides the warnings on stderr, a changed key that is
+	// accepted stays on the status line
+	warning := ""
+	if e := checkPeer(user.ID, peer, false); errors.Is(e, ErrKeyChanged) && accept {
+		warning = fmt.Sprintf("WARNING: the key of %s changed since you verified it", peer.ID)
+	} else if e != nil {
+		return e
+	}
+
+	session, older, err := openSession(client, serverAddress, user.ID, peer.ID)
+	if err != nil {
+		return err
+	}
+
+	ui := newChatUI(user, peer, session)
+	ui.warning = warning
+	ui.older = older
+
+	return ui.run(client, serverAddress)
+}
+
+// openSession returns the session between the users with its last messages,
+// and the id to load the messages before them with, creating the session if
+// needed.
+func openSession(client *resty.Client, server string, from string, to string) (*chat.Session, uint64, error) {
+	session := chat.NewSession(from, to)
+	if session == nil {
+		return nil, 0, errors.New("cannot chat with yourself")
+	}
+
+	url := fmt.Sprintf("%s/chats/%s/%s", server, from, to)
+	page, err := fetchPage(client, url, 0)
+	if err == nil {
+		session.Messages = page.Messages
+		session.Receipts = page.Receipts
+
+		return session, olderCursor(page), nil
+	} else if !errors.Is(err, errSessionDeleted) {
+		return nil, 0, err
+	}
+
+	r, err := client.R().Post(url)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if r.StatusCode() != http.StatusCreated && r.StatusCode() != http.StatusOK {
+		return nil, 0, fmt.Errorf("error creating chat:\n %s", string(r.Body()))
+	}
+
+	return session, 0, nil
+}
+
+// fetchPage returns the last DefaultHistory messages of the chat at url
+// before the message with the id before, or the last ones if before is 0.
+func fetchPage(client *resty.Client, url string, before uint64) (*chat.Page, error) {
+	query := map[string]string{"limit": strconv.Itoa(DefaultHistory)}
+	if before > 0 {
+		query["before"] = strconv.FormatUint(before, 10)
+	}
+
+	page := &chat.Page{}
+	r, err := client.R().SetQueryParams(query).SetResult(page).Get(url + "/messages")
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.StatusCode() {
+	case http.StatusOK:
+		return page, nil
+	case http.StatusNotFound:
+		return nil, errSessionDeleted
+	default:
+		return nil, fmt.Errorf("error getting chat:\n %s", string(r.Body()))
+	}
+}
+
+// olderCursor returns the id to load the messages before the page with, 0
+// when there are none.
+func olderCursor(page *chat.Page) uint64 {
+	if len(page.Messages) < DefaultHistory || page.Start <= 1 {
+		return 0
+	}
+
+	return page.Start
+}
+
+// olderPage is a page of older messages, or the error loading it.
+type olderPage struct {
+	page *chat.Page
+	err  error
+}
+
+// uiMessage is a decrypted message as shown in the history.
+type uiMessage struct {
+	id      uint64
+	time    time.Time
+	sender  string
+	text    string
+	warning string
+}
+
+// chatUI is the full screen chat. All its state is owned by the goroutine
+// that runs it, input and network updates are passed in over channels. The
+// messages typed are sent in order by a goroutine of their own, through the
+// outbox. Older messages are loaded a page at a time as the user scrolls up
+// past them, older is the id they are loaded before and 0 once they are all
+// loaded.
+type chatUI struct {
+	user     *auth.User
+	peer     *auth.User
+	users    map[string]*auth.User
+	session  *chat.Session
+	messages []uiMessage
+	limit    int
+	older    uint64
+	loading  bool
+	atTop    bool
+	input    []rune
+	scroll   int
+	status   string
+	notice   string
+	warning  string
+	outbox   chan string
+	sending  int
+	out      *bufio.Writer
+}
+
+// OutboxSize is the number of typed messages that may wait to be sent.
+const OutboxSize = 16
+
+func newChatUI(user *auth.User, peer *auth.User, session *chat.Session) *chatUI {
+	ui := &chatUI{
+		user:     user,
+		peer:     peer,
+		users:    map[string]*auth.User{user.ID: user, peer.ID: peer},
+		session:  session,
+		messages: make([]uiMessage, 0, len(session.Messages)),
+		limit:    0,
+		older:    0,
+		loading:  false,
+		atTop:    false,
+		input:    []rune{},
+		scroll:   0,
+		status:   "connecting",
+		notice:   "type /help for the commands",
+		warning:  "",
+		outbox:   make(chan string, OutboxSize),
+		sending:  0,
+		out:      bufio.NewWriter(os.Stdout),
+	}
+
+	for i := range session.Messages {
+		ui.add(&session.Messages[i])
+	}
+
+	return ui
+}
+
+func (ui *chatUI) run(client *resty.Client, server string) error {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = term.Restore(fd, state) }()
+
+	fmt.Fprint(ui.out, ansiAltScreen)
+	defer func() {
+		fmt.Fprint(ui.out, ansiMainScreen)
+		ui.out.Flush()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := newFollower(client, server, ui.user, ui.peer.ID, ui.session.LastID())
+	go f.run(ctx)
+
+	// Messages are read as they are shown
+	chatURL := fmt.Sprintf("%s/chats/%s/%s", server, ui.user.ID, ui.peer.ID)
+	if n := len(ui.session.Messages); n > 0 {
+		last := ui.session.Messages[n-1].ID
+		go func() { _ = markRead(client, chatURL, last) }()
+	}
+
+	sent := make(chan error, OutboxSize)
+	go ui.send(ctx, client, server, sent)
+
+	pages := make(chan olderPage, 1)
+
+	keys := readKeys(os.Stdin)
+	updates := f.updates
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		ui.render()
+
+		select {
+		case k, ok := <-keys:
+			if !ok || ui.handleKey(k) {
+				return nil
+			}
+
+			if (k.code == keyUp || k.code == keyPageUp) && ui.atTop && ui.older > 0 && !ui.loading {
+				ui.loading = true
+				before := ui.older
+				go func() {
+					page, err := fetchPage(client, chatURL, before)
+					pages <- olderPage{page: page, err: err}
+				}()
+			}
+		case p := <-pages:
+			ui.prepend(p)
+		case err := <-sent:
+			ui.sending--
+			ui.notice = ""
+			if err != nil {
+				ui.notice = err.Error()
+			}
+		case u, ok := <-updates:
+			if !ok {
+				updates = nil
+				ui.status = "offline"
+				continue
+			}
+
+			ui.update(u)
+
+			if e := u.event; e != nil && e.Type == chat.EventMessage && e.Message != nil && e.Message.Sender != ui.user.ID {
+				id := e.Message.ID
+				go func() { _ = markRead(client, chatURL, id) }()
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ui *chatUI) update(u followUpdate) {
+	if u.event == nil {
+		ui.status = u.status
+		return
+	}
+
+	switch u.event.Type {
+	case chat.EventMessage:
+		if u.event.Message != nil {
+			ui.add(u.event.Message)
+		}
+	case chat.EventMessageEdited, chat.EventMessageDeleted:
+		if m := u.event.Message; m != nil {
+			ui.replace(m)
+		}
+	case chat.EventReceipt:
+		ui.session.Receipts = u.event.Receipts
+	case chat.EventPurged:
+		// Messages that disappeared on the server go from the screen too
+		ui.messages = slices.DeleteFunc(ui.messages, func(m uiMessage) bool { return m.id <= u.event.ID })
+	case chat.EventSessionDeleted:
+		ui.notice = "the chat was deleted"
+	}
+}
+
+func (ui *chatUI) add(msg *chat.Message) {
+	ui.messages = append(ui.messages, ui.read(msg))
+}
+
+// prepend shows the page of older messages above the others, the lines on
+// the screen stay where they are.
+func (ui *chatUI) prepend(p olderPage) {
+	ui.loading = false
+	if p.err != nil {
+		ui.notice = "error loading older messages: " + p.err.Error()
+		return
+	}
+
+	older := make([]uiMessage, 0, len(p.page.Messages)+len(ui.messages))
+	for i := range p.page.Messages {
+		older = append(older, ui.read(&p.page.Messages[i]))
+	}
+
+	ui.messages = append(older, ui.messages...)
+	ui.older = olderCursor(p.page)
+}
+
+// replace shows the message in place of the message with its id, messages
+// that are not shown are left out.
+func (ui *chatUI) replace(msg *chat.Message) {
+	i, ok := slices.BinarySearchFunc(ui.messages, msg.ID, func(m uiMessage, id uint64) int {
+		return cmp.Compare(m.id, id)
+	})
+	if ok {
+		ui.messages[i] = ui.read(msg)
+	}
+}
+
+func (ui *chatUI) read(msg *chat.Message) uiMessage {
+	text, warning := readMessage(msg, ui.session, ui.users, ui.user)
+
+	return uiMessage{
+		id:      msg.ID,
+		time:    msg.Time,
+		sender:  msg.Sender,
+		text:    text,
+		warning: warning,
+	}
+}
+
+// send sends the messages of the outbox one at a time, so that they keep
+// their order, and reports the result of each on sent.
+func (ui *chatUI) send(ctx context.Context, client *resty.Client, server string, sent chan<- error) {
+	for {
+		select {
+		case line := <-ui.outbox:
+			err := sendMessage(client, server, ui.user, ui.peer, line)
+
+			select {
+			case sent <- err:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleKey applies a key press, it reports true when the user quits.
+func (ui *chatUI) handleKey(k key) bool {
+	switch k.code {
+	case keyRune:
+		ui.input = append(ui.input, k.r)
+	case keyBackspace:
+		if len(ui.input) > 0 {
+			ui.input = ui.input[:len(ui.input)-1]
+		}
+	case keyClearLine:
+		ui.input = ui.input[:0]
+	case keyPageUp, keyUp:
+		ui.scroll += ui.step(k.code)
+	case keyPageDown, keyDown:
+		ui.scroll = max(0, ui.scroll-ui.step(k.code))
+	case keyInterrupt:
+		return true
+	case keyEOF:
+		return len(ui.input) == 0
+	case keyEnter:
+		line := strings.TrimSpace(string(ui.input))
+		ui.input = ui.input[:0]
+
+		if strings.HasPrefix(line, "/") {
+			return ui.command(line)
+		}
+
+		if line == "" {
+			return false
+		}
+
+		select {
+		case ui.outbox <- line:
+			ui.scroll = 0
+			ui.sending++
+			ui.notice = ""
+		default:
+			ui.input = []rune(line)
+			ui.notice = "too many messages are waiting to be sent"
+		}
+	case keyRedraw:
+		fmt.Fprint(ui.out, ansiClearScreen)
+	}
+
+	return false
+}
+
+func (ui *chatUI) step(code keyCode) int {
+	if code == keyUp || code == keyDown {
+		return 1
+	}
+
+	_, height := ui.size()
+
+	return max(1, height-4)
+}
+
+// command runs a slash command, it reports true when the user quits.
+func (ui *chatUI) command(line string) bool {
+	fields := strings.Fields(line)
+
+	switch fields[0] {
+	case "/quit", "/q", "/exit":
+		return true
+	case "/history":
+		ui.limit = 0
+		if len(fields) > 1 && fields[1] != "all" {
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n <= 0 {
+				ui.notice = "usage: /history [n|all]"
+				return false
+			}
+
+			ui.limit = n
+		}
+
+		ui.scroll = 0
+		ui.notice = fmt.Sprintf("showing %d of %d messages", len(ui.visible()), len(ui.messages))
+	case "/help":
+		ui.notice = "/quit, /history [n|all], /help; PgUp/PgDn and arrows scroll, Ctrl-L redraws"
+	default:
+		ui.notice = "unknown command " + fields[0]
+	}
+
+	return false
+}
+
+func (ui *chatUI) visible() []uiMessage {
+	if ui.limit == 0 || ui.limit >= len(ui.messages) {
+		return ui.messages
+	}
+
+	return ui.messages[len(ui.messages)-ui.limit:]
+}
+
+func (ui *chatUI) size() (int, int) {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width < 20 || height < 5 {
+		return 80, 24
+	}
+
+	return width, height
+}
+
+// render draws the whole screen: a header, the history pane, a status line
+// and the input line.
+func (ui *chatUI) render() {
+	width, height := ui.size()
+	pane := height - 3
+
+	lines := []string{}
+	for _, m := range ui.visible() {
+		lines = append(lines, ui.format(m, width)...)
+	}
+
+	ui.scroll = min(ui.scroll, max(0, len(lines)-pane))
+	end := len(lines) - ui.scroll
+	start := max(0, end-pane)
+	ui.atTop = start == 0
+
+	fmt.Fprint(ui.out, ansiHome)
+
+	title := oneLine(fmt.Sprintf(" chata: %s <-> %s", ui.user.ID, ui.peer.ID))
+	fmt.Fprint(ui.out, ansiClearLine, ansiReverse, pad(title, width), ansiReset, "\r\n")
+
+	for i := range pane {
+		fmt.Fprint(ui.out, ansiClearLine)
+		if start+i < end {
+			fmt.Fprint(ui.out, lines[start+i])
+		}
+
+		fmt.Fprint(ui.out, "\r\n")
+	}
+
+	status := "[" + ui.status + "]"
+	if ui.sending > 0 {
+		status += fmt.Sprintf(" [sending %d]", ui.sending)
+	}
+
+	if ui.scroll > 0 {
+		status += fmt.Sprintf(" [scrolled up %d lines]", ui.scroll)
+	}
+
+	if ui.notice != "" {
+		status += " " + ui.notice
+	}
+
+	// A changed key of the peer is shown for as long as the chat is open
+	style := ansiDim
+	if ui.warning != "" {
+		status = ui.warning + " " + status
+		style = ansiRed + ansiReverse
+	}
+
+	fmt.Fprint(ui.out, ansiClearLine, style, pad(oneLine(status), width), ansiReset, "\r\n")
+
+	input := ui.input[max(0, len(ui.input)-(width-3)):]
+	fmt.Fprint(ui.out, ansiClearLine, "> ", oneLine(string(input)))
+	ui.out.Flush()
+}
+
+// format returns the lines of a message wrapped to the width of the screen,
+// with the timestamp dimmed and the sender colored. The control characters
+// of the message are replaced, it starts a new line at its newlines.
+func (ui *chatUI) format(m uiMessage, width int) []string {
+	ts := m.time.Local().Format("15:04")
+	if y, d := m.time.Local().YearDay(), time.Now().YearDay(); y != d {
+		ts = m.time.Local().Format("Jan 02 15:04")
+	}
+
+	color := ansiYellow
+	if m.sender == ui.user.ID {
+		color = ansiCyan
+
+		if mark := ui.session.Status(&chat.Message{ID: m.id, Sender: m.sender}).Mark(); mark != "" {
+			m.text += " " + mark
+		}
+	}
+
+	sender := oneLine(m.sender)
+	prefix := fmt.Sprintf("[%s] %s: ", ts, sender)
+	text := strings.ReplaceAll(sanitize(m.text), "\t", "    ")
+
+	lines := []string{}
+	for _, l := range strings.Split(prefix+text, "\n") {
+		lines = append(lines, wrap(l, width)...)
+	}
+
+	if rest, ok := strings.CutPrefix(lines[0], prefix); ok {
+		lines[0] = ansiDim + "[" + ts + "] " + ansiReset + color + sender + ansiReset + ": " + rest
+	}
+
+	if m.warning != "" {
+		for _, l := range wrap("  WARNING: "+oneLine(m.warning), width) {
+			lines = append(lines, ansiRed+l+ansiReset)
+		}
+	}
+
+	return lines
+}
+
+// oneLine returns the text with its control characters replaced, to be shown
+// on a single line of the screen.
+func oneLine(text string) string {
+	return strings.NewReplacer("\n", " ", "\t", " ").Replace(sanitize(text))
+}
+
+// wrap splits the text into lines of at most width runes.
+func wrap(text string, width int) []string {
+	lines := []string{}
+	for utf8.RuneCountInString(text) > width {
+		cut := 0
+		for range width {
+			_, n := utf8.DecodeRuneInString(text[cut:])
+			cut += n
+		}
+
+		lines = append(lines, text[:cut])
+		text = text[cut:]
+	}
+
+	return append(lines, text)
+}
+
+func pad(s string, width int) string {
+	n := utf8.RuneCountInString(s)
+	if n >= width {
+		return string([]rune(s)[:width])
+	}
+
+	return s + strings.Repeat(" ", width-n)
+}
+
+type keyCode int
+
+const (
+	keyRune keyCode = iota
+	keyEnter
+	keyBackspace
+	keyClearLine
+	keyInterrupt
+	keyEOF
+	keyRedraw
+	keyUp
+	keyDown
+	keyPageUp
+	keyPageDown
+	keyIgnored
+)
+
+type key struct {
+	code keyCode
+	r    rune
+}
+
+// readKeys reads the key presses from the terminal in raw mode.
+func readKeys(in io.Reader) <-chan key {
+	keys := make(chan key, 16)
+
+	go func() {
+		defer close(keys)
+
+		buf := make([]byte, 256)
+		for {
+			n, err := in.Read(buf)
+			if err != nil {
+				return
+			}
+
+			for _, k := range parseKeys(buf[:n]) {
+				keys <- k
+			}
+		}
+	}()
+
+	return keys
+}
+
+// escapes are the escape sequences of the keys the UI knows about.
+var escapes = map[string]keyCode{
+	"[A":  keyUp,
+	"[B":  keyDown,
+	"OA":  keyUp,
+	"OB":  keyDown,
+	"[5~": keyPageUp,
+	"[6~": keyPageDown,
+}
+
+func parseKeys(b []byte) []key {
+	keys := []key{}
+
+	for len(b) > 0 {
+		switch c := b[0]; {
+		case c == 0x1b && len(b) > 1 && (b[1] == '[' || b[1] == 'O'):
+			end := escapeLen(b)
+			code, ok := escapes[string(b[1:end])]
+			if !ok {
+				code = keyIgnored
+			}
+
+			keys = append(keys, key{code: code})
+			b = b[end:]
+
+			continue
+		case c == 0x1b:
+			// A key with Alt, or ESC alone, what follows is typed
+			keys = append(keys, key{code: keyIgnored})
+		case c == '\r' || c == '\n':
+			keys = append(keys, key{code: keyEnter})
+		case c == 0x7f || c == 0x08:
+			keys = append(keys, key{code: keyBackspace})
+		case c == 0x03:
+			keys = append(keys, key{code: keyInterrupt})
+		case c == 0x04:
+			keys = append(keys, key{code: keyEOF})
+		case c == 0x0c:
+			keys = append(keys, key{code: keyRedraw})
+		case c == 0x15:
+			keys = append(keys, key{code: keyClearLine})
+		case c < 0x20:
+		default:
+			r, n := utf8.DecodeRune(b)
+			keys = append(keys, key{code: keyRune, r: r})
+			b = b[n:]
+
+			continue
+		}
+
+		b = b[1:]
+	}
+
+	return keys
+}
+
+// escapeLen returns the length of the escape sequence at the start of b,
+// which starts with ESC [ or ESC O. A CSI sequence, ESC [, has parameter and
+// intermediate bytes before its final byte, an SS3 sequence, ESC O, only a
+// final byte. A sequence ends before a byte that cannot be in it, and at the
+// end of b if it is cut short.
+func escapeLen(b []byte) int {
+	if b[1] == 'O' {
+		return min(3, len(b))
+	}
+
+	end := 2
+	for end < len(b) && b[end] >= 0x30 && b[end] <= 0x3f {
+		end++
+	}
+
+	for end < len(b) && b[end] >= 0x20 && b[end] <= 0x2f {
+		end++
+	}
+
+	if end < len(b) && b[end] >= 0x40 && b[end] <= 0x7e {
+		end++
+	}
+
+	return end
+}
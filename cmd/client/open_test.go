@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rchamarthy/chata/chat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		text    string
+		kept    string
+		oneLine string
+	}{
+		{"hello", "hello", "hello"},
+		{"two\nlines\tand a tab", "two\nlines\tand a tab", "two lines and a tab"},
+		{"\x1b[2J\x1b]0;owned\x07", "�[2J�]0;owned�", "�[2J�]0;owned�"},
+		{"back\rspace\b\x7f", "back�space��", "back�space��"},
+		{"c1 \u009b31m", "c1 �31m", "c1 �31m"},
+		{"ünïcödé ✓", "ünïcödé ✓", "ünïcödé ✓"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.kept, sanitize(test.text), "%q", test.text)
+		assert.Equal(t, test.oneLine, oneLine(test.text), "%q", test.text)
+	}
+}
+
+// runes returns the keys that type the text.
+func runes(text string) []key {
+	keys := []key{}
+	for _, r := range text {
+		keys = append(keys, key{code: keyRune, r: r})
+	}
+
+	return keys
+}
+
+func TestParseKeys(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in   string
+		keys []key
+	}{
+		{"", []key{}},
+		{"hi", []key{{code: keyRune, r: 'h'}, {code: keyRune, r: 'i'}}},
+		{"é✓", []key{{code: keyRune, r: 'é'}, {code: keyRune, r: '✓'}}},
+		{"a\r", []key{{code: keyRune, r: 'a'}, {code: keyEnter}}},
+		{"\n", []key{{code: keyEnter}}},
+		{"\x7f\x08", []key{{code: keyBackspace}, {code: keyBackspace}}},
+		{"\x03", []key{{code: keyInterrupt}}},
+		{"\x04", []key{{code: keyEOF}}},
+		{"\x0c", []key{{code: keyRedraw}}},
+		{"\x15", []key{{code: keyClearLine}}},
+		{"\x01\x1f", []key{}},
+		{"\x1b[A\x1b[B", []key{{code: keyUp}, {code: keyDown}}},
+		{"\x1b[5~\x1b[6~", []key{{code: keyPageUp}, {code: keyPageDown}}},
+		{"\x1b[1;5Cx", []key{{code: keyIgnored}, {code: keyRune, r: 'x'}}},
+		{"\x1b", []key{{code: keyIgnored}}},
+		{"\x1bOA\x1bOB", []key{{code: keyUp}, {code: keyDown}}},
+		// ESC that does not start a sequence, such as Alt, does not take the
+		// keys after it
+		{"\x1bab", []key{{code: keyIgnored}, {code: keyRune, r: 'a'}, {code: keyRune, r: 'b'}}},
+		{"\x1bhi there", append([]key{{code: keyIgnored}}, runes("hi there")...)},
+		{"\x1b\x1b[A", []key{{code: keyIgnored}, {code: keyUp}}},
+		// Final bytes are 0x40-0x7e after the parameter bytes
+		{"\x1b[\\x", []key{{code: keyIgnored}, {code: keyRune, r: 'x'}}},
+		{"\x1b[1;2\x01x", []key{{code: keyIgnored}, {code: keyRune, r: 'x'}}},
+		{"\x1b[1;2", []key{{code: keyIgnored}}},
+		{"\x1bO", []key{{code: keyIgnored}}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.keys, parseKeys([]byte(test.in)), "%q", test.in)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		text  string
+		width int
+		lines []string
+	}{
+		{"", 5, []string{""}},
+		{"short", 10, []string{"short"}},
+		{"exact", 5, []string{"exact"}},
+		{"one more", 5, []string{"one m", "ore"}},
+		{"abcdefghij", 5, []string{"abcde", "fghij"}},
+		{"ünïcödé ✓", 4, []string{"ünïc", "ödé ", "✓"}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.lines, wrap(test.text, test.width), "%q in %d", test.text, test.width)
+	}
+}
+
+func TestPad(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		s      string
+		width  int
+		padded string
+	}{
+		{"", 3, "   "},
+		{"ab", 4, "ab  "},
+		{"abc", 3, "abc"},
+		{"abcdef", 3, "abc"},
+		{"ünï", 5, "ünï  "},
+		{"✓✓✓✓", 2, "✓✓"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.padded, pad(test.s, test.width), "%q in %d", test.s, test.width)
+	}
+}
+
+func TestOlderCursor(t *testing.T) {
+	t.Parallel()
+
+	full := make([]chat.Message, DefaultHistory)
+	tests := []struct {
+		page  chat.Page
+		older uint64
+	}{
+		{chat.Page{Start: 1, Messages: []chat.Message{}}, 0},
+		{chat.Page{Start: 40, Messages: full[:10]}, 0},
+		{chat.Page{Start: 1, Messages: full}, 0},
+		{chat.Page{Start: 51, Messages: full}, 51},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.older, olderCursor(&test.page), "start %d", test.page.Start)
+	}
+}
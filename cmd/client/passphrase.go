@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// The passphrase of the private keys can be given in the environment, or in a
+// file, for scripts that cannot answer a prompt.
+const (
+	PassphraseEnv        = "CHATA_PASSPHRASE"
+	PassphraseFileEnv    = "CHATA_PASSPHRASE_FILE"
+	NewPassphraseEnv     = "CHATA_NEW_PASSPHRASE"
+	NewPassphraseFileEnv = "CHATA_NEW_PASSPHRASE_FILE"
+)
+
+var (
+	ErrNoTerminal         = errors.New("no terminal to ask for the passphrase, set " + PassphraseEnv)
+	ErrPassphraseMismatch = errors.New("passphrases do not match")
+)
+
+// passphrase returns the passphrase that unlocks the private key of the user.
+func passphrase(id string) ([]byte, error) {
+	pass, ok, err := envPassphrase(PassphraseEnv, PassphraseFileEnv)
+	if ok || err != nil {
+		return pass, err
+	}
+
+	return prompt(fmt.Sprintf("passphrase for %s: ", id))
+}
+
+// newPassphrase returns the passphrase to lock the private key of the user
+// with. The passphrase is asked twice to catch typos. An empty passphrase
+// leaves the private key unencrypted.
+func newPassphrase(id string) ([]byte, error) {
+	pass, ok, err := envPassphrase(NewPassphraseEnv, NewPassphraseFileEnv)
+	if ok || err != nil {
+		return pass, err
+	}
+
+	pass, err = prompt(fmt.Sprintf("new passphrase for %s (empty for none): ", id))
+	if err != nil {
+		return nil, err
+	}
+
+	again, err := prompt(fmt.Sprintf("repeat passphrase for %s: ", id))
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(pass, again) {
+		return nil, ErrPassphraseMismatch
+	}
+
+	return pass, nil
+}
+
+// envPassphrase reads the passphrase from the environment variable or from
+// the file named by the file variable.
+func envPassphrase(env string, fileEnv string) ([]byte, bool, error) {
+	if pass, ok := os.LookupEnv(env); ok {
+		return []byte(pass), true, nil
+	}
+
+	file := os.Getenv(fileEnv)
+	if file == "" {
+		return nil, false, nil
+	}
+
+	pass, err := os.ReadFile(file)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return bytes.TrimRight(pass, "\r\n"), true, nil
+}
+
+// prompt reads a passphrase from the terminal without echoing it.
+func prompt(msg string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, ErrNoTerminal
+	}
+
+	fmt.Fprint(os.Stderr, msg)
+	defer fmt.Fprintln(os.Stderr)
+
+	return term.ReadPassword(fd)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func passwdCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "passwd <id>",
+		Short: "change the passphrase of a user",
+		Long:  "change the passphrase that encrypts the private key of a user",
+		RunE:  ChangePassphrase,
+		Args:  cobra.ExactArgs(1),
+	}
+}
+
+func ChangePassphrase(_ *cobra.Command, args []string) error {
+	id := args[0]
+
+	user, err := loadUser(id)
+	if err != nil {
+		return err
+	}
+
+	pass, err := newPassphrase(id)
+	if err != nil {
+		return err
+	}
+
+	if e := saveUser(user, pass); e != nil {
+		return e
+	}
+
+	fmt.Printf("passphrase of user id: %s is changed\n", id)
+	return nil
+}
@@ -6,7 +6,6 @@ import (
 	"os"
 	"path"
 
-	"github.com/go-resty/resty/v2"
 	"github.com/rchamarthy/chata/auth"
 	"github.com/spf13/cobra"
 )
@@ -29,15 +28,24 @@ func RegisterUser(cmd *cobra.Command, args []string) error {
 
 	user := auth.NewUser(args[1], args[0])
 
-	if e := saveUser(user); e != nil {
+	pass, ok, err := envPassphrase(PassphraseEnv, PassphraseFileEnv)
+	if !ok && err == nil {
+		pass, err = newPassphrase(user.ID)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if e := saveUser(user, pass); e != nil {
 		return e
 	}
 
-	user.Key = user.Key.Public()
+	// The registration is signed with the new key to prove we own it
+	client := signingClient(user.ID, user.Key)
 
 	url := fmt.Sprintf("%s/users/%s", serverAddress, user.ID)
-	client := resty.New()
-	r, err := client.R().SetBody(user).Put(url)
+	r, err := client.R().SetBody(user.Public()).Put(url)
 	if err != nil {
 		return err
 	}
@@ -50,16 +58,111 @@ func RegisterUser(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func saveUser(user *auth.User) error {
-	home, err := os.UserHomeDir()
+// saveUser saves the user with the private key encrypted with the
+// passphrase. An empty passphrase saves the private key in the clear.
+func saveUser(user *auth.User, passphrase []byte) error {
+	chatDir, err := userDir()
 	if err != nil {
 		return err
 	}
 
-	chatDir := path.Join(home, ".chata")
 	if e := os.MkdirAll(chatDir, 0700); e != nil {
 		return e
 	}
 
-	return user.SaveUser(chatDir)
+	saved := user.Copy()
+	if len(passphrase) != 0 {
+		err = mapKeys(saved, func(key *auth.Identity) (*auth.Identity, error) {
+			return key.Lock(passphrase)
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "warning: the private key of %s is saved without a passphrase\n", user.ID)
+	}
+
+	return saved.SaveUser(chatDir, nil)
+}
+
+// loadUser loads the user with the private key unlocked.
+func loadUser(id string) (*auth.User, error) {
+	user, _, err := loadUserWithPassphrase(id)
+
+	return user, err
+}
+
+// loadUserWithPassphrase loads the user and also returns the passphrase that
+// unlocked the private key, to save the user again.
+func loadUserWithPassphrase(id string) (*auth.User, []byte, error) {
+	chatDir, err := userDir()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := auth.LoadUser(path.Join(chatDir, id), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !user.Key.IsLocked() {
+		return user, nil, nil
+	}
+
+	pass, err := passphrase(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = mapKeys(user, func(key *auth.Identity) (*auth.Identity, error) {
+		return key.Unlock(pass)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error unlocking the key of %s: %w", id, err)
+	}
+
+	return user, pass, nil
+}
+
+// mapKeys replaces the current and the previous keys of the user with the
+// result of f, which is called once per key.
+func mapKeys(user *auth.User, f func(*auth.Identity) (*auth.Identity, error)) error {
+	done := map[string]*auth.Identity{}
+	mapKey := func(key *auth.Identity) (*auth.Identity, error) {
+		fp, err := key.Fingerprint()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := done[fp]; !ok {
+			if done[fp], err = f(key); err != nil {
+				return nil, err
+			}
+		}
+
+		return done[fp], nil
+	}
+
+	var err error
+	if user.Key, err = mapKey(user.Key); err != nil {
+		return err
+	}
+
+	for _, rec := range user.Keys {
+		if rec.Key, err = mapKey(rec.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// userDir is where the users and their private keys are saved.
+func userDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(home, ".chata"), nil
 }
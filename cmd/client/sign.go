@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rchamarthy/chata/auth"
+)
+
+// newClient returns a REST client that signs every request as the user with
+// the private key saved in ~/.chata/<id>.
+func newClient(id string) (*resty.Client, error) {
+	user, err := loadUser(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return signingClient(user.ID, user.Key), nil
+}
+
+// signingClient returns a REST client that signs every request with key.
+func signingClient(id string, key *auth.Identity) *resty.Client {
+	client := resty.New()
+	client.SetPreRequestHook(func(_ *resty.Client, r *http.Request) error {
+		body, err := requestBody(r)
+		if err != nil {
+			return err
+		}
+
+		return key.SignRequest(id, r, body)
+	})
+
+	return client
+}
+
+// requestBody returns a copy of the body that is about to be sent.
+func requestBody(r *http.Request) ([]byte, error) {
+	if r.GetBody == nil {
+		return nil, nil
+	}
+
+	body, err := r.GetBody()
+	if err != nil || body == nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return io.ReadAll(body)
+}
+
+// signedHeader returns the headers of a signed GET request, for clients that
+// are not built with resty such as the WebSocket dialer.
+func signedHeader(id string, key *auth.Identity, url string) (http.Header, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if e := key.SignRequest(id, req, nil); e != nil {
+		return nil, e
+	}
+
+	return req.Header, nil
+}
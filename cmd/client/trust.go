@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rchamarthy/chata/auth"
+	"gopkg.in/yaml.v3"
+)
+
+// AcceptKeyChangeFlag is the flag that uses the key of a verified peer that
+// changed anyway, without verifying the peer again.
+const AcceptKeyChangeFlag = "accept-key-change"
+
+// ErrKeyChanged is returned for verified peers whose key changed without a
+// rotation signed by the verified key.
+var ErrKeyChanged = errors.New("the key of a verified peer has changed")
+
+// Trust is the key of a peer that was verified out of band.
+type Trust struct {
+	Fingerprint string    `yaml:"fingerprint"`
+	Verified    time.Time `yaml:"verified"`
+}
+
+// TrustStore has the peers verified by a user, it is saved in
+// ~/.chata/trust/<id>.
+type TrustStore map[string]*Trust
+
+func loadTrust(id string) (TrustStore, error) {
+	file, err := trustFile(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := TrustStore{}
+
+	b, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ts, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if e := yaml.Unmarshal(b, ts); e != nil {
+		return nil, fmt.Errorf("error reading %s: %w", file, e)
+	}
+
+	return ts, nil
+}
+
+func (ts TrustStore) save(id string) error {
+	file, err := trustFile(id)
+	if err != nil {
+		return err
+	}
+
+	if e := os.MkdirAll(path.Dir(file), 0700); e != nil {
+		return e
+	}
+
+	b, err := yaml.Marshal(ts)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, b, 0600)
+}
+
+func trustFile(id string) (string, error) {
+	dir, err := userDir()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(dir, "trust", id), nil
+}
+
+// checkPeer compares the key the server returned for the peer with the key
+// that was verified, if any. A key rotation signed by the verified key keeps
+// the peer verified, any other change is reported loudly because the server
+// may be swapping keys to read the messages. The key is not used until the
+// peer is verified again, unless accept is set.
+func checkPeer(id string, peer *auth.User, accept bool) error {
+	ts, err := loadTrust(id)
+	if err != nil {
+		return err
+	}
+
+	trust, ok := ts[peer.ID]
+	if !ok {
+		return nil
+	}
+
+	fp, err := peer.Key.Fingerprint()
+	if err != nil {
+		return err
+	}
+
+	if fp == trust.Fingerprint {
+		return nil
+	}
+
+	if e := peer.VerifyKeyChain(trust.Fingerprint); e != nil {
+		warnKeyChange(id, peer.ID, trust.Fingerprint, fp)
+		if accept {
+			return nil
+		}
+
+		return fmt.Errorf("%w: %s, verify it again or pass --%s", ErrKeyChanged, peer.ID, AcceptKeyChangeFlag)
+	}
+
+	fmt.Fprintf(os.Stderr, "note: %s rotated the verified key, the new key is signed by it\n", peer.ID)
+	trust.Fingerprint = fp
+
+	return ts.save(id)
+}
+
+func warnKeyChange(id string, peer string, verified string, fp string) {
+	banner := strings.Repeat("!", 72)
+	fmt.Fprintln(os.Stderr, banner)
+	fmt.Fprintf(os.Stderr, "WARNING: THE KEY OF %s HAS CHANGED SINCE YOU VERIFIED IT!\n", strings.ToUpper(peer))
+	fmt.Fprintf(os.Stderr, "verified key: %s\n", auth.FormatFingerprint(verified))
+	fmt.Fprintf(os.Stderr, "server key:   %s\n", auth.FormatFingerprint(fp))
+	fmt.Fprintln(os.Stderr, "The server may be reading or forging your messages.")
+	fmt.Fprintf(os.Stderr, "Compare the safety number with %s again: chata user verify %s %s\n", peer, id, peer)
+	fmt.Fprintln(os.Stderr, banner)
+}
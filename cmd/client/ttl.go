@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func chatTTLCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "ttl <from> <to> <ttl>",
+		Short: "make the messages of a chat disappear",
+		Long:  "make the messages of a chat disappear after a time such as 24h, off keeps them",
+		RunE:  ChatTTL,
+		Args:  cobra.ExactArgs(3),
+	}
+}
+
+func groupTTLCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "ttl <from> <group> <ttl>",
+		Short: "make the messages of a group disappear",
+		Long: "make the messages of a group disappear after a time such as 24h, off keeps them. " +
+			"Only admins of the group may do this",
+		RunE: GroupTTL,
+		Args: cobra.ExactArgs(3),
+	}
+}
+
+func ChatTTL(cmd *cobra.Command, args []string) error {
+	return setTTL(cmd, "chats", args)
+}
+
+func GroupTTL(cmd *cobra.Command, args []string) error {
+	return setTTL(cmd, "groups", args)
+}
+
+// setTTL sets the ttl of the chat or the group in args.
+func setTTL(cmd *cobra.Command, what string, args []string) error {
+	serverAddress, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return err
+	}
+
+	from, to, ttl := args[0], args[1], args[2]
+	if ttl == "off" {
+		ttl = "0"
+	}
+
+	client, err := newClient(from)
+	if err != nil {
+		return err
+	}
+
+	result := map[string]string{}
+	url := fmt.Sprintf("%s/%s/%s/%s/ttl", serverAddress, what, from, to)
+	r, err := client.R().SetBody(map[string]string{"ttl": ttl}).SetResult(&result).Put(url)
+	if err != nil {
+		return err
+	}
+
+	if r.StatusCode() != http.StatusOK {
+		return fmt.Errorf("error setting ttl:\n %s", string(r.Body()))
+	}
+
+	if result["ttl"] == "0s" {
+		fmt.Println("messages are kept")
+		return nil
+	}
+
+	fmt.Printf("messages disappear after %s\n", result["ttl"])
+	return nil
+}
+
+// disappearing returns the note shown next to a session whose messages
+// disappear.
+func disappearing(ttl time.Duration) string {
+	if ttl <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" (disappearing after %s)", ttl)
+}
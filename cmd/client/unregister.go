@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net/http"
 
-	"github.com/go-resty/resty/v2"
 	"github.com/spf13/cobra"
 )
 
@@ -26,8 +25,12 @@ func UnregisterUser(cmd *cobra.Command, args []string) error {
 
 	id := args[0]
 
+	client, err := newClient(id)
+	if err != nil {
+		return err
+	}
+
 	url := fmt.Sprintf("%s/users/%s", serverAddress, id)
-	client := resty.New()
 	r, err := client.R().Delete(url)
 	if err != nil {
 		return err
@@ -3,8 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"os"
-	"path"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/rchamarthy/chata/auth"
@@ -48,55 +47,70 @@ func UpdateUser(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	user, key, err := makeUser(args[0], name, uKey, admin)
+	current, pass, err := loadUserWithPassphrase(args[0])
 	if err != nil {
 		return err
 	}
 
+	// Sign with the current key, the server does not know the new one yet
+	client := signingClient(current.ID, current.Key)
+	user := makeUser(current, name, admin)
+
 	url := fmt.Sprintf("%s/users/%s", serverAddress, user.ID)
-	client := resty.New()
-	r, err := client.R().SetBody(user).SetResult(user).Post(url)
+	updated := &auth.User{}
+	r, err := client.R().SetBody(user.Public()).SetResult(updated).Post(url)
 	if err != nil {
 		return err
 	}
 
 	if r.StatusCode() != http.StatusOK {
-		return fmt.Errorf("error registering user:\n %s", string(r.Body()))
+		return fmt.Errorf("error updating user:\n %s", string(r.Body()))
 	}
 
-	// Save user profile with private key
+	user.Name = updated.Name
+	user.Roles = updated.Roles
+
 	if uKey {
-		user.Key = key
+		if e := rotateKey(client, serverAddress, user); e != nil {
+			return e
+		}
 	}
 
-	if e := saveUser(user); e != nil {
+	// Save user profile with the private keys
+	if e := saveUser(user, pass); e != nil {
 		return e
 	}
 
 	fmt.Printf("user with id: %s is updated\n", user.ID)
-	user.Key = user.Key.Public() // avoid printing private key
-	return PrintYaml(user)
+	return PrintYaml(user.Public()) // avoid printing private keys
 }
 
-func makeUser(id string, name string, uKey bool, admin bool) (*auth.User, *auth.Identity, error) {
-	home, err := os.UserHomeDir()
+// rotateKey replaces the key of the user with a new key, the rotation is
+// signed with the current key. The previous keys are kept to read old
+// messages.
+func rotateKey(client *resty.Client, server string, user *auth.User) error {
+	rec, err := user.RotateKey(auth.GenerateIdentity(), time.Now())
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	user, err := auth.LoadUser(path.Join(home, ".chata", id))
+	url := fmt.Sprintf("%s/users/%s/keys", server, user.ID)
+	r, err := client.R().SetBody(rec.Public()).Post(url)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	var key *auth.Identity
-	if uKey {
-		key = auth.GenerateIdentity()
-		user.Key = key.Public()
-	} else {
-		user.Key = user.Key.Public()
+	if r.StatusCode() != http.StatusOK {
+		return fmt.Errorf("error rotating key:\n %s", string(r.Body()))
 	}
 
+	return nil
+}
+
+// makeUser returns a copy of the user with the updated profile.
+func makeUser(current *auth.User, name string, admin bool) *auth.User {
+	user := current.Copy()
+
 	if admin {
 		user.Roles.Add(auth.ADMIN)
 	}
@@ -105,5 +119,5 @@ func makeUser(id string, name string, uKey bool, admin bool) (*auth.User, *auth.
 		user.Name = name
 	}
 
-	return user, key, nil
+	return user
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/spf13/cobra"
+)
+
+func verifyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify <me> <peer>",
+		Short: "verify the key of a peer",
+		Long: "show the safety number of two users and mark the peer as verified. " +
+			"Compare the safety number with the peer in person or over another channel.",
+		RunE: VerifyPeer,
+		Args: cobra.ExactArgs(2),
+	}
+
+	cmd.Flags().BoolP("yes", "y", false, "mark the peer as verified without asking")
+
+	return cmd
+}
+
+func VerifyPeer(cmd *cobra.Command, args []string) error {
+	serverAddress, err := cmd.Flags().GetString("server")
+	if err != nil {
+		return err
+	}
+
+	yes, err := cmd.Flags().GetBool("yes")
+	if err != nil {
+		return err
+	}
+
+	user, err := loadUser(args[0])
+	if err != nil {
+		return err
+	}
+
+	client := signingClient(user.ID, user.Key)
+	peer, err := fetchUser(client, serverAddress, args[1])
+	if err != nil {
+		return err
+	}
+
+	// A changed key is what verifying again is for
+	if e := checkPeer(user.ID, peer, true); e != nil {
+		return e
+	}
+
+	number, err := auth.SafetyNumber(user, peer)
+	if err != nil {
+		return err
+	}
+
+	fp, err := peer.Key.Fingerprint()
+	if err != nil {
+		return err
+	}
+
+	if e := printFingerprints(user, peer, number); e != nil {
+		return e
+	}
+
+	if !yes && !confirm(fmt.Sprintf("Does %s see the same safety number? [y/N]: ", peer.ID)) {
+		fmt.Printf("%s is not verified\n", peer.ID)
+		return nil
+	}
+
+	ts, err := loadTrust(user.ID)
+	if err != nil {
+		return err
+	}
+
+	ts[peer.ID] = &Trust{Fingerprint: fp, Verified: time.Now().UTC()}
+	if e := ts.save(user.ID); e != nil {
+		return e
+	}
+
+	fmt.Printf("%s is verified\n", peer.ID)
+	return nil
+}
+
+func printFingerprints(user *auth.User, peer *auth.User, number string) error {
+	for _, u := range []*auth.User{user, peer} {
+		fp, err := u.Key.Fingerprint()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%-12s %s\n", u.ID, auth.FormatFingerprint(fp))
+	}
+
+	fmt.Println("\nsafety number:")
+
+	groups := strings.Fields(number)
+	for len(groups) > 0 {
+		n := min(4, len(groups))
+		fmt.Printf("    %s\n", strings.Join(groups[:n], " "))
+		groups = groups[n:]
+	}
+
+	fmt.Println()
+
+	return nil
+}
+
+func confirm(msg string) bool {
+	fmt.Print(msg)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/store"
+)
+
+// CallerKey is the gin context key of the authenticated *auth.User.
+const CallerKey = "caller"
+
+// DefaultMaxBodySize bounds the body of a request unless the configuration
+// sets maxBodySize.
+const DefaultMaxBodySize = 4 << 20
+
+// Authenticator verifies that every request is signed by a registered user.
+// Bodies are read before their signature is checked, so they are read up to
+// maxBody bytes.
+type Authenticator struct {
+	db       store.UserStore
+	verifier *auth.RequestVerifier
+	maxBody  int64
+}
+
+func NewAuthenticator(db store.UserStore, maxBody int64) *Authenticator {
+	return &Authenticator{
+		db:       db,
+		verifier: auth.NewRequestVerifier(auth.DefaultClockSkew),
+		maxBody:  maxBody,
+	}
+}
+
+// Required is a middleware that rejects requests which are not signed by a
+// registered user. The authenticated user is stored in the context under
+// CallerKey.
+func (a *Authenticator) Required() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sig, err := auth.ParseRequestSignature(c.Request.Header)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, UserError{Error: err.Error()})
+			return
+		}
+
+		user := a.db.GetUser(sig.User)
+		if user == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, UserError{
+				Error: "unknown user " + sig.User,
+			})
+			return
+		}
+
+		body, err := a.readBody(c)
+		if err != nil {
+			c.AbortWithStatusJSON(bodyStatus(err), UserError{Error: err.Error()})
+			return
+		}
+
+		if err := a.verify(c, sig, user.Key, body); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, UserError{Error: err.Error()})
+			return
+		}
+
+		c.Set(CallerKey, user)
+		c.Next()
+	}
+}
+
+// VerifySelfSigned checks that a request is signed by the given user with
+// the given key. It is used to prove possession of the private key when a
+// user registers and there is no stored key to check against yet.
+func (a *Authenticator) VerifySelfSigned(c *gin.Context, user *auth.User, body []byte) error {
+	sig, err := auth.ParseRequestSignature(c.Request.Header)
+	if err != nil {
+		return err
+	}
+
+	if sig.User != user.ID {
+		return errors.New("request is not signed by " + user.ID)
+	}
+
+	return a.verify(c, sig, user.Key, body)
+}
+
+func (a *Authenticator) verify(c *gin.Context, sig *auth.RequestSignature,
+	key *auth.Identity, body []byte,
+) error {
+	return a.verifier.Verify(sig, key, c.Request.Method, c.Request.URL.RequestURI(), body)
+}
+
+// readBody returns the request body and puts it back so that handlers can
+// still bind it. Bodies over the limit of the authenticator are not read.
+func (a *Authenticator) readBody(c *gin.Context) ([]byte, error) {
+	if c.Request.Body == nil {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, a.maxBody))
+	if err != nil {
+		return nil, err
+	}
+
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
+
+// bodyStatus returns the status of a request whose body could not be read.
+func bodyStatus(err error) int {
+	if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
+
+// Caller returns the authenticated user of the request.
+func Caller(c *gin.Context) *auth.User {
+	v, ok := c.Get(CallerKey)
+	if !ok {
+		return nil
+	}
+
+	user, _ := v.(*auth.User)
+
+	return user
+}
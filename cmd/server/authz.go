@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rchamarthy/chata/auth"
+)
+
+// Authorizer enforces the role policy on the authenticated caller.
+type Authorizer struct {
+	policy auth.Policy
+}
+
+func NewAuthorizer(policy auth.Policy) *Authorizer {
+	return &Authorizer{policy: policy}
+}
+
+// Allow is a middleware that rejects callers who may not perform the action
+// on the resource owned by the user named in the owner path parameter.
+func (a *Authorizer) Allow(action auth.Action, owner string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !a.Check(c, action, c.Param(owner)) {
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Check reports whether the caller may perform the action on a resource
+// owned by owner. The request is answered with 403 when it may not.
+func (a *Authorizer) Check(c *gin.Context, action auth.Action, owner string) bool {
+	if err := a.policy.Authorize(action, Caller(c), owner); err != nil {
+		c.JSON(http.StatusForbidden, UserError{Error: err.Error()})
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/store"
+)
+
+// BackupHandler serves backups of the users and the chats to admins. Only the
+// file backend is backed up.
+type BackupHandler struct {
+	users *store.UserDB
+	chats *store.ChatDB
+}
+
+func NewBackupHandler(e *gin.Engine, users store.UserStore, chats store.ChatStore,
+	authn *Authenticator, authz *Authorizer,
+) *BackupHandler {
+	h := &BackupHandler{users: nil, chats: nil}
+	h.users, _ = users.(*store.UserDB)
+	h.chats, _ = chats.(*store.ChatDB)
+
+	api := e.Group("/admin", authn.Required())
+	api.POST("/backup", authz.Allow(auth.BackupData, ""), h.Backup)
+
+	return h
+}
+
+// Backup sends a tar.gz backup of the users and the chats as they are at the
+// time of the request. The backup is taken into a temporary file first, so
+// that a slow download does not hold the stores up.
+func (h *BackupHandler) Backup(c *gin.Context) {
+	if h.users == nil || h.chats == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{
+			"error": "backups are only supported by the file backend",
+		})
+		return
+	}
+
+	f, err := os.CreateTemp("", "chata-backup-*.tar.gz")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	m, err := store.Backup(f, h.users, h.chats)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	name := fmt.Sprintf("chata-backup-%s.tar.gz", m.Created.Format("20060102T150405Z"))
+	c.DataFromReader(http.StatusOK, size, "application/gzip", f, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=%q", name),
+	})
+}
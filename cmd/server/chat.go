@@ -2,40 +2,54 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rchamarthy/chata/auth"
 	"github.com/rchamarthy/chata/chat"
 	"github.com/rchamarthy/chata/store"
 )
 
+// MaxIdempotencyKey bounds the length of the client id of a message.
+const MaxIdempotencyKey = 128
+
 type ChatHandler struct {
-	chatDir string
-	db      *store.ChatDB
-	userDB  *store.UserDB
+	db     store.ChatStore
+	userDB store.UserStore
+	authz  *Authorizer
+	hub    *chat.Hub
 }
 
-func NewChatHandler(e *gin.Engine, config *Config, userDB *store.UserDB) *ChatHandler {
+func NewChatHandler(e *gin.Engine, db store.ChatStore, userDB store.UserStore,
+	authn *Authenticator, authz *Authorizer,
+) *ChatHandler {
 	c := &ChatHandler{
-		chatDir: config.ChatsDir,
-		db:      store.NewChatDB(config.ChatsDir),
-		userDB:  userDB,
+		db:     db,
+		userDB: userDB,
+		authz:  authz,
+		hub:    chat.NewHub(chat.DefaultEventBuffer),
 	}
 
-	if e := c.db.Init(); e != nil {
-		panic(e)
-	}
+	go store.CompactEvery(context.Background(), c.db, store.DefaultCompactInterval)
 
-	if e := c.db.Load(context.Background()); e != nil {
-		panic(e)
-	}
+	api := e.Group("/", authn.Required())
+	api.GET("/chats/:from/:to", authz.Allow(auth.ReadChat, "from"), c.GetChatForUserAndPeer)
+	api.GET("/chats/:from/:to/events", authz.Allow(auth.ReadChat, "from"), c.Events)
+	api.GET("/chats/:from/:to/messages", authz.Allow(auth.ReadChat, "from"), c.GetMessages)
+	api.GET("/chats/:from", authz.Allow(auth.ListChats, "from"), c.GetAllChatsForUser)
+	api.POST("/chats/:from/:to", authz.Allow(auth.CreateChat, "from"), c.AddChat)
+	api.DELETE("/chats/:from/:to", authz.Allow(auth.DeleteChat, "from"), c.DeleteChat)
+	api.POST("/message/:from/:to", authz.Allow(auth.SendMessage, "from"), c.SendMessage)
 
-	e.GET("/chats/:from/:to", c.GetChatForUserAndPeer)
-	e.GET("/chats/:from", c.GetAllChatsForUser)
-	e.POST("/chats/:from/:to", c.AddChat)
-	e.DELETE("/chats/:from/:to", c.DeleteChat)
-	e.POST("/message/:from/:to", c.SendMessage)
+	c.registerGroups(api, authz)
+	c.registerChanges(api, authz)
+	c.registerReceipts(api, authz)
+	c.registerTTL(api, authz)
 
 	return c
 }
@@ -58,6 +72,8 @@ func (h *ChatHandler) GetChatForUserAndPeer(c *gin.Context) {
 		return
 	}
 
+	markDelivered(h.db, h.hub, chat, from, chat.Messages)
+
 	c.JSON(http.StatusOK, chat)
 }
 
@@ -78,7 +94,18 @@ func (h *ChatHandler) GetAllChatsForUser(c *gin.Context) {
 		})
 		return
 	}
-	c.JSON(http.StatusOK, chats)
+
+	summaries := make([]chat.Summary, 0, len(chats))
+	for _, session := range chats {
+		summaries = append(summaries, session.Summarize(from))
+	}
+
+	// Most recent first
+	slices.SortFunc(summaries, func(a, b chat.Summary) int {
+		return b.LastTime.Compare(a.LastTime)
+	})
+
+	c.JSON(http.StatusOK, summaries)
 }
 
 func (h *ChatHandler) AddChat(c *gin.Context) {
@@ -118,6 +145,8 @@ func (h *ChatHandler) AddChat(c *gin.Context) {
 		return
 	}
 
+	// The store owns the session once it is added
+	event := chat.NewSessionEvent(chat.EventSessionCreated, chatSession)
 	if e := h.db.Add(chatSession); e != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": e.Error(),
@@ -125,8 +154,10 @@ func (h *ChatHandler) AddChat(c *gin.Context) {
 		return
 	}
 
+	h.hub.Publish(event)
+
 	c.JSON(http.StatusCreated, gin.H{
-		"id": chatSession.ID,
+		"id": event.Session,
 	})
 }
 
@@ -140,6 +171,8 @@ func (h *ChatHandler) DeleteChat(c *gin.Context) {
 		return
 	}
 
+	session := h.db.Get(from, to)
+
 	if e := h.db.Delete(from, to); e != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": e.Error(),
@@ -147,6 +180,8 @@ func (h *ChatHandler) DeleteChat(c *gin.Context) {
 		return
 	}
 
+	h.hub.Publish(chat.NewSessionEvent(chat.EventSessionDeleted, session))
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 	})
@@ -170,52 +205,170 @@ func (h *ChatHandler) SendMessage(c *gin.Context) {
 		return
 	}
 
-	message := struct {
-		Text string `json:"text"`
-	}{}
+	h.appendMessage(c, session, from)
+}
 
-	if e := c.BindJSON(&message); e != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": e.Error(),
-		})
+// appendMessage adds the signed and encrypted message in the body of the
+// request from the sender to the session and publishes it to the members.
+func (h *ChatHandler) appendMessage(c *gin.Context, session *chat.Session, from string) {
+	msg, ok := h.bindMessage(c, session, from, 0)
+	if !ok {
 		return
 	}
 
-	if message.Text == "" {
+	clientID, err := idempotencyKey(c, msg.ClientID)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "message is not specified",
+			"error": err.Error(),
 		})
 		return
 	}
 
-	session.AddMessage(from, message.Text)
+	msg.ClientID = clientID
 
-	if e := session.Save(h.chatDir); e != nil {
+	session, msg, err = h.db.AppendMessage(session.ID, msg)
+	if errors.Is(err, chat.ErrDuplicateMessage) {
+		// A retry of a message that made it, answer as the first time
+		c.JSON(http.StatusOK, gin.H{
+			"success":   true,
+			"id":        msg.ID,
+			"duplicate": true,
+		})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": e.Error(),
+			"error": err.Error(),
 		})
 		return
 	}
 
+	h.hub.Publish(chat.NewMessageEvent(session, msg))
+
 	c.JSON(http.StatusOK, gin.H{
-		"success": true,
+		"success":   true,
+		"id":        msg.ID,
+		"duplicate": false,
 	})
 }
 
-func (h *ChatHandler) ValidUsers(c *gin.Context, from string, to string) bool {
-	if u := h.userDB.GetUser(from); u == nil {
+// bindMessage reads the message in the body of the request and checks that
+// it is encrypted for the members of the session and signed by the sender.
+// A message that is an edit replaces the message with the id replaces. The
+// request is answered if the message is not valid.
+func (h *ChatHandler) bindMessage(c *gin.Context, session *chat.Session, from string,
+	replaces uint64,
+) (chat.Message, bool) {
+	message := struct {
+		Text      string         `json:"text"`
+		ClientID  string         `json:"clientId"`
+		Time      time.Time      `json:"time"`
+		Envelope  *auth.Envelope `json:"envelope"`
+		Signature auth.Bytes     `json:"signature"`
+	}{}
+
+	if e := c.BindJSON(&message); e != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": fmt.Sprintf("user %s does not exist", from),
+			"error": e.Error(),
 		})
-		return false
+		return chat.Message{}, false
+	}
+
+	if message.Text != "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "plaintext messages are not accepted, encrypt the message",
+		})
+		return chat.Message{}, false
 	}
 
-	if u := h.userDB.GetUser(to); u == nil {
+	members := session.Members()
+	if !h.sealedFor(message.Envelope, members...) {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": fmt.Sprintf("user %s does not exist", to),
+			"error": fmt.Sprintf("message must be encrypted for %s", strings.Join(members, ", ")),
 		})
+		return chat.Message{}, false
+	}
+
+	if d := time.Since(message.Time); d > auth.DefaultClockSkew || d < -auth.DefaultClockSkew {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "message time is outside the allowed clock skew",
+		})
+		return chat.Message{}, false
+	}
+
+	msg := chat.Message{
+		ID:        0,
+		ClientID:  message.ClientID,
+		Sender:    from,
+		Time:      message.Time,
+		Envelope:  message.Envelope,
+		Signature: message.Signature,
+		Replaces:  replaces,
+	}
+
+	key, err := h.userDB.GetUser(from).KeyAt(msg.Time)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return chat.Message{}, false
+	}
+
+	if e := msg.Verify(session.ID, session.Recipient(from), key); e != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad message signature: " + e.Error(),
+		})
+		return chat.Message{}, false
+	}
+
+	return msg, true
+}
+
+// idempotencyKey returns the client id of a message, from the message or
+// from the Idempotency-Key header.
+func idempotencyKey(c *gin.Context, clientID string) (string, error) {
+	key := c.GetHeader(chat.IdempotencyKeyHeader)
+
+	switch {
+	case key == "":
+		key = clientID
+	case clientID != "" && clientID != key:
+		return "", fmt.Errorf("%s does not match the client id of the message", chat.IdempotencyKeyHeader)
+	}
+
+	if len(key) > MaxIdempotencyKey {
+		return "", fmt.Errorf("client id is longer than %d bytes", MaxIdempotencyKey)
+	}
+
+	return key, nil
+}
+
+// sealedFor reports whether every participant is able to open the envelope.
+func (h *ChatHandler) sealedFor(env *auth.Envelope, participants ...string) bool {
+	if env == nil || len(env.Keys) != len(participants) {
 		return false
 	}
 
+	for _, id := range participants {
+		u := h.userDB.GetUser(id)
+		if u == nil || !env.IsRecipient(u.Key) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ValidUsers reports whether all the users exist and answers the request
+// if one does not.
+func (h *ChatHandler) ValidUsers(c *gin.Context, users ...string) bool {
+	for _, id := range users {
+		if u := h.userDB.GetUser(id); u == nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("user %s does not exist", id),
+			})
+			return false
+		}
+	}
+
 	return true
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/rchamarthy/chata/store"
+)
+
+func (h *ChatHandler) registerChanges(api *gin.RouterGroup, authz *Authorizer) {
+	api.PATCH("/chats/:from/:to/messages/:msgID", authz.Allow(auth.EditMessage, "from"), h.EditMessage)
+	api.DELETE("/chats/:from/:to/messages/:msgID", authz.Allow(auth.DeleteMessage, "from"), h.DeleteMessage)
+	api.PATCH("/groups/:from/:id/messages/:msgID", authz.Allow(auth.EditMessage, "from"), h.EditGroupMessage)
+	api.DELETE("/groups/:from/:id/messages/:msgID", authz.Allow(auth.DeleteMessage, "from"), h.DeleteGroupMessage)
+}
+
+// EditMessage replaces a message of from with the signed and encrypted
+// revision in the body.
+func (h *ChatHandler) EditMessage(c *gin.Context) {
+	session := h.chatSession(c)
+	if session == nil {
+		return
+	}
+
+	h.editMessage(c, session)
+}
+
+// DeleteMessage deletes a message. Senders delete their own messages and
+// admins delete any message.
+func (h *ChatHandler) DeleteMessage(c *gin.Context) {
+	session := h.chatSession(c)
+	if session == nil {
+		return
+	}
+
+	h.deleteMessage(c, session)
+}
+
+func (h *ChatHandler) EditGroupMessage(c *gin.Context) {
+	group := h.memberGroup(c)
+	if group == nil {
+		return
+	}
+
+	h.editMessage(c, group)
+}
+
+// DeleteGroupMessage deletes a message of a group, the admins of the group
+// may delete any message of the group.
+func (h *ChatHandler) DeleteGroupMessage(c *gin.Context) {
+	group := h.memberGroup(c)
+	if group == nil {
+		return
+	}
+
+	h.deleteMessage(c, group)
+}
+
+// chatSession returns the chat between from and to of the request.
+func (h *ChatHandler) chatSession(c *gin.Context) *chat.Session {
+	session := h.db.Get(c.Param("from"), c.Param("to"))
+	if session == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "chat not found",
+		})
+		return nil
+	}
+
+	return session
+}
+
+func (h *ChatHandler) editMessage(c *gin.Context, session *chat.Session) {
+	id, ok := messageID(c)
+	if !ok {
+		return
+	}
+
+	revision, ok := h.bindMessage(c, session, c.Param("from"), id)
+	if !ok {
+		return
+	}
+
+	h.changeMessage(c, session, chat.NewEdit(revision))
+}
+
+func (h *ChatHandler) deleteMessage(c *gin.Context, session *chat.Session) {
+	id, ok := messageID(c)
+	if !ok {
+		return
+	}
+
+	i, found := session.Find(id)
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": chat.ErrNoMessage.Error(),
+		})
+		return
+	}
+
+	caller := Caller(c)
+	if !session.IsAdmin(caller.ID) && !h.authz.Check(c, auth.DeleteMessage, session.Messages[i].Sender) {
+		return
+	}
+
+	h.changeMessage(c, session, chat.NewDelete(id, caller.ID, time.Now()))
+}
+
+// changeMessage applies the change, publishes it to the members of the
+// session and answers with the changed message.
+func (h *ChatHandler) changeMessage(c *gin.Context, session *chat.Session, change chat.Change) {
+	session, msg, err := h.db.ChangeMessage(session.ID, change)
+	if err != nil {
+		c.JSON(changeStatus(err), gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	h.hub.Publish(chat.NewChangeEvent(session, msg))
+
+	c.JSON(http.StatusOK, msg)
+}
+
+// messageID returns the id of the message in the request, the request is
+// answered if it is not a valid id.
+func messageID(c *gin.Context) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param("msgID"), 10, 64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad message id " + c.Param("msgID"),
+		})
+		return 0, false
+	}
+
+	return id, true
+}
+
+func changeStatus(err error) int {
+	switch {
+	case errors.Is(err, chat.ErrNoMessage), errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, chat.ErrNotSender):
+		return http.StatusForbidden
+	case errors.Is(err, chat.ErrMessageDeleted):
+		return http.StatusConflict
+	case errors.Is(err, chat.ErrBadChange):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rchamarthy/chata/store"
+	"github.com/spf13/cobra"
+)
+
+func fsckCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "fsck <config-file>",
+		Short: "check the data of the server",
+		Long: "check the data directories of the server for files left by crashes and corrupt files, " +
+			"--repair removes the former and quarantines the latter. Stop the server first",
+		RunE: Fsck,
+		Args: cobra.ExactArgs(1),
+	}
+
+	c.Flags().Bool("repair", false, "repair the problems that are found")
+
+	return c
+}
+
+func Fsck(cmd *cobra.Command, args []string) error {
+	repair, err := cmd.Flags().GetBool("repair")
+	if err != nil {
+		return err
+	}
+
+	cfg, err := LoadConfig(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+
+	problems := []store.Problem{}
+	switch cfg.Backend {
+	case store.BackendMemory:
+		fmt.Println("the memory backend keeps nothing to check")
+		return nil
+	case store.BackendBolt:
+		problems, err = store.CheckBolt(cfg.Database)
+	default:
+		problems, err = checkDirs(cfg, repair)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	left := 0
+	for _, p := range problems {
+		if p.Repair == "" {
+			left++
+		}
+	}
+
+	switch {
+	case len(problems) == 0:
+		fmt.Println("no problems found")
+	case left == 0:
+		fmt.Printf("%d problems repaired\n", len(problems))
+	case repair:
+		return fmt.Errorf("%d problems found, %d cannot be repaired", len(problems), left)
+	default:
+		return fmt.Errorf("%d problems found, run with --repair to repair them", len(problems))
+	}
+
+	return nil
+}
+
+// checkDirs checks the users and the chats directories of the file backend.
+func checkDirs(cfg *Config, repair bool) ([]store.Problem, error) {
+	sealer, err := cfg.Sealer()
+	if err != nil {
+		return nil, err
+	}
+
+	problems, err := store.CheckUsers(cfg.UsersDir, sealer, repair)
+	if err != nil {
+		return problems, err
+	}
+
+	chats, err := store.CheckChats(cfg.ChatsDir, sealer, repair)
+
+	return append(problems, chats...), err
+}
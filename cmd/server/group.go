@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+)
+
+func (h *ChatHandler) registerGroups(api *gin.RouterGroup, authz *Authorizer) {
+	api.POST("/groups/:from", authz.Allow(auth.CreateChat, "from"), h.CreateGroup)
+	api.GET("/groups/:from", authz.Allow(auth.ListChats, "from"), h.GetAllGroupsForUser)
+	api.GET("/groups/:from/:id", authz.Allow(auth.ReadChat, "from"), h.GetGroup)
+	api.DELETE("/groups/:from/:id", authz.Allow(auth.DeleteChat, "from"), h.DeleteGroup)
+	api.POST("/groups/:from/:id/members/:user", authz.Allow(auth.CreateChat, "from"), h.AddMember)
+	api.DELETE("/groups/:from/:id/members/:user", authz.Allow(auth.CreateChat, "from"), h.RemoveMember)
+	api.POST("/groups/:from/:id/admins/:user", authz.Allow(auth.CreateChat, "from"), h.SetAdmin)
+	api.DELETE("/groups/:from/:id/admins/:user", authz.Allow(auth.CreateChat, "from"), h.SetAdmin)
+	api.GET("/groups/:from/:id/messages", authz.Allow(auth.ReadChat, "from"), h.GetGroupMessages)
+	api.POST("/groups/:from/:id/messages", authz.Allow(auth.SendMessage, "from"), h.SendGroupMessage)
+}
+
+// CreateGroup creates a group owned by from with the members in the body.
+func (h *ChatHandler) CreateGroup(c *gin.Context) {
+	from := c.Param("from")
+
+	body := struct {
+		Name    string   `json:"name"`
+		Members []string `json:"members"`
+	}{}
+
+	if e := c.BindJSON(&body); e != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": e.Error(),
+		})
+		return
+	}
+
+	if body.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "group name is not specified",
+		})
+		return
+	}
+
+	if !h.ValidUsers(c, append([]string{from}, body.Members...)...) {
+		return
+	}
+
+	group, err := chat.NewGroup(from, body.Name, body.Members...)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// The store owns the group once it is added
+	event := chat.NewSessionEvent(chat.EventSessionCreated, group)
+	if e := h.db.Add(group); e != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": e.Error(),
+		})
+		return
+	}
+
+	h.hub.Publish(event)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id": event.Session,
+	})
+}
+
+// GetAllGroupsForUser returns the summaries of the groups of from, the most
+// recent first.
+func (h *ChatHandler) GetAllGroupsForUser(c *gin.Context) {
+	from := c.Param("from")
+	groups := h.db.GetGroupsByUser(from)
+
+	summaries := make([]chat.Summary, 0, len(groups))
+	for _, group := range groups {
+		summaries = append(summaries, group.Summarize(from))
+	}
+
+	slices.SortFunc(summaries, func(a, b chat.Summary) int {
+		return b.LastTime.Compare(a.LastTime)
+	})
+
+	c.JSON(http.StatusOK, summaries)
+}
+
+// GetGroup returns the group without its messages, they are read a page at a
+// time with GetGroupMessages.
+func (h *ChatHandler) GetGroup(c *gin.Context) {
+	group := h.memberGroup(c)
+	if group == nil {
+		return
+	}
+
+	metadata := group.Snapshot()
+	metadata.Messages = []chat.Message{}
+
+	c.JSON(http.StatusOK, metadata)
+}
+
+// DeleteGroup deletes the group, only its owner may do this.
+func (h *ChatHandler) DeleteGroup(c *gin.Context) {
+	group := h.memberGroup(c)
+	if group == nil {
+		return
+	}
+
+	if group.Owner != c.Param("from") {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": chat.ErrNotOwner.Error(),
+		})
+		return
+	}
+
+	if e := h.db.DeleteByID(group.ID); e != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": e.Error(),
+		})
+		return
+	}
+
+	h.hub.Publish(chat.NewSessionEvent(chat.EventSessionDeleted, group))
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+	})
+}
+
+// AddMember adds a user to the group, from must be an admin of the group.
+func (h *ChatHandler) AddMember(c *gin.Context) {
+	from := c.Param("from")
+	user := c.Param("user")
+
+	if !h.ValidUsers(c, user) {
+		return
+	}
+
+	h.updateMembers(c, func(g *chat.Session) error {
+		return g.AddMember(from, user)
+	})
+}
+
+// RemoveMember removes a user from the group, members leave a group by
+// removing themselves.
+func (h *ChatHandler) RemoveMember(c *gin.Context) {
+	from := c.Param("from")
+	user := c.Param("user")
+
+	h.updateMembers(c, func(g *chat.Session) error {
+		return g.RemoveMember(from, user)
+	}, user)
+}
+
+// SetAdmin grants the admin role to a member with POST and revokes it with
+// DELETE, from must be the owner of the group.
+func (h *ChatHandler) SetAdmin(c *gin.Context) {
+	from := c.Param("from")
+	user := c.Param("user")
+	admin := c.Request.Method == http.MethodPost
+
+	h.updateMembers(c, func(g *chat.Session) error {
+		return g.SetAdmin(from, user, admin)
+	})
+}
+
+func (h *ChatHandler) SendGroupMessage(c *gin.Context) {
+	group := h.memberGroup(c)
+	if group == nil {
+		return
+	}
+
+	h.appendMessage(c, group, c.Param("from"))
+}
+
+// memberGroup returns the group of the request if from is a member of it.
+// Groups of other users are not found.
+func (h *ChatHandler) memberGroup(c *gin.Context) *chat.Session {
+	group := h.groupFinder(c.Param("from"), c.Param("id"))()
+	if group == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": errGroupGone.Error(),
+		})
+		return nil
+	}
+
+	return group
+}
+
+// updateMembers changes the members of the group of the request and tells
+// the members, and the users that were removed, about the change.
+func (h *ChatHandler) updateMembers(c *gin.Context, update func(g *chat.Session) error, removed ...string) {
+	group := h.memberGroup(c)
+	if group == nil {
+		return
+	}
+
+	group, err := h.db.UpdateMembers(group.ID, update)
+	if err != nil {
+		c.JSON(membershipStatus(err), gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	event := chat.NewSessionEvent(chat.EventMembers, group)
+	event.Users = append(event.Users, removed...)
+	h.hub.Publish(event)
+
+	c.JSON(http.StatusOK, group)
+}
+
+func membershipStatus(err error) int {
+	switch {
+	case errors.Is(err, chat.ErrNotAdmin), errors.Is(err, chat.ErrNotOwner), errors.Is(err, chat.ErrKickOwner):
+		return http.StatusForbidden
+	case errors.Is(err, chat.ErrNotMember):
+		return http.StatusNotFound
+	case errors.Is(err, chat.ErrAlreadyMember), errors.Is(err, chat.ErrGroupFull):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/chat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createGroup creates a group of the owner with the members and returns its
+// id.
+func (s *testServer) createGroup(t *testing.T, owner string, name string, members ...string) string {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]any{"name": name, "members": members})
+	require.NoError(t, err)
+
+	w := s.request(t, owner, http.MethodPost, "/groups/"+owner, body, nil)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	created := struct {
+		ID string `json:"id"`
+	}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+
+	return created.ID
+}
+
+func TestGroupMessages(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	s := newTestServer(t, DefaultMaxBodySize, "alice", "bob", "carol")
+	id := s.createGroup(t, "alice", "team", "bob")
+
+	for _, body := range []string{"1", "2", "3", "4", "5"} {
+		_, _, err := s.chats.db.AppendMessage(id, chat.Message{Sender: "alice", Body: body, Time: time.Now()})
+		require.NoError(err)
+	}
+
+	// The list and the group come without their messages
+	w := s.request(t, "bob", http.MethodGet, "/groups/bob", nil, nil)
+	require.Equal(http.StatusOK, w.Code)
+	summaries := []chat.Summary{}
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &summaries))
+	require.Len(summaries, 1)
+	require.Equal(id, summaries[0].ID)
+	require.Equal("alice", summaries[0].Owner)
+	require.Equal(5, summaries[0].Count)
+	require.Equal(5, summaries[0].Unread)
+	require.Equal("5", summaries[0].Last.Body)
+
+	w = s.request(t, "bob", http.MethodGet, "/groups/bob/"+id, nil, nil)
+	require.Equal(http.StatusOK, w.Code)
+	group := chat.Session{}
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &group))
+	require.Equal([]string{"alice", "bob"}, group.Members())
+	require.Empty(group.Messages)
+
+	// Messages come a page at a time with the cursors of chats
+	page := decodePage(t, s.request(t, "bob", http.MethodGet, "/groups/bob/"+id+"/messages?limit=2", nil, nil))
+	require.Equal([]string{"4", "5"}, pageBodies(page))
+	require.Equal(5, page.Unread)
+	page = decodePage(t, s.request(t, "bob", http.MethodGet, "/groups/bob/"+id+"/messages?before=4", nil, nil))
+	require.Equal([]string{"1", "2", "3"}, pageBodies(page))
+	page = decodePage(t, s.request(t, "bob", http.MethodGet, "/groups/bob/"+id+"/messages?after=3&wait=0s", nil, nil))
+	require.Equal([]string{"4", "5"}, pageBodies(page))
+
+	// A long-poll wakes up for a new message of the group
+	req := s.signed(t, "bob", http.MethodGet, "/groups/bob/"+id+"/messages?after=5&wait=10s", nil, nil)
+	done := make(chan *http.Response)
+	go func() { done <- s.serve(req).Result() }()
+
+	require.Eventually(func() bool { return s.chats.hub.Subscribers("bob") > 0 }, 5*time.Second, time.Millisecond)
+	session, m, err := s.chats.db.AppendMessage(id, chat.Message{Sender: "alice", Body: "6", Time: time.Now()})
+	require.NoError(err)
+	s.chats.hub.Publish(chat.NewMessageEvent(session, m))
+
+	r := <-done
+	defer r.Body.Close()
+	require.Equal(http.StatusOK, r.StatusCode)
+	page = chat.Page{}
+	require.NoError(json.NewDecoder(r.Body).Decode(&page))
+	require.Equal([]string{"6"}, pageBodies(page))
+
+	// Other users do not find the group
+	for _, uri := range []string{"/groups/carol/" + id, "/groups/carol/" + id + "/messages"} {
+		w := s.request(t, "carol", http.MethodGet, uri, nil, nil)
+		assert.Equal(t, http.StatusNotFound, w.Code, uri)
+	}
+
+	w = s.request(t, "bob", http.MethodGet, "/groups/bob/"+id+"/messages?before=0", nil, nil)
+	require.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestCreateGroup(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	s := newTestServer(t, DefaultMaxBodySize, "alice", "bob", "carol")
+	id := s.createGroup(t, "alice", "team", "bob", "carol")
+
+	group := s.chats.db.GetByID(id)
+	require.NotNil(group)
+	require.Equal("team", group.Name)
+	require.Equal("alice", group.Owner)
+	require.Equal([]string{"alice", "bob", "carol"}, group.Members())
+
+	tests := []struct {
+		user   string
+		uri    string
+		body   string
+		status int
+	}{
+		{"alice", "/groups/alice", `{"members":["bob"]}`, http.StatusBadRequest},
+		{"alice", "/groups/alice", `{"name":"team","members":["nobody"]}`, http.StatusBadRequest},
+		{"alice", "/groups/alice", `not json`, http.StatusBadRequest},
+		// Groups are only created for the caller
+		{"bob", "/groups/alice", `{"name":"team","members":["bob"]}`, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		w := s.request(t, test.user, http.MethodPost, test.uri, []byte(test.body), nil)
+		assert.Equal(t, test.status, w.Code, test.body)
+	}
+
+	require.Len(s.chats.db.GetGroupsByUser("alice"), 1)
+}
+
+func TestGroupMembers(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	s := newTestServer(t, DefaultMaxBodySize, "alice", "bob", "carol", "dave")
+	id := s.createGroup(t, "alice", "team", "bob")
+	members := func() []string { return s.chats.db.GetByID(id).Members() }
+	change := func(user string, method string, what string, member string) int {
+		return s.request(t, user, method, "/groups/"+user+"/"+id+"/"+what+"/"+member, nil, nil).Code
+	}
+
+	// Admins add and remove members, other members may not
+	require.Equal(http.StatusOK, change("alice", http.MethodPost, "members", "carol"))
+	require.Equal([]string{"alice", "bob", "carol"}, members())
+	require.Equal(http.StatusForbidden, change("bob", http.MethodPost, "members", "dave"))
+	require.Equal(http.StatusForbidden, change("bob", http.MethodDelete, "members", "carol"))
+	require.Equal(http.StatusForbidden, change("bob", http.MethodPost, "admins", "carol"))
+	require.Equal(http.StatusConflict, change("alice", http.MethodPost, "members", "bob"))
+	require.Equal(http.StatusBadRequest, change("alice", http.MethodPost, "members", "nobody"))
+
+	require.Equal(http.StatusOK, change("alice", http.MethodPost, "admins", "bob"))
+	require.Equal(http.StatusOK, change("bob", http.MethodPost, "members", "dave"))
+	require.Equal([]string{"alice", "bob", "carol", "dave"}, members())
+
+	// Users that are not members do not find the group
+	w := s.request(t, "dave", http.MethodGet, "/groups/dave/"+id, nil, nil)
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal(http.StatusOK, change("bob", http.MethodDelete, "members", "dave"))
+	w = s.request(t, "dave", http.MethodGet, "/groups/dave/"+id, nil, nil)
+	require.Equal(http.StatusNotFound, w.Code)
+	require.Equal(http.StatusNotFound, change("dave", http.MethodDelete, "members", "dave"))
+	w = s.request(t, "dave", http.MethodPost, "/groups/dave/"+id+"/messages", []byte(`{}`), nil)
+	require.Equal(http.StatusNotFound, w.Code)
+
+	// Members leave by removing themselves, the owner cannot be removed
+	require.Equal(http.StatusOK, change("carol", http.MethodDelete, "members", "carol"))
+	require.Equal([]string{"alice", "bob"}, members())
+	require.Equal(http.StatusForbidden, change("bob", http.MethodDelete, "members", "alice"))
+
+	// Only the owner deletes the group
+	w = s.request(t, "bob", http.MethodDelete, "/groups/bob/"+id, nil, nil)
+	require.Equal(http.StatusForbidden, w.Code)
+	require.NotNil(s.chats.db.GetByID(id))
+	w = s.request(t, "alice", http.MethodDelete, "/groups/alice/"+id, nil, nil)
+	require.Equal(http.StatusOK, w.Code)
+	require.Nil(s.chats.db.GetByID(id))
+	w = s.request(t, "bob", http.MethodGet, "/groups/bob/"+id, nil, nil)
+	require.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestGroupMembersEvent(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	s := newTestServer(t, DefaultMaxBodySize, "alice", "bob", "carol")
+	id := s.createGroup(t, "alice", "team", "bob", "carol")
+
+	subs := map[string]*chat.Subscription{}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		subs[user] = s.chats.hub.Subscribe(user)
+		defer subs[user].Close()
+	}
+
+	w := s.request(t, "alice", http.MethodDelete, "/groups/alice/"+id+"/members/carol", nil, nil)
+	require.Equal(http.StatusOK, w.Code)
+
+	// The members are told, and so is the user that was removed
+	for user, sub := range subs {
+		select {
+		case e := <-sub.Events():
+			require.Equal(chat.EventMembers, e.Type, user)
+			require.Equal(id, e.Session, user)
+			require.ElementsMatch([]string{"alice", "bob", "carol"}, e.Users, user)
+		case <-time.After(5 * time.Second):
+			require.Fail("no members event", user)
+		}
+	}
+}
@@ -3,22 +3,43 @@ package main
 import (
 	"fmt"
 	"os"
+
+	"github.com/spf13/cobra"
 )
 
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Printf("Usage: %s <config-file>\n", os.Args[0])
+	if err := rootCmd().Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+}
+
+func rootCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:           "chata-server <config-file>",
+		Short:         "chata server",
+		Long:          "A simple chat server, it serves the users and the chats of the configuration",
+		RunE:          Serve,
+		Args:          cobra.ExactArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
 
-	server, e := NewServer(os.Args[1])
+	c.AddCommand(fsckCmd(), migrateCmd(), rekeyCmd(), restoreCmd(), sealCmd())
+
+	return c
+}
+
+// Serve runs the server of the configuration until it fails.
+func Serve(_ *cobra.Command, args []string) error {
+	server, e := NewServer(args[0])
 	if e != nil {
-		fmt.Printf("Server Error: %v\n", e)
-		os.Exit(2)
+		return fmt.Errorf("server error: %w", e)
 	}
 
 	if e := server.Run(); e != nil {
-		fmt.Printf("Server Run Error: %v\n", e)
-		os.Exit(3)
+		return fmt.Errorf("server run error: %w", e)
 	}
+
+	return nil
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rchamarthy/chata/store"
+	"github.com/spf13/cobra"
+)
+
+func migrateCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "migrate <config-file>",
+		Short: "upgrade the data of the server to the current schema",
+		Long: "upgrade the users and sessions that were saved in an older version of their schema, " +
+			"--dry-run only reports what would change. Stop the server first, the server upgrades them on start too",
+		RunE: Migrate,
+		Args: cobra.ExactArgs(1),
+	}
+
+	c.Flags().Bool("dry-run", false, "report the upgrades without making them")
+
+	return c
+}
+
+func Migrate(cmd *cobra.Command, args []string) error {
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+
+	cfg, err := LoadConfig(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+
+	upgrades := []store.Upgrade{}
+	switch cfg.Backend {
+	case store.BackendMemory:
+		fmt.Println("the memory backend keeps nothing to migrate")
+		return nil
+	case store.BackendBolt:
+		upgrades, err = store.MigrateBolt(cfg.Database, dryRun)
+	default:
+		upgrades, err = migrateDirs(cfg, dryRun)
+	}
+
+	for _, u := range upgrades {
+		fmt.Println(u)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(upgrades) == 0:
+		fmt.Println("all records are current")
+	case dryRun:
+		fmt.Printf("%d records would be upgraded, run without --dry-run to upgrade them\n", len(upgrades))
+	default:
+		fmt.Printf("%d records upgraded\n", len(upgrades))
+	}
+
+	return nil
+}
+
+// migrateDirs upgrades the users and the chats directories of the file
+// backend.
+func migrateDirs(cfg *Config, dryRun bool) ([]store.Upgrade, error) {
+	sealer, err := cfg.Sealer()
+	if err != nil {
+		return nil, err
+	}
+
+	upgrades, err := store.MigrateUsers(cfg.UsersDir, sealer, dryRun)
+	if err != nil {
+		return upgrades, err
+	}
+
+	chats, err := store.MigrateChats(cfg.ChatsDir, sealer, dryRun)
+
+	return append(upgrades, chats...), err
+}
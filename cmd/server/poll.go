@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/rchamarthy/chata/chat"
+)
+
+// Bounds of the time a long-poll waits for new messages.
+const (
+	DefaultPollWait = 30 * time.Second
+	MaxPollWait     = 2 * time.Minute
+)
+
+var (
+	errSessionGone = errors.New("chat not found")
+	errGroupGone   = errors.New("group not found")
+)
+
+// sessionFinder finds the session of a request, again on every call so that
+// waits see new messages. It returns nil once the session is gone.
+type sessionFinder func() *chat.Session
+
+// chatFinder finds the chat of from and to.
+func (h *ChatHandler) chatFinder(from string, to string) sessionFinder {
+	return func() *chat.Session {
+		return h.db.Get(from, to)
+	}
+}
+
+// groupFinder finds the group with the id if from is a member of it.
+func (h *ChatHandler) groupFinder(from string, id string) sessionFinder {
+	return func() *chat.Session {
+		group := h.db.GetByID(id)
+		if group == nil || !group.IsGroup() || !group.HasMember(from) {
+			return nil
+		}
+
+		return group
+	}
+}
+
+// GetMessages returns a page of the messages of a session. The page is
+// chosen with one of the cursors, which are message ids so that they still
+// hold once old messages are purged:
+//
+//   - after=N, the messages with ids after N. It is a long-poll that answers
+//     as soon as the session has such a message, or with no messages when
+//     wait expires.
+//   - before=N, the messages with ids before N.
+//   - since=T, the last messages sent at or after the RFC 3339 time T.
+//
+// Without a cursor it returns the last messages. At most limit messages are
+// returned.
+func (h *ChatHandler) GetMessages(c *gin.Context) {
+	h.getMessages(c, h.chatFinder(c.Param("from"), c.Param("to")), errSessionGone)
+}
+
+// GetGroupMessages returns a page of the messages of a group like
+// GetMessages, from must be a member of the group.
+func (h *ChatHandler) GetGroupMessages(c *gin.Context) {
+	h.getMessages(c, h.groupFinder(c.Param("from"), c.Param("id")), errGroupGone)
+}
+
+// getMessages answers with the page of the messages of the session that find
+// finds, or with gone if there is none.
+func (h *ChatHandler) getMessages(c *gin.Context, find sessionFinder, gone error) {
+	after, wait, err := pollParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	cursor, limit, err := pageParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	session := find()
+	if session == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": gone.Error(),
+		})
+		return
+	}
+
+	switch {
+	case cursor.before > 0:
+		h.deliverPage(c, session, session.PageBefore(cursor.before, limit))
+		return
+	case !cursor.since.IsZero():
+		after = session.IDSince(cursor.since)
+		if c.Query("wait") == "" {
+			h.deliverPage(c, session, session.PageAfter(after, limit))
+			return
+		}
+	case c.Query("after") == "" && c.GetHeader("Last-Event-ID") == "" && c.Query("wait") == "":
+		h.deliverPage(c, session, session.LastPage(limit))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), wait)
+	defer cancel()
+
+	page, err := h.waitForMessages(ctx, c.Param("from"), find, after, limit)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": gone.Error(),
+		})
+		return
+	}
+
+	h.deliverPage(c, session, page)
+}
+
+// deliverPage answers with the page, with the receipts as they are once the
+// messages of the page are delivered to from.
+func (h *ChatHandler) deliverPage(c *gin.Context, session *chat.Session, page chat.Page) {
+	from := c.Param("from")
+	markDelivered(h.db, h.hub, session, from, page.Messages)
+
+	page.Unread = session.Unread(from)
+	page.Receipts = session.Receipts
+
+	c.JSON(http.StatusOK, page)
+}
+
+// Events streams the messages of a session as Server-Sent Events, starting
+// after the message with the id after or the Last-Event-ID of a reconnecting
+// client. The id of every event is the id of its message. The stream ends
+// when the session is deleted, or after wait if it is given.
+func (h *ChatHandler) Events(c *gin.Context) {
+	from := c.Param("from")
+	to := c.Param("to")
+
+	after, wait, err := pollParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if c.Query("wait") == "" {
+		wait = 0
+	}
+
+	session := h.db.Get(from, to)
+	if session == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": errSessionGone.Error(),
+		})
+		return
+	}
+
+	sub := h.hub.Subscribe(from)
+	defer func() { sub.Close() }()
+
+	var deadline <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	ticker := time.NewTicker(StreamPingPeriod)
+	defer ticker.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	last := after
+	send := func() bool {
+		s := h.db.Get(from, to)
+		if s == nil {
+			c.Render(-1, sse.Event{Event: chat.EventSessionDeleted, Data: chat.NewSessionEvent(chat.EventSessionDeleted, session)})
+			return false
+		}
+
+		msgs := s.MessagesAfter(last)
+		for _, m := range msgs {
+			id := strconv.FormatUint(m.ID, 10)
+			c.Render(-1, sse.Event{Id: id, Event: chat.EventMessage, Data: chat.NewMessageEvent(s, m)})
+			last = m.ID
+		}
+
+		markDelivered(h.db, h.hub, s, from, msgs)
+
+		return true
+	}
+
+	c.Stream(func(w io.Writer) bool {
+		if !send() {
+			return false
+		}
+
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				// Dropped for being slow, catch up from the session
+				sub = h.hub.Subscribe(from)
+			} else if e.Type == chat.EventSessionDeleted && e.Session == session.ID {
+				return send()
+			} else if (e.Type == chat.EventReceipt || e.Type == chat.EventPurged) && e.Session == session.ID {
+				c.Render(-1, sse.Event{Event: e.Type, Data: e})
+			} else if isChange(e) && e.Session == session.ID && e.ID <= last {
+				// Changes to messages that are yet to be sent go with them
+				c.Render(-1, sse.Event{Event: e.Type, Data: e})
+			}
+		case <-ticker.C:
+			_, err := io.WriteString(w, ": ping\n\n")
+			return err == nil
+		case <-deadline:
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		}
+
+		return true
+	})
+}
+
+// waitForMessages returns a page of the messages of the session that find
+// finds with ids after after, waiting for the events of from until the
+// context is done.
+func (h *ChatHandler) waitForMessages(ctx context.Context, from string, find sessionFinder, after uint64,
+	limit int,
+) (chat.Page, error) {
+	sub := h.hub.Subscribe(from)
+	defer func() { sub.Close() }()
+
+	for {
+		session := find()
+		if session == nil {
+			return chat.Page{}, errSessionGone
+		}
+
+		if page := session.PageAfter(after, limit); len(page.Messages) > 0 {
+			return page, nil
+		}
+
+		select {
+		case _, ok := <-sub.Events():
+			if !ok {
+				sub = h.hub.Subscribe(from)
+			}
+		case <-ctx.Done():
+			return session.PageAfter(after, limit), nil
+		}
+	}
+}
+
+// pollParams returns the id of the message to start after and the time to
+// wait for.
+func pollParams(c *gin.Context) (uint64, time.Duration, error) {
+	after := uint64(0)
+	if a := c.Query("after"); a != "" {
+		n, err := strconv.ParseUint(a, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad after %q", a)
+		}
+
+		after = n
+	}
+
+	// A reconnecting event source resumes after the last event it got
+	if id := c.GetHeader("Last-Event-ID"); id != "" {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad Last-Event-ID %q", id)
+		}
+
+		after = n
+	}
+
+	wait := DefaultPollWait
+	if w := c.Query("wait"); w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil || d < 0 {
+			return 0, 0, fmt.Errorf("bad wait %q", w)
+		}
+
+		wait = min(d, MaxPollWait)
+	}
+
+	return after, wait, nil
+}
+
+// pageCursor is where a page of messages starts, before is 0 when the page is
+// not before a message.
+type pageCursor struct {
+	before uint64
+	since  time.Time
+}
+
+// pageParams returns the before and since cursors and the size of the page.
+func pageParams(c *gin.Context) (pageCursor, int, error) {
+	cursor := pageCursor{before: 0, since: time.Time{}}
+
+	// Message ids start at 1
+	if b := c.Query("before"); b != "" {
+		n, err := strconv.ParseUint(b, 10, 64)
+		if err != nil || n == 0 {
+			return cursor, 0, fmt.Errorf("bad before %q", b)
+		}
+
+		cursor.before = n
+	}
+
+	if s := c.Query("since"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return cursor, 0, fmt.Errorf("bad since %q, expected an RFC 3339 time", s)
+		}
+
+		cursor.since = t
+	}
+
+	limit := chat.DefaultPageSize
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return cursor, 0, fmt.Errorf("bad limit %q", l)
+		}
+
+		limit = min(n, chat.MaxPageSize)
+	}
+
+	if cursor.before > 0 && (c.Query("after") != "" || !cursor.since.IsZero()) {
+		return cursor, 0, errors.New("before cannot be combined with after or since")
+	}
+
+	return cursor, limit, nil
+}
+
+// isChange reports whether the event is an edit or a deletion of a message.
+func isChange(e chat.Event) bool {
+	return e.Type == chat.EventMessageEdited || e.Type == chat.EventMessageDeleted
+}
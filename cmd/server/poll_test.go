@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addMessages appends messages from alice to the chat of alice and bob and
+// publishes them like the handlers do.
+func (s *testServer) addMessages(t *testing.T, bodies ...string) {
+	t.Helper()
+
+	for _, body := range bodies {
+		session, m, err := s.chats.db.AppendMessage(chat.SessionID("alice", "bob"),
+			chat.Message{Sender: "alice", Body: body, Time: time.Now()})
+		require.NoError(t, err)
+		s.chats.hub.Publish(chat.NewMessageEvent(session, m))
+	}
+}
+
+func decodePage(t *testing.T, w *httptest.ResponseRecorder) chat.Page {
+	t.Helper()
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	page := chat.Page{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+
+	return page
+}
+
+func pageBodies(page chat.Page) []string {
+	bodies := []string{}
+	for _, m := range page.Messages {
+		bodies = append(bodies, m.Body)
+	}
+
+	return bodies
+}
+
+func TestPollAfterPurge(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	s := newTestServer(t, DefaultMaxBodySize, "alice", "bob")
+	require.Equal(http.StatusCreated, s.request(t, "alice", http.MethodPost, "/chats/alice/bob", nil, nil).Code)
+	s.addMessages(t, "1", "2", "3", "4", "5")
+
+	page := decodePage(t, s.request(t, "bob", http.MethodGet, "/chats/bob/alice/messages?limit=2", nil, nil))
+	require.Equal([]string{"4", "5"}, pageBodies(page))
+	require.Equal(uint64(4), page.Start)
+	require.Equal(uint64(5), page.Next)
+
+	// The cursors are ids, they still hold once messages are purged
+	_, n, err := s.chats.db.Purge(chat.SessionID("alice", "bob"), time.Now(), chat.Retention{MaxAge: 0, MaxMessages: 3})
+	require.NoError(err)
+	require.Equal(2, n)
+
+	page = decodePage(t, s.request(t, "bob", http.MethodGet, "/chats/bob/alice/messages?after=3&wait=0s", nil, nil))
+	require.Equal([]string{"4", "5"}, pageBodies(page))
+	page = decodePage(t, s.request(t, "bob", http.MethodGet, "/chats/bob/alice/messages?before=4", nil, nil))
+	require.Equal([]string{"3"}, pageBodies(page))
+	page = decodePage(t, s.request(t, "bob", http.MethodGet, "/chats/bob/alice/messages?after=0&wait=0s", nil, nil))
+	require.Equal([]string{"3", "4", "5"}, pageBodies(page))
+
+	// A long-poll after the last message waits for the next one
+	req := s.signed(t, "bob", http.MethodGet, "/chats/bob/alice/messages?after=5&wait=10s", nil, nil)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- s.serve(req) }()
+
+	require.Eventually(func() bool { return s.chats.hub.Subscribers("bob") > 0 }, 5*time.Second, time.Millisecond)
+	s.addMessages(t, "6")
+
+	page = decodePage(t, <-done)
+	require.Equal([]string{"6"}, pageBodies(page))
+	require.Equal(uint64(6), page.Next)
+}
+
+// testContext returns the context of a request for the query with the
+// Last-Event-ID header, if lastID is not empty.
+func testContext(query string, lastID string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+	if lastID != "" {
+		c.Request.Header.Set("Last-Event-ID", lastID)
+	}
+
+	return c
+}
+
+func TestPollParams(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		query  string
+		lastID string
+		after  uint64
+		wait   time.Duration
+		err    string
+	}{
+		{"", "", 0, DefaultPollWait, ""},
+		{"after=7", "", 7, DefaultPollWait, ""},
+		{"after=0&wait=0s", "", 0, 0, ""},
+		{"after=7&wait=5s", "", 7, 5 * time.Second, ""},
+		{"wait=1h", "", 0, MaxPollWait, ""},
+		{"after=-1", "", 0, 0, "bad after"},
+		{"after=x", "", 0, 0, "bad after"},
+		{"wait=-1s", "", 0, 0, "bad wait"},
+		{"wait=soon", "", 0, 0, "bad wait"},
+		// A reconnecting event source resumes after its last event
+		{"", "9", 9, DefaultPollWait, ""},
+		{"after=3", "9", 9, DefaultPollWait, ""},
+		{"after=3", "x", 0, 0, "bad Last-Event-ID"},
+		{"after=3", "-2", 0, 0, "bad Last-Event-ID"},
+	}
+
+	for _, test := range tests {
+		after, wait, err := pollParams(testContext(test.query, test.lastID))
+		if test.err != "" {
+			assert.ErrorContains(t, err, test.err, "%s %s", test.query, test.lastID)
+			continue
+		}
+
+		if assert.NoError(t, err, "%s %s", test.query, test.lastID) {
+			assert.Equal(t, test.after, after, "%s %s", test.query, test.lastID)
+			assert.Equal(t, test.wait, wait, "%s %s", test.query, test.lastID)
+		}
+	}
+}
+
+func TestPageParams(t *testing.T) {
+	t.Parallel()
+
+	since := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		query  string
+		cursor pageCursor
+		limit  int
+		err    string
+	}{
+		{"", pageCursor{before: 0, since: time.Time{}}, chat.DefaultPageSize, ""},
+		{"before=5&limit=10", pageCursor{before: 5, since: time.Time{}}, 10, ""},
+		{"limit=100000", pageCursor{before: 0, since: time.Time{}}, chat.MaxPageSize, ""},
+		{"since=2024-01-02T03:04:05Z", pageCursor{before: 0, since: since}, chat.DefaultPageSize, ""},
+		{"before=0", pageCursor{}, 0, "bad before"},
+		{"before=-1", pageCursor{}, 0, "bad before"},
+		{"before=x", pageCursor{}, 0, "bad before"},
+		{"since=yesterday", pageCursor{}, 0, "bad since"},
+		{"limit=0", pageCursor{}, 0, "bad limit"},
+		{"limit=-3", pageCursor{}, 0, "bad limit"},
+		{"limit=x", pageCursor{}, 0, "bad limit"},
+		{"before=5&after=2", pageCursor{}, 0, "cannot be combined"},
+		{"before=5&since=2024-01-02T03:04:05Z", pageCursor{}, 0, "cannot be combined"},
+	}
+
+	for _, test := range tests {
+		cursor, limit, err := pageParams(testContext(test.query, ""))
+		if test.err != "" {
+			assert.ErrorContains(t, err, test.err, test.query)
+			continue
+		}
+
+		if assert.NoError(t, err, test.query) {
+			assert.Equal(t, test.cursor, cursor, test.query)
+			assert.Equal(t, test.limit, limit, test.query)
+		}
+	}
+
+	// Bad parameters are answered with 400
+	s := newTestServer(t, DefaultMaxBodySize, "alice", "bob")
+	require.Equal(t, http.StatusCreated, s.request(t, "alice", http.MethodPost, "/chats/alice/bob", nil, nil).Code)
+	for _, query := range []string{"after=x", "before=0", "limit=0", "wait=x", "before=1&after=1"} {
+		w := s.request(t, "bob", http.MethodGet, "/chats/bob/alice/messages?"+query, nil, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestWaitForMessages(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	s := newTestServer(t, DefaultMaxBodySize, "alice", "bob")
+	require.Equal(http.StatusCreated, s.request(t, "alice", http.MethodPost, "/chats/alice/bob", nil, nil).Code)
+	s.addMessages(t, "1")
+
+	// Messages that are there already are returned at once
+	page, err := s.chats.waitForMessages(context.Background(), "bob", s.chats.chatFinder("bob", "alice"), 0, 10)
+	require.NoError(err)
+	require.Equal([]string{"1"}, pageBodies(page))
+
+	// Without new messages it returns an empty page once the wait is over
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	page, err = s.chats.waitForMessages(ctx, "bob", s.chats.chatFinder("bob", "alice"), 1, 10)
+	require.NoError(err)
+	require.Empty(page.Messages)
+	require.Equal(uint64(1), page.Next)
+	require.GreaterOrEqual(time.Since(start), 20*time.Millisecond)
+
+	// A message that is published wakes it up
+	type result struct {
+		page chat.Page
+		err  error
+	}
+
+	done := make(chan result)
+	go func() {
+		page, err := s.chats.waitForMessages(context.Background(), "bob", s.chats.chatFinder("bob", "alice"), 1, 10)
+		done <- result{page: page, err: err}
+	}()
+
+	require.Eventually(func() bool { return s.chats.hub.Subscribers("bob") > 0 }, 5*time.Second, time.Millisecond)
+	s.addMessages(t, "2")
+
+	r := <-done
+	require.NoError(r.err)
+	require.Equal([]string{"2"}, pageBodies(r.page))
+
+	// And so does the deletion of the session
+	go func() {
+		page, err := s.chats.waitForMessages(context.Background(), "bob", s.chats.chatFinder("bob", "alice"), 2, 10)
+		done <- result{page: page, err: err}
+	}()
+
+	require.Eventually(func() bool { return s.chats.hub.Subscribers("bob") > 0 }, 5*time.Second, time.Millisecond)
+	require.Equal(http.StatusOK, s.request(t, "alice", http.MethodDelete, "/chats/alice/bob", nil, nil).Code)
+	require.ErrorIs((<-done).err, errSessionGone)
+}
+
+// sseIDs returns the ids of the message events of a stream of Server-Sent
+// Events.
+func sseIDs(stream string) []string {
+	ids := []string{}
+	for _, line := range strings.Split(stream, "\n") {
+		if id, ok := strings.CutPrefix(line, "id:"); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+func TestEventsResume(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	s := newTestServer(t, DefaultMaxBodySize, "alice", "bob")
+	server := httptest.NewServer(s.engine)
+	t.Cleanup(server.Close)
+
+	require.Equal(http.StatusCreated, s.request(t, "alice", http.MethodPost, "/chats/alice/bob", nil, nil).Code)
+	s.addMessages(t, "1", "2", "3", "4")
+
+	events := func(uri string, lastID string) string {
+		header := http.Header{}
+		if lastID != "" {
+			header.Set("Last-Event-ID", lastID)
+		}
+
+		signed := s.signed(t, "bob", http.MethodGet, uri, nil, header)
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+uri, nil)
+		require.NoError(err)
+		req.Header = signed.Header
+
+		r, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		defer r.Body.Close()
+
+		require.Equal(http.StatusOK, r.StatusCode)
+		b, err := io.ReadAll(r.Body)
+		require.NoError(err)
+
+		return string(b)
+	}
+
+	// The id of every event is the id of its message
+	stream := events("/chats/bob/alice/events?after=1&wait=50ms", "")
+	require.Equal([]string{"2", "3", "4"}, sseIDs(stream))
+	require.Contains(stream, "event:"+chat.EventMessage)
+
+	// A reconnecting client resumes after its Last-Event-ID, even once the
+	// messages before it are purged
+	_, _, err := s.chats.db.Purge(chat.SessionID("alice", "bob"), time.Now(), chat.Retention{MaxAge: 0, MaxMessages: 2})
+	require.NoError(err)
+	require.Equal([]string{"4"}, sseIDs(events("/chats/bob/alice/events?after=1&wait=50ms", "3")))
+	require.Equal([]string{"3", "4"}, sseIDs(events("/chats/bob/alice/events?wait=50ms", "")))
+	require.Empty(sseIDs(events("/chats/bob/alice/events?wait=50ms", "4")))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/rchamarthy/chata/store"
+)
+
+func (h *ChatHandler) registerReceipts(api *gin.RouterGroup, authz *Authorizer) {
+	api.POST("/chats/:from/:to/read/:msgID", authz.Allow(auth.ReadChat, "from"), h.MarkRead)
+	api.POST("/groups/:from/:id/read/:msgID", authz.Allow(auth.ReadChat, "from"), h.MarkGroupRead)
+}
+
+// MarkRead marks the messages of the chat up to the message id as read by
+// from.
+func (h *ChatHandler) MarkRead(c *gin.Context) {
+	session := h.chatSession(c)
+	if session == nil {
+		return
+	}
+
+	h.markRead(c, session)
+}
+
+func (h *ChatHandler) MarkGroupRead(c *gin.Context) {
+	group := h.memberGroup(c)
+	if group == nil {
+		return
+	}
+
+	h.markRead(c, group)
+}
+
+func (h *ChatHandler) markRead(c *gin.Context, session *chat.Session) {
+	id, ok := messageID(c)
+	if !ok {
+		return
+	}
+
+	from := c.Param("from")
+	session, err := markReceipt(h.db, h.hub, session, from, chat.Receipt{Delivered: id, Read: id})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"receipt": session.Receipt(from),
+		"unread":  session.Unread(from),
+	})
+}
+
+// markReceipt moves the receipt of the user in the session up and tells the
+// members of the session if it changed. It returns the session after the
+// change.
+func markReceipt(db store.ChatStore, hub *chat.Hub, session *chat.Session, user string,
+	r chat.Receipt,
+) (*chat.Session, error) {
+	session, changed, err := db.MarkReceipt(session.ID, user, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if changed {
+		hub.Publish(chat.NewReceiptEvent(session))
+	}
+
+	return session, nil
+}
+
+// markDelivered records that the messages up to the last one in msgs were
+// delivered to the user. Failing to record it does not fail the delivery,
+// the receipt is recorded again with the next one.
+func markDelivered(db store.ChatStore, hub *chat.Hub, session *chat.Session, user string, msgs []chat.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	_, _ = markReceipt(db, hub, session, user, chat.Receipt{Delivered: msgs[len(msgs)-1].ID, Read: 0})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rchamarthy/chata/store"
+	"github.com/spf13/cobra"
+)
+
+func rekeyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rekey <config-file>",
+		Short: "rotate the master key",
+		Long: "reseal the files of the server with a new master key and replace the key in the key file with it. " +
+			"Stop the server first, a rekey that is cut short is finished by running it again. " +
+			"The replaced key is kept in the key file with the " + store.RetiredKeySuffix + " suffix so that older " +
+			"backups still restore, remove that file once they are no longer needed",
+		RunE: Rekey,
+		Args: cobra.ExactArgs(1),
+	}
+}
+
+func sealCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "seal <config-file>",
+		Short: "seal the files of the server",
+		Long: "seal the files of the server that are in the clear with the master key in the key file, " +
+			"which is made if it is not there yet. Stop the server first and run it once when sealing is " +
+			"turned on, the server does not start while there are files in the clear",
+		RunE: Seal,
+		Args: cobra.ExactArgs(1),
+	}
+}
+
+func Seal(_ *cobra.Command, args []string) error {
+	cfg, err := LoadConfig(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+
+	if cfg.KeyFile == "" {
+		return errors.New("keyFile is not specified, the files of the server are not sealed")
+	}
+
+	n, err := store.SealFiles(cfg.KeyFile, cfg.UsersDir, cfg.ChatsDir)
+	if err != nil {
+		return fmt.Errorf("seal stopped after %d files, fix the file and run it again: %w", n, err)
+	}
+
+	fmt.Printf("%d files sealed with the master key in %s, keep a copy of it apart from the data\n", n, cfg.KeyFile)
+
+	return nil
+}
+
+func Rekey(_ *cobra.Command, args []string) error {
+	cfg, err := LoadConfig(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+
+	if cfg.KeyFile == "" {
+		return errors.New("keyFile is not specified, the files of the server are not sealed")
+	}
+
+	n, err := store.Rekey(cfg.KeyFile, cfg.UsersDir, cfg.ChatsDir)
+	if err != nil {
+		return fmt.Errorf("rekey stopped after %d files, fix the file and run it again: %w", n, err)
+	}
+
+	fmt.Printf("%d files resealed with the new master key in %s\n", n, cfg.KeyFile)
+	fmt.Printf("the retired key is kept in %s until you remove it\n", cfg.KeyFile+store.RetiredKeySuffix)
+
+	return nil
+}
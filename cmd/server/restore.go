@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rchamarthy/chata/store"
+	"github.com/spf13/cobra"
+)
+
+func restoreCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "restore <config-file> <archive>",
+		Short: "restore a backup",
+		Long: "restore a backup taken with POST /admin/backup into the users and chats directories of the server. " +
+			"The backup is checked against its manifest and every user and session in it must load before it " +
+			"replaces the directories, which are kept aside. When the files are sealed the manifest must carry a " +
+			"MAC made with the master key or with a key that rekey retired, so backups taken before a rekey " +
+			"restore as long as the retired keys are kept. Stop the server first",
+		RunE: Restore,
+		Args: cobra.ExactArgs(2),
+	}
+}
+
+func Restore(_ *cobra.Command, args []string) error {
+	cfg, err := LoadConfig(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+
+	if cfg.Backend != "" && cfg.Backend != store.BackendFile {
+		return fmt.Errorf("restore is only supported by the %s backend", store.BackendFile)
+	}
+
+	sealer, err := cfg.Sealer()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m, aside, err := store.Restore(f, cfg.UsersDir, cfg.ChatsDir, sealer)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("restored %d files of the backup of %s\n", len(m.Files), m.Created.Local().Format(time.RFC1123))
+	for _, dir := range aside {
+		fmt.Printf("the data that was there is kept in %s\n", dir)
+	}
+
+	return nil
+}
@@ -3,15 +3,51 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rchamarthy/chata"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/rchamarthy/chata/store"
 	"gojini.dev/config"
 )
 
 type Config struct {
-	Address  string `json:"address"  yaml:"address"`
-	UsersDir string `json:"usersDir" yaml:"usersDir"`
-	ChatsDir string `json:"chatsDir" yaml:"chatsDir"`
+	Address     string          `json:"address"     yaml:"address"`
+	Backend     string          `json:"backend"     yaml:"backend"`
+	UsersDir    string          `json:"usersDir"    yaml:"usersDir"`
+	ChatsDir    string          `json:"chatsDir"    yaml:"chatsDir"`
+	Database    string          `json:"database"    yaml:"database"`
+	KeyFile     string          `json:"keyFile"     yaml:"keyFile"`
+	MaxBodySize int64           `json:"maxBodySize" yaml:"maxBodySize"`
+	Retention   RetentionConfig `json:"retention"   yaml:"retention"`
+}
+
+// RetentionConfig bounds how long the server keeps messages for, maxAge is
+// a duration such as 720h. Sessions may keep their messages for less with a
+// TTL of their own.
+type RetentionConfig struct {
+	MaxAge      string `json:"maxAge"      yaml:"maxAge"`
+	MaxMessages int    `json:"maxMessages" yaml:"maxMessages"`
+}
+
+// Policy returns the retention of the configuration.
+func (c *RetentionConfig) Policy() (chat.Retention, error) {
+	r := chat.Retention{MaxAge: 0, MaxMessages: c.MaxMessages}
+
+	if c.MaxAge != "" {
+		d, err := time.ParseDuration(c.MaxAge)
+		if err != nil {
+			return r, fmt.Errorf("bad retention maxAge: %w", err)
+		}
+
+		r.MaxAge = d
+	}
+
+	return r, r.Validate()
 }
 
 func (c *Config) Validate() error {
@@ -19,34 +55,119 @@ func (c *Config) Validate() error {
 		return errors.New("address is not specified")
 	}
 
-	if c.UsersDir == "" {
-		return errors.New("usersDir is not specified")
+	switch c.Backend {
+	case "", store.BackendFile:
+		if c.UsersDir == "" {
+			return errors.New("usersDir is not specified")
+		}
+
+		if c.ChatsDir == "" {
+			return errors.New("chatsDir is not specified")
+		}
+	case store.BackendBolt:
+		if c.Database == "" {
+			return errors.New("database is not specified")
+		}
+	case store.BackendMemory:
+	default:
+		return fmt.Errorf("unknown backend %q", c.Backend)
 	}
 
-	if c.ChatsDir == "" {
-		return errors.New("chatsDir is not specified")
+	if c.MaxBodySize < 0 {
+		return errors.New("maxBodySize cannot be negative")
 	}
 
-	return nil
+	if c.KeyFile != "" && c.Backend != "" && c.Backend != store.BackendFile {
+		return fmt.Errorf("keyFile is only supported by the %s backend", store.BackendFile)
+	}
+
+	_, err := c.Retention.Policy()
+
+	return err
 }
 
-type ChatServer struct {
-	engine *gin.Engine
-	config *Config
-	users  *UserHandler
-	chats  *ChatHandler
+// BodyLimit returns the largest request body the server reads.
+func (c *Config) BodyLimit() int64 {
+	if c.MaxBodySize == 0 {
+		return DefaultMaxBodySize
+	}
+
+	return c.MaxBodySize
 }
 
-func NewServer(configFile string) (*ChatServer, error) {
-	ctx := context.Background()
+// OpenStores returns the stores of the users and the chats of the backend.
+func (c *Config) OpenStores() (store.UserStore, store.ChatStore, error) {
+	switch c.Backend {
+	case store.BackendMemory:
+		return store.NewMemoryUserStore(), store.NewMemoryChatStore(), nil
+	case store.BackendBolt:
+		db, err := store.OpenBolt(c.Database)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return store.NewBoltUserStore(db), store.NewBoltChatStore(db), nil
+	default:
+		if c.KeyFile == "" {
+			return store.NewUserDB(c.UsersDir), store.NewChatDB(c.ChatsDir), nil
+		}
+
+		keyring, err := c.Keyring()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return store.NewSealedUserDB(c.UsersDir, keyring), store.NewSealedChatDB(c.ChatsDir, keyring), nil
+	}
+}
+
+// Keyring returns the keyring of the key file that seals the files of the
+// file backend. The key file is made by the seal command, which seals the
+// files that are in the clear first.
+func (c *Config) Keyring() (*store.Keyring, error) {
+	if _, e := os.Stat(c.KeyFile); errors.Is(e, os.ErrNotExist) {
+		return nil, fmt.Errorf("key file %s is not there, make it with the seal command", c.KeyFile)
+	}
+
+	return store.LoadKeyring(c.KeyFile)
+}
+
+// Sealer returns the keyring of the key file without making a new key, the
+// sealer is nil if the files are not sealed.
+func (c *Config) Sealer() (chata.Sealer, error) {
+	var sealer chata.Sealer
+	if c.KeyFile != "" {
+		keyring, err := store.LoadKeyring(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		sealer = keyring
+	}
+
+	return sealer, nil
+}
+
+type ChatServer struct {
+	engine  *gin.Engine
+	config  *Config
+	users   *UserHandler
+	chats   *ChatHandler
+	stream  *StreamHandler
+	backup  *BackupHandler
+	sweeper *store.Sweeper
+}
 
-	store := config.New()
-	if e := store.LoadFromFile(ctx, configFile); e != nil {
+// LoadConfig reads the configuration of the server from the file and
+// validates it.
+func LoadConfig(ctx context.Context, configFile string) (*Config, error) {
+	configStore := config.New()
+	if e := configStore.LoadFromFile(ctx, configFile); e != nil {
 		return nil, e
 	}
 
 	cfg := &Config{}
-	if e := store.Get("server", cfg); e != nil {
+	if e := configStore.Get("server", cfg); e != nil {
 		return nil, e
 	}
 
@@ -54,16 +175,82 @@ func NewServer(configFile string) (*ChatServer, error) {
 		return nil, e
 	}
 
+	return cfg, nil
+}
+
+func NewServer(configFile string) (*ChatServer, error) {
+	ctx := context.WithValue(context.Background(), chata.LogKey, slog.Default())
+
+	cfg, err := LoadConfig(ctx, configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	retention, err := cfg.Retention.Policy()
+	if err != nil {
+		return nil, err
+	}
+
+	userStore, chatStore, err := cfg.OpenStores()
+	if err != nil {
+		return nil, err
+	}
+
+	if e := loadStores(ctx, userStore, chatStore); e != nil {
+		return nil, e
+	}
+
 	engine := gin.Default()
-	users := NewUserHandler(engine, cfg)
+	users := NewUserHandler(engine, userStore, cfg.BodyLimit())
+	chats := NewChatHandler(engine, chatStore, users.db, users.auth, users.authz)
+
 	return &ChatServer{
-		engine: engine,
-		config: cfg,
-		users:  users,
-		chats:  NewChatHandler(engine, cfg, users.db),
+		engine:  engine,
+		config:  cfg,
+		users:   users,
+		chats:   chats,
+		stream:  NewStreamHandler(engine, chats, users.auth, users.authz),
+		backup:  NewBackupHandler(engine, userStore, chatStore, users.auth, users.authz),
+		sweeper: store.NewSweeper(chatStore, retention, time.Now, chats.hub),
 	}, nil
 }
 
+// loadStores initializes the stores and loads them. The stores put corrupt
+// files aside as they load, the errors that are left keep the server from
+// starting.
+func loadStores(ctx context.Context, users store.UserStore, chats store.ChatStore) error {
+	if e := users.Init(); e != nil {
+		return e
+	}
+
+	if e := users.Load(ctx); e != nil {
+		return fmt.Errorf("error loading users: %w", loadError(e))
+	}
+
+	if e := chats.Init(); e != nil {
+		return e
+	}
+
+	if e := chats.Load(ctx); e != nil {
+		return fmt.Errorf("error loading chats: %w", loadError(e))
+	}
+
+	return nil
+}
+
+// loadError tells how to seal files that are still in the clear once
+// sealing is turned on.
+func loadError(err error) error {
+	if errors.Is(err, chata.ErrNotSealed) {
+		return fmt.Errorf("%w, seal the files with the seal command first", err)
+	}
+
+	return err
+}
+
 func (s *ChatServer) Run() error {
+	ctx := context.WithValue(context.Background(), chata.LogKey, slog.Default())
+	go s.sweeper.Run(ctx, store.DefaultSweepInterval)
+
 	return s.engine.Run(s.config.Address)
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// testServer is a server with memory stores and registered users whose
+// private keys sign the requests of the tests.
+type testServer struct {
+	engine *gin.Engine
+	users  *UserHandler
+	chats  *ChatHandler
+	keys   map[string]*auth.Identity
+}
+
+func newTestServer(t *testing.T, maxBody int64, ids ...string) *testServer {
+	t.Helper()
+
+	engine := gin.New()
+	users := NewUserHandler(engine, store.NewMemoryUserStore(), maxBody)
+	chats := NewChatHandler(engine, store.NewMemoryChatStore(), users.db, users.auth, users.authz)
+	NewStreamHandler(engine, chats, users.auth, users.authz)
+
+	s := &testServer{engine: engine, users: users, chats: chats, keys: map[string]*auth.Identity{}}
+	for _, id := range ids {
+		user := auth.NewUser(id, id, auth.CHATTER)
+		s.keys[id] = user.Key
+		user.Key = user.Key.Public()
+		require.NoError(t, users.db.Add(user))
+	}
+
+	return s
+}
+
+// request serves the request signed by the user.
+func (s *testServer) request(t *testing.T, user string, method string, uri string,
+	body []byte, header http.Header,
+) *httptest.ResponseRecorder {
+	t.Helper()
+
+	return s.serve(s.signed(t, user, method, uri, body, header))
+}
+
+// signed returns the request signed by the user.
+func (s *testServer) signed(t *testing.T, user string, method string, uri string,
+	body []byte, header http.Header,
+) *http.Request {
+	t.Helper()
+
+	req := httptest.NewRequest(method, uri, bytes.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	require.NoError(t, s.keys[user].SignRequest(user, req, body))
+
+	return req
+}
+
+func (s *testServer) serve(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.engine.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestBodyLimit(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	s := newTestServer(t, 64, "alice", "bob")
+
+	w := s.request(t, "alice", http.MethodPost, "/chats/alice/bob", bytes.Repeat([]byte("a"), 65), nil)
+	require.Equal(http.StatusRequestEntityTooLarge, w.Code)
+
+	w = s.request(t, "alice", http.MethodPost, "/chats/alice/bob", nil, nil)
+	require.Equal(http.StatusCreated, w.Code, w.Body.String())
+
+	// Registration reads the body before the key in it is known
+	w = s.request(t, "alice", http.MethodPut, "/users/carol", bytes.Repeat([]byte("a"), 65), nil)
+	require.Equal(http.StatusRequestEntityTooLarge, w.Code)
+}
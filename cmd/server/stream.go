@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/rchamarthy/chata/store"
+)
+
+// Heartbeat of the stream. The server pings every StreamPingPeriod and drops
+// clients that do not answer within StreamPongWait.
+const (
+	StreamWriteWait  = 10 * time.Second
+	StreamPongWait   = 60 * time.Second
+	StreamPingPeriod = StreamPongWait * 9 / 10
+)
+
+// StreamHandler pushes the events of the sessions of the caller over a
+// WebSocket.
+type StreamHandler struct {
+	db       store.ChatStore
+	hub      *chat.Hub
+	authz    *Authorizer
+	upgrader *websocket.Upgrader
+}
+
+func NewStreamHandler(e *gin.Engine, chats *ChatHandler, authn *Authenticator, authz *Authorizer) *StreamHandler {
+	h := &StreamHandler{
+		db:    chats.db,
+		hub:   chats.hub,
+		authz: authz,
+		upgrader: &websocket.Upgrader{
+			HandshakeTimeout: StreamWriteWait,
+		},
+	}
+
+	api := e.Group("/", authn.Required())
+	api.GET("/stream", h.Stream)
+
+	return h
+}
+
+// Stream sends the events of the caller as JSON messages. Clients resume
+// after a reconnect with one resume=<peer>:<id> parameter per session, where
+// id is the id of the last message of the session they already have. Groups
+// are resumed with their id in place of the peer.
+func (h *StreamHandler) Stream(c *gin.Context) {
+	caller := Caller(c)
+	if !h.authz.Check(c, auth.ListChats, caller.ID) {
+		return
+	}
+
+	resume, err := parseResume(c.QueryArray("resume"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Subscribe before reading the backlog so that nothing is missed
+	sub := h.hub.Subscribe(caller.ID)
+	defer sub.Close()
+
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return // The upgrader has answered the request
+	}
+	defer conn.Close()
+
+	sent, err := h.sendBacklog(conn, caller.ID, resume)
+	if err != nil {
+		return
+	}
+
+	done := readPump(conn)
+	ticker := time.NewTicker(StreamPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				closeStream(conn, websocket.ClosePolicyViolation, "too slow, reconnect and resume")
+				return
+			}
+
+			if last, ok := sent[e.Session]; ok && e.Type == chat.EventMessage && e.ID <= last {
+				continue // Already sent with the backlog
+			}
+
+			if writeEvent(conn, e) != nil {
+				return
+			}
+
+			if e.Type == chat.EventMessage && e.Message.Sender != caller.ID {
+				if session := h.db.GetByID(e.Session); session != nil {
+					markDelivered(h.db, h.hub, session, caller.ID, []chat.Message{*e.Message})
+				}
+			}
+		case <-ticker.C:
+			deadline := time.Now().Add(StreamWriteWait)
+			if conn.WriteControl(websocket.PingMessage, nil, deadline) != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// sendBacklog sends the messages the client missed and returns the id of the
+// last message the client has of every session.
+func (h *StreamHandler) sendBacklog(conn *websocket.Conn, user string,
+	resume map[string]uint64,
+) (map[string]uint64, error) {
+	sent := map[string]uint64{}
+
+	for peer, id := range resume {
+		session := h.resumeSession(user, peer)
+		if session == nil {
+			// The session is gone, or the user left the group, while the
+			// client was away
+			s := &chat.Session{ID: chat.SessionID(user, peer), User1: user, User2: peer}
+			if chat.IsGroupID(peer) {
+				s = &chat.Session{ID: peer, Owner: user, Participants: []string{user}}
+			}
+
+			if e := writeEvent(conn, chat.NewSessionEvent(chat.EventSessionDeleted, s)); e != nil {
+				return nil, e
+			}
+
+			continue
+		}
+
+		sent[session.ID] = id
+		msgs := session.MessagesAfter(id)
+		for _, m := range msgs {
+			if e := writeEvent(conn, chat.NewMessageEvent(session, m)); e != nil {
+				return nil, e
+			}
+
+			sent[session.ID] = m.ID
+		}
+
+		markDelivered(h.db, h.hub, session, user, msgs)
+	}
+
+	return sent, nil
+}
+
+// resumeSession returns the session of the user with the peer, or the group
+// with the id peer if the user is a member of it.
+func (h *StreamHandler) resumeSession(user string, peer string) *chat.Session {
+	if !chat.IsGroupID(peer) {
+		return h.db.Get(user, peer)
+	}
+
+	group := h.db.GetByID(peer)
+	if group == nil || !group.HasMember(user) {
+		return nil
+	}
+
+	return group
+}
+
+// parseResume parses the <peer>:<id> resume parameters.
+func parseResume(params []string) (map[string]uint64, error) {
+	resume := make(map[string]uint64, len(params))
+
+	for _, p := range params {
+		peer, id, ok := strings.Cut(p, ":")
+		if !ok || peer == "" {
+			return nil, fmt.Errorf("bad resume parameter %q, expected <peer>:<id>", p)
+		}
+
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad resume id %q", id)
+		}
+
+		resume[peer] = n
+	}
+
+	return resume, nil
+}
+
+// readPump reads the messages of the client, which only answers pings. The
+// returned channel is closed when the connection is closed or the client
+// stops answering.
+func readPump(conn *websocket.Conn) <-chan struct{} {
+	done := make(chan struct{})
+
+	_ = conn.SetReadDeadline(time.Now().Add(StreamPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(StreamPongWait))
+	})
+
+	go func() {
+		defer close(done)
+
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	return done
+}
+
+func writeEvent(conn *websocket.Conn, e chat.Event) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(StreamWriteWait)); err != nil {
+		return err
+	}
+
+	return conn.WriteJSON(e)
+}
+
+func closeStream(conn *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(StreamWriteWait))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/stretchr/testify/require"
+)
+
+// dial opens the stream of the user at uri on the running server.
+func (s *testServer) dial(t *testing.T, server *httptest.Server, user string, uri string) *websocket.Conn {
+	t.Helper()
+
+	req := s.signed(t, user, http.MethodGet, uri, nil, nil)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + uri
+
+	conn, r, err := websocket.DefaultDialer.Dial(url, req.Header)
+	require.NoError(t, err)
+	require.NoError(t, r.Body.Close())
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func readEvent(t *testing.T, conn *websocket.Conn) chat.Event {
+	t.Helper()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	e := chat.Event{}
+	require.NoError(t, conn.ReadJSON(&e))
+
+	return e
+}
+
+func TestStreamResumeAfterPurge(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	s := newTestServer(t, DefaultMaxBodySize, "alice", "bob")
+	server := httptest.NewServer(s.engine)
+	t.Cleanup(server.Close)
+
+	require.Equal(http.StatusCreated, s.request(t, "alice", http.MethodPost, "/chats/alice/bob", nil, nil).Code)
+	s.addMessages(t, "1", "2", "3", "4", "5")
+
+	_, _, err := s.chats.db.Purge(chat.SessionID("alice", "bob"), time.Now(), chat.Retention{MaxAge: 0, MaxMessages: 3})
+	require.NoError(err)
+
+	// The client has up to message 3, it gets the messages after it
+	conn := s.dial(t, server, "bob", "/stream?resume=alice:3")
+	for _, id := range []uint64{4, 5} {
+		e := readEvent(t, conn)
+		require.Equal(chat.EventMessage, e.Type)
+		require.Equal(id, e.ID)
+		require.Equal(id, e.Message.ID)
+	}
+
+	// Delivering the backlog publishes receipts, then new messages follow
+	s.addMessages(t, "6")
+	for {
+		e := readEvent(t, conn)
+		if e.Type == chat.EventMessage {
+			require.Equal(uint64(6), e.ID)
+			break
+		}
+	}
+}
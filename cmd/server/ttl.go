@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/rchamarthy/chata/store"
+)
+
+func (h *ChatHandler) registerTTL(api *gin.RouterGroup, authz *Authorizer) {
+	api.PUT("/chats/:from/:to/ttl", authz.Allow(auth.CreateChat, "from"), h.SetTTL)
+	api.PUT("/groups/:from/:id/ttl", authz.Allow(auth.CreateChat, "from"), h.SetGroupTTL)
+}
+
+// SetTTL makes the messages of the chat disappear after the ttl in the body,
+// a ttl of 0 keeps them.
+func (h *ChatHandler) SetTTL(c *gin.Context) {
+	session := h.chatSession(c)
+	if session == nil {
+		return
+	}
+
+	h.setTTL(c, session)
+}
+
+// SetGroupTTL sets the ttl of the messages of a group, from must be an admin
+// of the group.
+func (h *ChatHandler) SetGroupTTL(c *gin.Context) {
+	group := h.memberGroup(c)
+	if group == nil {
+		return
+	}
+
+	h.setTTL(c, group)
+}
+
+func (h *ChatHandler) setTTL(c *gin.Context, session *chat.Session) {
+	body := struct {
+		TTL string `json:"ttl"`
+	}{}
+
+	if e := c.BindJSON(&body); e != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": e.Error(),
+		})
+		return
+	}
+
+	ttl := time.Duration(0)
+	if body.TTL != "" {
+		d, err := time.ParseDuration(body.TTL)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "bad ttl: " + err.Error(),
+			})
+			return
+		}
+
+		ttl = d
+	}
+
+	session, err := h.db.SetTTL(session.ID, c.Param("from"), ttl)
+	if err != nil {
+		c.JSON(ttlStatus(err), gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	h.hub.Publish(chat.NewSessionEvent(chat.EventSettings, session))
+
+	c.JSON(http.StatusOK, gin.H{
+		"ttl": ttl.String(),
+	})
+}
+
+func ttlStatus(err error) int {
+	switch {
+	case errors.Is(err, chat.ErrBadTTL):
+		return http.StatusBadRequest
+	case errors.Is(err, chat.ErrNotAdmin):
+		return http.StatusForbidden
+	case errors.Is(err, chat.ErrNotMember), errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rchamarthy/chata/auth"
@@ -11,33 +11,33 @@ import (
 )
 
 type UserHandler struct {
-	usersDir string
-	db       *store.UserDB
+	db    store.UserStore
+	auth  *Authenticator
+	authz *Authorizer
 }
 
 type UserError struct {
 	Error string `json:"error" yaml:"error"`
 }
 
-func NewUserHandler(e *gin.Engine, config *Config) *UserHandler {
+func NewUserHandler(e *gin.Engine, db store.UserStore, maxBody int64) *UserHandler {
 	u := &UserHandler{
-		usersDir: config.UsersDir,
-		db:       store.NewUserDB(config.UsersDir),
+		db:    db,
+		auth:  nil,
+		authz: NewAuthorizer(auth.DefaultPolicy()),
 	}
 
-	if e := u.db.Init(); e != nil {
-		panic(e)
-	}
-
-	if e := u.db.Load(context.Background()); e != nil {
-		panic(e)
-	}
+	u.auth = NewAuthenticator(u.db, maxBody)
 
-	e.GET("/users", u.GetAllUsers)
-	e.GET("/users/:id", u.GetUser)
+	// Registration is signed with the key being registered
 	e.PUT("/users/:id", u.RegisterUser)
-	e.DELETE("/users/:id", u.DeleteUser)
-	e.POST("/users/:id", u.UpdateUser)
+
+	api := e.Group("/", u.auth.Required())
+	api.GET("/users", u.authz.Allow(auth.ListUsers, ""), u.GetAllUsers)
+	api.GET("/users/:id", u.authz.Allow(auth.GetUser, "id"), u.GetUser)
+	api.DELETE("/users/:id", u.authz.Allow(auth.DeleteUser, "id"), u.DeleteUser)
+	api.POST("/users/:id", u.authz.Allow(auth.UpdateUser, "id"), u.UpdateUser)
+	api.POST("/users/:id/keys", u.authz.Allow(auth.UpdateUser, "id"), u.RotateKey)
 
 	return u
 }
@@ -45,11 +45,27 @@ func NewUserHandler(e *gin.Engine, config *Config) *UserHandler {
 func (h *UserHandler) RegisterUser(c *gin.Context) {
 	newUser := auth.NewUser("", "")
 
+	body, err := h.auth.readBody(c)
+	if err != nil {
+		c.JSON(bodyStatus(err), UserError{Error: err.Error()})
+		return
+	}
+
 	if err := c.BindJSON(newUser); err != nil {
 		c.JSON(http.StatusBadRequest, UserError{Error: err.Error()})
 		return
 	}
 
+	if newUser.Key == nil {
+		c.JSON(http.StatusBadRequest, UserError{Error: "user public key cannot be empty"})
+		return
+	}
+
+	if err := h.auth.VerifySelfSigned(c, newUser, body); err != nil {
+		c.JSON(http.StatusUnauthorized, UserError{Error: err.Error()})
+		return
+	}
+
 	if h.db.IsEmpty() {
 		// This is the first user, first is always an admin
 		newUser.Roles.Add(auth.ADMIN)
@@ -68,7 +84,15 @@ func (h *UserHandler) RegisterUser(c *gin.Context) {
 
 	newUser.Key = newUser.Key.Public()
 
-	err := h.db.Add(newUser)
+	rec, err := auth.NewKeyRecord(newUser.Key, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, UserError{Error: err.Error()})
+		return
+	}
+
+	newUser.Keys = []*auth.KeyRecord{rec}
+
+	err = h.db.Add(newUser)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, UserError{Error: err.Error()})
 		return
@@ -142,20 +166,100 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 		return
 	}
 
-	if err := c.BindJSON(user); err != nil {
+	// Bind into a copy so that a rejected update leaves the stored user as is
+	update := user.Copy()
+	keys := update.Keys
+	if err := c.BindJSON(update); err != nil {
 		c.JSON(http.StatusBadRequest, UserError{Error: err.Error()})
 		return
 	}
 
-	user.Key = user.Key.Public()
-	user.Roles.Add(auth.CHATTER)
-	user.Roles.Add(auth.SELF)
+	if update.ID != id {
+		c.JSON(http.StatusBadRequest, UserError{
+			Error: fmt.Sprintf("id %s cannot be changed to %s", id, update.ID),
+		})
+		return
+	}
 
-	err := h.db.Add(user)
+	if !sameKey(update.Key, user.Key) {
+		c.JSON(http.StatusBadRequest, UserError{
+			Error: fmt.Sprintf("key of %s can only be changed with a signed rotation", id),
+		})
+		return
+	}
+
+	update.Key = user.Key
+	update.Keys = keys
+	update.Roles.Add(auth.CHATTER)
+	update.Roles.Add(auth.SELF)
+
+	if !update.Roles.Equal(user.Roles) && !h.authz.Check(c, auth.ChangeRoles, id) {
+		return
+	}
+
+	err := h.db.Add(update)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, UserError{Error: err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, user)
+	c.JSON(http.StatusOK, update)
+}
+
+// RotateKey replaces the key of a user with a new key. The rotation must be
+// signed with the current key, the previous keys are kept to verify old
+// messages.
+func (h *UserHandler) RotateKey(c *gin.Context) {
+	id := c.Params.ByName("id")
+
+	user := h.db.GetUser(id)
+	if user == nil {
+		c.JSON(http.StatusNotFound, UserError{
+			Error: fmt.Sprintf("id %s does not exist", id),
+		})
+		return
+	}
+
+	rec := &auth.KeyRecord{}
+	if err := c.BindJSON(rec); err != nil {
+		c.JSON(http.StatusBadRequest, UserError{Error: err.Error()})
+		return
+	}
+
+	if rec.Key == nil {
+		c.JSON(http.StatusBadRequest, UserError{Error: "key cannot be empty"})
+		return
+	}
+
+	if d := time.Since(rec.Created); d > auth.DefaultClockSkew || d < -auth.DefaultClockSkew {
+		c.JSON(http.StatusBadRequest, UserError{
+			Error: "key creation time is outside the allowed clock skew",
+		})
+		return
+	}
+
+	update := user.Copy()
+	if err := update.AddKey(rec.Public()); err != nil {
+		c.JSON(http.StatusBadRequest, UserError{Error: err.Error()})
+		return
+	}
+
+	if err := h.db.Add(update); err != nil {
+		c.JSON(http.StatusInternalServerError, UserError{Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, update)
+}
+
+// sameKey reports whether both identities have the same public keys.
+func sameKey(a *auth.Identity, b *auth.Identity) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	fa, errA := a.Fingerprint()
+	fb, errB := b.Fingerprint()
+
+	return errA == nil && errB == nil && fa == fb
 }
@@ -0,0 +1,68 @@
+package chata
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TempSuffix ends the names of the temporary files WriteFile writes before it
+// renames them, a crash can leave them behind.
+const TempSuffix = ".tmp"
+
+// IsTempFile reports whether the file is a temporary file of WriteFile.
+func IsTempFile(name string) bool {
+	return strings.HasSuffix(name, TempSuffix)
+}
+
+// WriteFile replaces the file with the data so that a crash leaves either the
+// old or the new content, never a part of it. The data is written to a
+// temporary file next to the file and synced, the temporary file is renamed
+// over the file and the directory is synced so that the rename lasts.
+func WriteFile(name string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(name)
+
+	f, err := os.CreateTemp(dir, filepath.Base(name)+".*"+TempSuffix)
+	if err != nil {
+		return err
+	}
+
+	temp := f.Name()
+	defer os.Remove(temp)
+
+	if _, e := f.Write(data); e != nil {
+		f.Close()
+		return e
+	}
+
+	if e := f.Sync(); e != nil {
+		f.Close()
+		return e
+	}
+
+	if e := f.Close(); e != nil {
+		return e
+	}
+
+	if e := os.Chmod(temp, perm); e != nil {
+		return e
+	}
+
+	if e := os.Rename(temp, name); e != nil {
+		return e
+	}
+
+	return SyncDir(dir)
+}
+
+// SyncDir syncs the directory so that the files created, renamed or removed
+// in it last.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,63 @@
+package chata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// SealedPrefix starts data that was sealed, data without it is in the clear.
+const SealedPrefix = "chata-sealed:"
+
+// ErrNoKey is returned for sealed data that there is no key to unseal.
+var ErrNoKey = errors.New("no key to unseal")
+
+// ErrNotSealed is returned for data in the clear where sealed data is
+// expected. Like ErrNoKey it does not make a file corrupt, the file is sealed
+// with store.SealFiles.
+var ErrNotSealed = errors.New("not sealed")
+
+// Sealer seals data at rest and unseals it again, store.Keyring is one. The
+// data is bound to the name of its file, sealed data moved to another file
+// does not unseal. Sealed data starts with SealedPrefix and holds no
+// newlines, so that the records of a log can be sealed one by one.
+type Sealer interface {
+	Seal(name string, data []byte) ([]byte, error)
+	Unseal(name string, data []byte) ([]byte, error)
+}
+
+// IsSealed reports whether the data was sealed.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(SealedPrefix))
+}
+
+// Seal seals the data of the file with the sealer. Without a sealer the data
+// is left in the clear.
+func Seal(sealer Sealer, file string, data []byte) ([]byte, error) {
+	if sealer == nil {
+		return data, nil
+	}
+
+	return sealer.Seal(filepath.Base(file), data)
+}
+
+// Unseal unseals the data of the file with the sealer. Without a sealer data
+// in the clear is returned as it is and sealed data cannot be read. With one
+// data in the clear is refused, files written before sealing was turned on
+// are sealed once with store.SealFiles.
+func Unseal(sealer Sealer, file string, data []byte) ([]byte, error) {
+	if sealer == nil {
+		if IsSealed(data) {
+			return nil, fmt.Errorf("%w %s: it is sealed", ErrNoKey, file)
+		}
+
+		return data, nil
+	}
+
+	if !IsSealed(data) {
+		return nil, fmt.Errorf("%w %s: it is in the clear", ErrNotSealed, file)
+	}
+
+	return sealer.Unseal(filepath.Base(file), data)
+}
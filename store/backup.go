@@ -0,0 +1,350 @@
+package store
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/rchamarthy/chata"
+)
+
+// SchemaVersion is the version of the layout of the files of the stores.
+// Backups record it and a backup of a later version is not restored. The
+// records in the files have versions of their own, see Migrations.
+const SchemaVersion = 1
+
+// A backup is a tar.gz archive of the files of the users under UsersPrefix
+// and of the chats under ChatsPrefix, followed by the manifest. Backups of
+// sealed stores end with a MAC of the manifest made with the keyring, which
+// Restore checks before it trusts the manifest.
+const (
+	UsersPrefix     = "users/"
+	ChatsPrefix     = "chats/"
+	ManifestFile    = "MANIFEST.json"
+	ManifestMACFile = "MANIFEST.mac"
+)
+
+// manifestKey authenticates manifests, the Keyring of sealed stores is one.
+type manifestKey interface {
+	MAC(data []byte) string
+	VerifyMAC(data []byte, mac string) error
+}
+
+// maxManifestSize bounds the manifest that Restore reads.
+const maxManifestSize = 64 << 20
+
+// ErrBadBackup is returned by Restore for backups that are partial, were
+// changed after they were taken or do not hold valid users and sessions.
+var ErrBadBackup = errors.New("bad backup")
+
+// Manifest lists the files of a backup with their checksums.
+type Manifest struct {
+	Version int          `json:"version" yaml:"version"`
+	Created time.Time    `json:"created" yaml:"created"`
+	Files   []BackupFile `json:"files"   yaml:"files"`
+}
+
+// BackupFile is a file of a backup, Name is its name in the archive.
+type BackupFile struct {
+	Name   string `json:"name"   yaml:"name"`
+	Size   int64  `json:"size"   yaml:"size"`
+	SHA256 string `json:"sha256" yaml:"sha256"`
+}
+
+// Backup writes a backup of the stores to w and returns its manifest. The
+// backup is taken with the stores locked, so that it holds them as they
+// were at one point in time. Users and sessions cannot change while it is
+// taken, sessions can still be read. Files are backed up as they are on
+// disk, sealed files stay sealed and the manifest is authenticated.
+func Backup(w io.Writer, users *UserDB, chats *ChatDB) (*Manifest, error) {
+	users.lock.RLock()
+	defer users.lock.RUnlock()
+
+	// Changes to sessions look their session up under the lock of the
+	// store and make the change under the lock of the session
+	chats.lock.RLock()
+	defer chats.lock.RUnlock()
+
+	entries := chats.sessions.entries()
+	for _, e := range entries {
+		e.lock.RLock()
+	}
+
+	defer func() {
+		for _, e := range entries {
+			e.lock.RUnlock()
+		}
+	}()
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	m := &Manifest{Version: SchemaVersion, Created: time.Now().UTC(), Files: []BackupFile{}}
+
+	for _, d := range [][2]string{{UsersPrefix, users.usersDir}, {ChatsPrefix, chats.sessionsDir}} {
+		prefix, dir := d[0], d[1]
+
+		names, err := dataFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			f, err := backupFile(tw, prefix+name, filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+
+			m.Files = append(m.Files, f)
+		}
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if e := writeEntry(tw, ManifestFile, b, m.Created); e != nil {
+		return nil, e
+	}
+
+	if key, ok := chats.sealer.(manifestKey); ok {
+		if e := writeEntry(tw, ManifestMACFile, []byte(key.MAC(b)+"\n"), m.Created); e != nil {
+			return nil, e
+		}
+	}
+
+	if e := tw.Close(); e != nil {
+		return nil, e
+	}
+
+	return m, gz.Close()
+}
+
+// writeEntry adds the data to the archive under the name.
+func writeEntry(tw *tar.Writer, name string, b []byte, modTime time.Time) error {
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(b)), ModTime: modTime}
+	if e := tw.WriteHeader(hdr); e != nil {
+		return e
+	}
+
+	_, err := tw.Write(b)
+
+	return err
+}
+
+// backupFile adds the file to the archive under the name.
+func backupFile(tw *tar.Writer, name string, p string) (BackupFile, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return BackupFile{}, err
+	}
+
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: info.Size(), ModTime: info.ModTime()}
+	if e := tw.WriteHeader(hdr); e != nil {
+		return BackupFile{}, e
+	}
+
+	h := sha256.New()
+	if _, e := io.Copy(io.MultiWriter(tw, h), f); e != nil {
+		return BackupFile{}, e
+	}
+
+	return BackupFile{Name: name, Size: info.Size(), SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// Restore restores the backup in r into the directories of the users and of
+// the chats, which are unsealed with the sealer. The backup is unpacked
+// beside the directories and checked against its manifest, and every user and
+// session in it must load, before the directories are swapped for it. With a
+// keyring the manifest must carry a MAC made with one of its keys, retired
+// keys included. The directories that were there are moved aside, Restore
+// returns where to. The stores of the directories must not be in use.
+func Restore(r io.Reader, usersDir string, chatsDir string, sealer chata.Sealer) (*Manifest, []string, error) {
+	usersDir, chatsDir = filepath.Clean(usersDir), filepath.Clean(chatsDir)
+	stages := map[string]string{UsersPrefix: usersDir + ".restore", ChatsPrefix: chatsDir + ".restore"}
+
+	// Stages are gone once they are swapped in
+	defer func() {
+		for _, stage := range stages {
+			os.RemoveAll(stage)
+		}
+	}()
+
+	for _, stage := range stages {
+		if e := os.RemoveAll(stage); e != nil {
+			return nil, nil, e
+		}
+
+		if e := os.MkdirAll(stage, 0755); e != nil {
+			return nil, nil, e
+		}
+	}
+
+	key, _ := sealer.(manifestKey)
+	m, err := unpack(r, stages, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	problems, err := CheckUsers(stages[UsersPrefix], sealer, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chats, err := CheckChats(stages[ChatsPrefix], sealer, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if problems = append(problems, chats...); len(problems) > 0 {
+		return nil, nil, fmt.Errorf("%w: %s", ErrBadBackup, problems[0])
+	}
+
+	stamp := time.Now().UTC().Format("20060102T150405")
+	aside := []string{}
+	for _, swap := range [][2]string{{usersDir, stages[UsersPrefix]}, {chatsDir, stages[ChatsPrefix]}} {
+		dir, stage := swap[0], swap[1]
+		if exists(dir) {
+			if e := os.Rename(dir, dir+".pre-restore."+stamp); e != nil {
+				return nil, aside, e
+			}
+
+			aside = append(aside, dir+".pre-restore."+stamp)
+		}
+
+		if e := os.Rename(stage, dir); e != nil {
+			return nil, aside, e
+		}
+
+		if e := chata.SyncDir(filepath.Dir(dir)); e != nil {
+			return nil, aside, e
+		}
+	}
+
+	return m, aside, nil
+}
+
+// unpack unpacks the backup into the directories of the prefixes and checks
+// the files against the manifest, and the manifest against its MAC if there
+// is a key.
+func unpack(r io.Reader, stages map[string]string, key manifestKey) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadBackup, err)
+	}
+	defer gz.Close()
+
+	var manifest, mac []byte
+	files := map[string]BackupFile{}
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrBadBackup, err)
+		}
+
+		if hdr.Name == ManifestFile || hdr.Name == ManifestMACFile {
+			b, e := io.ReadAll(io.LimitReader(tr, maxManifestSize))
+			if e != nil {
+				return nil, fmt.Errorf("%w: %s: %w", ErrBadBackup, hdr.Name, e)
+			}
+
+			if hdr.Name == ManifestFile {
+				manifest = b
+			} else {
+				mac = b
+			}
+
+			continue
+		}
+
+		dir, name := path.Split(hdr.Name)
+		stage := stages[dir]
+		if stage == "" || !filepath.IsLocal(name) || name != filepath.Base(name) || hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%w: unexpected file %s", ErrBadBackup, hdr.Name)
+		}
+
+		f, err := unpackFile(tr, hdr.Name, filepath.Join(stage, name))
+		if err != nil {
+			return nil, err
+		}
+
+		files[hdr.Name] = f
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("%w: no manifest, the backup is partial", ErrBadBackup)
+	}
+
+	if key != nil {
+		if mac == nil {
+			return nil, fmt.Errorf("%w: the manifest has no MAC", ErrBadBackup)
+		}
+
+		if e := key.VerifyMAC(manifest, string(mac)); e != nil {
+			return nil, fmt.Errorf("%w: manifest: %w", ErrBadBackup, e)
+		}
+	}
+
+	m := &Manifest{Version: 0, Created: time.Time{}, Files: nil}
+	if e := json.Unmarshal(manifest, m); e != nil {
+		return nil, fmt.Errorf("%w: manifest: %w", ErrBadBackup, e)
+	}
+
+	if m.Version > SchemaVersion {
+		return nil, fmt.Errorf("%w: version %d is later than %d", ErrBadBackup, m.Version, SchemaVersion)
+	}
+
+	for _, f := range m.Files {
+		if files[f.Name] != f {
+			return nil, fmt.Errorf("%w: %s does not match the manifest", ErrBadBackup, f.Name)
+		}
+
+		delete(files, f.Name)
+	}
+
+	if len(files) > 0 {
+		return nil, fmt.Errorf("%w: %d files are not in the manifest", ErrBadBackup, len(files))
+	}
+
+	return m, nil
+}
+
+// unpackFile writes the file in the archive to p.
+func unpackFile(r io.Reader, name string, p string) (BackupFile, error) {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return BackupFile{}, fmt.Errorf("%w: %s: %w", ErrBadBackup, name, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return BackupFile{}, fmt.Errorf("%w: %s: %w", ErrBadBackup, name, err)
+	}
+
+	if e := f.Sync(); e != nil {
+		return BackupFile{}, e
+	}
+
+	return BackupFile{Name: name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
@@ -0,0 +1,292 @@
+package store_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/rchamarthy/chata/store"
+	"github.com/stretchr/testify/require"
+)
+
+// rewrite rewrites the backup with the files that change returns, a file is
+// dropped if change returns false.
+func rewrite(t *testing.T, backup []byte, change func(hdr *tar.Header, data []byte) ([]byte, bool)) []byte {
+	t.Helper()
+
+	gz, err := gzip.NewReader(bytes.NewReader(backup))
+	require.NoError(t, err)
+
+	out := &bytes.Buffer{}
+	zw := gzip.NewWriter(out)
+	tw := tar.NewWriter(zw)
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		data, keep := change(hdr, data)
+		if !keep {
+			continue
+		}
+
+		hdr.Size = int64(len(data))
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(data)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
+
+	return out.Bytes()
+}
+
+func TestBackup(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	dir := t.TempDir()
+	ctx := context.Background()
+	usersDir, chatsDir := path.Join(dir, "users"), path.Join(dir, "chats")
+
+	users, chats := store.NewUserDB(usersDir), store.NewChatDB(chatsDir)
+	require.NoError(users.Init())
+	require.NoError(chats.Init())
+
+	ids := []string{}
+	for i := range 5 {
+		id := fmt.Sprintf("user%d", i)
+		require.NoError(users.Add(auth.NewUser(id, id)))
+		if i > 0 {
+			session := chat.NewSession("user0", id)
+			require.NoError(chats.Add(session))
+			_, _, err := chats.AppendMessage(session.ID, chat.Message{Sender: "user0", Body: "hi", Time: time.Now()})
+			require.NoError(err)
+			ids = append(ids, session.ID)
+		}
+	}
+
+	// Messages keep coming while the backup is taken
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for _, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				_, _, _ = chats.AppendMessage(id, chat.Message{Sender: "user0", Body: "hi", Time: time.Now()})
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	backup := &bytes.Buffer{}
+	m, err := store.Backup(backup, users, chats)
+	close(done)
+	wg.Wait()
+	require.NoError(err)
+	require.Equal(store.SchemaVersion, m.Version)
+	require.Len(m.Files, 5+4+4)
+
+	// Restore swaps the directories for the backup and keeps them aside
+	restored, aside, err := store.Restore(bytes.NewReader(backup.Bytes()), usersDir, chatsDir, nil)
+	require.NoError(err)
+	require.Equal(m.Files, restored.Files)
+	require.Len(aside, 2)
+	require.DirExists(aside[0])
+
+	reloaded := store.NewChatDB(chatsDir)
+	require.NoError(reloaded.Load(ctx))
+	require.Len(reloaded.All(), 4)
+	for _, s := range reloaded.All() {
+		// Every message of the backup is whole
+		for i, msg := range s.Messages {
+			require.Equal(uint64(i+1), msg.ID)
+		}
+	}
+
+	reloadedUsers := store.NewUserDB(usersDir)
+	require.NoError(reloadedUsers.Load(ctx))
+	require.Len(reloadedUsers.GetAllUsers(), 5)
+
+	// Restoring into directories that are not there yet
+	other := t.TempDir()
+	_, aside, err = store.Restore(bytes.NewReader(backup.Bytes()), path.Join(other, "u"), path.Join(other, "c"), nil)
+	require.NoError(err)
+	require.Empty(aside)
+	require.FileExists(path.Join(other, "u", "user1"))
+}
+
+func TestRestoreBadBackup(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	dir := t.TempDir()
+	usersDir, chatsDir := path.Join(dir, "users"), path.Join(dir, "chats")
+
+	users, chats := store.NewUserDB(usersDir), store.NewChatDB(chatsDir)
+	require.NoError(users.Init())
+	require.NoError(chats.Init())
+	require.NoError(users.Add(auth.NewUser("user1", "user1")))
+	require.NoError(chats.Add(chat.NewSession("user1", "user2")))
+
+	buf := &bytes.Buffer{}
+	_, err := store.Backup(buf, users, chats)
+	require.NoError(err)
+	backup := buf.Bytes()
+
+	bad := map[string][]byte{
+		"truncated": backup[:len(backup)/2],
+		"no manifest": rewrite(t, backup, func(hdr *tar.Header, data []byte) ([]byte, bool) {
+			return data, hdr.Name != store.ManifestFile
+		}),
+		"tampered": rewrite(t, backup, func(hdr *tar.Header, data []byte) ([]byte, bool) {
+			if hdr.Name == store.UsersPrefix+"user1" {
+				data = bytes.Replace(data, []byte("user1"), []byte("userX"), 1)
+			}
+
+			return data, true
+		}),
+		"missing file": rewrite(t, backup, func(hdr *tar.Header, data []byte) ([]byte, bool) {
+			return data, hdr.Name != store.UsersPrefix+"user1"
+		}),
+		"extra file": rewrite(t, backup, func(hdr *tar.Header, data []byte) ([]byte, bool) {
+			if hdr.Name == store.ManifestFile {
+				return data, true
+			}
+
+			hdr.Name += "-copy"
+			return data, true
+		}),
+		"outside": rewrite(t, backup, func(hdr *tar.Header, data []byte) ([]byte, bool) {
+			if hdr.Name == store.UsersPrefix+"user1" {
+				hdr.Name = store.UsersPrefix + "../../user1"
+			}
+
+			return data, true
+		}),
+		"later version": rewrite(t, backup, func(hdr *tar.Header, data []byte) ([]byte, bool) {
+			if hdr.Name == store.ManifestFile {
+				v := fmt.Sprintf(`"version": %d`, store.SchemaVersion)
+				data = bytes.Replace(data, []byte(v), []byte(`"version": 99`), 1)
+			}
+
+			return data, true
+		}),
+	}
+
+	for name, b := range bad {
+		_, _, err := store.Restore(bytes.NewReader(b), usersDir, chatsDir, nil)
+		require.ErrorIs(err, store.ErrBadBackup, name)
+	}
+
+	// Backups that hold corrupt users are not restored, even when they
+	// match their manifest
+	require.NoError(os.WriteFile(path.Join(usersDir, "user2"), []byte("id: ["), 0600))
+	buf.Reset()
+	_, err = store.Backup(buf, users, chats)
+	require.NoError(err)
+	_, _, err = store.Restore(bytes.NewReader(buf.Bytes()), usersDir, chatsDir, nil)
+	require.ErrorIs(err, store.ErrBadBackup)
+
+	// Nothing was swapped in
+	entries, err := os.ReadDir(dir)
+	require.NoError(err)
+	require.Len(entries, 2)
+	require.FileExists(path.Join(usersDir, "user2"))
+}
+
+func TestSealedBackup(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	dir := t.TempDir()
+	usersDir, chatsDir := path.Join(dir, "users"), path.Join(dir, "chats")
+	keyFile := path.Join(t.TempDir(), "key")
+	require.NoError(store.GenerateKey(keyFile))
+	k, err := store.LoadKeyring(keyFile)
+	require.NoError(err)
+
+	users, chats := sealedStores(t, dir, k)
+	require.NoError(users.Add(auth.NewUser("Alice", "alice")))
+	require.NoError(users.Add(auth.NewUser("Bob", "bob")))
+	require.NoError(chats.Add(chat.NewSession("alice", "bob")))
+
+	buf := &bytes.Buffer{}
+	m, err := store.Backup(buf, users, chats)
+	require.NoError(err)
+	backup := buf.Bytes()
+
+	// A manifest that is rewritten to match a backup with files taken out
+	// does not carry a MAC that verifies
+	dropped := rewrite(t, backup, func(hdr *tar.Header, data []byte) ([]byte, bool) {
+		if hdr.Name != store.ManifestFile {
+			return data, hdr.Name != store.UsersPrefix+"bob"
+		}
+
+		manifest := store.Manifest{Version: 0, Created: time.Time{}, Files: nil}
+		require.NoError(json.Unmarshal(data, &manifest))
+		manifest.Files = slices.DeleteFunc(manifest.Files, func(f store.BackupFile) bool {
+			return f.Name == store.UsersPrefix+"bob"
+		})
+		b, e := json.MarshalIndent(manifest, "", "  ")
+		require.NoError(e)
+
+		return b, true
+	})
+	noMAC := rewrite(t, backup, func(hdr *tar.Header, data []byte) ([]byte, bool) {
+		return data, hdr.Name != store.ManifestMACFile
+	})
+
+	for name, b := range map[string][]byte{"dropped": dropped, "no MAC": noMAC} {
+		_, _, err := store.Restore(bytes.NewReader(b), usersDir, chatsDir, k)
+		require.ErrorIs(err, store.ErrBadBackup, name)
+	}
+
+	// Backups taken before a rekey restore with the retired key
+	_, err = store.Rekey(keyFile, usersDir, chatsDir)
+	require.NoError(err)
+	k, err = store.LoadKeyring(keyFile)
+	require.NoError(err)
+	restored, _, err := store.Restore(bytes.NewReader(backup), usersDir, chatsDir, k)
+	require.NoError(err)
+	require.Equal(m.Files, restored.Files)
+	users, _ = sealedStores(t, dir, k)
+	require.True(users.HasUser("bob"))
+
+	// But not once it is removed
+	require.NoError(os.Remove(keyFile + store.RetiredKeySuffix))
+	k, err = store.LoadKeyring(keyFile)
+	require.NoError(err)
+	_, _, err = store.Restore(bytes.NewReader(backup), usersDir, chatsDir, k)
+	require.ErrorIs(err, store.ErrBadBackup)
+	require.ErrorIs(err, chata.ErrNoKey)
+}
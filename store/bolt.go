@@ -0,0 +1,576 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rchamarthy/chata"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the bolt database. Users and sessions are saved in YAML like
+// their files, messages in JSON like the message logs, with one nested
+// bucket per session keyed by the id of the message.
+var (
+	usersBucket    = []byte("users")
+	sessionsBucket = []byte("sessions")
+	messagesBucket = []byte("messages")
+)
+
+// BoltOpenTimeout is how long OpenBolt waits for another process to release
+// the database.
+const BoltOpenTimeout = 5 * time.Second
+
+// OpenBolt opens, or creates, a bolt database that can hold both the users
+// and the chats.
+func OpenBolt(file string) (*bolt.DB, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: BoltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", file, err)
+	}
+
+	return db, nil
+}
+
+// BoltUserStore is a UserStore that keeps the users in a bolt database.
+type BoltUserStore struct {
+	db    *bolt.DB
+	users Users
+	lock  *sync.RWMutex
+}
+
+func NewBoltUserStore(db *bolt.DB) *BoltUserStore {
+	return &BoltUserStore{
+		db:    db,
+		users: Users{},
+		lock:  &sync.RWMutex{},
+	}
+}
+
+func (s *BoltUserStore) Init() error {
+	return createBuckets(s.db, usersBucket)
+}
+
+func (s *BoltUserStore) Load(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Users saved in an older schema are upgraded first
+	if e := upgradeBucket(ctx, s.db, usersBucket, RecordUser); e != nil {
+		return e
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usersBucket)
+		if b == nil {
+			return errNoBucket(usersBucket)
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			user, err := auth.ParseUser(v)
+			if err != nil {
+				return fmt.Errorf("error loading user %s: %w", k, err)
+			}
+
+			return s.users.Add(user)
+		})
+	})
+}
+
+func (s *BoltUserStore) Destroy() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.users = Users{}
+	return deleteBuckets(s.db, usersBucket)
+}
+
+func (s *BoltUserStore) Add(user *auth.User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if e := user.Validate(); e != nil {
+		return e
+	}
+
+	b, err := user.Marshal()
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).Put([]byte(user.ID), b)
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.users.Add(user)
+}
+
+func (s *BoltUserStore) GetUser(id string) *auth.User {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.users[id]
+}
+
+func (s *BoltUserStore) GetAllUsers() Users {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.users.Copy()
+}
+
+func (s *BoltUserStore) DeleteUser(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.users[id] == nil {
+		return fmt.Errorf("user %s not found", id)
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(s.users, id)
+	return nil
+}
+
+func (s *BoltUserStore) HasUser(id string) bool {
+	return s.GetUser(id) != nil
+}
+
+func (s *BoltUserStore) IsEmpty() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return len(s.users) == 0
+}
+
+// BoltChatStore is a ChatStore that keeps the chats in a bolt database. A
+// message is appended in a transaction of its own, which bolt syncs to disk
+// before it commits.
+type BoltChatStore struct {
+	db       *bolt.DB
+	sessions *Sessions
+	lock     *sync.RWMutex
+}
+
+func NewBoltChatStore(db *bolt.DB) *BoltChatStore {
+	return &BoltChatStore{
+		db:       db,
+		sessions: NewSessions(),
+		lock:     &sync.RWMutex{},
+	}
+}
+
+func (s *BoltChatStore) Init() error {
+	return createBuckets(s.db, sessionsBucket, messagesBucket)
+}
+
+func (s *BoltChatStore) Load(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Sessions saved in an older schema are upgraded first
+	if e := upgradeBucket(ctx, s.db, sessionsBucket, RecordSession); e != nil {
+		return e
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(sessionsBucket)
+		messages := tx.Bucket(messagesBucket)
+		if sessions == nil || messages == nil {
+			return errNoBucket(sessionsBucket)
+		}
+
+		return sessions.ForEach(func(k, v []byte) error {
+			session, err := chat.ParseSession(v)
+			if err != nil {
+				return fmt.Errorf("error loading session %s: %w", k, err)
+			}
+
+			if b := messages.Bucket(k); b != nil {
+				e := b.ForEach(func(_, m []byte) error {
+					msg := chat.Message{}
+					if e := json.Unmarshal(m, &msg); e != nil {
+						return fmt.Errorf("error loading message of session %s: %w", k, e)
+					}
+
+					session.Messages = append(session.Messages, msg)
+					return nil
+				})
+				if e != nil {
+					return e
+				}
+			}
+
+			session.NumberMessages()
+			s.sessions.Add(session)
+			return nil
+		})
+	})
+}
+
+func (s *BoltChatStore) Destroy() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sessions = NewSessions()
+	return deleteBuckets(s.db, sessionsBucket, messagesBucket)
+}
+
+func (s *BoltChatStore) Add(session *chat.Session) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session.NumberMessages()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if e := putSession(tx, session); e != nil {
+			return e
+		}
+
+		// Messages the session already has go in with it
+		b, err := tx.Bucket(messagesBucket).CreateBucketIfNotExists([]byte(session.ID))
+		if err != nil {
+			return err
+		}
+
+		for _, m := range session.Messages {
+			if e := putMessage(b, m); e != nil {
+				return e
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.sessions.Add(session)
+	return nil
+}
+
+func (s *BoltChatStore) Get(user1 string, user2 string) *chat.Session {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.sessions.Get(user1, user2)
+}
+
+func (s *BoltChatStore) GetByID(id string) *chat.Session {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.sessions.GetByID(id)
+}
+
+func (s *BoltChatStore) GetSessionsByUser(user string) []*chat.Session {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.sessions.GetSessionsByUser(user)
+}
+
+func (s *BoltChatStore) GetGroupsByUser(user string) []*chat.Session {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.sessions.GetGroupsByUser(user)
+}
+
+func (s *BoltChatStore) Delete(user1 string, user2 string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session := s.sessions.Get(user1, user2)
+	if session == nil {
+		return fmt.Errorf("session for users %s and %s not found", user1, user2)
+	}
+
+	return s.delete(session.ID)
+}
+
+func (s *BoltChatStore) DeleteByID(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.delete(id)
+}
+
+// delete must be called with the lock held.
+func (s *BoltChatStore) delete(id string) error {
+	return s.sessions.remove(id, func(*chat.Session) error {
+		return s.db.Update(func(tx *bolt.Tx) error {
+			if e := tx.Bucket(sessionsBucket).Delete([]byte(id)); e != nil {
+				return e
+			}
+
+			e := tx.Bucket(messagesBucket).DeleteBucket([]byte(id))
+			if errors.Is(e, bolt.ErrBucketNotFound) {
+				return nil
+			}
+
+			return e
+		})
+	})
+}
+
+func (s *BoltChatStore) UpdateMembers(id string, update func(group *chat.Session) error) (*chat.Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.sessions.UpdateMembers(id, func(group *chat.Session) error {
+		if e := update(group); e != nil {
+			return e
+		}
+
+		return s.db.Update(func(tx *bolt.Tx) error {
+			return putSession(tx, group)
+		})
+	})
+}
+
+// update runs change on the session with the id under the lock of the
+// session alone, bolt orders the transactions of different sessions.
+func (s *BoltChatStore) update(id string, change func(session *chat.Session) error) (*chat.Session, error) {
+	s.lock.RLock()
+	e := s.sessions.entry(id)
+	s.lock.RUnlock()
+
+	return e.update(id, change)
+}
+
+func (s *BoltChatStore) AppendMessage(id string, m chat.Message) (*chat.Session, chat.Message, error) {
+	session, err := s.update(id, func(session *chat.Session) error {
+		var err error
+		if m, err = session.Prepare(m, time.Now()); err != nil {
+			return err
+		}
+
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.Bucket(messagesBucket).CreateBucketIfNotExists([]byte(id))
+			if err != nil {
+				return err
+			}
+
+			return putMessage(b, m)
+		})
+		if err != nil {
+			return err
+		}
+
+		session.Append(m)
+		return nil
+	})
+
+	return session, m, err
+}
+
+// ChangeMessage saves the changed message over the one it replaces.
+func (s *BoltChatStore) ChangeMessage(id string, c chat.Change) (*chat.Session, chat.Message, error) {
+	var m chat.Message
+	session, err := s.update(id, func(session *chat.Session) error {
+		// Change a snapshot so the session is left as it was if the
+		// update fails
+		changed := session.Snapshot()
+		i, err := changed.Apply(c)
+		if err != nil {
+			return err
+		}
+
+		m = changed.Messages[i]
+
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(messagesBucket).Bucket([]byte(id))
+			if b == nil {
+				return fmt.Errorf("messages of session %s not found", id)
+			}
+
+			return putMessage(b, m)
+		})
+		if err != nil {
+			return err
+		}
+
+		session.Messages = changed.Messages
+		return nil
+	})
+
+	return session, m, err
+}
+
+func (s *BoltChatStore) MarkReceipt(id string, user string, r chat.Receipt) (*chat.Session, bool, error) {
+	changed := false
+	session, err := s.update(id, func(session *chat.Session) error {
+		receipts := session.Receipts
+		if !session.Mark(user, r) {
+			return nil
+		}
+
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			return putSession(tx, session)
+		})
+		if err != nil {
+			session.Receipts = receipts
+			return err
+		}
+
+		changed = true
+		return nil
+	})
+
+	return session, changed, err
+}
+
+func (s *BoltChatStore) SetTTL(id string, user string, ttl time.Duration) (*chat.Session, error) {
+	return s.update(id, func(session *chat.Session) error {
+		old := session.TTL
+		if e := session.SetTTL(user, ttl); e != nil {
+			return e
+		}
+
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			return putSession(tx, session)
+		})
+		if err != nil {
+			session.TTL = old
+			return err
+		}
+
+		return nil
+	})
+}
+
+func (s *BoltChatStore) All() []*chat.Session {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.sessions.All()
+}
+
+// Purge deletes the expired messages of the session and saves the id of the
+// last of them with the session, in one transaction.
+func (s *BoltChatStore) Purge(id string, now time.Time, r chat.Retention) (*chat.Session, int, error) {
+	n := 0
+	session, err := s.update(id, func(session *chat.Session) error {
+		if n = session.Expired(now, r); n == 0 {
+			return nil
+		}
+
+		purged := session.Snapshot()
+		purged.Purge(n)
+
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			if b := tx.Bucket(messagesBucket).Bucket([]byte(id)); b != nil {
+				for _, m := range session.Messages[:n] {
+					if e := b.Delete(messageKey(m.ID)); e != nil {
+						return e
+					}
+				}
+			}
+
+			return putSession(tx, purged)
+		})
+		if err != nil {
+			n = 0
+			return err
+		}
+
+		session.Purge(n)
+		return nil
+	})
+
+	return session, n, err
+}
+
+// Compact does nothing, bolt reuses the pages it frees.
+func (s *BoltChatStore) Compact(context.Context) error {
+	return nil
+}
+
+// upgradeBucket upgrades the records of the kind in the bucket that were
+// saved in an older schema.
+func upgradeBucket(ctx context.Context, db *bolt.DB, bucket []byte, kind string) error {
+	upgrades, err := migrateBucket(db, bucket, kind, false)
+	for _, u := range upgrades {
+		chata.Log(ctx).Info("upgraded "+kind, "record", u.Record, "from", u.From, "to", u.To)
+	}
+
+	return err
+}
+
+func putSession(tx *bolt.Tx, session *chat.Session) error {
+	b, err := session.MarshalMetadata()
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(sessionsBucket).Put([]byte(session.ID), b)
+}
+
+func putMessage(b *bolt.Bucket, m chat.Message) error {
+	v, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(messageKey(m.ID), v)
+}
+
+// messageKey returns the key of the message with the id, big endian so that
+// the messages are kept in order.
+func messageKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+
+	return k
+}
+
+func createBuckets(db *bolt.DB, names ...[]byte) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			if _, e := tx.CreateBucketIfNotExists(name); e != nil {
+				return e
+			}
+		}
+
+		return nil
+	})
+}
+
+// deleteBuckets empties the buckets, they are created again so the store
+// remains usable.
+func deleteBuckets(db *bolt.DB, names ...[]byte) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			if e := tx.DeleteBucket(name); e != nil && !errors.Is(e, bolt.ErrBucketNotFound) {
+				return e
+			}
+
+			if _, e := tx.CreateBucket(name); e != nil {
+				return e
+			}
+		}
+
+		return nil
+	})
+}
+
+func errNoBucket(name []byte) error {
+	return fmt.Errorf("bucket %s not found, the store is not initialized", name)
+}
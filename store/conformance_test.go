@@ -0,0 +1,249 @@
+package store_test
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/rchamarthy/chata/store"
+	"github.com/stretchr/testify/require"
+)
+
+// backend opens the stores of a backend in dir. Stores of a durable backend
+// that are opened again in the same dir find what was saved before.
+type backend struct {
+	name    string
+	durable bool
+	open    func(t *testing.T, dir string) (store.UserStore, store.ChatStore, func())
+}
+
+func backends() []backend {
+	return []backend{
+		{
+			name:    store.BackendFile,
+			durable: true,
+			open: func(_ *testing.T, dir string) (store.UserStore, store.ChatStore, func()) {
+				return store.NewUserDB(path.Join(dir, "users")), store.NewChatDB(path.Join(dir, "chats")), func() {}
+			},
+		},
+		{
+			name:    store.BackendMemory,
+			durable: false,
+			open: func(*testing.T, string) (store.UserStore, store.ChatStore, func()) {
+				return store.NewMemoryUserStore(), store.NewMemoryChatStore(), func() {}
+			},
+		},
+		{
+			name:    store.BackendBolt,
+			durable: true,
+			open: func(t *testing.T, dir string) (store.UserStore, store.ChatStore, func()) {
+				db, err := store.OpenBolt(path.Join(dir, "chata.db"))
+				require.NoError(t, err)
+
+				return store.NewBoltUserStore(db), store.NewBoltChatStore(db), func() { db.Close() }
+			},
+		},
+	}
+}
+
+func TestUserStoreConformance(t *testing.T) {
+	t.Parallel()
+
+	for _, b := range backends() {
+		t.Run(b.name, func(t *testing.T) {
+			t.Parallel()
+
+			require := require.New(t)
+			dir := t.TempDir()
+			ctx := context.Background()
+
+			users, _, closeStores := b.open(t, dir)
+			require.NoError(users.Init())
+			require.NoError(users.Load(ctx))
+			require.True(users.IsEmpty())
+
+			require.Error(users.Add(auth.NewUser("", "")))
+			require.NoError(users.Add(auth.NewUser("User One", "user1", auth.ADMIN).Public()))
+			require.NoError(users.Add(auth.NewUser("User Two", "user2").Public()))
+			require.False(users.IsEmpty())
+			require.True(users.HasUser("user1"))
+			require.False(users.HasUser("user3"))
+			require.Nil(users.GetUser("user3"))
+			require.Len(users.GetAllUsers(), 2)
+
+			// Adding a user again updates it
+			update := users.GetUser("user2").Copy()
+			update.Name = "Second User"
+			require.NoError(users.Add(update))
+			require.Equal("Second User", users.GetUser("user2").Name)
+
+			require.NoError(users.DeleteUser("user1"))
+			require.Error(users.DeleteUser("user1"))
+			require.Len(users.GetAllUsers(), 1)
+			closeStores()
+
+			if b.durable {
+				users, _, closeStores = b.open(t, dir)
+				require.NoError(users.Load(ctx))
+
+				u := users.GetUser("user2")
+				require.NotNil(u)
+				require.Equal("Second User", u.Name)
+				require.True(u.Roles.HasRole(auth.SELF))
+				require.NoError(u.VerifyKeyChain(u.Keys[0].Fingerprint))
+				require.Nil(users.GetUser("user1"))
+
+				require.NoError(users.Destroy())
+				require.True(users.IsEmpty())
+				closeStores()
+			}
+		})
+	}
+}
+
+func TestChatStoreConformance(t *testing.T) {
+	t.Parallel()
+
+	for _, b := range backends() {
+		t.Run(b.name, func(t *testing.T) {
+			t.Parallel()
+
+			require := require.New(t)
+			dir := t.TempDir()
+			ctx := context.Background()
+
+			_, chats, closeStores := b.open(t, dir)
+			require.NoError(chats.Init())
+			require.NoError(chats.Load(ctx))
+
+			session := chat.NewSession("user1", "user2")
+			require.NoError(chats.Add(session))
+			require.Equal(session, chats.Get("user2", "user1"))
+			require.Equal(session, chats.GetByID(session.ID))
+			require.Nil(chats.Get("user1", "user3"))
+
+			group, err := chat.NewGroup("user1", "friends", "user2")
+			require.NoError(err)
+			require.NoError(chats.Add(group))
+			require.Len(chats.GetSessionsByUser("user1"), 2)
+			require.Len(chats.GetGroupsByUser("user2"), 1)
+			require.Empty(chats.GetGroupsByUser("user3"))
+
+			msg := chat.Message{Sender: "user1", Body: "hello", Time: time.Now().UTC()}
+			snapshot := chats.GetByID(group.ID)
+			session, saved, err := chats.AppendMessage(session.ID, msg)
+			require.NoError(err)
+			require.Equal(uint64(1), saved.ID)
+			_, _, err = chats.AppendMessage(group.ID, msg)
+			require.NoError(err)
+			hi := chat.Message{Sender: "user2", Body: "hi", Time: time.Now().UTC(), ClientID: "c1"}
+			_, saved, err = chats.AppendMessage(group.ID, hi)
+			require.NoError(err)
+			require.Equal(uint64(2), saved.ID)
+
+			// A message sent again with its client id is only added once
+			_, again, err := chats.AppendMessage(group.ID, hi)
+			require.ErrorIs(err, chat.ErrDuplicateMessage)
+			require.Equal(saved, again)
+			mine := chat.Message{Sender: "user1", Body: "mine", Time: time.Now().UTC(), ClientID: "c1"}
+			group, _, err = chats.AppendMessage(group.ID, mine)
+			require.NoError(err)
+			require.Len(session.Messages, 1)
+			require.Len(group.Messages, 3)
+			require.Empty(snapshot.Messages, "snapshots do not change")
+			_, _, err = chats.AppendMessage("missing", msg)
+			require.ErrorIs(err, store.ErrNotFound)
+
+			group, err = chats.UpdateMembers(group.ID, func(g *chat.Session) error {
+				return g.AddMember("user1", "user3")
+			})
+			require.NoError(err)
+			require.Equal([]string{"user1", "user2", "user3"}, group.Members())
+			require.Len(chats.GetGroupsByUser("user3"), 1)
+			_, err = chats.UpdateMembers(group.ID, func(g *chat.Session) error {
+				return g.AddMember("user2", "user4")
+			})
+			require.ErrorIs(err, chat.ErrNotAdmin)
+			require.Len(chats.GetGroupsByUser("user3"), 1)
+			_, err = chats.UpdateMembers(session.ID, func(*chat.Session) error { return nil })
+			require.Error(err)
+
+			require.NoError(chats.Compact(ctx))
+
+			// Edits and deletions are saved, after the compaction so that a
+			// reload replays them
+			edit := chat.Message{Sender: "user1", Body: "mine!", Time: time.Now().UTC(), Replaces: 3}
+			before := group
+			group, changed, err := chats.ChangeMessage(group.ID, chat.NewEdit(edit))
+			require.NoError(err)
+			require.Equal("mine!", changed.Current().Body)
+			require.Equal("mine!", group.Messages[2].Current().Body)
+			require.Equal("mine", before.Messages[2].Current().Body, "snapshots do not change")
+			_, _, err = chats.ChangeMessage(group.ID, chat.NewEdit(chat.Message{Sender: "user1", Body: "x", Replaces: 2}))
+			require.ErrorIs(err, chat.ErrNotSender)
+			require.Empty(chats.GetByID(group.ID).Messages[1].Edits)
+			_, changed, err = chats.ChangeMessage(group.ID, chat.NewDelete(1, "user2", time.Now().UTC()))
+			require.NoError(err)
+			require.True(changed.IsDeleted())
+			_, _, err = chats.ChangeMessage(session.ID, chat.NewDelete(2, "user1", time.Now().UTC()))
+			require.ErrorIs(err, chat.ErrNoMessage)
+
+			group, changedReceipt, err := chats.MarkReceipt(group.ID, "user2", chat.Receipt{Delivered: 3, Read: 2})
+			require.NoError(err)
+			require.True(changedReceipt)
+			require.Equal(chat.Receipt{Delivered: 3, Read: 2}, group.Receipt("user2"))
+			_, changedReceipt, err = chats.MarkReceipt(group.ID, "user2", chat.Receipt{Delivered: 1, Read: 1})
+			require.NoError(err)
+			require.False(changedReceipt)
+			closeStores()
+
+			if b.durable {
+				_, chats, closeStores = b.open(t, dir)
+				require.NoError(chats.Load(ctx))
+
+				s := chats.Get("user1", "user2")
+				require.NotNil(s)
+				require.Len(s.Messages, 1)
+				require.Equal("hello", s.Messages[0].Body)
+				require.True(msg.Time.Equal(s.Messages[0].Time))
+
+				g := chats.GetByID(group.ID)
+				require.NotNil(g)
+				require.Equal([]string{"user1", "user2", "user3"}, g.Members())
+				require.Len(g.Messages, 3)
+				require.Equal("hi", g.Messages[1].Body)
+				require.Equal(uint64(2), g.Messages[1].ID)
+				require.True(g.Messages[0].IsDeleted())
+				require.Empty(g.Messages[0].Body)
+				require.Equal("mine!", g.Messages[2].Current().Body)
+				require.Equal("mine", g.Messages[2].Body)
+				require.Equal(chat.Receipt{Delivered: 3, Read: 2}, g.Receipt("user2"))
+				require.Len(chats.GetGroupsByUser("user3"), 1)
+
+				// Duplicates are found after a reload
+				_, _, err = chats.AppendMessage(g.ID, hi)
+				require.ErrorIs(err, chat.ErrDuplicateMessage)
+
+				// Appends go after the messages that were loaded
+				_, saved, err = chats.AppendMessage(g.ID, msg)
+				require.NoError(err)
+				require.Equal(uint64(4), saved.ID)
+				defer closeStores()
+			}
+
+			require.NoError(chats.Delete("user2", "user1"))
+			require.Error(chats.Delete("user1", "user2"))
+			require.Nil(chats.GetByID(session.ID))
+			require.NoError(chats.DeleteByID(group.ID))
+			require.Error(chats.DeleteByID(group.ID))
+			require.Empty(chats.GetSessionsByUser("user1"))
+
+			require.NoError(chats.Add(chat.NewSession("user1", "user2")))
+			require.NoError(chats.Destroy())
+			require.Empty(chats.GetSessionsByUser("user1"))
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rchamarthy/chata"
+	"github.com/rchamarthy/chata/chat"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Problem is a file of a store that is not as it should be. Repair is what
+// was done about it, it is empty if nothing was.
+type Problem struct {
+	File    string `json:"file"             yaml:"file"`
+	Problem string `json:"problem"          yaml:"problem"`
+	Repair  string `json:"repair,omitempty" yaml:"repair,omitempty"`
+}
+
+func (p Problem) String() string {
+	if p.Repair == "" {
+		return p.File + ": " + p.Problem
+	}
+
+	return p.File + ": " + p.Problem + " (" + p.Repair + ")"
+}
+
+// checker checks the files of a directory of a store and repairs them if it
+// was asked to.
+type checker struct {
+	dir      string
+	sealer   chata.Sealer
+	repair   bool
+	problems []Problem
+}
+
+// report records the problem with the file and, if the checker repairs,
+// repairs it with fix.
+func (c *checker) report(name string, problem string, repair string, fix func() error) error {
+	p := Problem{File: filepath.Join(c.dir, name), Problem: problem, Repair: ""}
+	if c.repair {
+		if e := fix(); e != nil {
+			return e
+		}
+
+		p.Repair = repair
+	}
+
+	c.problems = append(c.problems, p)
+
+	return nil
+}
+
+// temp reports a temporary file left behind by a crash, it is removed.
+func (c *checker) temp(name string) error {
+	return c.report(name, "temporary file left by a crash", "removed", func() error {
+		return os.Remove(filepath.Join(c.dir, name))
+	})
+}
+
+// corrupt reports a corrupt file, it is quarantined with the related files.
+func (c *checker) corrupt(name string, err error, names ...string) error {
+	return c.report(name, err.Error(), "quarantined", func() error {
+		return Quarantine(c.dir, names...)
+	})
+}
+
+// files returns the names of the files of the directory of the checker, the
+// corrupt directory and other directories are skipped.
+func (c *checker) files() ([]string, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// CheckUsers checks the files of the users in dir, which are unsealed with the
+// sealer. With repair, temporary files left by crashes are removed and
+// corrupt users are quarantined.
+func CheckUsers(dir string, sealer chata.Sealer, repair bool) ([]Problem, error) {
+	c := &checker{dir: dir, sealer: sealer, repair: repair, problems: nil}
+
+	names, err := c.files()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if chata.IsTempFile(name) {
+			err = c.temp(name)
+		} else if _, _, e := loadUserFile(filepath.Join(dir, name), sealer); errors.Is(e, ErrCorrupt) {
+			err = c.corrupt(name, e, name)
+		} else {
+			err = e
+		}
+
+		if err != nil {
+			return c.problems, err
+		}
+	}
+
+	return c.problems, nil
+}
+
+// CheckChats checks the files of the sessions in dir, which are unsealed with
+// the sealer. With repair, temporary files left by crashes are removed, torn
+// records at the end of logs are cut off and corrupt sessions and logs
+// without a session are quarantined. Without repair the files are only read.
+func CheckChats(dir string, sealer chata.Sealer, repair bool) ([]Problem, error) {
+	c := &checker{dir: dir, sealer: sealer, repair: repair, problems: nil}
+
+	names, err := c.files()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		err = c.checkChat(name)
+		if err != nil {
+			return c.problems, err
+		}
+	}
+
+	return c.problems, nil
+}
+
+func (c *checker) checkChat(name string) error {
+	switch {
+	case chata.IsTempFile(name):
+		return c.temp(name)
+	case !chat.IsSessionFile(name):
+		if !strings.HasSuffix(name, chat.LogSuffix) {
+			return nil
+		}
+
+		// Logs go with their sessions, a log that is gone went with its
+		// session already
+		if !exists(filepath.Join(c.dir, name)) || exists(filepath.Join(c.dir, strings.TrimSuffix(name, chat.LogSuffix))) {
+			return nil
+		}
+
+		return c.corrupt(name, errors.New("log without a session"), name)
+	}
+
+	p := filepath.Join(c.dir, name)
+
+	torn, err := checkSessionFile(p, c.sealer)
+	switch {
+	case errors.Is(err, ErrCorrupt):
+		return c.corrupt(name, err, sessionFiles(p)...)
+	case err != nil:
+		return err
+	case torn < 0:
+		return nil
+	}
+
+	problem := fmt.Sprintf("torn last record after byte %d", torn)
+
+	return c.report(chat.LogFile(name), problem, "cut off", func() error {
+		return os.Truncate(chat.LogFile(p), torn)
+	})
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// CheckBolt checks the pages of the bolt database. Bolt writes in
+// transactions, a crash does not leave a part of one behind, so problems are
+// only reported.
+func CheckBolt(file string) ([]Problem, error) {
+	db, err := OpenBolt(file)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	problems := []Problem{}
+	err = db.View(func(tx *bolt.Tx) error {
+		for e := range tx.Check() {
+			problems = append(problems, Problem{File: file, Problem: e.Error(), Repair: ""})
+		}
+
+		return nil
+	})
+
+	return problems, err
+}
@@ -0,0 +1,142 @@
+package store_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/rchamarthy/chata/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	dir := t.TempDir()
+	ctx := context.Background()
+	usersDir, chatsDir := path.Join(dir, "users"), path.Join(dir, "chats")
+
+	users, chats := store.NewUserDB(usersDir), store.NewChatDB(chatsDir)
+	require.NoError(users.Init())
+	require.NoError(chats.Init())
+	require.NoError(users.Add(auth.NewUser("user1", "user1")))
+
+	session := chat.NewSession("user1", "user2")
+	require.NoError(chats.Add(session))
+	_, _, err := chats.AppendMessage(session.ID, chat.Message{Sender: "user1", Body: "hi", Time: time.Now()})
+	require.NoError(err)
+
+	problems, err := store.CheckUsers(usersDir, nil, false)
+	require.NoError(err)
+	require.Empty(problems)
+	problems, err = store.CheckChats(chatsDir, nil, false)
+	require.NoError(err)
+	require.Empty(problems)
+
+	// What a crash or a full disk leaves behind
+	write := func(p string, b string) {
+		require.NoError(os.WriteFile(p, []byte(b), 0600))
+	}
+
+	write(path.Join(usersDir, "user2"), "")
+	write(path.Join(usersDir, "user1.123.tmp"), "id: us")
+	write(path.Join(chatsDir, "user1-user3"), "id: [")
+	write(path.Join(chatsDir, "user1-user3.log"), "")
+	write(path.Join(chatsDir, "user2-user3.log"), "{}\n")
+
+	logFile := chat.LogFile(path.Join(chatsDir, session.ID))
+	good, err := os.ReadFile(logFile)
+	require.NoError(err)
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(err)
+	_, err = f.WriteString(`{"sender":"us`)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	// Checking reports the problems and leaves the files alone
+	problems, err = store.CheckUsers(usersDir, nil, false)
+	require.NoError(err)
+	require.Len(problems, 2)
+	problems, err = store.CheckChats(chatsDir, nil, false)
+	require.NoError(err)
+	require.Len(problems, 3)
+	for _, p := range problems {
+		require.Empty(p.Repair, p.String())
+	}
+
+	require.FileExists(path.Join(chatsDir, "user1-user3"))
+	torn, err := os.ReadFile(logFile)
+	require.NoError(err)
+	require.Equal(string(good)+`{"sender":"us`, string(torn))
+	require.Contains(problems, store.Problem{
+		File: logFile, Problem: fmt.Sprintf("torn last record after byte %d", len(good)), Repair: "",
+	})
+
+	// Repairing fixes them
+	problems, err = store.CheckUsers(usersDir, nil, true)
+	require.NoError(err)
+	require.Len(problems, 2)
+	problems, err = store.CheckChats(chatsDir, nil, true)
+	require.NoError(err)
+	require.Len(problems, 3)
+	for _, p := range problems {
+		require.NotEmpty(p.Repair, p.String())
+	}
+
+	require.NoFileExists(path.Join(chatsDir, "user1-user3"))
+	require.NoFileExists(path.Join(chatsDir, "user1-user3.log"))
+	quarantined, err := os.ReadDir(path.Join(chatsDir, store.CorruptDir))
+	require.NoError(err)
+	require.Len(quarantined, 3)
+
+	problems, err = store.CheckUsers(usersDir, nil, false)
+	require.NoError(err)
+	require.Empty(problems)
+	problems, err = store.CheckChats(chatsDir, nil, false)
+	require.NoError(err)
+	require.Empty(problems)
+
+	reloaded := store.NewChatDB(chatsDir)
+	require.NoError(reloaded.Load(ctx))
+	require.Len(reloaded.All(), 1)
+	require.Len(reloaded.GetByID(session.ID).Messages, 1)
+
+	_, err = store.CheckUsers(path.Join(dir, "missing"), nil, false)
+	require.Error(err)
+}
+
+func TestLoadQuarantine(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	chats := store.NewChatDB(dir)
+	require.NoError(chats.Init())
+	require.NoError(chats.Add(chat.NewSession("user1", "user2")))
+	require.NoError(os.WriteFile(path.Join(dir, "user1-user3"), nil, 0600))
+	require.NoError(os.WriteFile(path.Join(dir, "user1-user3.log"), []byte("garbage\n{}\n"), 0600))
+	require.NoError(os.WriteFile(path.Join(dir, "user1-user4"), []byte("id: user1-user5\n"), 0600))
+
+	// Corrupt sessions do not keep the others from loading
+	reloaded := store.NewChatDB(dir)
+	require.NoError(reloaded.Load(ctx))
+	require.Len(reloaded.All(), 1)
+	require.NotNil(reloaded.Get("user1", "user2"))
+
+	quarantined, err := os.ReadDir(path.Join(dir, store.CorruptDir))
+	require.NoError(err)
+	require.Len(quarantined, 3)
+	require.NoFileExists(path.Join(dir, "user1-user3.log"))
+
+	reloaded = store.NewChatDB(dir)
+	require.NoError(reloaded.Load(ctx))
+	require.Len(reloaded.All(), 1)
+}
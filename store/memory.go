@@ -0,0 +1,247 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+)
+
+// MemoryUserStore is a UserStore that keeps nothing on disk, for tests.
+type MemoryUserStore struct {
+	users Users
+	lock  *sync.RWMutex
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users: Users{},
+		lock:  &sync.RWMutex{},
+	}
+}
+
+func (db *MemoryUserStore) Init() error {
+	return nil
+}
+
+func (db *MemoryUserStore) Load(context.Context) error {
+	return nil
+}
+
+func (db *MemoryUserStore) Destroy() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.users = Users{}
+	return nil
+}
+
+func (db *MemoryUserStore) Add(user *auth.User) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return db.users.Add(user)
+}
+
+func (db *MemoryUserStore) GetUser(id string) *auth.User {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.users[id]
+}
+
+func (db *MemoryUserStore) GetAllUsers() Users {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.users.Copy()
+}
+
+func (db *MemoryUserStore) DeleteUser(id string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.users[id] == nil {
+		return fmt.Errorf("user %s not found", id)
+	}
+
+	delete(db.users, id)
+	return nil
+}
+
+func (db *MemoryUserStore) HasUser(id string) bool {
+	return db.GetUser(id) != nil
+}
+
+func (db *MemoryUserStore) IsEmpty() bool {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return len(db.users) == 0
+}
+
+// MemoryChatStore is a ChatStore that keeps nothing on disk, for tests.
+type MemoryChatStore struct {
+	sessions *Sessions
+	lock     *sync.RWMutex
+}
+
+func NewMemoryChatStore() *MemoryChatStore {
+	return &MemoryChatStore{
+		sessions: NewSessions(),
+		lock:     &sync.RWMutex{},
+	}
+}
+
+func (db *MemoryChatStore) Init() error {
+	return nil
+}
+
+func (db *MemoryChatStore) Load(context.Context) error {
+	return nil
+}
+
+func (db *MemoryChatStore) Destroy() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.sessions = NewSessions()
+	return nil
+}
+
+func (db *MemoryChatStore) Add(session *chat.Session) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.sessions.Add(session)
+	return nil
+}
+
+func (db *MemoryChatStore) Get(user1 string, user2 string) *chat.Session {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.sessions.Get(user1, user2)
+}
+
+func (db *MemoryChatStore) GetByID(id string) *chat.Session {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.sessions.GetByID(id)
+}
+
+func (db *MemoryChatStore) GetSessionsByUser(user string) []*chat.Session {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.sessions.GetSessionsByUser(user)
+}
+
+func (db *MemoryChatStore) GetGroupsByUser(user string) []*chat.Session {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.sessions.GetGroupsByUser(user)
+}
+
+func (db *MemoryChatStore) Delete(user1 string, user2 string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return db.sessions.Delete(user1, user2)
+}
+
+func (db *MemoryChatStore) DeleteByID(id string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return db.sessions.DeleteByID(id)
+}
+
+func (db *MemoryChatStore) UpdateMembers(id string, update func(group *chat.Session) error) (*chat.Session, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return db.sessions.UpdateMembers(id, update)
+}
+
+// update runs change on the session with the id under the lock of the
+// session alone.
+func (db *MemoryChatStore) update(id string, change func(session *chat.Session) error) (*chat.Session, error) {
+	db.lock.RLock()
+	e := db.sessions.entry(id)
+	db.lock.RUnlock()
+
+	return e.update(id, change)
+}
+
+func (db *MemoryChatStore) AppendMessage(id string, m chat.Message) (*chat.Session, chat.Message, error) {
+	session, err := db.update(id, func(session *chat.Session) error {
+		var err error
+		if m, err = session.Prepare(m, time.Now()); err != nil {
+			return err
+		}
+
+		session.Append(m)
+		return nil
+	})
+
+	return session, m, err
+}
+
+func (db *MemoryChatStore) ChangeMessage(id string, c chat.Change) (*chat.Session, chat.Message, error) {
+	var m chat.Message
+	session, err := db.update(id, func(session *chat.Session) error {
+		i, err := session.Apply(c)
+		if err != nil {
+			return err
+		}
+
+		m = session.Messages[i]
+		return nil
+	})
+
+	return session, m, err
+}
+
+func (db *MemoryChatStore) MarkReceipt(id string, user string, r chat.Receipt) (*chat.Session, bool, error) {
+	changed := false
+	session, err := db.update(id, func(session *chat.Session) error {
+		changed = session.Mark(user, r)
+		return nil
+	})
+
+	return session, changed, err
+}
+
+func (db *MemoryChatStore) SetTTL(id string, user string, ttl time.Duration) (*chat.Session, error) {
+	return db.update(id, func(session *chat.Session) error {
+		return session.SetTTL(user, ttl)
+	})
+}
+
+func (db *MemoryChatStore) All() []*chat.Session {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.sessions.All()
+}
+
+func (db *MemoryChatStore) Purge(id string, now time.Time, r chat.Retention) (*chat.Session, int, error) {
+	n := 0
+	session, err := db.update(id, func(session *chat.Session) error {
+		n = session.Expired(now, r)
+		session.Purge(n)
+		return nil
+	})
+
+	return session, n, err
+}
+
+func (db *MemoryChatStore) Compact(context.Context) error {
+	return nil
+}
@@ -0,0 +1,294 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/rchamarthy/chata"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+)
+
+// Kinds of the records that the stores save. Every record is saved with the
+// version of the schema of its kind, records saved before there were versions
+// are version 0. The messages of a session are versioned with the session.
+const (
+	RecordUser    = "user"
+	RecordSession = "session"
+)
+
+// ErrNewerSchema is returned for records saved by a later version of the
+// server, they are not loaded rather than taken for corrupt.
+var ErrNewerSchema = errors.New("record of a later schema version")
+
+// Migration upgrades records of a kind from version From to the next one.
+// Upgrade changes the record, as it was decoded from YAML, in place. The
+// version of the record is set by the registry, a migration without Upgrade
+// only changes the version.
+type Migration struct {
+	Kind        string
+	From        int
+	Description string
+	Upgrade     func(record map[string]any) error
+}
+
+// Upgrade is the upgrade of a record from the version it was saved in to the
+// current version of its kind, with the migrations it takes.
+type Upgrade struct {
+	Record     string   `json:"record"     yaml:"record"`
+	Kind       string   `json:"kind"       yaml:"kind"`
+	From       int      `json:"from"       yaml:"from"`
+	To         int      `json:"to"         yaml:"to"`
+	Migrations []string `json:"migrations" yaml:"migrations"`
+}
+
+func (u Upgrade) String() string {
+	return fmt.Sprintf("%s: %s version %d to %d (%s)", u.Record, u.Kind, u.From, u.To, strings.Join(u.Migrations, ", "))
+}
+
+// Registry holds the migrations of the kinds of records up to the current
+// versions of the kinds.
+type Registry struct {
+	versions   map[string]int
+	migrations map[string][]Migration
+}
+
+// NewRegistry returns a registry without migrations for the kinds with their
+// current versions.
+func NewRegistry(versions map[string]int) *Registry {
+	return &Registry{versions: versions, migrations: map[string][]Migration{}}
+}
+
+// Register adds the migration to the registry. Migrations of a kind are
+// registered in order, from version 0 up to the current version.
+func (r *Registry) Register(m Migration) error {
+	current, ok := r.versions[m.Kind]
+	if !ok {
+		return fmt.Errorf("migration of unknown kind of record %s", m.Kind)
+	}
+
+	if next := len(r.migrations[m.Kind]); m.From != next || m.From >= current {
+		return fmt.Errorf("migration of %s records from version %d, expected one from %d up to %d",
+			m.Kind, m.From, next, current)
+	}
+
+	r.migrations[m.Kind] = append(r.migrations[m.Kind], m)
+
+	return nil
+}
+
+// Migrate upgrades the record of the kind, saved in YAML, to the current
+// version of its kind and returns it with the upgrade. A record that is
+// current is returned as it is, without an upgrade. Name names the record in
+// the upgrade and in errors.
+func (r *Registry) Migrate(kind string, name string, b []byte) ([]byte, *Upgrade, error) {
+	current, ok := r.versions[kind]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown kind of record %s", kind)
+	}
+
+	v := struct {
+		Version int `yaml:"version"`
+	}{Version: 0}
+	if e := yaml.Unmarshal(b, &v); e != nil {
+		return nil, nil, fmt.Errorf("%w %s: %w", ErrCorrupt, name, e)
+	}
+
+	switch {
+	case v.Version == current:
+		return b, nil, nil
+	case v.Version > current:
+		return nil, nil, fmt.Errorf("%w: %s is %s version %d, this server reads up to version %d",
+			ErrNewerSchema, name, kind, v.Version, current)
+	case v.Version < 0:
+		return nil, nil, fmt.Errorf("%w %s: version %d", ErrCorrupt, name, v.Version)
+	}
+
+	record := map[string]any{}
+	if e := yaml.Unmarshal(b, &record); e != nil {
+		return nil, nil, fmt.Errorf("%w %s: %w", ErrCorrupt, name, e)
+	}
+
+	u := &Upgrade{Record: name, Kind: kind, From: v.Version, To: current, Migrations: []string{}}
+	migrations := r.migrations[kind]
+	for version := v.Version; version < current; version++ {
+		if version >= len(migrations) {
+			return nil, nil, fmt.Errorf("%s: no migration of %s records from version %d", name, kind, version)
+		}
+
+		m := migrations[version]
+		if m.Upgrade != nil {
+			if e := m.Upgrade(record); e != nil {
+				return nil, nil, fmt.Errorf("%s: migrating %s from version %d: %w", name, kind, version, e)
+			}
+		}
+
+		record["version"] = version + 1
+		u.Migrations = append(u.Migrations, m.Description)
+	}
+
+	b, err := yaml.Marshal(record)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return b, u, nil
+}
+
+// Migrations is the registry that the stores migrate the records they load
+// with.
+var Migrations = defaultMigrations()
+
+func defaultMigrations() *Registry {
+	r := NewRegistry(map[string]int{RecordUser: auth.UserVersion, RecordSession: chat.SessionVersion})
+
+	// Version 1 is the schema that was saved without a version
+	auth.PanicOnError(r.Register(Migration{
+		Kind: RecordUser, From: 0, Description: "record the schema version", Upgrade: nil,
+	}))
+	auth.PanicOnError(r.Register(Migration{
+		Kind: RecordSession, From: 0, Description: "record the schema version", Upgrade: nil,
+	}))
+
+	return r
+}
+
+// MigrateUsers upgrades the users in dir, which are unsealed with the sealer,
+// to the current version of their schema and returns the upgrades. With
+// dryRun the upgrades are only reported. Corrupt users stop the migration,
+// fsck puts them aside. The store of the directory must not be in use.
+func MigrateUsers(dir string, sealer chata.Sealer, dryRun bool) ([]Upgrade, error) {
+	names, err := dataFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	upgrades := []Upgrade{}
+	for _, name := range names {
+		user, u, err := loadUserFile(filepath.Join(dir, name), sealer)
+		if err != nil {
+			return upgrades, err
+		}
+
+		if u == nil {
+			continue
+		}
+
+		upgrades = append(upgrades, *u)
+		if !dryRun {
+			if e := user.SaveUser(dir, sealer); e != nil {
+				return upgrades, e
+			}
+		}
+	}
+
+	return upgrades, nil
+}
+
+// MigrateChats upgrades the sessions in dir like MigrateUsers does the users.
+// A dry run reads the session files and not their logs.
+func MigrateChats(dir string, sealer chata.Sealer, dryRun bool) ([]Upgrade, error) {
+	names, err := dataFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	upgrades := []Upgrade{}
+	for _, name := range names {
+		if !chat.IsSessionFile(name) {
+			continue
+		}
+
+		p := filepath.Join(dir, name)
+		_, u, err := readSessionFile(p, sealer)
+		if err != nil {
+			return upgrades, err
+		}
+
+		if u == nil {
+			continue
+		}
+
+		upgrades = append(upgrades, *u)
+		if dryRun {
+			continue
+		}
+
+		session, _, err := loadSessionFile(p, sealer)
+		if err != nil {
+			return upgrades, err
+		}
+
+		if e := session.SaveMetadata(dir, sealer); e != nil {
+			return upgrades, e
+		}
+	}
+
+	return upgrades, nil
+}
+
+// MigrateBolt upgrades the users and the sessions in the bolt database like
+// MigrateUsers does the users in a directory.
+func MigrateBolt(file string, dryRun bool) ([]Upgrade, error) {
+	db, err := OpenBolt(file)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	upgrades, err := migrateBucket(db, usersBucket, RecordUser, dryRun)
+	if err != nil {
+		return upgrades, err
+	}
+
+	sessions, err := migrateBucket(db, sessionsBucket, RecordSession, dryRun)
+
+	return append(upgrades, sessions...), err
+}
+
+// migrateBucket upgrades the records of the kind in the bucket, with dryRun it
+// only reports them.
+func migrateBucket(db *bolt.DB, bucket []byte, kind string, dryRun bool) ([]Upgrade, error) {
+	upgrades := []Upgrade{}
+	migrate := func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return errNoBucket(bucket)
+		}
+
+		// Buckets cannot change while they are iterated over
+		records := map[string][]byte{}
+		e := b.ForEach(func(k, v []byte) error {
+			v, u, err := Migrations.Migrate(kind, string(bucket)+"/"+string(k), v)
+			if err != nil || u == nil {
+				return err
+			}
+
+			upgrades = append(upgrades, *u)
+			records[string(k)] = v
+
+			return nil
+		})
+		if e != nil || dryRun {
+			return e
+		}
+
+		for k, v := range records {
+			if e := b.Put([]byte(k), v); e != nil {
+				return e
+			}
+		}
+
+		return nil
+	}
+
+	if dryRun {
+		return upgrades, db.View(migrate)
+	}
+
+	return upgrades, db.Update(migrate)
+}
@@ -0,0 +1,236 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/rchamarthy/chata/store"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	r := store.NewRegistry(map[string]int{"thing": 2})
+
+	// Migrations are registered in order, up to the current version
+	rename := store.Migration{Kind: "thing", From: 0, Description: "rename", Upgrade: func(record map[string]any) error {
+		record["title"] = record["name"]
+		delete(record, "name")
+		return nil
+	}}
+	require.Error(r.Register(store.Migration{Kind: "other", From: 0, Description: "", Upgrade: nil}))
+	require.Error(r.Register(store.Migration{Kind: "thing", From: 1, Description: "", Upgrade: nil}))
+	require.NoError(r.Register(rename))
+
+	_, _, err := r.Migrate("thing", "t", []byte("name: a\n"))
+	require.ErrorContains(err, "no migration")
+
+	fail := errors.New("cannot upgrade")
+	count := store.Migration{Kind: "thing", From: 1, Description: "count", Upgrade: func(record map[string]any) error {
+		if record["title"] == "bad" {
+			return fail
+		}
+
+		record["count"] = 1
+		return nil
+	}}
+	require.NoError(r.Register(count))
+	require.Error(r.Register(store.Migration{Kind: "thing", From: 2, Description: "", Upgrade: nil}))
+
+	// Records without a version are version 0
+	b, u, err := r.Migrate("thing", "t", []byte("name: a\n"))
+	require.NoError(err)
+	require.Equal(&store.Upgrade{Record: "t", Kind: "thing", From: 0, To: 2, Migrations: []string{"rename", "count"}}, u)
+	record := map[string]any{}
+	require.NoError(yaml.Unmarshal(b, &record))
+	require.Equal(map[string]any{"version": 2, "title": "a", "count": 1}, record)
+
+	b, u, err = r.Migrate("thing", "t", []byte("version: 1\ntitle: b\n"))
+	require.NoError(err)
+	require.Equal([]string{"count"}, u.Migrations)
+	require.Contains(string(b), "count: 1")
+
+	// Current records are left as they are
+	current := []byte("version: 2\ntitle: c\n")
+	b, u, err = r.Migrate("thing", "t", current)
+	require.NoError(err)
+	require.Nil(u)
+	require.Equal(current, b)
+
+	_, _, err = r.Migrate("thing", "t", []byte("version: 3\n"))
+	require.ErrorIs(err, store.ErrNewerSchema)
+	require.NotErrorIs(err, store.ErrCorrupt)
+	_, _, err = r.Migrate("thing", "t", []byte("version: [\n"))
+	require.ErrorIs(err, store.ErrCorrupt)
+	_, _, err = r.Migrate("thing", "t", []byte("name: bad\n"))
+	require.ErrorIs(err, fail)
+	_, _, err = r.Migrate("other", "t", current)
+	require.Error(err)
+}
+
+// legacy returns the record without its version, as it was saved before
+// records had versions.
+func legacy(t *testing.T, b []byte) []byte {
+	t.Helper()
+
+	version, rest, _ := strings.Cut(string(b), "\n")
+	require.True(t, strings.HasPrefix(version, "version: "), string(b))
+
+	return []byte(rest)
+}
+
+func TestMigrateFiles(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	dir := t.TempDir()
+	ctx := context.Background()
+	usersDir, chatsDir := path.Join(dir, "users"), path.Join(dir, "chats")
+
+	users, chats := store.NewUserDB(usersDir), store.NewChatDB(chatsDir)
+	require.NoError(users.Init())
+	require.NoError(chats.Init())
+	alice := auth.NewUser("Alice", "alice")
+	require.NoError(users.Add(alice))
+	session := chat.NewSession("alice", "bob")
+	session.TTL = time.Hour
+	require.NoError(chats.Add(session))
+	_, _, err := chats.AppendMessage(session.ID, chat.Message{Sender: "alice", Body: "hi", Time: time.Now()})
+	require.NoError(err)
+
+	upgrades, err := store.MigrateUsers(usersDir, nil, true)
+	require.NoError(err)
+	require.Empty(upgrades)
+
+	// Files saved before records had versions
+	userFile, sessionFile := path.Join(usersDir, "alice"), path.Join(chatsDir, session.ID)
+	for _, p := range []string{userFile, sessionFile} {
+		b, e := os.ReadFile(p)
+		require.NoError(e)
+		require.NoError(os.WriteFile(p, legacy(t, b), 0600))
+	}
+
+	// A dry run reports the upgrades and changes nothing
+	old, err := os.ReadFile(userFile)
+	require.NoError(err)
+	upgrades, err = store.MigrateUsers(usersDir, nil, true)
+	require.NoError(err)
+	require.Len(upgrades, 1)
+	require.Equal(store.Upgrade{
+		Record: userFile, Kind: store.RecordUser, From: 0, To: auth.UserVersion,
+		Migrations: []string{"record the schema version"},
+	}, upgrades[0])
+	upgrades, err = store.MigrateChats(chatsDir, nil, true)
+	require.NoError(err)
+	require.Len(upgrades, 1)
+	require.Equal(sessionFile, upgrades[0].Record)
+	b, err := os.ReadFile(userFile)
+	require.NoError(err)
+	require.Equal(old, b)
+
+	// Migrating upgrades the users
+	upgrades, err = store.MigrateUsers(usersDir, nil, false)
+	require.NoError(err)
+	require.Len(upgrades, 1)
+	upgrades, err = store.MigrateUsers(usersDir, nil, true)
+	require.NoError(err)
+	require.Empty(upgrades)
+
+	// Loading upgrades the sessions, their messages are kept
+	chats = store.NewChatDB(chatsDir)
+	require.NoError(chats.Load(ctx))
+	loaded := chats.GetByID(session.ID)
+	require.Equal(time.Hour, loaded.TTL)
+	require.Len(loaded.Messages, 1)
+	require.Equal("hi", loaded.Messages[0].Body)
+	upgrades, err = store.MigrateChats(chatsDir, nil, true)
+	require.NoError(err)
+	require.Empty(upgrades)
+
+	users = store.NewUserDB(usersDir)
+	require.NoError(users.Load(ctx))
+	require.Equal(alice.Key.Public(), users.GetUser("alice").Key.Public())
+
+	// Records of a later version are not loaded and not taken for corrupt
+	b, err = os.ReadFile(userFile)
+	require.NoError(err)
+	require.NoError(os.WriteFile(userFile, []byte(strings.Replace(string(b), "version: 1", "version: 99", 1)), 0600))
+	require.ErrorIs(store.NewUserDB(usersDir).Load(ctx), store.ErrNewerSchema)
+	_, err = store.MigrateUsers(usersDir, nil, true)
+	require.ErrorIs(err, store.ErrNewerSchema)
+	require.FileExists(userFile)
+	require.NoDirExists(path.Join(usersDir, store.CorruptDir))
+}
+
+func TestMigrateBolt(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	file := path.Join(t.TempDir(), "chata.db")
+	ctx := context.Background()
+
+	db, err := store.OpenBolt(file)
+	require.NoError(err)
+	users, chats := store.NewBoltUserStore(db), store.NewBoltChatStore(db)
+	require.NoError(users.Init())
+	require.NoError(chats.Init())
+	require.NoError(users.Add(auth.NewUser("Alice", "alice")))
+	session := chat.NewSession("alice", "bob")
+	require.NoError(chats.Add(session))
+
+	// Records saved before records had versions
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{"users", "sessions"} {
+			b := tx.Bucket([]byte(bucket))
+			records := map[string][]byte{}
+			e := b.ForEach(func(k, v []byte) error {
+				records[string(k)] = legacy(t, v)
+				return nil
+			})
+			if e != nil {
+				return e
+			}
+
+			for k, v := range records {
+				if e := b.Put([]byte(k), v); e != nil {
+					return e
+				}
+			}
+		}
+
+		return nil
+	})
+	require.NoError(err)
+	require.NoError(db.Close())
+
+	upgrades, err := store.MigrateBolt(file, true)
+	require.NoError(err)
+	require.Len(upgrades, 2)
+	require.Equal("users/alice", upgrades[0].Record)
+	require.Equal("sessions/"+session.ID, upgrades[1].Record)
+
+	// Loading upgrades the records
+	db, err = store.OpenBolt(file)
+	require.NoError(err)
+	users, chats = store.NewBoltUserStore(db), store.NewBoltChatStore(db)
+	require.NoError(users.Load(ctx))
+	require.NoError(chats.Load(ctx))
+	require.NotNil(users.GetUser("alice"))
+	require.NotNil(chats.GetByID(session.ID))
+	require.NoError(db.Close())
+
+	upgrades, err = store.MigrateBolt(file, true)
+	require.NoError(err)
+	require.Empty(upgrades)
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rchamarthy/chata"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+)
+
+// CorruptDir is the directory, in the directory of a store, that corrupt
+// files are moved to. The store loads without them and they are kept to be
+// looked at.
+const CorruptDir = ".corrupt"
+
+// ErrCorrupt is returned for files of a store that cannot be read back.
+var ErrCorrupt = errors.New("corrupt file")
+
+// Quarantine moves the files of dir with the names into the corrupt directory
+// of dir, names that are not there are skipped. The files are stamped with
+// the time so that files quarantined before are kept.
+func Quarantine(dir string, names ...string) error {
+	corrupt := filepath.Join(dir, CorruptDir)
+	if e := os.MkdirAll(corrupt, 0700); e != nil {
+		return e
+	}
+
+	stamp := time.Now().UTC().Format("20060102T150405")
+	for _, name := range names {
+		e := os.Rename(filepath.Join(dir, name), filepath.Join(corrupt, name+"."+stamp))
+		if e != nil && !errors.Is(e, os.ErrNotExist) {
+			return e
+		}
+	}
+
+	if e := chata.SyncDir(corrupt); e != nil {
+		return e
+	}
+
+	return chata.SyncDir(dir)
+}
+
+// loadUserFile reads the user in the file, unseals it and migrates it to the
+// current version of its schema. A file that does not hold a valid user named
+// after the file is corrupt. The upgrade is nil if the user is current.
+func loadUserFile(p string, sealer chata.Sealer) (*auth.User, *Upgrade, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err = chata.Unseal(sealer, p, b)
+	if errors.Is(err, chata.ErrNoKey) || errors.Is(err, chata.ErrNotSealed) {
+		return nil, nil, err
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("%w %s: %w", ErrCorrupt, p, err)
+	}
+
+	b, u, err := Migrations.Migrate(RecordUser, p, b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := auth.ParseUser(b)
+	if err == nil {
+		err = user.Validate()
+	}
+
+	if err == nil && user.ID != filepath.Base(p) {
+		err = fmt.Errorf("holds user %s", user.ID)
+	}
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w %s: %w", ErrCorrupt, p, err)
+	}
+
+	return user, u, nil
+}
+
+// readSessionFile reads the session file, unseals it and migrates it to the
+// current version of its schema. The upgrade is nil if the session is current.
+func readSessionFile(p string, sealer chata.Sealer) ([]byte, *Upgrade, error) {
+	b, err := chat.ReadSessionFile(p, sealer)
+	if errors.Is(err, chat.ErrCorruptSession) {
+		return nil, nil, fmt.Errorf("%w: %w", ErrCorrupt, err)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	return Migrations.Migrate(RecordSession, p, b)
+}
+
+// loadSessionFile reads the session in the file and its log, unseals them and
+// migrates the session to the current version of its schema. A session that
+// cannot be read back or is not named after the file is corrupt. The upgrade
+// is nil if the session is current.
+func loadSessionFile(p string, sealer chata.Sealer) (*chat.Session, *Upgrade, error) {
+	b, u, err := readSessionFile(p, sealer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session, err := chat.LoadSessionData(p, b, sealer)
+	if e := checkSession(p, session, err); e != nil {
+		return nil, nil, e
+	}
+
+	return session, u, nil
+}
+
+// checkSessionFile reads the session in the file and its log like
+// loadSessionFile without changing them. It returns the size of the log
+// without its torn last record, or -1 if the log is whole.
+func checkSessionFile(p string, sealer chata.Sealer) (int64, error) {
+	b, _, err := readSessionFile(p, sealer)
+	if err != nil {
+		return -1, err
+	}
+
+	session, torn, err := chat.CheckSessionData(p, b, sealer)
+	if e := checkSession(p, session, err); e != nil {
+		return -1, e
+	}
+
+	return torn, nil
+}
+
+// checkSession returns the error of loading the session in the file, corrupt
+// sessions and logs are ErrCorrupt.
+func checkSession(p string, session *chat.Session, err error) error {
+	switch {
+	case errors.Is(err, chat.ErrCorruptSession), errors.Is(err, chat.ErrCorruptLog):
+		return fmt.Errorf("%w: %w", ErrCorrupt, err)
+	case err != nil:
+		return err
+	case session.ID != filepath.Base(p):
+		return fmt.Errorf("%w %s: holds session %s", ErrCorrupt, p, session.ID)
+	}
+
+	return nil
+}
+
+// sessionFiles returns the names of the files of the session in the file.
+func sessionFiles(p string) []string {
+	name := filepath.Base(p)
+
+	return []string{name, chat.LogFile(name)}
+}
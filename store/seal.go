@@ -0,0 +1,498 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rchamarthy/chata"
+	"github.com/rchamarthy/chata/chat"
+)
+
+// Files of the file backend are sealed at rest with AES-256-GCM. Every file,
+// and every record of a message log, is sealed with a data key of its own
+// that is sealed with the master key and kept with the data:
+//
+//	chata-sealed:base64(version | master key id | sealed data key | sealed data)
+//
+// Both are bound to the name of the file. The master key is kept in a key
+// file of its own, outside of the data directories.
+const (
+	sealVersion = 1
+	keySize     = 32
+	keyIDSize   = 8
+)
+
+// NewKeySuffix ends the name of the key file that Rekey writes the new
+// master key to before it reseals the files.
+const NewKeySuffix = ".new"
+
+// RetiredKeySuffix ends the name of the file that Rekey keeps the master keys
+// it replaced in, a key per line. Retired keys still unseal, so that files
+// and backups sealed before a rekey can be read, until the file is removed.
+const RetiredKeySuffix = ".old"
+
+// macLabel derives the key that MAC authenticates with from a master key.
+const macLabel = "chata-mac"
+
+var (
+	errUnseal = errors.New("sealed data does not unseal")
+	errMAC    = errors.New("MAC does not match")
+)
+
+// masterKey is a master key and its id, the id tells which master key sealed
+// a file.
+type masterKey struct {
+	id     []byte
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+// Keyring seals files with its master key and unseals files that were sealed
+// with any of its keys.
+type Keyring struct {
+	master *masterKey
+	keys   map[string]*masterKey
+}
+
+// GenerateKey writes a new random master key to the key file, which must not
+// be there yet.
+func GenerateKey(keyFile string) error {
+	key := make([]byte, keySize)
+	if _, e := rand.Read(key); e != nil {
+		return e
+	}
+
+	f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, e := f.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); e != nil {
+		f.Close()
+		return e
+	}
+
+	if e := f.Sync(); e != nil {
+		f.Close()
+		return e
+	}
+
+	if e := f.Close(); e != nil {
+		return e
+	}
+
+	return chata.SyncDir(filepath.Dir(keyFile))
+}
+
+// LoadKeyring reads the master key in the key file. A new key left next to
+// the key file by a rekey that was cut short unseals too, and so do the keys
+// that earlier rekeys retired.
+func LoadKeyring(keyFile string) (*Keyring, error) {
+	master, err := readKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Keyring{master: master, keys: map[string]*masterKey{}}
+	k.add(master)
+
+	next, err := readKey(keyFile + NewKeySuffix)
+	if err == nil {
+		k.add(next)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	retired, err := readKeys(keyFile + RetiredKeySuffix)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, key := range retired {
+		k.add(key)
+	}
+
+	return k, nil
+}
+
+func readKey(keyFile string) (*masterKey, error) {
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseKey(keyFile, strings.TrimSpace(string(b)))
+}
+
+// readKeys reads the keys of a file that holds a key per line.
+func readKeys(keyFile string) ([]*masterKey, error) {
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*masterKey{}
+	for _, line := range strings.Fields(string(b)) {
+		key, err := parseKey(keyFile, line)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func parseKey(keyFile string, s string) (*masterKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("key file %s does not hold a key", keyFile)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	id := sha256.Sum256(key)
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(macLabel))
+
+	return &masterKey{id: id[:keyIDSize], aead: aead, macKey: h.Sum(nil)}, nil
+}
+
+func (key *masterKey) mac(data []byte) []byte {
+	h := hmac.New(sha256.New, key.macKey)
+	h.Write(data)
+
+	return h.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (k *Keyring) add(key *masterKey) {
+	k.keys[hex.EncodeToString(key.id)] = key
+}
+
+// seal seals the data with the AEAD, the nonce goes first.
+func seal(aead cipher.AEAD, name string, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, e := rand.Read(nonce); e != nil {
+		return nil, e
+	}
+
+	return aead.Seal(nonce, nonce, data, []byte(name)), nil
+}
+
+func unseal(aead cipher.AEAD, name string, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errUnseal
+	}
+
+	nonce, data := data[:aead.NonceSize()], data[aead.NonceSize():]
+	b, err := aead.Open(nil, nonce, data, []byte(name))
+	if err != nil {
+		return nil, errUnseal
+	}
+
+	return b, nil
+}
+
+// Seal seals the data of the file with a new data key.
+func (k *Keyring) Seal(name string, data []byte) ([]byte, error) {
+	dataKey := make([]byte, keySize)
+	if _, e := rand.Read(dataKey); e != nil {
+		return nil, e
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedKey, err := seal(k.master.aead, name, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := seal(aead, name, data)
+	if err != nil {
+		return nil, err
+	}
+
+	b := append([]byte{sealVersion}, k.master.id...)
+	b = append(append(b, sealedKey...), sealed...)
+
+	return append([]byte(chata.SealedPrefix), base64.StdEncoding.EncodeToString(b)...), nil
+}
+
+// Unseal unseals the data of the file, it fails with chata.ErrNoKey if the
+// data was sealed with a master key that is not in the keyring.
+func (k *Keyring) Unseal(name string, data []byte) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(string(bytes.TrimPrefix(data, []byte(chata.SealedPrefix))))
+	if err != nil || len(b) < 1+keyIDSize || b[0] != sealVersion {
+		return nil, errUnseal
+	}
+
+	id := b[1 : 1+keyIDSize]
+	master := k.keys[hex.EncodeToString(id)]
+	if master == nil {
+		return nil, fmt.Errorf("%w %s: sealed with master key %x", chata.ErrNoKey, name, id)
+	}
+
+	b = b[1+keyIDSize:]
+	sealedKeySize := master.aead.NonceSize() + keySize + master.aead.Overhead()
+	if len(b) < sealedKeySize {
+		return nil, errUnseal
+	}
+
+	dataKey, err := unseal(master.aead, name, b[:sealedKeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return unseal(aead, name, b[sealedKeySize:])
+}
+
+// MAC authenticates the data with a key derived from the master key. The id
+// of the master key goes first, so that the MAC still verifies once the key
+// is retired.
+func (k *Keyring) MAC(data []byte) string {
+	return hex.EncodeToString(k.master.id) + ":" + hex.EncodeToString(k.master.mac(data))
+}
+
+// VerifyMAC checks a MAC of the data that MAC made with any of the keys of
+// the keyring, it fails with chata.ErrNoKey if the key is not there.
+func (k *Keyring) VerifyMAC(data []byte, mac string) error {
+	id, sum, _ := strings.Cut(strings.TrimSpace(mac), ":")
+	master := k.keys[id]
+	if master == nil {
+		return fmt.Errorf("%w: MAC made with master key %s", chata.ErrNoKey, id)
+	}
+
+	b, err := hex.DecodeString(sum)
+	if err != nil || !hmac.Equal(b, master.mac(data)) {
+		return errMAC
+	}
+
+	return nil
+}
+
+// resealFile unseals the file with the sealer and seals it again, the records
+// of logs one by one. With all set every file is resealed and data in the
+// clear is refused, with all unset data in the clear is taken as it is and
+// only files that hold some are resealed. It reports whether it resealed.
+func resealFile(p string, sealer chata.Sealer, all bool) (bool, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return false, err
+	}
+
+	// Whole files are one record, logs a record per line
+	isLog := strings.HasSuffix(p, chat.LogSuffix)
+	records := [][]byte{b}
+	if isLog {
+		records = bytes.SplitAfter(b, []byte("\n"))
+	}
+
+	out := &bytes.Buffer{}
+	inClear := false
+	for _, record := range records {
+		if isLog {
+			line, ok := bytes.CutSuffix(record, []byte("\n"))
+			if !ok {
+				// The end of the log, or a torn record that loading cuts
+				// off too
+				continue
+			}
+
+			record = line
+		}
+
+		data := record
+		if all || chata.IsSealed(record) {
+			d, e := chata.Unseal(sealer, p, record)
+			if e != nil {
+				return false, fmt.Errorf("%s: %w", p, e)
+			}
+
+			data = d
+		} else {
+			inClear = true
+		}
+
+		sealed, e := chata.Seal(sealer, p, data)
+		if e != nil {
+			return false, e
+		}
+
+		out.Write(sealed)
+		if isLog {
+			out.WriteByte('\n')
+		}
+	}
+
+	if !all && !inClear {
+		return false, nil
+	}
+
+	return true, chata.WriteFile(p, out.Bytes(), 0600)
+}
+
+// resealDir reseals the files of the directory, temporary files are left
+// alone. It stops at the first file that does not unseal and returns the
+// number of files resealed.
+func resealDir(dir string, sealer chata.Sealer, all bool) (int, error) {
+	names, err := dataFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, name := range names {
+		resealed, err := resealFile(filepath.Join(dir, name), sealer, all)
+		if err != nil {
+			return n, err
+		}
+
+		if resealed {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// SealFiles seals the files in the directories that are in the clear, as
+// they were written before sealing was turned on, with the master key of the
+// key file. A key file that is not there yet gets a new master key, and
+// directories that are not there yet are skipped. Sealed
+// stores refuse files in the clear, so this is done once, before they load
+// them. The stores of the directories must not be in use.
+func SealFiles(keyFile string, dirs ...string) (int, error) {
+	if _, e := os.Stat(keyFile); errors.Is(e, os.ErrNotExist) {
+		if e := GenerateKey(keyFile); e != nil {
+			return 0, e
+		}
+	}
+
+	k, err := LoadKeyring(keyFile)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, dir := range dirs {
+		sealed, err := resealDir(dir, k, false)
+		n += sealed
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// dataFiles returns the names of the files of the directory that hold data,
+// temporary files left by crashes do not.
+func dataFiles(dir string) ([]string, error) {
+	c := &checker{dir: dir, sealer: nil, repair: false, problems: nil}
+
+	names, err := c.files()
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(names, chata.IsTempFile), nil
+}
+
+// Rekey reseals the files in the directories with a new master key and
+// replaces the key in the key file with it. The new key is kept next to the
+// key file until every file is resealed, a rekey that is cut short unseals
+// with both keys and is finished by running it again. The key it replaces is
+// added to the retired keys, which are only ever removed by hand. The stores
+// of the directories must not be in use.
+func Rekey(keyFile string, dirs ...string) (int, error) {
+	newKeyFile := keyFile + NewKeySuffix
+	if _, e := os.Stat(newKeyFile); errors.Is(e, os.ErrNotExist) {
+		if e := GenerateKey(newKeyFile); e != nil {
+			return 0, e
+		}
+	}
+
+	k, err := LoadKeyring(keyFile)
+	if err != nil {
+		return 0, err
+	}
+
+	k.master, err = readKey(newKeyFile)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, dir := range dirs {
+		resealed, err := resealDir(dir, k, true)
+		n += resealed
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if e := retireKey(keyFile); e != nil {
+		return n, e
+	}
+
+	if e := os.Rename(newKeyFile, keyFile); e != nil {
+		return n, e
+	}
+
+	return n, chata.SyncDir(filepath.Dir(keyFile))
+}
+
+// retireKey adds the key of the key file to its retired keys, unless a rekey
+// that was cut short added it already.
+func retireKey(keyFile string) error {
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	key := strings.TrimSpace(string(b))
+	retiredFile := keyFile + RetiredKeySuffix
+	retired, err := os.ReadFile(retiredFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if slices.Contains(strings.Fields(string(retired)), key) {
+		return nil
+	}
+
+	return chata.WriteFile(retiredFile, append(retired, key+"\n"...), 0600)
+}
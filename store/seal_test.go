@@ -0,0 +1,303 @@
+package store_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata"
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+	"github.com/rchamarthy/chata/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyring(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	dir := t.TempDir()
+	keyFile := path.Join(dir, "key")
+
+	_, err := store.LoadKeyring(keyFile)
+	require.ErrorIs(err, os.ErrNotExist)
+	require.NoError(store.GenerateKey(keyFile))
+	require.Error(store.GenerateKey(keyFile)) // Keys are never overwritten
+
+	k, err := store.LoadKeyring(keyFile)
+	require.NoError(err)
+
+	sealed, err := chata.Seal(k, "/some/dir/file", []byte("secret"))
+	require.NoError(err)
+	require.True(chata.IsSealed(sealed))
+	require.NotContains(string(sealed), "secret")
+	require.NotContains(string(sealed), "\n")
+
+	data, err := chata.Unseal(k, "/other/dir/file", sealed)
+	require.NoError(err)
+	require.Equal("secret", string(data))
+
+	// Every seal has a data key of its own
+	again, err := chata.Seal(k, "file", []byte("secret"))
+	require.NoError(err)
+	require.NotEqual(sealed, again)
+
+	// Sealed data is bound to its file and does not survive tampering
+	_, err = chata.Unseal(k, "other", sealed)
+	require.Error(err)
+	require.NotErrorIs(err, chata.ErrNoKey)
+	tampered := slices.Clone(sealed)
+	if i := len(tampered) - 8; tampered[i] == 'A' {
+		tampered[i] = 'B'
+	} else {
+		tampered[i] = 'A'
+	}
+	_, err = chata.Unseal(k, "file", tampered)
+	require.Error(err)
+	_, err = chata.Unseal(k, "file", []byte(chata.SealedPrefix+"garbage"))
+	require.Error(err)
+
+	// Data in the clear is only read without a sealer, sealed data needs its
+	// key
+	_, err = chata.Unseal(k, "file", []byte("in the clear"))
+	require.ErrorIs(err, chata.ErrNotSealed)
+	data, err = chata.Unseal(nil, "file", []byte("in the clear"))
+	require.NoError(err)
+	require.Equal("in the clear", string(data))
+	_, err = chata.Unseal(nil, "file", sealed)
+	require.ErrorIs(err, chata.ErrNoKey)
+
+	otherFile := path.Join(dir, "other")
+	require.NoError(store.GenerateKey(otherFile))
+	other, err := store.LoadKeyring(otherFile)
+	require.NoError(err)
+	_, err = chata.Unseal(other, "file", sealed)
+	require.ErrorIs(err, chata.ErrNoKey)
+
+	require.NoError(os.WriteFile(otherFile, []byte("not a key"), 0600))
+	_, err = store.LoadKeyring(otherFile)
+	require.Error(err)
+}
+
+// sealedStores returns stores of the directory that seal with the keyring.
+func sealedStores(t *testing.T, dir string, k chata.Sealer) (*store.UserDB, *store.ChatDB) {
+	t.Helper()
+
+	users := store.NewSealedUserDB(path.Join(dir, "users"), k)
+	chats := store.NewSealedChatDB(path.Join(dir, "chats"), k)
+	require.NoError(t, users.Init())
+	require.NoError(t, chats.Init())
+	require.NoError(t, users.Load(context.Background()))
+	require.NoError(t, chats.Load(context.Background()))
+
+	return users, chats
+}
+
+// requireSealed fails unless every file of the directory is sealed.
+func requireSealed(t *testing.T, dir string) {
+	t.Helper()
+
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		b, err := os.ReadFile(p)
+		require.NoError(t, err)
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			require.True(t, chata.IsSealed([]byte(line)), p)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestSealedStores(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	dir := t.TempDir()
+	ctx := context.Background()
+	keyFile := path.Join(t.TempDir(), "key")
+
+	// Files written before sealing was turned on
+	users, chats := store.NewUserDB(path.Join(dir, "users")), store.NewChatDB(path.Join(dir, "chats"))
+	require.NoError(users.Init())
+	require.NoError(chats.Init())
+	require.NoError(users.Add(auth.NewUser("Alice", "alice")))
+	session := chat.NewSession("alice", "bob")
+	require.NoError(chats.Add(session))
+	_, _, err := chats.AppendMessage(session.ID, chat.Message{Sender: "alice", Body: "secret", Time: time.Now()})
+	require.NoError(err)
+
+	// Files in the clear are not taken for corrupt once sealing is turned
+	// on, they keep the stores from loading until they are sealed
+	require.NoError(store.GenerateKey(keyFile))
+	k, err := store.LoadKeyring(keyFile)
+	require.NoError(err)
+	require.ErrorIs(store.NewSealedUserDB(path.Join(dir, "users"), k).Load(ctx), chata.ErrNotSealed)
+	require.ErrorIs(store.NewSealedChatDB(path.Join(dir, "chats"), k).Load(ctx), chata.ErrNotSealed)
+	require.NoDirExists(path.Join(dir, "users", store.CorruptDir))
+	require.NoDirExists(path.Join(dir, "chats", store.CorruptDir))
+	require.FileExists(path.Join(dir, "users", "alice"))
+	require.FileExists(path.Join(dir, "chats", session.ID))
+
+	// Files in the clear are sealed once, with the key
+	n, err := store.SealFiles(keyFile, path.Join(dir, "users"), path.Join(dir, "chats"), path.Join(dir, "none"))
+	require.NoError(err)
+	require.Equal(3, n)
+	requireSealed(t, dir)
+	n, err = store.SealFiles(keyFile, path.Join(dir, "users"), path.Join(dir, "chats"))
+	require.NoError(err)
+	require.Zero(n)
+
+	sealedUsers, sealedChats := sealedStores(t, dir, k)
+	require.True(sealedUsers.HasUser("alice"))
+	require.Len(sealedChats.GetByID(session.ID).Messages, 1)
+
+	// New records are sealed too
+	_, _, err = sealedChats.AppendMessage(session.ID, chat.Message{Sender: "bob", Body: "secret", Time: time.Now()})
+	require.NoError(err)
+	_, _, err = sealedChats.ChangeMessage(session.ID, chat.NewDelete(1, "alice", time.Now()))
+	require.NoError(err)
+	require.NoError(sealedUsers.Add(auth.NewUser("Bob", "bob")))
+	requireSealed(t, dir)
+
+	_, reloaded := sealedStores(t, dir, k)
+	messages := reloaded.GetByID(session.ID).Messages
+	require.Len(messages, 2)
+	require.NotNil(messages[0].Deleted)
+	require.Equal("secret", messages[1].Body)
+
+	require.NoError(reloaded.Compact(ctx))
+	requireSealed(t, dir)
+	_, reloaded = sealedStores(t, dir, k)
+	require.Len(reloaded.GetByID(session.ID).Messages, 2)
+
+	problems, err := store.CheckUsers(path.Join(dir, "users"), k, false)
+	require.NoError(err)
+	require.Empty(problems)
+	problems, err = store.CheckChats(path.Join(dir, "chats"), k, false)
+	require.NoError(err)
+	require.Empty(problems)
+
+	// A torn sealed record is cut off like one in the clear
+	logFile := chat.LogFile(path.Join(dir, "chats", session.ID))
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(err)
+	_, err = f.WriteString(chata.SealedPrefix + "AAAA")
+	require.NoError(err)
+	require.NoError(f.Close())
+	_, reloaded = sealedStores(t, dir, k)
+	require.Len(reloaded.GetByID(session.ID).Messages, 2)
+	requireSealed(t, dir)
+
+	// A user planted in the clear is not taken for a real one, and neither is
+	// a record in the clear in a sealed log
+	planted := auth.NewUser("Mallory", "mallory", auth.ADMIN)
+	require.NoError(planted.SaveUser(path.Join(dir, "users"), nil))
+	plantedUsers := store.NewSealedUserDB(path.Join(dir, "users"), k)
+	require.ErrorIs(plantedUsers.Load(ctx), chata.ErrNotSealed)
+	require.False(plantedUsers.HasUser("mallory"))
+	require.NoError(os.Remove(path.Join(dir, "users", "mallory")))
+
+	logBytes, err := os.ReadFile(logFile)
+	require.NoError(err)
+	inClear := append(slices.Clone(logBytes), []byte(`{"id":3,"sender":"bob","body":"planted"}`+"\n")...)
+	require.NoError(os.WriteFile(logFile, inClear, 0600))
+	require.ErrorIs(store.NewSealedChatDB(path.Join(dir, "chats"), k).Load(ctx), chata.ErrNotSealed)
+	require.NoError(os.WriteFile(logFile, logBytes, 0600))
+	require.NoDirExists(path.Join(dir, "users", store.CorruptDir))
+	require.NoDirExists(path.Join(dir, "chats", store.CorruptDir))
+
+	// Without the key nothing loads, and nothing is taken for corrupt
+	require.ErrorIs(store.NewUserDB(path.Join(dir, "users")).Load(ctx), chata.ErrNoKey)
+	require.ErrorIs(store.NewChatDB(path.Join(dir, "chats")).Load(ctx), chata.ErrNoKey)
+	require.NoDirExists(path.Join(dir, "users", store.CorruptDir))
+	require.NoDirExists(path.Join(dir, "chats", store.CorruptDir))
+}
+
+
+func TestRekey(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	dir := t.TempDir()
+	usersDir, chatsDir := path.Join(dir, "users"), path.Join(dir, "chats")
+	keyFile := path.Join(t.TempDir(), "key")
+	require.NoError(store.GenerateKey(keyFile))
+	old, err := store.LoadKeyring(keyFile)
+	require.NoError(err)
+
+	users, chats := sealedStores(t, dir, old)
+	require.NoError(users.Add(auth.NewUser("Alice", "alice")))
+	session := chat.NewSession("alice", "bob")
+	require.NoError(chats.Add(session))
+	_, _, err = chats.AppendMessage(session.ID, chat.Message{Sender: "alice", Body: "hi", Time: time.Now()})
+	require.NoError(err)
+
+	n, err := store.Rekey(keyFile, usersDir, chatsDir)
+	require.NoError(err)
+	require.Equal(3, n)
+	require.NoFileExists(keyFile + store.NewKeySuffix)
+
+	// The old key unseals nothing, the new one everything
+	require.ErrorIs(store.NewSealedChatDB(chatsDir, old).Load(context.Background()), chata.ErrNoKey)
+	k, err := store.LoadKeyring(keyFile)
+	require.NoError(err)
+	users, chats = sealedStores(t, dir, k)
+	require.True(users.HasUser("alice"))
+	require.Len(chats.GetByID(session.ID).Messages, 1)
+
+	// The old key is retired rather than lost, data it sealed still unseals
+	sealed, err := chata.Seal(old, "file", []byte("before the rekey"))
+	require.NoError(err)
+	data, err := chata.Unseal(k, "file", sealed)
+	require.NoError(err)
+	require.Equal("before the rekey", string(data))
+	require.NoError(os.Rename(keyFile+store.RetiredKeySuffix, keyFile+".removed"))
+	k, err = store.LoadKeyring(keyFile)
+	require.NoError(err)
+	_, err = chata.Unseal(k, "file", sealed)
+	require.ErrorIs(err, chata.ErrNoKey)
+	require.NoError(os.Rename(keyFile+".removed", keyFile+store.RetiredKeySuffix))
+
+	// A rekey that was cut short leaves files sealed with either key, both
+	// unseal them and running it again finishes it
+	require.NoError(store.GenerateKey(keyFile + store.NewKeySuffix))
+	next, err := store.LoadKeyring(keyFile + store.NewKeySuffix)
+	require.NoError(err)
+	require.NoError(store.NewSealedUserDB(usersDir, next).Add(auth.NewUser("Bob", "bob")))
+
+	both, err := store.LoadKeyring(keyFile)
+	require.NoError(err)
+	users, chats = sealedStores(t, dir, both)
+	require.True(users.HasUser("bob"))
+	_, _, err = chats.AppendMessage(session.ID, chat.Message{Sender: "bob", Body: "hi", Time: time.Now()})
+	require.NoError(err)
+
+	n, err = store.Rekey(keyFile, usersDir, chatsDir)
+	require.NoError(err)
+	require.Equal(4, n)
+
+	users, chats = sealedStores(t, dir, next)
+	require.True(users.HasUser("alice"))
+	require.True(users.HasUser("bob"))
+	require.Len(chats.GetByID(session.ID).Messages, 2)
+
+	// Every rekey retires its key once, the first key still unseals
+	b, err := os.ReadFile(keyFile + store.RetiredKeySuffix)
+	require.NoError(err)
+	require.Len(strings.Fields(string(b)), 2)
+	k, err = store.LoadKeyring(keyFile)
+	require.NoError(err)
+	data, err = chata.Unseal(k, "file", sealed)
+	require.NoError(err)
+	require.Equal("before the rekey", string(data))
+}
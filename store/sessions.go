@@ -2,89 +2,300 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/rchamarthy/chata"
 	"github.com/rchamarthy/chata/chat"
 )
 
+// ErrNotFound is returned for changes to a session that does not exist, or
+// no longer does.
+var ErrNotFound = errors.New("not found")
+
+// entry is a session of the index and the lock that orders the changes to
+// it. Changes hold the lock, snapshots hold its read lock. Changes that found
+// the entry before it was deleted find it deleted.
+type entry struct {
+	lock    sync.RWMutex
+	session *chat.Session
+	deleted bool
+}
+
+// snapshot returns a snapshot of the session of the entry.
+func (e *entry) snapshot() *chat.Session {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	return e.session.Snapshot()
+}
+
+// update runs change on the session of the entry with the lock of the entry
+// held and returns a snapshot of the session after the change.
+func (e *entry) update(id string, change func(session *chat.Session) error) (*chat.Session, error) {
+	if e == nil {
+		return nil, notFound(id)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.deleted {
+		return nil, notFound(id)
+	}
+
+	if err := change(e.session); err != nil {
+		return nil, err
+	}
+
+	return e.session.Snapshot(), nil
+}
+
+// remove runs remove on the session of the entry with the lock of the entry
+// held and marks the entry deleted if it succeeds.
+func (e *entry) remove(id string, remove func(session *chat.Session) error) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.deleted {
+		return notFound(id)
+	}
+
+	if remove != nil {
+		if err := remove(e.session); err != nil {
+			return err
+		}
+	}
+
+	e.deleted = true
+
+	return nil
+}
+
+func notFound(id string) error {
+	return fmt.Errorf("session %s %w", id, ErrNotFound)
+}
+
+// Sessions indexes the sessions by id and by their users. Sessions between
+// two users are found from either user, groups from every member. Sessions
+// are handed out as snapshots, the index keeps the sessions it was given and
+// changes them one at a time under the lock of each session.
 type Sessions struct {
-	sessions        map[string]*chat.Session
-	sessionsByUsers map[string]map[string]*chat.Session
+	sessions        map[string]*entry
+	sessionsByUsers map[string]map[string]*entry
+	groupsByUsers   map[string]map[string]*entry
 }
 
 func NewSessions() *Sessions {
 	return &Sessions{
-		sessions:        map[string]*chat.Session{},
-		sessionsByUsers: map[string]map[string]*chat.Session{},
+		sessions:        map[string]*entry{},
+		sessionsByUsers: map[string]map[string]*entry{},
+		groupsByUsers:   map[string]map[string]*entry{},
 	}
 }
 
+// Add indexes the session, which belongs to the index from then on. A session
+// with the same id is replaced.
 func (s *Sessions) Add(session *chat.Session) {
-	s.sessions[session.ID] = session
+	if old := s.sessions[session.ID]; old != nil {
+		_ = old.remove(session.ID, nil)
+		s.unindex(old.session)
+	}
 
-	user1Sessions := s.sessionsByUsers[session.User1]
-	if user1Sessions == nil {
-		user1Sessions = map[string]*chat.Session{}
-		s.sessionsByUsers[session.User1] = user1Sessions
+	e := &entry{session: session}
+	s.sessions[session.ID] = e
+	s.index(e)
+}
+
+// index adds the entry to the indexes of the users of its session.
+func (s *Sessions) index(e *entry) {
+	session := e.session
+	if session.IsGroup() {
+		for _, member := range session.Members() {
+			index(s.groupsByUsers, member, session.ID, e)
+		}
+
+		return
+	}
+
+	index(s.sessionsByUsers, session.User1, session.User2, e)
+	index(s.sessionsByUsers, session.User2, session.User1, e)
+}
+
+// unindex drops the session from the indexes of its users.
+func (s *Sessions) unindex(session *chat.Session) {
+	if session.IsGroup() {
+		for _, member := range session.Members() {
+			unindex(s.groupsByUsers, member, session.ID)
+		}
+
+		return
 	}
-	user1Sessions[session.User2] = session
 
-	user2Sessions := s.sessionsByUsers[session.User2]
-	if user2Sessions == nil {
-		user2Sessions = map[string]*chat.Session{}
-		s.sessionsByUsers[session.User2] = user2Sessions
+	unindex(s.sessionsByUsers, session.User1, session.User2)
+	unindex(s.sessionsByUsers, session.User2, session.User1)
+}
+
+func index(idx map[string]map[string]*entry, user string, key string, e *entry) {
+	userSessions := idx[user]
+	if userSessions == nil {
+		userSessions = map[string]*entry{}
+		idx[user] = userSessions
 	}
-	user2Sessions[session.User1] = session
+
+	userSessions[key] = e
 }
 
+func unindex(idx map[string]map[string]*entry, user string, key string) {
+	delete(idx[user], key)
+	if len(idx[user]) == 0 {
+		delete(idx, user)
+	}
+}
+
+// Get returns a snapshot of the session between the users.
 func (s *Sessions) Get(user1 string, user2 string) *chat.Session {
-	user1Sessions := s.sessionsByUsers[user1]
-	if user1Sessions == nil {
+	e := s.sessionsByUsers[user1][user2]
+	if e == nil {
 		return nil
 	}
-	return user1Sessions[user2]
+
+	return e.snapshot()
+}
+
+// GetByID returns a snapshot of the session, or group, with the id.
+func (s *Sessions) GetByID(id string) *chat.Session {
+	e := s.sessions[id]
+	if e == nil {
+		return nil
+	}
+
+	return e.snapshot()
+}
+
+// entry returns the entry of the session with the id, nil if there is none.
+func (s *Sessions) entry(id string) *entry {
+	return s.sessions[id]
 }
 
+// entries returns the entries of every session and group.
+func (s *Sessions) entries() map[string]*entry {
+	return maps.Clone(s.sessions)
+}
+
+// All returns snapshots of every session and group.
+func (s *Sessions) All() []*chat.Session {
+	return snapshots(s.sessions)
+}
+
+// GetSessionsByUser returns snapshots of the sessions and the groups of the
+// user.
 func (s *Sessions) GetSessionsByUser(user string) []*chat.Session {
 	user1Sessions := s.sessionsByUsers[user]
-	if user1Sessions == nil {
+	groups := s.groupsByUsers[user]
+	if user1Sessions == nil && groups == nil {
 		return nil
 	}
 
-	sessions := make([]*chat.Session, 0, len(user1Sessions))
-	for _, session := range user1Sessions {
-		sessions = append(sessions, session)
+	return append(snapshots(user1Sessions), snapshots(groups)...)
+}
+
+// GetGroupsByUser returns snapshots of the groups the user is a member of.
+func (s *Sessions) GetGroupsByUser(user string) []*chat.Session {
+	return snapshots(s.groupsByUsers[user])
+}
+
+func snapshots(entries map[string]*entry) []*chat.Session {
+	sessions := make([]*chat.Session, 0, len(entries))
+	for _, e := range entries {
+		sessions = append(sessions, e.snapshot())
 	}
+
 	return sessions
 }
 
 func (s *Sessions) Delete(user1 string, user2 string) error {
-	session := s.Get(user1, user2)
-	if session == nil {
+	e := s.sessionsByUsers[user1][user2]
+	if e == nil {
 		return fmt.Errorf("session for users %s and %s not found", user1, user2)
 	}
 
-	delete(s.sessions, session.ID)
-	delete(s.sessionsByUsers[user1], user2)
-	delete(s.sessionsByUsers[user2], user1)
+	return s.remove(e.session.ID, nil)
+}
+
+// DeleteByID removes the session, or group, with the id from the indexes.
+func (s *Sessions) DeleteByID(id string) error {
+	return s.remove(id, nil)
+}
+
+// remove runs remove on the session with the id, with the lock of the
+// session held, and drops the session from the indexes if it succeeds.
+func (s *Sessions) remove(id string, remove func(session *chat.Session) error) error {
+	e := s.sessions[id]
+	if e == nil {
+		return notFound(id)
+	}
+
+	if err := e.remove(id, remove); err != nil {
+		return err
+	}
+
+	delete(s.sessions, id)
+	s.unindex(e.session)
 
 	return nil
 }
 
+// UpdateMembers changes the members of a group with update, with the lock of
+// the group held, and indexes the group by its new members. Update runs on a
+// snapshot of the group that only replaces the group if update succeeds, so
+// that a change that is not saved is not kept either. It returns a snapshot
+// of the group after the change.
+func (s *Sessions) UpdateMembers(id string, update func(group *chat.Session) error) (*chat.Session, error) {
+	e := s.sessions[id]
+	if e == nil || !e.session.IsGroup() {
+		return nil, fmt.Errorf("group %s not found", id)
+	}
+
+	return e.update(id, func(group *chat.Session) error {
+		updated := group.Snapshot()
+		if err := update(updated); err != nil {
+			return err
+		}
+
+		s.unindex(group)
+		*group = *updated
+		s.index(e)
+
+		return nil
+	})
+}
+
+// ChatDB is the ChatStore that keeps every session in a file of its own, with
+// the messages of the session in an append-only log beside it. The files are
+// sealed with the sealer if there is one.
 type ChatDB struct {
 	sessionsDir string
+	sealer      chata.Sealer
 	sessions    *Sessions
 	lock        *sync.RWMutex
 }
 
 func NewChatDB(db string) *ChatDB {
+	return NewSealedChatDB(db, nil)
+}
+
+// NewSealedChatDB returns a ChatDB that seals its files with the sealer.
+func NewSealedChatDB(db string, sealer chata.Sealer) *ChatDB {
 	return &ChatDB{
 		sessionsDir: db,
+		sealer:      sealer,
 		sessions:    NewSessions(),
 		lock:        &sync.RWMutex{},
 	}
@@ -106,6 +317,7 @@ func (db *ChatDB) Destroy() error {
 }
 
 type sessionError struct {
+	file    string
 	session *chat.Session
 	err     error
 }
@@ -120,17 +332,27 @@ func (db *ChatDB) Load(ctx context.Context) error {
 		waitGroup := &sync.WaitGroup{}
 		err := filepath.WalkDir(d,
 			func(p string, d fs.DirEntry, err error) error {
+				if err == nil && d.IsDir() && d.Name() == CorruptDir {
+					return filepath.SkipDir
+				}
+
 				waitGroup.Add(1)
 				go func(p string, f fs.DirEntry) {
 					defer waitGroup.Done()
 					if err != nil {
-						channel <- sessionError{nil, err}
+						channel <- sessionError{p, nil, err}
 						return
 					}
 
-					if f.Type().IsRegular() {
-						s, e := chat.LoadSession(p)
-						channel <- sessionError{s, e}
+					if f.Type().IsRegular() && chat.IsSessionFile(f.Name()) {
+						s, up, e := loadSessionFile(p, db.sealer)
+						if e == nil && up != nil {
+							// Sessions saved in an older schema are saved again
+							chata.Log(ctx).Info("upgrading session", "file", p, "from", up.From, "to", up.To)
+							e = s.SaveMetadata(filepath.Dir(p), db.sealer)
+						}
+
+						channel <- sessionError{p, s, e}
 					}
 				}(p, d)
 
@@ -148,6 +370,15 @@ func (db *ChatDB) Load(ctx context.Context) error {
 	var err error
 	log := chata.Log(ctx)
 	for se := range sessionChan {
+		// Corrupt sessions are put aside, the others are served
+		if errors.Is(se.err, ErrCorrupt) {
+			log.Warn("quarantining corrupt session", "file", se.file, "error", se.err)
+			se.err = Quarantine(filepath.Dir(se.file), sessionFiles(se.file)...)
+			if se.err == nil {
+				continue
+			}
+		}
+
 		if se.err == nil {
 			db.sessions.Add(se.session)
 		} else {
@@ -159,11 +390,12 @@ func (db *ChatDB) Load(ctx context.Context) error {
 	return err
 }
 
+// Add saves the session and adds it to the store, which owns it from then on.
 func (db *ChatDB) Add(session *chat.Session) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	if e := session.Save(db.sessionsDir); e != nil {
+	if e := session.Save(db.sessionsDir, db.sealer); e != nil {
 		return e
 	}
 
@@ -187,11 +419,7 @@ func (db *ChatDB) Delete(user1 string, user2 string) error {
 		return fmt.Errorf("session for users %s and %s not found", user1, user2)
 	}
 
-	if e := session.Delete(db.sessionsDir); e != nil {
-		return e
-	}
-
-	return db.sessions.Delete(user1, user2)
+	return db.delete(session.ID)
 }
 
 func (db *ChatDB) GetSessionsByUser(user string) []*chat.Session {
@@ -201,3 +429,191 @@ func (db *ChatDB) GetSessionsByUser(user string) []*chat.Session {
 	sessions := db.sessions.GetSessionsByUser(user)
 	return sessions
 }
+
+// GetByID returns the session, or group, with the id.
+func (db *ChatDB) GetByID(id string) *chat.Session {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.sessions.GetByID(id)
+}
+
+// GetGroupsByUser returns the groups the user is a member of.
+func (db *ChatDB) GetGroupsByUser(user string) []*chat.Session {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.sessions.GetGroupsByUser(user)
+}
+
+// DeleteByID deletes the session, or group, with the id.
+func (db *ChatDB) DeleteByID(id string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return db.delete(id)
+}
+
+// delete removes the files of the session and the session from the index,
+// it must be called with the lock held.
+func (db *ChatDB) delete(id string) error {
+	return db.sessions.remove(id, func(session *chat.Session) error {
+		return session.Delete(db.sessionsDir)
+	})
+}
+
+// UpdateMembers changes the members of a group with update and saves the
+// group. The group is indexed by its new members once update returns.
+func (db *ChatDB) UpdateMembers(id string, update func(group *chat.Session) error) (*chat.Session, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return db.sessions.UpdateMembers(id, func(group *chat.Session) error {
+		if e := update(group); e != nil {
+			return e
+		}
+
+		return group.Save(db.sessionsDir, db.sealer)
+	})
+}
+
+// update runs change on the session with the id under the lock of the
+// session alone, changes to other sessions go on meanwhile.
+func (db *ChatDB) update(id string, change func(session *chat.Session) error) (*chat.Session, error) {
+	db.lock.RLock()
+	e := db.sessions.entry(id)
+	db.lock.RUnlock()
+
+	return e.update(id, change)
+}
+
+// AppendMessage adds the message to the session and appends it to the log of
+// the session.
+func (db *ChatDB) AppendMessage(id string, m chat.Message) (*chat.Session, chat.Message, error) {
+	session, err := db.update(id, func(session *chat.Session) error {
+		var err error
+		if m, err = session.Prepare(m, time.Now()); err != nil {
+			return err
+		}
+
+		return session.AppendMessage(db.sessionsDir, db.sealer, m)
+	})
+
+	return session, m, err
+}
+
+// ChangeMessage applies the change to the session and appends it to the log
+// of the session.
+func (db *ChatDB) ChangeMessage(id string, c chat.Change) (*chat.Session, chat.Message, error) {
+	var m chat.Message
+	session, err := db.update(id, func(session *chat.Session) error {
+		i, err := session.AppendChange(db.sessionsDir, db.sealer, c)
+		if err != nil {
+			return err
+		}
+
+		m = session.Messages[i]
+		return nil
+	})
+
+	return session, m, err
+}
+
+// MarkReceipt moves the receipt of the user up and writes the session file,
+// the messages are left alone.
+func (db *ChatDB) MarkReceipt(id string, user string, r chat.Receipt) (*chat.Session, bool, error) {
+	changed := false
+	session, err := db.update(id, func(session *chat.Session) error {
+		receipts := session.Receipts
+		if !session.Mark(user, r) {
+			return nil
+		}
+
+		if e := session.SaveMetadata(db.sessionsDir, db.sealer); e != nil {
+			session.Receipts = receipts
+			return e
+		}
+
+		changed = true
+		return nil
+	})
+
+	return session, changed, err
+}
+
+// SetTTL sets the TTL of the session and writes the session file.
+func (db *ChatDB) SetTTL(id string, user string, ttl time.Duration) (*chat.Session, error) {
+	return db.update(id, func(session *chat.Session) error {
+		old := session.TTL
+		if e := session.SetTTL(user, ttl); e != nil {
+			return e
+		}
+
+		if e := session.SaveMetadata(db.sessionsDir, db.sealer); e != nil {
+			session.TTL = old
+			return e
+		}
+
+		return nil
+	})
+}
+
+func (db *ChatDB) All() []*chat.Session {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.sessions.All()
+}
+
+// Purge drops the expired messages of the session and rewrites its log
+// without them. A copy of the session is purged and compacted, it replaces
+// the session once it is on disk.
+func (db *ChatDB) Purge(id string, now time.Time, r chat.Retention) (*chat.Session, int, error) {
+	n := 0
+	session, err := db.update(id, func(session *chat.Session) error {
+		if n = session.Expired(now, r); n == 0 {
+			return nil
+		}
+
+		purged := session.Snapshot()
+		purged.Purge(n)
+		if e := purged.Compact(db.sessionsDir, db.sealer); e != nil {
+			n = 0
+			return e
+		}
+
+		*session = *purged
+		return nil
+	})
+
+	return session, n, err
+}
+
+// Compact rewrites the logs of the sessions that need it, such as sessions
+// whose messages are still in the session file or that have changes to fold
+// into their messages. Sessions are compacted one at a time, the others are
+// not held up.
+func (db *ChatDB) Compact(ctx context.Context) error {
+	db.lock.RLock()
+	entries := db.sessions.entries()
+	db.lock.RUnlock()
+
+	var err error
+	for id, session := range entries {
+		_, e := session.update(id, func(session *chat.Session) error {
+			if !session.NeedsCompaction() {
+				return nil
+			}
+
+			return session.Compact(db.sessionsDir, db.sealer)
+		})
+
+		// Sessions deleted meanwhile need no compaction
+		if e != nil && !errors.Is(e, ErrNotFound) {
+			chata.Log(ctx).Error("error compacting session", "session", id, "error", e)
+			err = e
+		}
+	}
+
+	return err
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path"
 	"testing"
 
 	"github.com/rchamarthy/chata/chat"
@@ -101,3 +102,121 @@ func TestSessionLoad(t *testing.T) {
 		require.Len(db.GetSessionsByUser(user), 9)
 	}
 }
+
+func TestSessionsGroups(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	s := store.NewSessions()
+
+	group, err := chat.NewGroup("alice", "friends", "bob", "carol")
+	require.NoError(err)
+	s.Add(group)
+	s.Add(chat.NewSession("alice", "bob"))
+
+	require.Equal(group, s.GetByID(group.ID))
+	require.Len(s.GetSessionsByUser("alice"), 2)
+	require.Len(s.GetSessionsByUser("carol"), 1)
+	require.Len(s.GetGroupsByUser("bob"), 1)
+	require.Empty(s.GetGroupsByUser("dave"))
+	require.Nil(s.Get("bob", "carol"))
+
+	require.NoError(s.DeleteByID(group.ID))
+	require.Nil(s.GetByID(group.ID))
+	require.Len(s.GetSessionsByUser("alice"), 1)
+	require.Empty(s.GetSessionsByUser("carol"))
+	require.Error(s.DeleteByID(group.ID))
+}
+
+func TestChatDBGroups(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	db := store.NewChatDB("./test-group-db")
+	require.NoError(db.Init())
+
+	defer os.RemoveAll("./test-group-db")
+
+	group, err := chat.NewGroup("alice", "friends", "bob")
+	require.NoError(err)
+	require.NoError(db.Add(group))
+
+	// Membership changes reindex the group
+	_, err = db.UpdateMembers(group.ID, func(g *chat.Session) error {
+		return g.AddMember("alice", "carol")
+	})
+	require.NoError(err)
+	require.Len(db.GetGroupsByUser("carol"), 1)
+
+	_, err = db.UpdateMembers(group.ID, func(g *chat.Session) error {
+		return g.RemoveMember("bob", "bob")
+	})
+	require.NoError(err)
+	require.Empty(db.GetGroupsByUser("bob"))
+
+	// A failed change keeps the group indexed
+	_, err = db.UpdateMembers(group.ID, func(g *chat.Session) error {
+		return g.AddMember("carol", "dave")
+	})
+	require.ErrorIs(err, chat.ErrNotAdmin)
+	require.Len(db.GetGroupsByUser("carol"), 1)
+	_, err = db.UpdateMembers("gmissing", func(*chat.Session) error { return nil })
+	require.Error(err)
+
+	// A change that is not saved is not kept either, a directory in place of
+	// the group file cannot be replaced
+	groupFile := path.Join("./test-group-db", group.ID)
+	saved, err := os.ReadFile(groupFile)
+	require.NoError(err)
+	require.NoError(os.Remove(groupFile))
+	require.NoError(os.MkdirAll(path.Join(groupFile, "blocked"), 0700))
+
+	_, err = db.UpdateMembers(group.ID, func(g *chat.Session) error {
+		return g.AddMember("alice", "dave")
+	})
+	require.Error(err)
+	require.Empty(db.GetGroupsByUser("dave"))
+	require.Equal([]string{"alice", "carol"}, db.GetByID(group.ID).Members())
+
+	require.NoError(os.RemoveAll(groupFile))
+	require.NoError(os.WriteFile(groupFile, saved, 0600))
+
+	// Groups survive a reload
+	reloaded := store.NewChatDB("./test-group-db")
+	require.NoError(reloaded.Load(context.Background()))
+	g := reloaded.GetByID(group.ID)
+	require.NotNil(g)
+	require.Equal([]string{"alice", "carol"}, g.Members())
+
+	require.NoError(db.DeleteByID(group.ID))
+	require.Nil(db.GetByID(group.ID))
+	require.Error(db.DeleteByID(group.ID))
+}
+
+func TestChatDBMessageLog(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	db := store.NewChatDB("./test-message-log")
+	require.NoError(db.Init())
+
+	defer os.RemoveAll("./test-message-log")
+
+	session := chat.NewSession("user1", "user2")
+	require.NoError(db.Add(session))
+	_, _, err := db.AppendMessage(session.ID, chat.Message{Sender: "user1", Body: "hi"})
+	require.NoError(err)
+
+	// The store owns the session, reach into it for a message that is not
+	// logged
+	session.AddMessage("user2", "not logged yet")
+	require.True(session.NeedsCompaction())
+	require.NoError(db.Compact(context.Background()))
+	require.False(session.NeedsCompaction())
+
+	// Logs are not mistaken for sessions
+	reloaded := store.NewChatDB("./test-message-log")
+	require.NoError(reloaded.Load(context.Background()))
+	require.Len(reloaded.GetSessionsByUser("user1"), 1)
+	require.Len(reloaded.Get("user1", "user2").Messages, 2)
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/rchamarthy/chata/auth"
+	"github.com/rchamarthy/chata/chat"
+)
+
+// Backends that keep the users and the chats.
+const (
+	BackendFile   = "file"
+	BackendMemory = "memory"
+	BackendBolt   = "bolt"
+)
+
+// DefaultCompactInterval is how often the chats are compacted.
+const DefaultCompactInterval = 10 * time.Minute
+
+// UserStore keeps the registered users. Users are loaded once with Load and
+// served from memory afterwards.
+type UserStore interface {
+	Init() error
+	Load(ctx context.Context) error
+	Destroy() error
+
+	Add(user *auth.User) error
+	GetUser(id string) *auth.User
+	GetAllUsers() Users
+	DeleteUser(id string) error
+	HasUser(id string) bool
+	IsEmpty() bool
+}
+
+// ChatStore keeps the sessions between two users, the groups and their
+// messages. Sessions are loaded once with Load and served from memory
+// afterwards, the store writes every change through to its backend.
+//
+// The store owns the sessions and makes every change to them. Changes to a
+// session are made one at a time, changes to different sessions in parallel.
+// Sessions are handed out as snapshots that later changes do not show in,
+// and changes return a snapshot of the session after the change.
+type ChatStore interface {
+	Init() error
+	Load(ctx context.Context) error
+	Destroy() error
+
+	// Add adds the session to the store, which owns the session from then
+	// on.
+	Add(session *chat.Session) error
+	Get(user1 string, user2 string) *chat.Session
+	GetByID(id string) *chat.Session
+	GetSessionsByUser(user string) []*chat.Session
+	GetGroupsByUser(user string) []*chat.Session
+	Delete(user1 string, user2 string) error
+	DeleteByID(id string) error
+
+	// UpdateMembers changes the members of a group with update and saves
+	// the group.
+	UpdateMembers(id string, update func(group *chat.Session) error) (*chat.Session, error)
+
+	// AppendMessage gives the message the next id of the session, adds it
+	// to the session and saves it. It returns the message as it was saved,
+	// or the earlier message and chat.ErrDuplicateMessage if the message
+	// was already sent.
+	AppendMessage(id string, m chat.Message) (*chat.Session, chat.Message, error)
+
+	// ChangeMessage edits or deletes a message of the session and saves it.
+	// It returns the message as it is after the change.
+	ChangeMessage(id string, c chat.Change) (*chat.Session, chat.Message, error)
+
+	// MarkReceipt moves the receipt of the user in the session up to r and
+	// saves the session if the receipt changed. It reports whether it did.
+	MarkReceipt(id string, user string, r chat.Receipt) (*chat.Session, bool, error)
+
+	// SetTTL sets the TTL of the session for the user and saves the session.
+	SetTTL(id string, user string, ttl time.Duration) (*chat.Session, error)
+
+	// All returns every session of the store.
+	All() []*chat.Session
+
+	// Purge drops the messages of the session that are expired at now, by
+	// the TTL of the session or the retention, from the session and from
+	// the backend. It returns the session and the number of messages it
+	// dropped, the session is left as it was if the backend fails.
+	Purge(id string, now time.Time, r chat.Retention) (*chat.Session, int, error)
+
+	// Compact reclaims the space of the store, if the backend needs it.
+	Compact(ctx context.Context) error
+}
+
+// CompactEvery compacts the chats every interval until the context is done.
+func CompactEvery(ctx context.Context, chats ChatStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = chats.Compact(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+var (
+	_ UserStore = (*UserDB)(nil)
+	_ UserStore = (*MemoryUserStore)(nil)
+	_ UserStore = (*BoltUserStore)(nil)
+	_ ChatStore = (*ChatDB)(nil)
+	_ ChatStore = (*MemoryChatStore)(nil)
+	_ ChatStore = (*BoltChatStore)(nil)
+)
@@ -0,0 +1,213 @@
+package store_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/chat"
+	"github.com/rchamarthy/chata/store"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConcurrentSession hammers one session from many goroutines, run it
+// with -race.
+func TestConcurrentSession(t *testing.T) {
+	t.Parallel()
+
+	const (
+		senders  = 8
+		messages = 25
+	)
+
+	for _, b := range backends() {
+		t.Run(b.name, func(t *testing.T) {
+			t.Parallel()
+
+			require := require.New(t)
+			dir := t.TempDir()
+			ctx := context.Background()
+
+			_, chats, closeStores := b.open(t, dir)
+			require.NoError(chats.Init())
+			require.NoError(chats.Load(ctx))
+
+			session := chat.NewSession("user1", "user2")
+			id := session.ID
+			require.NoError(chats.Add(session))
+
+			waitGroup := &sync.WaitGroup{}
+			errs := make(chan error, senders*messages)
+
+			for sender := range senders {
+				waitGroup.Add(1)
+				go func() {
+					defer waitGroup.Done()
+
+					user := fmt.Sprintf("user%d", sender%2+1)
+					for i := range messages {
+						m := chat.Message{Sender: user, Body: "hi", Time: time.Now().UTC(), ClientID: fmt.Sprintf("%d-%d", sender, i)}
+						s, saved, err := chats.AppendMessage(id, m)
+						if err != nil {
+							errs <- err
+							continue
+						}
+
+						// Edit the message and move the receipts along as it goes
+						edit := chat.Message{Sender: user, Body: "hi!", Time: time.Now().UTC(), Replaces: saved.ID}
+						if _, _, e := chats.ChangeMessage(id, chat.NewEdit(edit)); e != nil {
+							errs <- e
+						}
+
+						if _, _, e := chats.MarkReceipt(id, s.Peer(user), chat.Receipt{Delivered: saved.ID, Read: 0}); e != nil {
+							errs <- e
+						}
+					}
+				}()
+			}
+
+			// Readers walk snapshots while they are written
+			done := make(chan struct{})
+			readers := &sync.WaitGroup{}
+			for range 4 {
+				readers.Add(1)
+				go func() {
+					defer readers.Done()
+
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+
+						s := chats.Get("user1", "user2")
+						last := uint64(0)
+						for _, m := range s.Messages {
+							if m.ID <= last {
+								errs <- fmt.Errorf("message %d after %d", m.ID, last)
+							}
+
+							last = m.ID
+							_ = m.Current().Body
+						}
+
+						_ = s.Summarize("user1")
+						_ = s.Unread("user2")
+						_ = chats.GetSessionsByUser("user1")
+					}
+				}()
+			}
+
+			// Compaction and sweeps run along
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+
+					if e := chats.Compact(ctx); e != nil {
+						errs <- e
+					}
+
+					if _, _, e := chats.Purge(id, time.Now(), chat.Retention{}); e != nil {
+						errs <- e
+					}
+				}
+			}()
+
+			waitGroup.Wait()
+			close(done)
+			readers.Wait()
+			close(errs)
+
+			for e := range errs {
+				require.NoError(e)
+			}
+
+			check := func(s *chat.Session) {
+				require.Len(s.Messages, senders*messages)
+				for i, m := range s.Messages {
+					require.Equal(uint64(i+1), m.ID)
+					require.Equal("hi!", m.Current().Body)
+				}
+			}
+
+			check(chats.GetByID(id))
+			closeStores()
+
+			if b.durable {
+				_, chats, closeStores = b.open(t, dir)
+				defer closeStores()
+				require.NoError(chats.Load(ctx))
+				check(chats.GetByID(id))
+			}
+		})
+	}
+}
+
+// TestConcurrentDelete deletes a session while it is written, writes after
+// the deletion do not bring the session back.
+func TestConcurrentDelete(t *testing.T) {
+	t.Parallel()
+
+	for _, b := range backends() {
+		t.Run(b.name, func(t *testing.T) {
+			t.Parallel()
+
+			require := require.New(t)
+			dir := t.TempDir()
+			ctx := context.Background()
+
+			_, chats, closeStores := b.open(t, dir)
+			require.NoError(chats.Init())
+			require.NoError(chats.Load(ctx))
+
+			session := chat.NewSession("user1", "user2")
+			id := session.ID
+			require.NoError(chats.Add(session))
+
+			waitGroup := &sync.WaitGroup{}
+			errs := make(chan error, 8)
+			for range 8 {
+				waitGroup.Add(1)
+				go func() {
+					defer waitGroup.Done()
+
+					for range 20 {
+						_, _, err := chats.AppendMessage(id, chat.Message{Sender: "user1", Body: "hi", Time: time.Now().UTC()})
+						if err != nil {
+							errs <- err
+							return
+						}
+					}
+				}()
+			}
+
+			require.NoError(chats.Delete("user1", "user2"))
+			waitGroup.Wait()
+			close(errs)
+
+			for e := range errs {
+				require.ErrorIs(e, store.ErrNotFound)
+			}
+
+			require.Nil(chats.GetByID(id))
+			closeStores()
+
+			if b.durable {
+				_, chats, closeStores = b.open(t, dir)
+				defer closeStores()
+				require.NoError(chats.Load(ctx))
+				require.Nil(chats.GetByID(id))
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rchamarthy/chata"
+	"github.com/rchamarthy/chata/chat"
+)
+
+// DefaultSweepInterval is how often the sweeper purges expired messages.
+const DefaultSweepInterval = time.Minute
+
+// Clock tells the time, tests use a clock they move by hand.
+type Clock func() time.Time
+
+// Sweeper purges the messages of the chats that are past the TTL of their
+// session or the retention of the server, and publishes the purges to the
+// members of the sessions on the hub.
+type Sweeper struct {
+	chats     ChatStore
+	retention chat.Retention
+	now       Clock
+	hub       *chat.Hub
+}
+
+func NewSweeper(chats ChatStore, retention chat.Retention, now Clock, hub *chat.Hub) *Sweeper {
+	return &Sweeper{
+		chats:     chats,
+		retention: retention,
+		now:       now,
+		hub:       hub,
+	}
+}
+
+// Sweep purges the expired messages of every session once and returns the
+// number of messages it purged.
+func (s *Sweeper) Sweep(ctx context.Context) (int, error) {
+	log := chata.Log(ctx)
+	now := s.now()
+	total := 0
+
+	var err error
+	for _, session := range s.chats.All() {
+		// Sessions deleted since they were listed are not swept
+		purged, n, e := s.chats.Purge(session.ID, now, s.retention)
+		if e != nil && !errors.Is(e, ErrNotFound) {
+			log.Error("error purging session", "session", session.ID, "error", e)
+			err = e
+		}
+
+		if n > 0 {
+			log.Info("purged messages", "session", session.ID, "count", n)
+			s.hub.Publish(chat.NewPurgeEvent(purged))
+			total += n
+		}
+	}
+
+	log.Debug("swept sessions", "purged", total)
+
+	return total, err
+}
+
+// Run sweeps every interval until the context is done.
+func (s *Sweeper) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, _ = s.Sweep(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
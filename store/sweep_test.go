@@ -0,0 +1,166 @@
+package store_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rchamarthy/chata/chat"
+	"github.com/rchamarthy/chata/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweeper(t *testing.T) {
+	t.Parallel()
+
+	for _, b := range backends() {
+		t.Run(b.name, func(t *testing.T) {
+			t.Parallel()
+
+			require := require.New(t)
+			dir := t.TempDir()
+			ctx := context.Background()
+
+			_, chats, closeStores := b.open(t, dir)
+			require.NoError(chats.Init())
+			require.NoError(chats.Load(ctx))
+
+			start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+			now := start
+			hub := chat.NewHub(chat.DefaultEventBuffer)
+			sweeper := store.NewSweeper(chats, chat.Retention{MaxAge: 24 * time.Hour, MaxMessages: 3}, func() time.Time {
+				return now
+			}, hub)
+			sub := hub.Subscribe("user2")
+			defer sub.Close()
+
+			session := chat.NewSession("user1", "user2")
+			require.NoError(chats.Add(session))
+			_, err := chats.SetTTL(session.ID, "user2", time.Hour)
+			require.NoError(err)
+			_, err = chats.SetTTL(session.ID, "user3", time.Hour)
+			require.ErrorIs(err, chat.ErrNotMember)
+
+			group, err := chat.NewGroup("user1", "friends", "user2")
+			require.NoError(err)
+			require.NoError(chats.Add(group))
+			_, err = chats.SetTTL(group.ID, "user2", time.Hour)
+			require.ErrorIs(err, chat.ErrNotAdmin)
+			require.Zero(chats.GetByID(group.ID).TTL)
+
+			for i := range 2 {
+				at := start.Add(time.Duration(i) * time.Hour)
+				_, _, err = chats.AppendMessage(session.ID, chat.Message{Sender: "user1", Body: "hi", Time: at})
+				require.NoError(err)
+			}
+
+			for range 5 {
+				_, _, err = chats.AppendMessage(group.ID, chat.Message{Sender: "user1", Body: "hi", Time: start})
+				require.NoError(err)
+			}
+
+			// The group keeps its last messages, the chat has nothing expired yet
+			n, err := sweeper.Sweep(ctx)
+			require.NoError(err)
+			require.Equal(2, n)
+			require.Len(chats.GetByID(session.ID).Messages, 2)
+			g := chats.GetByID(group.ID)
+			require.Len(g.Messages, 3)
+			require.Equal(uint64(3), g.Messages[0].ID)
+
+			// The members are told which messages are gone
+			e := <-sub.Events()
+			require.Equal(chat.EventPurged, e.Type)
+			require.Equal(group.ID, e.Session)
+			require.Equal(uint64(2), e.ID)
+			require.Empty(sub.Events())
+
+			// The first message of the chat is past its ttl
+			now = start.Add(90 * time.Minute)
+			n, err = sweeper.Sweep(ctx)
+			require.NoError(err)
+			require.Equal(1, n)
+			s := chats.GetByID(session.ID)
+			require.Len(s.Messages, 1)
+			require.Equal(uint64(2), s.Messages[0].ID)
+
+			// Sweeping again purges nothing
+			n, err = sweeper.Sweep(ctx)
+			require.NoError(err)
+			require.Zero(n)
+
+			// The retention of the server bounds the groups without a ttl
+			now = start.Add(25 * time.Hour)
+			n, err = sweeper.Sweep(ctx)
+			require.NoError(err)
+			require.Equal(4, n)
+			require.Empty(chats.GetByID(session.ID).Messages)
+			require.Empty(chats.GetByID(group.ID).Messages)
+
+			// Sessions that are gone are not found, the sweeper skips them
+			_, _, err = chats.Purge("missing", now, chat.Retention{MaxMessages: 1})
+			require.ErrorIs(err, store.ErrNotFound)
+			closeStores()
+
+			if b.durable {
+				_, chats, closeStores = b.open(t, dir)
+				defer closeStores()
+				require.NoError(chats.Load(ctx))
+
+				s = chats.GetByID(session.ID)
+				require.NotNil(s)
+				require.Empty(s.Messages)
+				require.Equal(time.Hour, s.TTL)
+
+				g = chats.GetByID(group.ID)
+				require.NotNil(g)
+				require.Empty(g.Messages)
+
+				// Ids of purged messages are not given out again
+				_, saved, err := chats.AppendMessage(g.ID, chat.Message{Sender: "user2", Body: "back", Time: now})
+				require.NoError(err)
+				require.Equal(uint64(6), saved.ID)
+			}
+		})
+	}
+}
+
+func TestPurgeFailure(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	dir := t.TempDir()
+	chats := store.NewChatDB(dir)
+	require.NoError(chats.Init())
+
+	session := chat.NewSession("user1", "user2")
+	require.NoError(chats.Add(session))
+	for range 3 {
+		_, _, err := chats.AppendMessage(session.ID, chat.Message{Sender: "user1", Body: "hi", Time: time.Now()})
+		require.NoError(err)
+	}
+
+	// A directory in place of the log cannot be replaced
+	logFile := chat.LogFile(path.Join(dir, session.ID))
+	require.NoError(os.Remove(logFile))
+	require.NoError(os.MkdirAll(path.Join(logFile, "blocked"), 0700))
+
+	_, n, err := chats.Purge(session.ID, time.Now(), chat.Retention{MaxAge: 0, MaxMessages: 1})
+	require.Error(err)
+	require.Zero(n)
+
+	// The session keeps its messages as long as the disk does
+	s := chats.GetByID(session.ID)
+	require.Len(s.Messages, 3)
+	require.Zero(s.Purged)
+
+	require.NoError(os.RemoveAll(logFile))
+	purged, n, err := chats.Purge(session.ID, time.Now(), chat.Retention{MaxAge: 0, MaxMessages: 1})
+	require.NoError(err)
+	require.Equal(2, n)
+	require.Len(purged.Messages, 1)
+	require.Equal(uint64(2), purged.Purged)
+	require.Len(chats.GetByID(session.ID).Messages, 1)
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"errors"
 	"io/fs"
 	"os"
 	"path"
@@ -33,19 +34,29 @@ func (users Users) Copy() Users {
 }
 
 type userError struct {
+	p string
 	u *auth.User
 	e error
 }
 
+// UserDB is the UserStore that keeps every user in a file of its own, sealed
+// with the sealer if there is one.
 type UserDB struct {
 	usersDir string
+	sealer   chata.Sealer
 	users    Users
 	lock     *sync.RWMutex
 }
 
 func NewUserDB(db string) *UserDB {
+	return NewSealedUserDB(db, nil)
+}
+
+// NewSealedUserDB returns a UserDB that seals its files with the sealer.
+func NewSealedUserDB(db string, sealer chata.Sealer) *UserDB {
 	return &UserDB{
 		usersDir: db,
+		sealer:   sealer,
 		users:    Users{},
 		lock:     &sync.RWMutex{},
 	}
@@ -76,17 +87,27 @@ func (db UserDB) Load(ctx context.Context) error {
 		waitGroup := &sync.WaitGroup{}
 		err := filepath.WalkDir(d,
 			func(p string, d fs.DirEntry, err error) error {
+				if err == nil && d.IsDir() && d.Name() == CorruptDir {
+					return filepath.SkipDir
+				}
+
 				waitGroup.Add(1)
 				go func(p string, f fs.DirEntry) {
 					defer waitGroup.Done()
 					if err != nil {
-						channel <- userError{nil, err}
+						channel <- userError{p, nil, err}
 						return
 					}
 
-					if f.Type().IsRegular() {
-						u, e := auth.LoadUser(p)
-						channel <- userError{u, e}
+					if f.Type().IsRegular() && !chata.IsTempFile(f.Name()) {
+						u, up, e := loadUserFile(p, db.sealer)
+						if e == nil && up != nil {
+							// Users saved in an older schema are saved again
+							chata.Log(ctx).Info("upgrading user", "file", p, "from", up.From, "to", up.To)
+							e = u.SaveUser(filepath.Dir(p), db.sealer)
+						}
+
+						channel <- userError{p, u, e}
 					}
 				}(p, d)
 
@@ -106,6 +127,15 @@ func (db UserDB) Load(ctx context.Context) error {
 
 	var err error
 	for user := range userChan {
+		// Corrupt users are put aside, the others are served
+		if errors.Is(user.e, ErrCorrupt) {
+			log.Warn("quarantining corrupt user file", "file", user.p, "error", user.e)
+			user.e = Quarantine(filepath.Dir(user.p), filepath.Base(user.p))
+			if user.e == nil {
+				continue
+			}
+		}
+
 		if user.e != nil {
 			log.Error("error loading user", "error", user.e)
 			err = user.e
@@ -127,7 +157,7 @@ func (db *UserDB) Add(user *auth.User) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	if e := user.SaveUser(db.usersDir); e != nil {
+	if e := user.SaveUser(db.usersDir, db.sealer); e != nil {
 		return e
 	}
 
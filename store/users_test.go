@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path"
 	"testing"
 
 	"github.com/rchamarthy/chata/auth"
@@ -35,7 +36,7 @@ func TestLoadUsers(t *testing.T) {
 	for i := range 10 {
 		n := fmt.Sprintf("user-%d", i)
 		u := auth.NewUser(n, n)
-		require.NoError(u.SaveUser("./test-dir"))
+		require.NoError(u.SaveUser("./test-dir", nil))
 	}
 
 	// Load all users
@@ -52,10 +53,23 @@ func TestLoadUsers(t *testing.T) {
 	require.NoError(e)
 	require.Len(db.GetAllUsers(), 10)
 
+	// Corrupt users are quarantined and the others still load
 	e = os.WriteFile("./test-dir/bad-user", []byte("name: blah"), 0600)
 	require.NoError(e)
-	e = db.Load(ctx)
-	require.Error(e)
+	require.NoError(os.WriteFile("./test-dir/user-0.123.tmp", []byte("id: user-0"), 0600))
+	db = store.NewUserDB("./test-dir")
+	require.NoError(db.Load(ctx))
+	require.Len(db.GetAllUsers(), 10)
+	require.NoFileExists("./test-dir/bad-user")
+
+	quarantined, err := os.ReadDir(path.Join("./test-dir", store.CorruptDir))
+	require.NoError(err)
+	require.Len(quarantined, 1)
+
+	// Quarantined users stay out of the next load
+	db = store.NewUserDB("./test-dir")
+	require.NoError(db.Load(ctx))
+	require.Len(db.GetAllUsers(), 10)
 }
 
 func TestUserDB(t *testing.T) {